@@ -0,0 +1,27 @@
+// Attaches CSRF token to every state changing request, sends user to login page once session is gone
+// and asks for profile when API refuses to guess it.
+const originalFetch = window.fetch;
+
+function csrfToken() {
+    const match = document.cookie.match(/(?:^|;\s*)jubako_csrf=([^;]+)/);
+    return match ? decodeURIComponent(match[1]) : "";
+}
+
+window.fetch = async (input, init = {}) => {
+    const method = (init.method || "GET").toUpperCase();
+    if (!["GET", "HEAD", "OPTIONS"].includes(method)) {
+        const headers = new Headers(init.headers || {});
+        const token = csrfToken();
+        if (token) headers.set("X-CSRF-Token", token);
+        init = { ...init, headers };
+    }
+
+    const response = await originalFetch(input, init);
+    if (response.status === 401) {
+        window.location.href = "/view/login.html";
+    } else if (response.status === 403 && typeof showProfilePicker === "function") {
+        const data = await response.clone().json().catch(() => ({}));
+        if (data.profile_required) showProfilePicker();
+    }
+    return response;
+};
@@ -0,0 +1,50 @@
+const events = new EventSource("/api/events");
+
+events.addEventListener("notification", (e) => {
+    try {
+        const event = JSON.parse(e.data);
+        const notification = event.data || {};
+        showToast(notification.title, notification.body);
+    } catch (err) {
+        console.error("Failed to parse notification event:", err);
+    }
+});
+
+events.onerror = (err) => {
+    console.error("Event stream connection error:", err);
+};
+
+function showToast(title, body) {
+    let container = document.getElementById("toast-container");
+    if (!container) {
+        container = document.createElement("div");
+        container.id = "toast-container";
+        container.style.position = "fixed";
+        container.style.right = "20px";
+        container.style.bottom = "20px";
+        container.style.display = "flex";
+        container.style.flexDirection = "column";
+        container.style.gap = "10px";
+        container.style.zIndex = "1000";
+        document.body.appendChild(container);
+    }
+
+    const toast = document.createElement("div");
+    toast.style.padding = "10px 14px";
+    toast.style.borderRadius = "8px";
+    toast.style.backgroundColor = "rgba(20, 20, 20, 0.9)";
+    toast.style.border = "1px solid #ff4500";
+
+    const titleEl = document.createElement("strong");
+    titleEl.textContent = title || "Jubako";
+    toast.appendChild(titleEl);
+
+    if (body) {
+        const bodyEl = document.createElement("div");
+        bodyEl.textContent = body;
+        toast.appendChild(bodyEl);
+    }
+
+    container.appendChild(toast);
+    setTimeout(() => toast.remove(), 6000);
+}
@@ -0,0 +1,61 @@
+(async () => {
+    try {
+        const response = await fetch("/api/anilist/lists", {
+            method: "GET",
+            headers: {
+                "Accept": "application/json"
+            }
+        });
+
+        if (!response.ok) {
+            console.error("Failed to fetch AniList lists:", response.statusText);
+            return;
+        }
+
+        const entries = await response.json();
+        if (!Array.isArray(entries) || entries.length === 0) {
+            return;
+        }
+
+        const container = document.createElement("div");
+        container.id = "library-container";
+        container.style.padding = "20px";
+
+        const title = document.createElement("h1");
+        title.textContent = "Library";
+        container.appendChild(title);
+
+        const sections = [
+            { status: "CURRENT", name: "Watching" },
+            { status: "PLANNING", name: "Planning" }
+        ];
+
+        sections.forEach(section => {
+            const list = entries.filter(entry => entry.status === section.status);
+            if (list.length === 0) return;
+
+            const sectionEl = document.createElement("section");
+            sectionEl.style.marginBottom = "20px";
+            sectionEl.style.padding = "10px";
+
+            const sectionTitle = document.createElement("h2");
+            sectionTitle.textContent = `${section.name} (${list.length})`;
+            sectionEl.appendChild(sectionTitle);
+
+            const ul = document.createElement("ul");
+            list.forEach(entry => {
+                const item = document.createElement("li");
+                const total = entry.episodes > 0 ? entry.episodes : "?";
+                item.textContent = `${entry.title} - ${entry.progress}/${total}`;
+                ul.appendChild(item);
+            });
+
+            sectionEl.appendChild(ul);
+            container.appendChild(sectionEl);
+        });
+
+        document.body.appendChild(container);
+    } catch (err) {
+        console.error("Error fetching or rendering library:", err);
+    }
+})();
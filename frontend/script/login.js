@@ -0,0 +1,32 @@
+const loginForm = document.getElementById("login-form");
+const loginError = document.getElementById("login-error");
+
+loginForm.addEventListener("submit", async (e) => {
+    e.preventDefault();
+    loginError.textContent = "";
+
+    try {
+        const response = await fetch("/api/auth/login", {
+            method: "POST",
+            headers: {
+                "Accept": "application/json",
+                "Content-Type": "application/json"
+            },
+            body: JSON.stringify({
+                username: document.getElementById("login-username").value,
+                password: document.getElementById("login-password").value
+            })
+        });
+
+        if (!response.ok) {
+            const data = await response.json().catch(() => ({}));
+            loginError.textContent = data.error || response.statusText;
+            return;
+        }
+
+        window.location.href = "/view/index.html";
+    } catch (err) {
+        console.error("API connection error:", err);
+        loginError.textContent = "Failed to connect to Jubako.";
+    }
+});
@@ -37,7 +37,8 @@ searchInput.addEventListener("keydown", async (e) => {
 
 (async () => {
     try {
-        const response = await fetch("/api/anime-timetable", {
+        const params = new URLSearchParams({ "tz": Intl.DateTimeFormat().resolvedOptions().timeZone });
+        const response = await fetch(`/api/anime-timetable?${params.toString()}`, {
             method: "GET",
             headers: {
                 "Accept": "application/json"
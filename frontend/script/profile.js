@@ -0,0 +1,101 @@
+// Profile picker shown when nothing is selected yet or selected profile needs its pin.
+async function showProfilePicker() {
+    if (document.getElementById("profile-picker")) return;
+
+    let data;
+    try {
+        const response = await fetch("/api/profiles", {
+            method: "GET",
+            headers: {
+                "Accept": "application/json"
+            }
+        });
+
+        if (!response.ok) {
+            console.error("Failed to fetch profiles:", response.statusText);
+            return;
+        }
+        data = await response.json();
+    } catch (err) {
+        console.error("API connection error:", err);
+        return;
+    }
+
+    const overlay = document.createElement("div");
+    overlay.id = "profile-picker";
+    overlay.style.position = "fixed";
+    overlay.style.inset = "0";
+    overlay.style.display = "flex";
+    overlay.style.flexDirection = "column";
+    overlay.style.alignItems = "center";
+    overlay.style.justifyContent = "center";
+    overlay.style.gap = "20px";
+    overlay.style.background = "var(--background-color)";
+    overlay.style.zIndex = "2000";
+
+    const title = document.createElement("h1");
+    title.textContent = "Who's watching?";
+    overlay.appendChild(title);
+
+    const list = document.createElement("div");
+    list.style.display = "flex";
+    list.style.gap = "20px";
+
+    data.profiles.forEach(profile => {
+        const button = document.createElement("button");
+        button.textContent = profile.has_pin ? `${profile.name} 🔒` : profile.name;
+        button.style.padding = "20px";
+        button.addEventListener("click", () => selectProfile(profile));
+        list.appendChild(button);
+    });
+
+    overlay.appendChild(list);
+    document.body.appendChild(overlay);
+}
+
+async function selectProfile(profile) {
+    let pin = "";
+    if (profile.has_pin) {
+        pin = prompt(`PIN for ${profile.name}`) || "";
+        if (!pin) return;
+    }
+
+    const response = await fetch(`/api/profiles/${profile.id}/select`, {
+        method: "POST",
+        headers: {
+            "Accept": "application/json",
+            "Content-Type": "application/json"
+        },
+        body: JSON.stringify({ pin })
+    });
+
+    if (!response.ok) {
+        const data = await response.json().catch(() => ({}));
+        alert(data.error || response.statusText);
+        return;
+    }
+
+    window.location.reload();
+}
+
+(async () => {
+    try {
+        const response = await fetch("/api/profiles", {
+            method: "GET",
+            headers: {
+                "Accept": "application/json"
+            }
+        });
+
+        if (!response.ok) return;
+
+        const data = await response.json();
+        if (data.current === null || data.profiles.length > 1 && !document.cookie.includes("jubako_profile_chosen")) {
+            // Ask once per browser session when there is anything to choose from
+            document.cookie = "jubako_profile_chosen=1; path=/";
+            showProfilePicker();
+        }
+    } catch (err) {
+        console.error("Error fetching profiles:", err);
+    }
+})();
@@ -0,0 +1,66 @@
+package anilist
+
+import (
+	"context"
+	"jubako/internal/model"
+)
+
+const airingSchedulesQuery = `
+query ($airingAt_greater: Int, $airingAt_lesser: Int, $page: Int) {
+  Page(page: $page, perPage: 50) {
+    pageInfo {
+      total
+      perPage
+      currentPage
+      lastPage
+      hasNextPage
+    }
+    airingSchedules(airingAt_greater: $airingAt_greater, airingAt_lesser: $airingAt_lesser, sort: TIME) {
+      id
+      airingAt
+      episode
+      media {
+        id
+        idMal
+        title {
+          romaji
+          english
+          native
+        }
+        coverImage {
+          large
+          color
+        }
+        description
+        episodes
+        duration
+        genres
+        averageScore
+        isAdult
+      }
+    }
+  }
+}
+`
+
+// AiringSchedules fetches single page of episodes airing between start and end (unix seconds).
+func (c *Client) AiringSchedules(ctx context.Context, start, end int64, page int) (*model.AniListResponse, error) {
+	variables := map[string]any{
+		"airingAt_greater": start,
+		"airingAt_lesser":  end,
+		"page":             page,
+	}
+
+	var resp model.AniListResponse
+	if err := c.Query(ctx, airingSchedulesQuery, variables, &resp); err != nil {
+		return nil, err
+	}
+
+	ids := make(map[int]int)
+	for _, s := range resp.Data.Page.AiringSchedules {
+		ids[s.Media.ID] = s.Media.IDMal
+	}
+
+	c.reportMalIDs(ids)
+	return &resp, nil
+}
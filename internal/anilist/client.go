@@ -0,0 +1,283 @@
+package anilist
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/amatsagu/lumo"
+)
+
+const (
+	DefaultBaseURL   = "https://graphql.anilist.co"
+	DefaultUserAgent = "Jubako (+https://github.com/amatsagu/jubako)"
+	DefaultTimeout   = 15 * time.Second
+	DefaultRetries   = 3
+)
+
+// RateLimitError is returned when AniList keeps rejecting requests with 429 after all retries were used.
+type RateLimitError struct {
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("AniList rate limit exceeded, retry after %v", e.RetryAfter)
+}
+
+// APIError describes non-successful http response or graphql level errors returned by AniList.
+type APIError struct {
+	StatusCode int
+	Messages   []string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("AniList API returned status %d: %s", e.StatusCode, strings.Join(e.Messages, "; "))
+}
+
+// MalIDHook receives MyAnimeList ids of media loaded from AniList, keyed by AniList media id.
+// Media without MyAnimeList counterpart is reported with id 0.
+type MalIDHook func(ids map[int]int)
+
+// Client is a small AniList GraphQL client that respects rate limit headers.
+// All exported fields may be changed before first use.
+type Client struct {
+	BaseURL    string
+	HTTP       *http.Client
+	UserAgent  string
+	MaxRetries int
+
+	blockedUntil time.Time // Set when AniList reports that we used our request budget
+	mu           sync.Mutex
+
+	malHooks []MalIDHook
+	hooksMu  sync.RWMutex // Protects malHooks
+}
+
+// NewClient creates AniList client. Empty baseURL and nil httpClient fall back to defaults.
+func NewClient(baseURL string, httpClient *http.Client) *Client {
+	if baseURL == "" {
+		baseURL = DefaultBaseURL
+	}
+
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: DefaultTimeout}
+	}
+
+	return &Client{
+		BaseURL:    baseURL,
+		HTTP:       httpClient,
+		UserAgent:  DefaultUserAgent,
+		MaxRetries: DefaultRetries,
+	}
+}
+
+// OnMalIDs registers hook that will be called whenever queried media comes with its MyAnimeList id.
+func (c *Client) OnMalIDs(hook MalIDHook) {
+	c.hooksMu.Lock()
+	c.malHooks = append(c.malHooks, hook)
+	c.hooksMu.Unlock()
+}
+
+func (c *Client) reportMalIDs(ids map[int]int) {
+	if len(ids) == 0 {
+		return
+	}
+
+	c.hooksMu.RLock()
+	hooks := c.malHooks
+	c.hooksMu.RUnlock()
+
+	for _, hook := range hooks {
+		hook(ids)
+	}
+}
+
+type graphqlError struct {
+	Message string `json:"message"`
+	Status  int    `json:"status"`
+}
+
+// Query executes graphql query and decodes whole response body (including "data" wrapper) into out.
+func (c *Client) Query(ctx context.Context, query string, variables map[string]any, out any) error {
+	return c.QueryAs(ctx, "", query, variables, out)
+}
+
+// QueryAs works like Query, but authorizes request with user's access token when it's not empty.
+func (c *Client) QueryAs(ctx context.Context, token string, query string, variables map[string]any, out any) error {
+	body, err := json.Marshal(map[string]any{
+		"query":     query,
+		"variables": variables,
+	})
+	if err != nil {
+		return err
+	}
+
+	var lastErr error
+	for attempt := 0; attempt < max(c.MaxRetries, 1); attempt++ {
+		if err := c.waitForBudget(ctx); err != nil {
+			return err
+		}
+
+		respBody, err := c.post(ctx, token, body)
+		if err == nil {
+			return decodeResponse(respBody, out)
+		}
+
+		var rlErr *RateLimitError
+		if !errors.As(err, &rlErr) {
+			return err
+		}
+
+		lastErr = err
+		lumo.Debug("AniList rate limit hit (attempt %d/%d), waiting %v...", attempt+1, c.MaxRetries, rlErr.RetryAfter)
+	}
+
+	return lastErr
+}
+
+func (c *Client) post(ctx context.Context, token string, body []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.BaseURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	if c.UserAgent != "" {
+		req.Header.Set("User-Agent", c.UserAgent)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if resp.StatusCode == http.StatusTooManyRequests {
+		retryAfter := parseRetryAfter(resp.Header, now)
+		c.blockFor(now.Add(retryAfter))
+		return nil, &RateLimitError{RetryAfter: retryAfter}
+	}
+
+	if resp.Header.Get("X-RateLimit-Remaining") == "0" {
+		if reset, ok := parseUnix(resp.Header.Get("X-RateLimit-Reset")); ok {
+			c.blockFor(reset)
+		}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		apiErr := &APIError{StatusCode: resp.StatusCode}
+		var envelope struct {
+			Errors []graphqlError `json:"errors"`
+		}
+
+		if json.Unmarshal(respBody, &envelope) == nil && len(envelope.Errors) > 0 {
+			for _, e := range envelope.Errors {
+				apiErr.Messages = append(apiErr.Messages, e.Message)
+			}
+		} else {
+			apiErr.Messages = []string{string(respBody)}
+		}
+		return nil, apiErr
+	}
+
+	return respBody, nil
+}
+
+func decodeResponse(body []byte, out any) error {
+	var envelope struct {
+		Errors []graphqlError `json:"errors"`
+	}
+
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return err
+	}
+
+	if len(envelope.Errors) > 0 {
+		apiErr := &APIError{StatusCode: http.StatusOK}
+		for _, e := range envelope.Errors {
+			apiErr.Messages = append(apiErr.Messages, e.Message)
+		}
+		return apiErr
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(body, out)
+}
+
+func (c *Client) blockFor(until time.Time) {
+	c.mu.Lock()
+	if until.After(c.blockedUntil) {
+		c.blockedUntil = until
+	}
+	c.mu.Unlock()
+}
+
+func (c *Client) waitForBudget(ctx context.Context) error {
+	c.mu.Lock()
+	wait := time.Until(c.blockedUntil)
+	c.mu.Unlock()
+
+	if wait <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// parseRetryAfter reads Retry-After (seconds or http date) header, falling back to X-RateLimit-Reset and finally one minute (AniList rate limit window).
+func parseRetryAfter(h http.Header, now time.Time) time.Duration {
+	if v := h.Get("Retry-After"); v != "" {
+		if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+			return time.Duration(secs) * time.Second
+		}
+
+		if at, err := http.ParseTime(v); err == nil {
+			return max(at.Sub(now), 0)
+		}
+	}
+
+	if reset, ok := parseUnix(h.Get("X-RateLimit-Reset")); ok {
+		return max(reset.Sub(now), 0)
+	}
+	return time.Minute
+}
+
+func parseUnix(v string) (time.Time, bool) {
+	if v == "" {
+		return time.Time{}, false
+	}
+
+	secs, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(secs, 0), true
+}
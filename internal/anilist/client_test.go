@@ -0,0 +1,199 @@
+package anilist
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+
+	data, err := os.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatalf("failed to read fixture %s: %v", name, err)
+	}
+	return data
+}
+
+func TestAiringSchedulesDecodesFixture(t *testing.T) {
+	fixture := readFixture(t, "airing_schedules.json")
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("expected POST, got %s", r.Method)
+		}
+
+		if got := r.Header.Get("User-Agent"); got != "jubako-test" {
+			t.Errorf("expected custom user agent, got %q", got)
+		}
+
+		var payload struct {
+			Query     string         `json:"query"`
+			Variables map[string]any `json:"variables"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Errorf("failed to decode request payload: %v", err)
+		}
+
+		if payload.Variables["page"] != float64(2) {
+			t.Errorf("expected page variable 2, got %v", payload.Variables["page"])
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(fixture)
+	}))
+	defer srv.Close()
+
+	c := NewClient(srv.URL, srv.Client())
+	c.UserAgent = "jubako-test"
+
+	var malIDs map[int]int
+	c.OnMalIDs(func(ids map[int]int) { malIDs = ids })
+
+	resp, err := c.AiringSchedules(context.Background(), 1760832000, 1761436800, 2)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	schedules := resp.Data.Page.AiringSchedules
+	if len(schedules) != 2 {
+		t.Fatalf("expected 2 schedules, got %d", len(schedules))
+	}
+
+	if schedules[0].ID != 401234 || schedules[0].Media.IDMal != 59027 || schedules[0].Episode != 3 {
+		t.Errorf("unexpected first schedule: %+v", schedules[0])
+	}
+
+	if schedules[1].Media.Title.English != "" || schedules[1].Media.Title.Romaji != "Dandadan 2nd Season" {
+		t.Errorf("unexpected second schedule title: %+v", schedules[1].Media.Title)
+	}
+
+	if len(malIDs) != 2 || malIDs[schedules[0].Media.ID] != 59027 {
+		t.Errorf("expected MyAnimeList ids of both media to be reported, got %v", malIDs)
+	}
+}
+
+func TestQueryReturnsGraphQLErrors(t *testing.T) {
+	fixture := readFixture(t, "graphql_error.json")
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(fixture)
+	}))
+	defer srv.Close()
+
+	err := NewClient(srv.URL, srv.Client()).Query(context.Background(), "query {}", nil, nil)
+
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("expected APIError, got %v", err)
+	}
+
+	if apiErr.StatusCode != http.StatusBadRequest || len(apiErr.Messages) != 1 {
+		t.Errorf("unexpected api error: %+v", apiErr)
+	}
+}
+
+func TestQueryRetriesAfterRateLimit(t *testing.T) {
+	fixture := readFixture(t, "airing_schedules.json")
+
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.Header().Set("X-RateLimit-Remaining", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"errors": [{"message": "Too Many Requests.", "status": 429}]}`))
+			return
+		}
+		w.Write(fixture)
+	}))
+	defer srv.Close()
+
+	if _, err := NewClient(srv.URL, srv.Client()).AiringSchedules(context.Background(), 0, 1, 1); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if calls.Load() != 2 {
+		t.Errorf("expected 2 calls, got %d", calls.Load())
+	}
+}
+
+func TestQueryGivesUpAfterMaxRetries(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+
+	c := NewClient(srv.URL, srv.Client())
+	c.MaxRetries = 2
+
+	err := c.Query(context.Background(), "query {}", nil, nil)
+
+	var rlErr *RateLimitError
+	if !errors.As(err, &rlErr) {
+		t.Fatalf("expected RateLimitError, got %v", err)
+	}
+
+	if calls.Load() != 2 {
+		t.Errorf("expected 2 calls, got %d", calls.Load())
+	}
+}
+
+func TestQueryWaitsForRateLimitReset(t *testing.T) {
+	fixture := readFixture(t, "airing_schedules.json")
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-RateLimit-Remaining", "0")
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10))
+		w.Write(fixture)
+	}))
+	defer srv.Close()
+
+	c := NewClient(srv.URL, srv.Client())
+	if err := c.Query(context.Background(), "query {}", nil, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Budget is exhausted for an hour, so next query must block until context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err := c.Query(ctx, "query {}", nil, nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Unix(1760000000, 0)
+
+	tests := []struct {
+		name   string
+		header http.Header
+		want   time.Duration
+	}{
+		{"seconds", http.Header{"Retry-After": {"30"}}, 30 * time.Second},
+		{"http date", http.Header{"Retry-After": {now.Add(45 * time.Second).UTC().Format(http.TimeFormat)}}, 45 * time.Second},
+		{"reset header", http.Header{"X-Ratelimit-Reset": {strconv.FormatInt(now.Add(10*time.Second).Unix(), 10)}}, 10 * time.Second},
+		{"fallback", http.Header{}, time.Minute},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseRetryAfter(tt.header, now); got != tt.want {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
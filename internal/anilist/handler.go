@@ -0,0 +1,117 @@
+package anilist
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"jubako/internal/profile"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/amatsagu/lumo"
+)
+
+// AccountHandler returns details of AniList account linked to selected profile (never the token itself).
+func (s *Syncer) AccountHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	profileID := profile.FromContext(r.Context())
+	account, _, err := s.Account(profileID)
+	if errors.Is(err, ErrNotLinked) {
+		fmt.Fprint(w, `{"linked": false}`)
+		return
+	}
+	if err != nil {
+		lumo.Error("Failed to read AniList account: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to read account"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]any{
+		"linked":            true,
+		"account":           account,
+		"pending_mutations": s.PendingMutations(profileID),
+	})
+}
+
+// LinkHandler links AniList account to selected profile using access token from json body ({"token": "..."}).
+func (s *Syncer) LinkHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var body struct {
+		Token string `json:"token"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || strings.TrimSpace(body.Token) == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "no token provided"})
+		return
+	}
+
+	account, err := s.Link(r.Context(), profile.FromContext(r.Context()), strings.TrimSpace(body.Token))
+	if err != nil {
+		// Only rejected token is user's fault, AniList being busy or down can be retried with the same token
+		var apiErr *APIError
+		var rateErr *RateLimitError
+		switch {
+		case errors.As(err, &apiErr) && (apiErr.StatusCode == http.StatusBadRequest || apiErr.StatusCode == http.StatusUnauthorized):
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "AniList rejected provided token"})
+			return
+		case errors.As(err, &rateErr) || errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusTooManyRequests:
+			if rateErr != nil {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(rateErr.RetryAfter.Seconds()))))
+			}
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(map[string]string{"error": "AniList is rate limiting requests, try again later"})
+			return
+		case errors.As(err, &apiErr) && apiErr.StatusCode >= http.StatusInternalServerError:
+			lumo.Warn("AniList is unavailable while linking account: %v", err)
+			w.WriteHeader(http.StatusBadGateway)
+			json.NewEncoder(w).Encode(map[string]string{"error": "AniList is unavailable, try again later"})
+			return
+		}
+
+		lumo.Error("Failed to link AniList account: %v", err)
+		w.WriteHeader(http.StatusBadGateway)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]any{
+		"linked":  true,
+		"account": account,
+	})
+}
+
+// UnlinkHandler removes AniList account linked to selected profile.
+func (s *Syncer) UnlinkHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := s.Unlink(profile.FromContext(r.Context())); err != nil {
+		lumo.Error("Failed to unlink AniList account: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to unlink account"})
+		return
+	}
+
+	fmt.Fprint(w, `{"linked": false}`)
+}
+
+// ListsHandler returns cached Watching/Planning list entries of account linked to selected profile.
+func (s *Syncer) ListsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	entries, err := s.Entries(profile.FromContext(r.Context()))
+	if err != nil {
+		lumo.Error("Failed to read AniList list entries: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to read list entries"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(entries)
+}
@@ -0,0 +1,197 @@
+package anilist
+
+import (
+	"context"
+	"jubako/internal/model"
+)
+
+const viewerQuery = `
+query {
+  Viewer {
+    id
+    name
+  }
+}
+`
+
+const mediaListCollectionQuery = `
+query ($userId: Int, $status_in: [MediaListStatus]) {
+  MediaListCollection(userId: $userId, type: ANIME, status_in: $status_in) {
+    lists {
+      name
+      status
+      entries {
+        id
+        mediaId
+        status
+        progress
+        media {
+          id
+          idMal
+          title {
+            romaji
+            english
+            native
+          }
+          coverImage {
+            large
+            color
+          }
+          episodes
+        }
+      }
+    }
+  }
+}
+`
+
+const saveMediaListEntryMutation = `
+mutation ($mediaId: Int, $progress: Int, $status: MediaListStatus) {
+  SaveMediaListEntry(mediaId: $mediaId, progress: $progress, status: $status) {
+    id
+    progress
+  }
+}
+`
+
+// Viewer returns AniList account that owns given access token.
+func (c *Client) Viewer(ctx context.Context, token string) (*model.TrackerAccount, error) {
+	var resp struct {
+		Data struct {
+			Viewer struct {
+				ID   int    `json:"id"`
+				Name string `json:"name"`
+			} `json:"Viewer"`
+		} `json:"data"`
+	}
+
+	if err := c.QueryAs(ctx, token, viewerQuery, nil, &resp); err != nil {
+		return nil, err
+	}
+
+	return &model.TrackerAccount{
+		UserID: resp.Data.Viewer.ID,
+		Name:   resp.Data.Viewer.Name,
+	}, nil
+}
+
+// MediaListCollection fetches user's anime list entries with any of given statuses (CURRENT, PLANNING, ...).
+func (c *Client) MediaListCollection(ctx context.Context, token string, userID int, statuses []string) ([]model.MediaListEntry, error) {
+	variables := map[string]any{
+		"userId":    userID,
+		"status_in": statuses,
+	}
+
+	var resp model.MediaListCollectionResponse
+	if err := c.QueryAs(ctx, token, mediaListCollectionQuery, variables, &resp); err != nil {
+		return nil, err
+	}
+
+	entries := make([]model.MediaListEntry, 0)
+	ids := make(map[int]int)
+	for _, list := range resp.Data.MediaListCollection.Lists {
+		entries = append(entries, list.Entries...)
+		for _, e := range list.Entries {
+			ids[e.MediaID] = e.Media.IDMal
+		}
+	}
+
+	c.reportMalIDs(ids)
+	return entries, nil
+}
+
+// SaveMediaListEntry updates progress of user's list entry, creating it if needed. Empty status keeps current one.
+func (c *Client) SaveMediaListEntry(ctx context.Context, token string, mediaID, progress int, status string) error {
+	variables := map[string]any{
+		"mediaId":  mediaID,
+		"progress": progress,
+	}
+	if status != "" {
+		variables["status"] = status
+	}
+
+	return c.QueryAs(ctx, token, saveMediaListEntryMutation, variables, nil)
+}
+
+const mediaListEntryQuery = `
+query ($id: Int) {
+  Media(id: $id, type: ANIME) {
+    id
+    idMal
+    episodes
+    mediaListEntry {
+      status
+      progress
+    }
+  }
+}
+`
+
+const mediaQuery = `
+query ($id: Int) {
+  Media(id: $id, type: ANIME) {
+    id
+    idMal
+    title {
+      romaji
+      english
+      native
+    }
+    coverImage {
+      large
+      color
+    }
+    description(asHtml: false)
+    episodes
+    duration
+    genres
+    averageScore
+    isAdult
+  }
+}
+`
+
+// ListStatus is an entry on user's anime list.
+type ListStatus struct {
+	Status   string `json:"status"`
+	Progress int    `json:"progress"`
+}
+
+// MediaListEntry returns episode count of anime (0 when not known yet) and its entry on list of the account that owns
+// access token, or nil when anime isn't on the list.
+func (c *Client) MediaListEntry(ctx context.Context, token string, mediaID int) (int, *ListStatus, error) {
+	var resp struct {
+		Data struct {
+			Media struct {
+				ID             int         `json:"id"`
+				IDMal          int         `json:"idMal"`
+				Episodes       int         `json:"episodes"`
+				MediaListEntry *ListStatus `json:"mediaListEntry"`
+			} `json:"Media"`
+		} `json:"data"`
+	}
+
+	if err := c.QueryAs(ctx, token, mediaListEntryQuery, map[string]any{"id": mediaID}, &resp); err != nil {
+		return 0, nil, err
+	}
+
+	media := resp.Data.Media
+	c.reportMalIDs(map[int]int{media.ID: media.IDMal})
+	return media.Episodes, media.MediaListEntry, nil
+}
+
+// Media returns details of single AniList anime.
+func (c *Client) Media(ctx context.Context, mediaID int) (*model.Media, error) {
+	var resp struct {
+		Data struct {
+			Media model.Media `json:"Media"`
+		} `json:"data"`
+	}
+
+	if err := c.Query(ctx, mediaQuery, map[string]any{"id": mediaID}, &resp); err != nil {
+		return nil, err
+	}
+
+	c.reportMalIDs(map[int]int{resp.Data.Media.ID: resp.Data.Media.IDMal})
+	return &resp.Data.Media, nil
+}
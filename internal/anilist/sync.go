@@ -0,0 +1,442 @@
+package anilist
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"jubako/internal/jobs"
+	"jubako/internal/model"
+	"jubako/internal/profile"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/amatsagu/lumo"
+)
+
+// SyncJob is name of the background job that replays queued mutations and refreshes user's lists.
+const SyncJob = "anilist-sync"
+
+// Statuses of list entries that are mirrored into local library.
+var syncedStatuses = []string{"CURRENT", "PLANNING"}
+
+var ErrNotLinked = errors.New("anilist account is not linked")
+
+// Syncer links local library with AniList accounts - each profile may link its own one.
+// Progress updates are stored in a local queue first, so marking episodes as watched works offline.
+type Syncer struct {
+	db        *sql.DB
+	client    *Client
+	scheduler *jobs.Scheduler
+}
+
+const accountSchema = `CREATE TABLE IF NOT EXISTS anilist_account (
+	profile_id INTEGER PRIMARY KEY,
+	token TEXT NOT NULL,
+	user_id INTEGER NOT NULL,
+	name TEXT NOT NULL,
+	linked_at DATETIME NOT NULL
+)`
+
+const listEntriesSchema = `CREATE TABLE IF NOT EXISTS anilist_list_entries (
+	profile_id INTEGER NOT NULL,
+	media_id INTEGER NOT NULL,
+	status TEXT NOT NULL,
+	progress INTEGER NOT NULL,
+	data TEXT NOT NULL,
+	updated_at DATETIME NOT NULL,
+	PRIMARY KEY (profile_id, media_id)
+)`
+
+const mutationsSchema = `CREATE TABLE IF NOT EXISTS anilist_mutations (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	profile_id INTEGER NOT NULL,
+	media_id INTEGER NOT NULL,
+	progress INTEGER NOT NULL,
+	created_at DATETIME NOT NULL,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	last_error TEXT
+)`
+
+func NewSyncer(db *sql.DB, client *Client, scheduler *jobs.Scheduler) *Syncer {
+	tables := []struct {
+		name, schema, columns string
+	}{
+		{"anilist_account", accountSchema, "token, user_id, name, linked_at"},
+		{"anilist_list_entries", listEntriesSchema, "media_id, status, progress, data, updated_at"},
+		{"anilist_mutations", mutationsSchema, "id, media_id, progress, created_at, attempts, last_error"},
+	}
+
+	for _, table := range tables {
+		if _, err := db.Exec(table.schema); err != nil {
+			lumo.Error("Failed to create %s table: %v", table.name, err)
+		}
+
+		if err := profile.MigrateTable(db, table.name, table.schema, table.columns); err != nil {
+			lumo.Error("Failed to migrate %s table: %v", table.name, err)
+		}
+	}
+
+	s := &Syncer{
+		db:        db,
+		client:    client,
+		scheduler: scheduler,
+	}
+
+	scheduler.Register(jobs.Job{
+		Name:     SyncJob,
+		Interval: 5 * time.Minute,
+		Delay:    10 * time.Second,
+		Jitter:   30 * time.Second,
+		Run:      s.Sync,
+	})
+	return s
+}
+
+// Link validates access token (obtained through implicit grant) and stores it together with account details for given profile.
+func (s *Syncer) Link(ctx context.Context, profileID int64, token string) (*model.TrackerAccount, error) {
+	account, err := s.client.Viewer(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	account.LinkedAt = time.Now()
+	_, err = s.db.Exec("INSERT OR REPLACE INTO anilist_account (profile_id, token, user_id, name, linked_at) VALUES (?, ?, ?, ?, ?)", profileID, token, account.UserID, account.Name, account.LinkedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	lumo.Info("Linked AniList account \"%s\" (%d) to profile %d.", account.Name, account.UserID, profileID)
+	if err := s.scheduler.Trigger(SyncJob, true); err != nil && !errors.Is(err, jobs.ErrAlreadyRunning) && !errors.Is(err, jobs.ErrNotStarted) {
+		lumo.Warn("Failed to trigger AniList sync after linking account: %v", err)
+	}
+	return account, nil
+}
+
+// Unlink forgets stored token, cached lists and all pending mutations of given profile.
+func (s *Syncer) Unlink(profileID int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, table := range []string{"anilist_account", "anilist_list_entries", "anilist_mutations"} {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE profile_id = ?", profileID); err != nil {
+			return err
+		}
+	}
+
+	lumo.Info("Unlinked AniList account of profile %d.", profileID)
+	return tx.Commit()
+}
+
+// Account returns account linked to profile with its access token or ErrNotLinked.
+func (s *Syncer) Account(profileID int64) (*model.TrackerAccount, string, error) {
+	var account model.TrackerAccount
+	var token string
+
+	err := s.db.QueryRow("SELECT token, user_id, name, linked_at FROM anilist_account WHERE profile_id = ?", profileID).Scan(&token, &account.UserID, &account.Name, &account.LinkedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, "", ErrNotLinked
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return &account, token, nil
+}
+
+// QueueProgress stores progress update to be pushed during next sync. It's meant to be used as library.WatchHook.
+func (s *Syncer) QueueProgress(profileID int64, mediaID, episode int) {
+	if _, _, err := s.Account(profileID); err != nil {
+		return
+	}
+
+	_, err := s.db.Exec("INSERT INTO anilist_mutations (profile_id, media_id, progress, created_at) VALUES (?, ?, ?, ?)", profileID, mediaID, episode, time.Now())
+	if err != nil {
+		werr := lumo.WrapError(err).Include("profile_id", profileID).Include("media_id", mediaID).Include("episode", episode)
+		lumo.Error("Failed to queue AniList progress update: %v", werr)
+		return
+	}
+
+	if err := s.scheduler.Trigger(SyncJob, true); err != nil && !errors.Is(err, jobs.ErrAlreadyRunning) && !errors.Is(err, jobs.ErrNotStarted) {
+		lumo.Warn("Failed to trigger AniList sync: %v", err)
+	}
+}
+
+// Sync replays queued mutations and refreshes cached lists of every linked profile.
+// Failed network calls leave mutations in queue for next run.
+func (s *Syncer) Sync(ctx context.Context) error {
+	profiles, err := s.linkedProfiles()
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, profileID := range profiles {
+		if err := s.syncProfile(ctx, profileID); err != nil {
+			errs = append(errs, fmt.Errorf("profile %d: %w", profileID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Syncer) syncProfile(ctx context.Context, profileID int64) error {
+	account, token, err := s.Account(profileID)
+	if errors.Is(err, ErrNotLinked) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := s.replayMutations(ctx, profileID, token); err != nil {
+		return err
+	}
+
+	entries, err := s.client.MediaListCollection(ctx, token, account.UserID, syncedStatuses)
+	if err != nil {
+		return err
+	}
+	return s.storeEntries(profileID, entries)
+}
+
+func (s *Syncer) linkedProfiles() ([]int64, error) {
+	rows, err := s.db.Query("SELECT profile_id FROM anilist_account ORDER BY profile_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make([]int64, 0)
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+type queuedMutation struct {
+	ids      []int64
+	mediaID  int
+	progress int
+}
+
+func (s *Syncer) replayMutations(ctx context.Context, profileID int64, token string) error {
+	rows, err := s.db.Query("SELECT id, media_id, progress FROM anilist_mutations WHERE profile_id = ? ORDER BY id", profileID)
+	if err != nil {
+		return err
+	}
+
+	// Collapse queue, so only the highest progress per media is pushed
+	byMedia := make(map[int]*queuedMutation)
+	order := make([]*queuedMutation, 0)
+	for rows.Next() {
+		var id int64
+		var mediaID, progress int
+		if err := rows.Scan(&id, &mediaID, &progress); err != nil {
+			rows.Close()
+			return err
+		}
+
+		m, ok := byMedia[mediaID]
+		if !ok {
+			m = &queuedMutation{mediaID: mediaID}
+			byMedia[mediaID] = m
+			order = append(order, m)
+		}
+		m.ids = append(m.ids, id)
+		m.progress = max(m.progress, progress)
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, m := range order {
+		err := s.push(ctx, token, m.mediaID, m.progress)
+		if err == nil {
+			s.deleteMutations(m.ids)
+			continue
+		}
+
+		if rejectsMutation(err) {
+			// AniList rejected this mutation, retrying won't help
+			werr := lumo.WrapError(err).Include("media_id", m.mediaID).Include("progress", m.progress)
+			lumo.Warn("Dropping rejected AniList progress update: %v", werr)
+			s.deleteMutations(m.ids)
+			continue
+		}
+
+		// Offline, rate limited or token expired - keep mutation queued for next run
+		s.markAttempt(m.ids, err)
+		return fmt.Errorf("failed to push queued progress update: %w", err)
+	}
+	return nil
+}
+
+// push updates progress on user's list, unless it's already further. Cached list holds only some statuses, so entry
+// is looked up first - watching an episode must not move completed or paused anime back to watching.
+func (s *Syncer) push(ctx context.Context, token string, mediaID, progress int) error {
+	episodes, current, err := s.client.MediaListEntry(ctx, token, mediaID)
+	if err != nil {
+		return err
+	}
+
+	if current != nil && current.Progress >= progress {
+		lumo.Debug("AniList progress of media %d is already %d, skipping queued %d.", mediaID, current.Progress, progress)
+		return nil
+	}
+
+	var status string
+	switch {
+	case episodes > 0 && progress >= episodes:
+		status = "COMPLETED"
+	case current == nil || current.Status == "PLANNING":
+		status = "CURRENT"
+	}
+
+	if err := s.client.SaveMediaListEntry(ctx, token, mediaID, progress, status); err != nil {
+		return err
+	}
+
+	lumo.Debug("Pushed AniList progress %d for media %d.", progress, mediaID)
+	return nil
+}
+
+// rejectsMutation reports whether AniList refused mutation itself (unknown media or invalid variables). Rejected
+// token is answered with 400 as well, but mutations must survive it until account is linked again.
+func rejectsMutation(err error) bool {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+
+	for _, msg := range apiErr.Messages {
+		msg = strings.ToLower(msg)
+		if strings.Contains(msg, "token") || strings.Contains(msg, "unauthorized") {
+			return false
+		}
+	}
+
+	switch apiErr.StatusCode {
+	case http.StatusNotFound:
+		return true
+	case http.StatusBadRequest, http.StatusUnprocessableEntity:
+		for _, msg := range apiErr.Messages {
+			msg = strings.ToLower(msg)
+			if strings.Contains(msg, "validation") || strings.Contains(msg, "variable") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *Syncer) deleteMutations(ids []int64) {
+	for _, id := range ids {
+		if _, err := s.db.Exec("DELETE FROM anilist_mutations WHERE id = ?", id); err != nil {
+			lumo.Error("Failed to delete AniList mutation %d: %v", id, err)
+		}
+	}
+}
+
+func (s *Syncer) markAttempt(ids []int64, cause error) {
+	for _, id := range ids {
+		if _, err := s.db.Exec("UPDATE anilist_mutations SET attempts = attempts + 1, last_error = ? WHERE id = ?", cause.Error(), id); err != nil {
+			lumo.Error("Failed to update AniList mutation %d: %v", id, err)
+		}
+	}
+}
+
+func (s *Syncer) storeEntries(profileID int64, entries []model.MediaListEntry) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM anilist_list_entries WHERE profile_id = ?", profileID); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, e := range entries {
+		title := e.Media.Title.English
+		if title == "" {
+			title = e.Media.Title.Romaji
+		}
+
+		data, err := json.Marshal(model.ListEntry{
+			MediaID:  e.MediaID,
+			IDMal:    e.Media.IDMal,
+			Title:    title,
+			Image:    e.Media.CoverImage.Large,
+			Color:    e.Media.CoverImage.Color,
+			Status:   e.Status,
+			Progress: e.Progress,
+			Episodes: e.Media.Episodes,
+		})
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("INSERT OR REPLACE INTO anilist_list_entries (profile_id, media_id, status, progress, data, updated_at) VALUES (?, ?, ?, ?, ?, ?)", profileID, e.MediaID, e.Status, e.Progress, string(data), now)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	lumo.Info("Synchronized %d AniList list entries of profile %d.", len(entries), profileID)
+	return nil
+}
+
+// Entries returns cached list entries of profile, so they are available while offline.
+func (s *Syncer) Entries(profileID int64) ([]model.ListEntry, error) {
+	rows, err := s.db.Query("SELECT data FROM anilist_list_entries WHERE profile_id = ? ORDER BY status, media_id", profileID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make([]model.ListEntry, 0)
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+
+		var entry model.ListEntry
+		if err := json.Unmarshal([]byte(data), &entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// PendingMutations returns number of progress updates of profile waiting to be pushed.
+func (s *Syncer) PendingMutations(profileID int64) int {
+	var count int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM anilist_mutations WHERE profile_id = ?", profileID).Scan(&count); err != nil {
+		lumo.Error("Failed to count pending AniList mutations: %v", err)
+	}
+	return count
+}
+
+// DeleteProfile unlinks account of removed profile. It's meant to be used as profile.DeleteHook.
+func (s *Syncer) DeleteProfile(profileID int64) {
+	if err := s.Unlink(profileID); err != nil {
+		lumo.Error("Failed to unlink AniList account of deleted profile %d: %v", profileID, err)
+	}
+}
@@ -0,0 +1,231 @@
+package anilist
+
+import (
+	"context"
+	"encoding/json"
+	"jubako/internal/jobs"
+	"jubako/internal/testutil"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func newTestSyncer(t *testing.T, handler http.HandlerFunc) *Syncer {
+	t.Helper()
+
+	db := testutil.OpenDB(t)
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	return NewSyncer(db, NewClient(srv.URL, srv.Client()), jobs.NewScheduler(context.Background(), db))
+}
+
+func TestSyncReplaysQueuedProgressWhenOnline(t *testing.T) {
+	var online atomic.Bool
+	var pushed atomic.Int32
+
+	s := newTestSyncer(t, func(w http.ResponseWriter, r *http.Request) {
+		var payload struct {
+			Query     string         `json:"query"`
+			Variables map[string]any `json:"variables"`
+		}
+		json.NewDecoder(r.Body).Decode(&payload)
+
+		switch {
+		case strings.Contains(payload.Query, "Viewer"):
+			w.Write([]byte(`{"data": {"Viewer": {"id": 42, "name": "jubako"}}}`))
+		case !online.Load():
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case strings.Contains(payload.Query, "SaveMediaListEntry"):
+			pushed.Add(1)
+			if payload.Variables["progress"] != float64(4) {
+				t.Errorf("expected collapsed progress 4, got %v", payload.Variables["progress"])
+			}
+			w.Write([]byte(`{"data": {"SaveMediaListEntry": {"id": 1, "progress": 4}}}`))
+		default:
+			w.Write([]byte(`{"data": {"MediaListCollection": {"lists": [{"name": "Watching", "status": "CURRENT", "entries": [{"id": 1, "mediaId": 178025, "status": "CURRENT", "progress": 4, "media": {"id": 178025, "title": {"romaji": "Gachiakuta"}}}]}]}}}`))
+		}
+	})
+
+	if _, err := s.Link(context.Background(), 1, "token"); err != nil {
+		t.Fatalf("failed to link account: %v", err)
+	}
+
+	s.QueueProgress(1, 178025, 3)
+	s.QueueProgress(1, 178025, 4)
+
+	if err := s.Sync(context.Background()); err == nil {
+		t.Fatal("expected sync to fail while offline")
+	}
+
+	if got := s.PendingMutations(1); got != 2 {
+		t.Fatalf("expected 2 queued mutations while offline, got %d", got)
+	}
+
+	online.Store(true)
+	if err := s.Sync(context.Background()); err != nil {
+		t.Fatalf("unexpected sync error: %v", err)
+	}
+
+	if got := s.PendingMutations(1); got != 0 {
+		t.Errorf("expected empty queue after sync, got %d", got)
+	}
+
+	if pushed.Load() != 1 {
+		t.Errorf("expected single collapsed mutation, got %d", pushed.Load())
+	}
+
+	entries, err := s.Entries(1)
+	if err != nil || len(entries) != 1 || entries[0].Title != "Gachiakuta" {
+		t.Errorf("unexpected cached entries: %+v (%v)", entries, err)
+	}
+}
+
+func TestQueueProgressIgnoredWithoutAccount(t *testing.T) {
+	s := newTestSyncer(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Error("no request expected without linked account")
+	})
+
+	s.QueueProgress(1, 1, 1)
+	if got := s.PendingMutations(1); got != 0 {
+		t.Errorf("expected no queued mutations, got %d", got)
+	}
+}
+
+func TestLinkHandlerSeparatesRejectedTokenFromOutage(t *testing.T) {
+	cases := []struct {
+		status int
+		want   int
+	}{
+		{http.StatusBadRequest, http.StatusUnauthorized}, // AniList answers invalid token with 400
+		{http.StatusUnauthorized, http.StatusUnauthorized},
+		{http.StatusTooManyRequests, http.StatusServiceUnavailable},
+		{http.StatusInternalServerError, http.StatusBadGateway},
+		{http.StatusServiceUnavailable, http.StatusBadGateway},
+	}
+
+	for _, c := range cases {
+		s := newTestSyncer(t, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(c.status)
+			w.Write([]byte(`{"errors": [{"message": "nope"}]}`))
+		})
+		s.client.MaxRetries = 0
+
+		rec := httptest.NewRecorder()
+		s.LinkHandler(rec, httptest.NewRequest(http.MethodPut, "/api/anilist/account", strings.NewReader(`{"token": "token"}`)))
+		if rec.Code != c.want {
+			t.Errorf("AniList status %d: expected %d, got %d (%s)", c.status, c.want, rec.Code, rec.Body)
+		}
+	}
+}
+
+func TestSyncKeepsQueueUnlessMutationIsRejected(t *testing.T) {
+	cases := []struct {
+		name   string
+		status int
+		body   string
+		kept   bool
+	}{
+		{"invalid token", http.StatusBadRequest, `{"errors": [{"message": "Invalid token", "status": 400}]}`, true},
+		{"unauthorized", http.StatusUnauthorized, `{"errors": [{"message": "Unauthorized.", "status": 401}]}`, true},
+		{"outage", http.StatusInternalServerError, `{"errors": [{"message": "Internal Server Error", "status": 500}]}`, true},
+		{"unknown media", http.StatusNotFound, `{"errors": [{"message": "Not Found.", "status": 404}]}`, false},
+		{"invalid variables", http.StatusBadRequest, `{"errors": [{"message": "validation", "status": 400, "validation": {"mediaId": ["The selected media id is invalid."]}}]}`, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := newTestSyncer(t, func(w http.ResponseWriter, r *http.Request) {
+				var payload struct {
+					Query string `json:"query"`
+				}
+				json.NewDecoder(r.Body).Decode(&payload)
+
+				switch {
+				case strings.Contains(payload.Query, "Viewer"):
+					w.Write([]byte(`{"data": {"Viewer": {"id": 42, "name": "jubako"}}}`))
+				case strings.Contains(payload.Query, "SaveMediaListEntry"):
+					w.WriteHeader(c.status)
+					w.Write([]byte(c.body))
+				default:
+					w.Write([]byte(`{"data": {"MediaListCollection": {"lists": []}}}`))
+				}
+			})
+
+			if _, err := s.Link(context.Background(), 1, "token"); err != nil {
+				t.Fatalf("failed to link account: %v", err)
+			}
+
+			s.QueueProgress(1, 178025, 3)
+			s.Sync(context.Background())
+
+			if got := s.PendingMutations(1); (got == 1) != c.kept {
+				t.Errorf("expected mutation kept=%v, got %d queued", c.kept, got)
+			}
+		})
+	}
+}
+
+func TestSyncRespectsStatusOnAniList(t *testing.T) {
+	cases := []struct {
+		name     string
+		entry    string
+		progress int
+		pushed   map[string]any // Nil when nothing should be pushed
+	}{
+		{"not on list", `null`, 4, map[string]any{"progress": float64(4), "status": "CURRENT"}},
+		{"planned", `{"status": "PLANNING", "progress": 0}`, 1, map[string]any{"progress": float64(1), "status": "CURRENT"}},
+		{"paused", `{"status": "PAUSED", "progress": 2}`, 4, map[string]any{"progress": float64(4)}},
+		{"dropped", `{"status": "DROPPED", "progress": 5}`, 6, map[string]any{"progress": float64(6)}},
+		{"ahead", `{"status": "CURRENT", "progress": 6}`, 4, nil},
+		{"completed", `{"status": "COMPLETED", "progress": 12}`, 3, nil},
+		{"last episode", `{"status": "CURRENT", "progress": 11}`, 12, map[string]any{"progress": float64(12), "status": "COMPLETED"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var pushed map[string]any
+			s := newTestSyncer(t, func(w http.ResponseWriter, r *http.Request) {
+				var payload struct {
+					Query     string         `json:"query"`
+					Variables map[string]any `json:"variables"`
+				}
+				json.NewDecoder(r.Body).Decode(&payload)
+
+				switch {
+				case strings.Contains(payload.Query, "Viewer"):
+					w.Write([]byte(`{"data": {"Viewer": {"id": 42, "name": "jubako"}}}`))
+				case strings.Contains(payload.Query, "mediaListEntry"):
+					w.Write([]byte(`{"data": {"Media": {"id": 178025, "idMal": 57334, "episodes": 12, "mediaListEntry": ` + c.entry + `}}}`))
+				case strings.Contains(payload.Query, "SaveMediaListEntry"):
+					pushed = payload.Variables
+					delete(pushed, "mediaId")
+					w.Write([]byte(`{"data": {"SaveMediaListEntry": {"id": 1}}}`))
+				default:
+					w.Write([]byte(`{"data": {"MediaListCollection": {"lists": []}}}`))
+				}
+			})
+
+			if _, err := s.Link(context.Background(), 1, "token"); err != nil {
+				t.Fatalf("failed to link account: %v", err)
+			}
+
+			s.QueueProgress(1, 178025, c.progress)
+			if err := s.Sync(context.Background()); err != nil {
+				t.Fatalf("unexpected sync error: %v", err)
+			}
+
+			if !maps.Equal(pushed, c.pushed) {
+				t.Errorf("expected update %v, got %v", c.pushed, pushed)
+			}
+
+			if got := s.PendingMutations(1); got != 0 {
+				t.Errorf("expected empty queue after sync, got %d", got)
+			}
+		})
+	}
+}
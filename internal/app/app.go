@@ -4,14 +4,26 @@ import (
 	"context"
 	"database/sql"
 	"embed"
-	"fmt"
 	"io/fs"
+	"jubako/internal/anilist"
+	"jubako/internal/auth"
 	"jubako/internal/config"
+	"jubako/internal/events"
+	"jubako/internal/instance"
+	"jubako/internal/jobs"
+	"jubako/internal/library"
+	"jubako/internal/mal"
+	"jubako/internal/notify"
+	"jubako/internal/organize"
+	"jubako/internal/player"
+	"jubako/internal/profile"
+	"jubako/internal/retention"
 	"jubako/internal/route"
 	"jubako/internal/swarm"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
 	"time"
 
@@ -25,31 +37,235 @@ type App struct {
 	CancelCtx context.CancelFunc
 	StartedAt *time.Time // In local time
 
+	Config      *config.Config
+	Settings    *config.Store
 	SwarmClient *swarm.SwarmClient
+	Jobs        *jobs.Scheduler
+	Library     *library.Library
+	Events      *events.Bus
+	Notifier    *notify.Notifier
+	Auth        *auth.Authenticator
+	Profiles    *profile.Manager
+	Instance    *instance.Instance
 	HttpServer  *http.Server
 	DB          *sql.DB
 	// WebView is stored directly as an interface (not a pointer to interface)
+	// It's nil when running in headless mode
 	WebView webview.WebView
 }
 
-func NewApplication(embeddedFrontend embed.FS) *App {
+func NewApplication(embeddedFrontend embed.FS, cfg *config.Config, inst *instance.Instance) *App {
 	lumo.Debug("Creating main application instance.")
 
 	ctx, cancel := context.WithCancel(context.Background())
 	mux := http.NewServeMux()
 
-	db, err := sql.Open("sqlite", config.APP_FILES_PATH+"/data.db")
+	dbPath := cfg.DatabasePath()
+	db, err := sql.Open("sqlite", dbPath)
 	if err != nil {
-		werr := lumo.WrapError(err).Include("sqlite_file_path", config.APP_FILES_PATH+"/data.db")
+		werr := lumo.WrapError(err).Include("sqlite_file_path", dbPath)
 		lumo.Panic("Failed to open local sqlite database: %v", werr)
 	}
 
-	sc := swarm.NewSwarmClient()
+	authenticator := auth.NewAuthenticator(db, cfg.AuthLoopbackExempt, cfg.Port)
+	mux.HandleFunc("POST /api/auth/login", authenticator.LoginHandler)
+	mux.HandleFunc("POST /api/auth/logout", authenticator.LogoutHandler)
+	mux.HandleFunc("GET /api/auth/session", authenticator.SessionHandler)
+	mux.HandleFunc("GET /api/auth/users", authenticator.UsersHandler)
+	mux.HandleFunc("POST /api/auth/users", authenticator.CreateUserHandler)
+	mux.HandleFunc("PUT /api/auth/users/{id}/password", authenticator.PasswordHandler)
+	mux.HandleFunc("DELETE /api/auth/users/{id}", authenticator.DeleteUserHandler)
+	mux.HandleFunc("GET /api/auth/tokens", authenticator.APITokensHandler)
+	mux.HandleFunc("POST /api/auth/tokens", authenticator.CreateAPITokenHandler)
+	mux.HandleFunc("DELETE /api/auth/tokens/{id}", authenticator.RevokeAPITokenHandler)
+
+	if users, err := authenticator.Users(); err == nil && len(users) == 0 && !cfg.IsLoopbackHost() {
+		lumo.Warn("Server is reachable from other devices, but no user account exists yet. Create one from this machine with POST %s/api/auth/users.", cfg.LocalURL())
+	}
+
+	profiles := profile.NewManager(db)
+	mux.HandleFunc("GET /api/profiles", profiles.ListHandler)
+	mux.HandleFunc("POST /api/profiles", profiles.CreateHandler)
+	mux.HandleFunc("PUT /api/profiles/{id}", profiles.UpdateHandler)
+	mux.HandleFunc("DELETE /api/profiles/{id}", profiles.DeleteHandler)
+	mux.HandleFunc("POST /api/profiles/{id}/select", profiles.SelectHandler)
+
+	bus := events.NewBus(ctx)
+	notifier := notify.NewNotifier(bus, notify.NewDesktopBackend())
+	mux.HandleFunc("GET /api/events", bus.StreamHandler)
+
+	settings := config.NewStore(cfg)
+	mux.HandleFunc("GET /api/settings", settings.SettingsHandler)
+	mux.HandleFunc("PUT /api/settings", settings.UpdateSettingsHandler)
+
+	anilistClient := anilist.NewClient(cfg.AniListURL, nil)
+
+	sc := swarm.NewSwarmClient(db, cfg.DownloadDir, cfg.CacheDir, cfg.Network)
+	if err := cfg.RelocateDownloads(db); err != nil {
+		lumo.Error("Failed to update paths of moved downloads: %v", err)
+	}
+	sc.SetSeedPolicy(cfg.Seeding)
+	sc.SetStorage(cfg.Storage)
+	sc.SetDisk(cfg.Disk)
+	sc.SetTrackers(cfg.Trackers)
+
+	organizer := organize.NewOrganizer(sc.Relocate, anilistClient.Media, nil)
+	organizer.SetSettings(settings.Settings())
+	sc.OnComplete(func(identifier string, details swarm.DownloadDetails) {
+		notifier.Notify(notify.Notification{
+			Kind:  notify.KindDownloadComplete,
+			Title: "Download complete",
+			Body:  filepath.Base(details.Path),
+		})
+
+		// Hooks run before seeding starts, so organizing (which may query AniList) must not hold them up
+		if d, err := sc.Download(details.InfoHash); err == nil {
+			go organizer.Completed(*d)
+		} else {
+			lumo.Error("Failed to read completed %s download: %v", details.InfoHash, err)
+		}
+	})
+	sc.OnFinish(func(d swarm.Download) {
+		go organizer.Finished(d)
+	})
+	sc.OnFailure(func(identifier string, err error) {
+		notifier.Notify(notify.Notification{
+			Kind:  notify.KindDownloadFailed,
+			Title: "Download failed",
+			Body:  identifier,
+		})
+	})
+	sc.ResumeDownloads() // After hooks, so resumed downloads are organized and reported like new ones
+	go sc.VerifyInterrupted()
 	mux.HandleFunc("GET /api/stream", sc.StreamHandler)
+	mux.HandleFunc("GET /api/downloads", sc.DownloadsHandler)
+	mux.HandleFunc("POST /api/downloads", sc.AddDownloadHandler)
+	mux.HandleFunc("PUT /api/downloads/{hash}/seeding", sc.SeedPolicyHandler)
+	mux.HandleFunc("POST /api/downloads/{hash}/verify", sc.VerifyHandler)
+	mux.HandleFunc("GET /api/downloads/{hash}/files", sc.FilesHandler)
+	mux.HandleFunc("GET /api/downloads/{hash}/trackers", sc.TrackersHandler)
+	mux.HandleFunc("POST /api/downloads/{hash}/trackers", sc.AddTrackersHandler)
+
+	// Speed profiles override global limits on schedule, so limits are always resolved for current time
+	resolveLimits := func(now time.Time) swarm.Limits {
+		s := settings.Settings()
+		download, upload, profile := s.LimitsAt(now)
+		return swarm.Limits{Download: download, Upload: upload, Profile: profile}
+	}
+	sc.SetLimits(resolveLimits(time.Now()))
+	mux.HandleFunc("GET /api/bandwidth", sc.BandwidthHandler)
+	mux.HandleFunc("GET /api/network", sc.NetworkStatusHandler)
+	mux.HandleFunc("GET /api/disk", sc.DiskStatusHandler)
+	sc.OnNetworkChange(func(status swarm.NetworkStatus) {
+		bus.Publish(swarm.NetworkEventType, status)
+
+		if !status.Available && status.Paused {
+			notifier.Notify(notify.Notification{
+				Kind:  notify.KindNetworkDown,
+				Title: "Torrents paused",
+				Body:  status.Interface + " network interface is not available",
+			})
+		} else if status.Available && status.KillSwitch {
+			notifier.Notify(notify.Notification{
+				Kind:  notify.KindNetworkRestored,
+				Title: "Torrents resumed",
+				Body:  status.Interface + " network interface is available again",
+			})
+		}
+	})
+
+	sc.OnDiskChange(func(status swarm.DiskStatus) {
+		bus.Publish(swarm.DiskEventType, status)
+
+		if status.Paused {
+			notifier.Notify(notify.Notification{
+				Kind:  notify.KindDiskLow,
+				Title: "Downloads paused",
+				Body:  "Download drive is running out of free space",
+			})
+		}
+	})
+
+	settings.OnChange(func(old, new config.Settings) {
+		if old.DownloadDir != new.DownloadDir {
+			// Running downloads must finish where they started, so existing files are moved on next start
+			lumo.Info("New downloads will be saved to %s. Existing files will be moved there on next start.", new.DownloadDir)
+			sc.SetDownloadDir(new.DownloadDir)
+		}
+		sc.SetLimits(resolveLimits(time.Now()))
+		sc.SetSeedPolicy(new.Seeding)
+		sc.SetStorage(new.Storage)
+		sc.SetDisk(new.Disk)
+		sc.SetTrackers(new.Trackers)
+		organizer.SetSettings(new)
+		if old.Network != new.Network {
+			if err := sc.Restart(new.Network); err != nil {
+				lumo.Error("Failed to restart torrent client: %v", err)
+			}
+		}
+		bus.Publish(config.EventType, new)
+	})
+
+	scheduler := jobs.NewScheduler(ctx, db)
+	scheduler.Register(route.NewTimetableRefreshJob(db, anilistClient))
+	scheduler.Register(swarm.NewBandwidthJob(sc, resolveLimits))
+	mux.HandleFunc("GET /api/jobs", scheduler.StatusHandler)
+	mux.HandleFunc("POST /api/jobs/{name}/run", scheduler.RunHandler)
+
+	lib := library.NewLibrary(db)
+	profiles.OnDelete(lib.DeleteProfile)
+	profiles.OnDelete(route.NewCalendarTokenCleanup(db))
+	mux.HandleFunc("GET /api/library/history", lib.HistoryHandler)
+	mux.HandleFunc("GET /api/library/continue", lib.ContinueWatchingHandler)
+	mux.HandleFunc("POST /api/library/watched", lib.WatchedHandler)
+	mux.HandleFunc("GET /api/library/deletions", lib.DeletionsHandler)
+	mux.HandleFunc("GET /api/library/subscriptions", lib.SubscriptionsHandler)
+	mux.HandleFunc("PUT /api/library/subscriptions/{media_id}", lib.SubscribeHandler)
+	mux.HandleFunc("DELETE /api/library/subscriptions/{media_id}", lib.UnsubscribeHandler)
+	scheduler.Register(route.NewAiringNotificationJob(db, lib, notifier))
+	scheduler.Register(swarm.NewQuotaJob(sc, lib.LastWatched))
+	sc.OnDelete(func(d swarm.Download, reason string) {
+		if err := lib.RecordDeletion(d.MediaID, d.Episode, d.Path, d.Size, reason); err != nil {
+			lumo.Error("Failed to record deletion of %s: %v", d.Path, err)
+		}
+	})
+
+	retentionManager := retention.NewManager(db, sc.Downloads, lib.LastWatched, sc.DeleteDownload)
+	retentionManager.SetRule(cfg.Retention)
+	settings.OnChange(func(old, new config.Settings) {
+		retentionManager.SetRule(new.Retention)
+	})
+	scheduler.Register(retention.NewJob(retentionManager))
+	mux.HandleFunc("GET /api/retention/rules", retentionManager.RulesHandler)
+	mux.HandleFunc("PUT /api/retention/rules/{media_id}", retentionManager.SetRuleHandler)
+	mux.HandleFunc("DELETE /api/retention/rules/{media_id}", retentionManager.DeleteRuleHandler)
+	mux.HandleFunc("GET /api/retention/preview", retentionManager.PreviewHandler)
+
+	anilistSyncer := anilist.NewSyncer(db, anilistClient, scheduler)
+	lib.OnWatched(anilistSyncer.QueueProgress)
+	profiles.OnDelete(anilistSyncer.DeleteProfile)
+	mux.HandleFunc("GET /api/anilist/account", anilistSyncer.AccountHandler)
+	mux.HandleFunc("PUT /api/anilist/account", anilistSyncer.LinkHandler)
+	mux.HandleFunc("DELETE /api/anilist/account", anilistSyncer.UnlinkHandler)
+	mux.HandleFunc("GET /api/anilist/lists", anilistSyncer.ListsHandler)
+
+	malClient := mal.NewClient(cfg.MalClientID, cfg.LocalURL()+"/api/mal/callback", nil)
+	malSyncer := mal.NewSyncer(db, malClient, scheduler)
+	anilistClient.OnMalIDs(malSyncer.RememberMalIDs)
+	lib.OnWatched(malSyncer.QueueProgress)
+	profiles.OnDelete(malSyncer.DeleteProfile)
+	mux.HandleFunc("GET /api/mal/account", malSyncer.AccountHandler)
+	mux.HandleFunc("POST /api/mal/authorize", malSyncer.AuthorizeHandler)
+	mux.HandleFunc("GET /api/mal/callback", malSyncer.CallbackHandler)
+	mux.HandleFunc("DELETE /api/mal/account", malSyncer.UnlinkHandler)
 
 	// API routes
 	mux.HandleFunc("GET /api/search", route.NewNavSearchHandler(db))
-	mux.HandleFunc("GET /api/anime-timetable", route.NewAnimeTimetableHandler(db))
+	mux.HandleFunc("GET /api/anime-timetable", route.NewAnimeTimetableHandler(db, anilistClient, scheduler))
+	mux.HandleFunc("GET /api/timetable.ics", route.NewTimetableCalendarHandler(db, lib))
+	calendarTokenHandler := route.NewCalendarTokenHandler(db)
+	mux.HandleFunc("GET /api/calendar", calendarTokenHandler)
+	mux.HandleFunc("POST /api/calendar", calendarTokenHandler)
 
 	frontendFS, err := fs.Sub(embeddedFrontend, "frontend")
 	if err != nil {
@@ -60,17 +276,29 @@ func NewApplication(embeddedFrontend embed.FS) *App {
 	// Serve the frontend assets at the root path "/"
 	mux.Handle("GET /", http.FileServer(http.FS(frontendFS)))
 
-	w := webview.New(true)
-	w.SetTitle("Jubako")
-	w.SetSize(1024, 640, webview.HintNone)
+	var w webview.WebView
+	if !cfg.Headless {
+		w = webview.New(true)
+		w.SetTitle("Jubako")
+		w.SetSize(1024, 640, webview.HintNone)
+	}
 
 	app := &App{
 		Ctx:         ctx,
 		CancelCtx:   cancel,
+		Config:      cfg,
+		Settings:    settings,
 		SwarmClient: sc,
+		Jobs:        scheduler,
+		Library:     lib,
+		Events:      bus,
+		Notifier:    notifier,
+		Auth:        authenticator,
+		Profiles:    profiles,
+		Instance:    inst,
 		HttpServer: &http.Server{
-			Addr:    "127.0.0.1:" + config.HTTP_PORT,
-			Handler: mux,
+			Addr:    cfg.ListenAddr(),
+			Handler: authenticator.Middleware(profiles.Middleware(mux)),
 		},
 		DB:      db,
 		WebView: w,
@@ -81,7 +309,9 @@ func NewApplication(embeddedFrontend embed.FS) *App {
 }
 
 func (app *App) Run() {
-	defer app.WebView.Destroy()
+	if app.WebView != nil {
+		defer app.WebView.Destroy()
+	}
 
 	startedAt := time.Now()
 	stop := make(chan os.Signal, 1)
@@ -90,7 +320,7 @@ func (app *App) Run() {
 	serverErr := make(chan error, 2)
 	app.StartedAt = &startedAt
 
-	lumo.Info("Started HTTP server at 127.0.0.1:%s!", config.HTTP_PORT)
+	lumo.Info("Started HTTP server at %s!", app.Config.ListenAddr())
 	go func() {
 		serverErr <- app.HttpServer.ListenAndServe()
 	}()
@@ -102,24 +332,66 @@ func (app *App) Run() {
 			lumo.Info("Received core app context cancellation -> requested to shut down app handler...")
 		case sig := <-stop:
 			lumo.Info("Received \"%v\" signal -> requested to shut down app handler...", sig)
-			app.WebView.Terminate()
+			app.stop()
 		case err := <-serverErr:
 			if err != nil && err != http.ErrServerClosed {
 				werr := lumo.WrapError(err)
 				lumo.Error("Received error from app's internal http server: %v", werr)
-				app.WebView.Terminate()
+				app.stop()
 			}
 		}
 	}()
 
-	app.WebView.Navigate(fmt.Sprintf("http://127.0.0.1:%s/view/index.html", config.HTTP_PORT))
+	app.Jobs.Start()
+	app.open(instance.Request{Magnets: app.Config.Magnets, Play: app.Config.Play})
+	app.Instance.Serve(app.handleLaunch)
+
+	if app.WebView == nil {
+		lumo.Info("Running in headless mode - open %s/view/index.html in a browser. Press Ctrl+C to stop.", app.Config.LocalURL())
+		<-app.Ctx.Done()
+	} else {
+		app.WebView.Navigate(app.Config.LocalURL() + "/view/index.html")
 
-	lumo.Info("Started WebView window - application should be ready.")
-	app.WebView.Run()
+		lumo.Info("Started WebView window - application should be ready.")
+		app.WebView.Run()
+	}
 
 	app.Shutdown()
 }
 
+// handleLaunch brings window to front and opens arguments of later launch, which exits right after.
+func (app *App) handleLaunch(req instance.Request) error {
+	lumo.Debug("Received arguments from another launch.")
+	app.open(req)
+
+	if app.WebView != nil {
+		app.WebView.Dispatch(func() {
+			focusWindow(app.WebView)
+		})
+	}
+	return nil
+}
+
+// open starts downloads and playback requested from command line.
+func (app *App) open(req instance.Request) {
+	for _, magnet := range req.Magnets {
+		app.SwarmClient.AddMagnet(magnet, "", nil)
+	}
+
+	if req.Play != "" {
+		go player.Launch(req.Play, app.Settings.Settings().PreferredPlayers)
+	}
+}
+
+// stop unblocks Run - by closing window or, in headless mode, by cancelling main context.
+func (app *App) stop() {
+	if app.WebView != nil {
+		app.WebView.Terminate()
+		return
+	}
+	app.CancelCtx()
+}
+
 func (app *App) Shutdown() {
 	lumo.Debug("Stopping all services watching main context...")
 	app.CancelCtx()
@@ -132,5 +404,11 @@ func (app *App) Shutdown() {
 		_ = app.HttpServer.Close()
 	}
 
+	lumo.Debug("Waiting for background jobs to finish...")
+	app.Jobs.Wait()
+	app.SwarmClient.Close()
+	app.Notifier.Close()
+	app.Instance.Close()
+
 	lumo.Info("Finished shutdown process. Bye!")
 }
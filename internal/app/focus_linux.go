@@ -0,0 +1,20 @@
+//go:build linux && cgo
+
+package app
+
+/*
+#cgo pkg-config: gtk+-3.0
+#include <gtk/gtk.h>
+
+static void present_window(void *window) {
+	gtk_window_present(GTK_WINDOW(window));
+}
+*/
+import "C"
+
+import webview "github.com/webview/webview_go"
+
+// focusWindow raises application window above others. It must be called from UI thread.
+func focusWindow(w webview.WebView) {
+	C.present_window(w.Window())
+}
@@ -0,0 +1,8 @@
+//go:build !linux || !cgo
+
+package app
+
+import webview "github.com/webview/webview_go"
+
+// focusWindow is no-op, window can only be brought to front on Linux for now.
+func focusWindow(w webview.WebView) {}
@@ -0,0 +1,454 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/amatsagu/lumo"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	SessionCookie = "jubako_session"
+	CSRFCookie    = "jubako_csrf"
+	CSRFHeader    = "X-CSRF-Token"
+
+	// Prefix makes API tokens easy to recognize (and to catch by secret scanners).
+	apiTokenPrefix = "jbk_"
+
+	sessionLifetime   = 30 * 24 * time.Hour
+	minPasswordLength = 8
+
+	// Failed logins from single address are throttled after that many attempts within loginFailureWindow.
+	maxLoginFailures   = 5
+	loginFailureWindow = 15 * time.Minute
+)
+
+var (
+	ErrInvalidCredentials = errors.New("invalid username or password")
+	ErrTooManyAttempts    = errors.New("too many failed login attempts, try again later")
+	ErrUserExists         = errors.New("user already exists")
+	ErrUnknownUser        = errors.New("unknown user")
+	ErrWeakPassword       = errors.New("password must be at least 8 characters long")
+	ErrInvalidUsername    = errors.New("username must be 1-64 characters long and cannot contain whitespace")
+	ErrInvalidToken       = errors.New("invalid or expired token")
+)
+
+// Hash compared against when username doesn't exist. Generated lazily, since bcrypt is deliberately slow.
+var dummyHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("jubako"), bcrypt.DefaultCost)
+	return hash
+})
+
+type User struct {
+	ID        int64     `json:"id"`
+	Username  string    `json:"username"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type Session struct {
+	User      User
+	CSRFToken string
+	ExpiresAt time.Time
+}
+
+// APIToken describes token used by scripts. Secret itself is only returned once, on creation.
+type APIToken struct {
+	ID         int64      `json:"id"`
+	UserID     int64      `json:"user_id"`
+	Name       string     `json:"name"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+// Authenticator manages local user accounts, browser sessions and API tokens.
+type Authenticator struct {
+	db *sql.DB
+
+	// When enabled, requests coming from this machine don't need any credentials.
+	LoopbackExempt bool
+
+	port int // Port of HTTP server, exempt requests must address it by loopback name
+
+	failures map[string][]time.Time
+	mu       sync.Mutex // Protects failures
+}
+
+type contextKey struct{}
+
+func NewAuthenticator(db *sql.DB, loopbackExempt bool, port int) *Authenticator {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS users (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		username TEXT NOT NULL UNIQUE COLLATE NOCASE,
+		password_hash TEXT NOT NULL,
+		created_at DATETIME NOT NULL
+	)`)
+	if err != nil {
+		lumo.Error("Failed to create users table: %v", err)
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS sessions (
+		token_hash TEXT PRIMARY KEY,
+		user_id INTEGER NOT NULL,
+		csrf_token TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		expires_at DATETIME NOT NULL
+	)`)
+	if err != nil {
+		lumo.Error("Failed to create sessions table: %v", err)
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS api_tokens (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		token_hash TEXT NOT NULL UNIQUE,
+		created_at DATETIME NOT NULL,
+		last_used_at DATETIME
+	)`)
+	if err != nil {
+		lumo.Error("Failed to create api_tokens table: %v", err)
+	}
+
+	return &Authenticator{
+		db:             db,
+		LoopbackExempt: loopbackExempt,
+		port:           port,
+		failures:       make(map[string][]time.Time),
+	}
+}
+
+// UserFromContext returns user that authenticated request. It's missing for loopback-exempt requests.
+func UserFromContext(ctx context.Context) (User, bool) {
+	user, ok := ctx.Value(contextKey{}).(User)
+	return user, ok
+}
+
+func withUser(ctx context.Context, user User) context.Context {
+	return context.WithValue(ctx, contextKey{}, user)
+}
+
+// CreateUser stores new account with bcrypt hashed password.
+func (a *Authenticator) CreateUser(username, password string) (User, error) {
+	username = strings.TrimSpace(username)
+	if username == "" || len(username) > 64 || strings.ContainsAny(username, " \t\r\n") {
+		return User{}, ErrInvalidUsername
+	}
+
+	if len(password) < minPasswordLength {
+		return User{}, ErrWeakPassword
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return User{}, err
+	}
+
+	user := User{Username: username, CreatedAt: time.Now()}
+	res, err := a.db.Exec("INSERT INTO users (username, password_hash, created_at) VALUES (?, ?, ?) ON CONFLICT (username) DO NOTHING", username, string(hash), user.CreatedAt)
+	if err != nil {
+		return User{}, err
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return User{}, ErrUserExists
+	}
+
+	user.ID, err = res.LastInsertId()
+	return user, err
+}
+
+// SetPassword replaces password of existing user and signs out all of their sessions.
+func (a *Authenticator) SetPassword(userID int64, password string) error {
+	if len(password) < minPasswordLength {
+		return ErrWeakPassword
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	res, err := a.db.Exec("UPDATE users SET password_hash = ? WHERE id = ?", string(hash), userID)
+	if err != nil {
+		return err
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrUnknownUser
+	}
+
+	_, err = a.db.Exec("DELETE FROM sessions WHERE user_id = ?", userID)
+	return err
+}
+
+// DeleteUser removes account together with all of its sessions and API tokens.
+func (a *Authenticator) DeleteUser(userID int64) error {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("DELETE FROM users WHERE id = ?", userID)
+	if err != nil {
+		return err
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrUnknownUser
+	}
+
+	if _, err := tx.Exec("DELETE FROM sessions WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM api_tokens WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (a *Authenticator) Users() ([]User, error) {
+	rows, err := a.db.Query("SELECT id, username, created_at FROM users ORDER BY username")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := make([]User, 0)
+	for rows.Next() {
+		var user User
+		if err := rows.Scan(&user.ID, &user.Username, &user.CreatedAt); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+func (a *Authenticator) userByName(username string) (User, string, error) {
+	var user User
+	var hash string
+	err := a.db.QueryRow("SELECT id, username, password_hash, created_at FROM users WHERE username = ?", username).Scan(&user.ID, &user.Username, &hash, &user.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, "", ErrUnknownUser
+	}
+	return user, hash, err
+}
+
+// Login verifies credentials and opens new session. Returned token should be stored in session cookie.
+func (a *Authenticator) Login(username, password, remoteAddr string) (string, Session, error) {
+	if a.throttled(remoteAddr) {
+		return "", Session{}, ErrTooManyAttempts
+	}
+
+	user, hash, err := a.userByName(strings.TrimSpace(username))
+	if errors.Is(err, ErrUnknownUser) {
+		// Compare anyway, so response time doesn't reveal which usernames exist
+		bcrypt.CompareHashAndPassword(dummyHash(), []byte(password))
+		a.recordFailure(remoteAddr)
+		return "", Session{}, ErrInvalidCredentials
+	}
+	if err != nil {
+		return "", Session{}, err
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		a.recordFailure(remoteAddr)
+		return "", Session{}, ErrInvalidCredentials
+	}
+
+	a.mu.Lock()
+	delete(a.failures, remoteAddr)
+	a.mu.Unlock()
+
+	token, err := randomToken()
+	if err != nil {
+		return "", Session{}, err
+	}
+
+	csrf, err := randomToken()
+	if err != nil {
+		return "", Session{}, err
+	}
+
+	now := time.Now()
+	session := Session{User: user, CSRFToken: csrf, ExpiresAt: now.Add(sessionLifetime)}
+	_, err = a.db.Exec("INSERT INTO sessions (token_hash, user_id, csrf_token, created_at, expires_at) VALUES (?, ?, ?, ?, ?)", hashToken(token), user.ID, csrf, now, session.ExpiresAt)
+	if err != nil {
+		return "", Session{}, err
+	}
+
+	if _, err := a.db.Exec("DELETE FROM sessions WHERE expires_at < ?", now); err != nil {
+		lumo.Warn("Failed to prune expired sessions: %v", err)
+	}
+
+	lumo.Info("User \"%s\" signed in from %s.", user.Username, remoteAddr)
+	return token, session, nil
+}
+
+// Logout invalidates session identified by its cookie token.
+func (a *Authenticator) Logout(token string) error {
+	_, err := a.db.Exec("DELETE FROM sessions WHERE token_hash = ?", hashToken(token))
+	return err
+}
+
+// Session returns still valid session identified by its cookie token.
+func (a *Authenticator) Session(token string) (Session, error) {
+	var session Session
+	err := a.db.QueryRow(`SELECT u.id, u.username, u.created_at, s.csrf_token, s.expires_at
+		FROM sessions s JOIN users u ON u.id = s.user_id
+		WHERE s.token_hash = ?`, hashToken(token)).Scan(&session.User.ID, &session.User.Username, &session.User.CreatedAt, &session.CSRFToken, &session.ExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Session{}, ErrInvalidToken
+	}
+	if err != nil {
+		return Session{}, err
+	}
+
+	if time.Now().After(session.ExpiresAt) {
+		return Session{}, ErrInvalidToken
+	}
+	return session, nil
+}
+
+// CreateAPIToken issues new token for given user. Returned secret cannot be recovered later.
+func (a *Authenticator) CreateAPIToken(userID int64, name string) (string, APIToken, error) {
+	var exists bool
+	if err := a.db.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE id = ?)", userID).Scan(&exists); err != nil {
+		return "", APIToken{}, err
+	}
+
+	if !exists {
+		return "", APIToken{}, ErrUnknownUser
+	}
+
+	secret, err := randomToken()
+	if err != nil {
+		return "", APIToken{}, err
+	}
+	secret = apiTokenPrefix + secret
+
+	token := APIToken{UserID: userID, Name: strings.TrimSpace(name), CreatedAt: time.Now()}
+	if token.Name == "" {
+		token.Name = "API token"
+	}
+
+	res, err := a.db.Exec("INSERT INTO api_tokens (user_id, name, token_hash, created_at) VALUES (?, ?, ?, ?)", userID, token.Name, hashToken(secret), token.CreatedAt)
+	if err != nil {
+		return "", APIToken{}, err
+	}
+
+	token.ID, err = res.LastInsertId()
+	return secret, token, err
+}
+
+// APITokens returns tokens of given user, or of all users when userID is 0.
+func (a *Authenticator) APITokens(userID int64) ([]APIToken, error) {
+	rows, err := a.db.Query("SELECT id, user_id, name, created_at, last_used_at FROM api_tokens WHERE ? = 0 OR user_id = ? ORDER BY created_at", userID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := make([]APIToken, 0)
+	for rows.Next() {
+		var token APIToken
+		var lastUsed sql.NullTime
+		if err := rows.Scan(&token.ID, &token.UserID, &token.Name, &token.CreatedAt, &lastUsed); err != nil {
+			return nil, err
+		}
+
+		if lastUsed.Valid {
+			token.LastUsedAt = &lastUsed.Time
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+// RevokeAPIToken deletes token. When userID isn't 0, token must belong to that user.
+func (a *Authenticator) RevokeAPIToken(userID, tokenID int64) error {
+	res, err := a.db.Exec("DELETE FROM api_tokens WHERE id = ? AND (? = 0 OR user_id = ?)", tokenID, userID, userID)
+	if err != nil {
+		return err
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrInvalidToken
+	}
+	return nil
+}
+
+// VerifyAPIToken returns owner of given API token secret.
+func (a *Authenticator) VerifyAPIToken(secret string) (User, error) {
+	if !strings.HasPrefix(secret, apiTokenPrefix) {
+		return User{}, ErrInvalidToken
+	}
+
+	var user User
+	var tokenID int64
+	err := a.db.QueryRow(`SELECT t.id, u.id, u.username, u.created_at
+		FROM api_tokens t JOIN users u ON u.id = t.user_id
+		WHERE t.token_hash = ?`, hashToken(secret)).Scan(&tokenID, &user.ID, &user.Username, &user.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrInvalidToken
+	}
+	if err != nil {
+		return User{}, err
+	}
+
+	if _, err := a.db.Exec("UPDATE api_tokens SET last_used_at = ? WHERE id = ?", time.Now(), tokenID); err != nil {
+		lumo.Warn("Failed to update API token usage time: %v", err)
+	}
+	return user, nil
+}
+
+func (a *Authenticator) throttled(remoteAddr string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	cutoff := time.Now().Add(-loginFailureWindow)
+	recent := a.failures[remoteAddr][:0]
+	for _, at := range a.failures[remoteAddr] {
+		if at.After(cutoff) {
+			recent = append(recent, at)
+		}
+	}
+
+	if len(recent) == 0 {
+		delete(a.failures, remoteAddr)
+		return false
+	}
+
+	a.failures[remoteAddr] = recent
+	return len(recent) >= maxLoginFailures
+}
+
+func (a *Authenticator) recordFailure(remoteAddr string) {
+	a.mu.Lock()
+	a.failures[remoteAddr] = append(a.failures[remoteAddr], time.Now())
+	a.mu.Unlock()
+}
+
+func randomToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// Only hashes of session and API tokens are stored, so leaked database doesn't grant access.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,202 @@
+package auth
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	_ "modernc.org/sqlite"
+)
+
+const testPort = 5578
+
+func newTestAuthenticator(t *testing.T, loopbackExempt bool) *Authenticator {
+	t.Helper()
+
+	db, err := sql.Open("sqlite", t.TempDir()+"/data.db")
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return NewAuthenticator(db, loopbackExempt, testPort)
+}
+
+func protectedHandler(a *Authenticator) http.Handler {
+	return a.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, ok := UserFromContext(r.Context()); ok {
+			w.Write([]byte(user.Username))
+			return
+		}
+		w.Write([]byte("anonymous"))
+	}))
+}
+
+func serve(h http.Handler, method, remoteAddr string, prepare func(r *http.Request)) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, "/api/jobs", nil)
+	r.Host = "localhost:" + strconv.Itoa(testPort)
+	r.RemoteAddr = remoteAddr
+	if prepare != nil {
+		prepare(r)
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestMiddlewareLoopbackExemption(t *testing.T) {
+	h := protectedHandler(newTestAuthenticator(t, true))
+
+	if w := serve(h, http.MethodGet, "127.0.0.1:40000", nil); w.Code != http.StatusOK || w.Body.String() != "anonymous" {
+		t.Errorf("expected loopback request to pass, got %d %q", w.Code, w.Body.String())
+	}
+
+	if w := serve(h, http.MethodGet, "192.168.1.20:40000", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected remote request to be rejected, got %d", w.Code)
+	}
+
+	w := serve(h, http.MethodPost, "127.0.0.1:40000", func(r *http.Request) {
+		r.Header.Set("Origin", "https://evil.example")
+	})
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected cross-origin loopback write to be rejected, got %d", w.Code)
+	}
+
+	for _, site := range []string{"cross-site", "same-site"} {
+		w = serve(h, http.MethodGet, "127.0.0.1:40000", func(r *http.Request) {
+			r.Header.Set("Sec-Fetch-Site", site)
+		})
+		if w.Code != http.StatusForbidden {
+			t.Errorf("expected %s loopback API call to be rejected, got %d", site, w.Code)
+		}
+	}
+
+	// DNS rebinding points attacker's domain to 127.0.0.1, so only literal loopback names are exempt
+	for _, host := range []string{"127.0.0.1:5578", "[::1]:5578", "LOCALHOST:5578"} {
+		w = serve(h, http.MethodPost, "127.0.0.1:40000", func(r *http.Request) {
+			r.Host = host
+			r.Header.Set("Origin", "http://"+host)
+		})
+		if w.Code != http.StatusOK {
+			t.Errorf("expected request to %s to be exempt, got %d", host, w.Code)
+		}
+	}
+
+	for _, host := range []string{"rebind.evil.example:5578", "localhost:8080", "localhost"} {
+		w = serve(h, http.MethodPost, "127.0.0.1:40000", func(r *http.Request) {
+			r.Host = host
+			r.Header.Set("Origin", "http://"+host)
+		})
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("expected request to %s not to be exempt, got %d", host, w.Code)
+		}
+	}
+
+	h = protectedHandler(newTestAuthenticator(t, false))
+	if w := serve(h, http.MethodGet, "127.0.0.1:40000", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected loopback request to be rejected without exemption, got %d", w.Code)
+	}
+}
+
+func TestMiddlewareSessionRequiresCSRF(t *testing.T) {
+	a := newTestAuthenticator(t, false)
+	h := protectedHandler(a)
+
+	if _, err := a.CreateUser("sora", "hunter22"); err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+
+	if _, _, err := a.Login("sora", "wrong-password", "10.0.0.2"); err != ErrInvalidCredentials {
+		t.Fatalf("expected ErrInvalidCredentials, got %v", err)
+	}
+
+	token, session, err := a.Login("SORA", "hunter22", "10.0.0.2")
+	if err != nil {
+		t.Fatalf("unexpected login error: %v", err)
+	}
+
+	withCookie := func(r *http.Request) {
+		r.AddCookie(&http.Cookie{Name: SessionCookie, Value: token})
+	}
+
+	if w := serve(h, http.MethodGet, "10.0.0.2:40000", withCookie); w.Code != http.StatusOK || w.Body.String() != "sora" {
+		t.Errorf("expected session request to pass, got %d %q", w.Code, w.Body.String())
+	}
+
+	if w := serve(h, http.MethodPost, "10.0.0.2:40000", withCookie); w.Code != http.StatusForbidden {
+		t.Errorf("expected write without csrf token to be rejected, got %d", w.Code)
+	}
+
+	w := serve(h, http.MethodPost, "10.0.0.2:40000", func(r *http.Request) {
+		withCookie(r)
+		r.Header.Set(CSRFHeader, session.CSRFToken)
+	})
+	if w.Code != http.StatusOK {
+		t.Errorf("expected write with csrf token to pass, got %d", w.Code)
+	}
+
+	if err := a.Logout(token); err != nil {
+		t.Fatalf("unexpected logout error: %v", err)
+	}
+
+	if w := serve(h, http.MethodGet, "10.0.0.2:40000", withCookie); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected request with ended session to be rejected, got %d", w.Code)
+	}
+}
+
+func TestMiddlewareAPIToken(t *testing.T) {
+	a := newTestAuthenticator(t, false)
+	h := protectedHandler(a)
+
+	user, err := a.CreateUser("script", "correct-horse")
+	if err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+
+	secret, token, err := a.CreateAPIToken(user.ID, "cron")
+	if err != nil {
+		t.Fatalf("failed to create API token: %v", err)
+	}
+
+	if !strings.HasPrefix(secret, apiTokenPrefix) {
+		t.Errorf("expected token with %q prefix, got %q", apiTokenPrefix, secret)
+	}
+
+	bearer := func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+secret) }
+
+	// API tokens aren't sent by browsers automatically, so they don't need csrf protection
+	if w := serve(h, http.MethodPost, "10.0.0.3:40000", bearer); w.Code != http.StatusOK || w.Body.String() != "script" {
+		t.Errorf("expected token request to pass, got %d %q", w.Code, w.Body.String())
+	}
+
+	if err := a.RevokeAPIToken(user.ID, token.ID); err != nil {
+		t.Fatalf("failed to revoke API token: %v", err)
+	}
+
+	if w := serve(h, http.MethodGet, "10.0.0.3:40000", bearer); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected revoked token to be rejected, got %d", w.Code)
+	}
+}
+
+func TestLoginThrottling(t *testing.T) {
+	a := newTestAuthenticator(t, false)
+	if _, err := a.CreateUser("sora", "hunter22"); err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+
+	for range maxLoginFailures {
+		a.Login("sora", "nope-nope", "10.0.0.4")
+	}
+
+	if _, _, err := a.Login("sora", "hunter22", "10.0.0.4"); err != ErrTooManyAttempts {
+		t.Errorf("expected ErrTooManyAttempts, got %v", err)
+	}
+
+	if _, _, err := a.Login("sora", "hunter22", "10.0.0.5"); err != nil {
+		t.Errorf("expected other address to sign in, got %v", err)
+	}
+}
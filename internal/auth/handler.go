@@ -0,0 +1,328 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/amatsagu/lumo"
+)
+
+type credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// LoginHandler verifies json credentials and sets session and CSRF cookies.
+func (a *Authenticator) LoginHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var body credentials
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "expected json body with username and password"})
+		return
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	token, session, err := a.Login(body.Username, body.Password, host)
+	switch {
+	case errors.Is(err, ErrTooManyAttempts):
+		lumo.Warn("Rejected login attempt from %s - too many failures.", host)
+		w.WriteHeader(http.StatusTooManyRequests)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	case errors.Is(err, ErrInvalidCredentials):
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	case err != nil:
+		lumo.Error("Failed to sign in user: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to sign in"})
+		return
+	}
+
+	secure := r.TLS != nil
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  session.ExpiresAt,
+		HttpOnly: true,
+		Secure:   secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	// Readable by frontend scripts, which echo it in CSRF header
+	http.SetCookie(w, &http.Cookie{
+		Name:     CSRFCookie,
+		Value:    session.CSRFToken,
+		Path:     "/",
+		Expires:  session.ExpiresAt,
+		Secure:   secure,
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	json.NewEncoder(w).Encode(map[string]any{
+		"user":       session.User,
+		"csrf_token": session.CSRFToken,
+		"expires_at": session.ExpiresAt,
+	})
+}
+
+// LogoutHandler ends current session and clears its cookies.
+func (a *Authenticator) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if cookie, err := r.Cookie(SessionCookie); err == nil {
+		if err := a.Logout(cookie.Value); err != nil {
+			lumo.Error("Failed to remove session: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "failed to sign out"})
+			return
+		}
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: SessionCookie, Path: "/", MaxAge: -1, HttpOnly: true})
+	http.SetCookie(w, &http.Cookie{Name: CSRFCookie, Path: "/", MaxAge: -1})
+	fmt.Fprint(w, `{"status": "success"}`)
+}
+
+// SessionHandler tells frontend whether it's signed in, or doesn't need to be at all.
+func (a *Authenticator) SessionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	res := map[string]any{
+		"authenticated": false,
+		"exempt":        a.isExempt(r),
+	}
+
+	if cookie, err := r.Cookie(SessionCookie); err == nil {
+		if session, err := a.Session(cookie.Value); err == nil {
+			res["authenticated"] = true
+			res["user"] = session.User
+		}
+	}
+
+	json.NewEncoder(w).Encode(res)
+}
+
+// UsersHandler returns all accounts.
+func (a *Authenticator) UsersHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	users, err := a.Users()
+	if err != nil {
+		lumo.Error("Failed to read users: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to read users"})
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(users); err != nil {
+		lumo.Error("Failed to encode users: %v", err)
+	}
+}
+
+// CreateUserHandler creates account from json credentials. First account can be created from this machine, thanks to loopback exemption.
+func (a *Authenticator) CreateUserHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var body credentials
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "expected json body with username and password"})
+		return
+	}
+
+	user, err := a.CreateUser(body.Username, body.Password)
+	switch {
+	case errors.Is(err, ErrInvalidUsername), errors.Is(err, ErrWeakPassword):
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	case errors.Is(err, ErrUserExists):
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	case err != nil:
+		lumo.Error("Failed to create user: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to create user"})
+		return
+	}
+
+	lumo.Info("Created user account \"%s\".", user.Username)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(user)
+}
+
+// PasswordHandler changes password of user from {id} path value. Signed in users may only change their own password.
+func (a *Authenticator) PasswordHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, ok := a.targetUser(w, r)
+	if !ok {
+		return
+	}
+
+	var body credentials
+	json.NewDecoder(r.Body).Decode(&body)
+
+	err := a.SetPassword(userID, body.Password)
+	switch {
+	case errors.Is(err, ErrWeakPassword):
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	case errors.Is(err, ErrUnknownUser):
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "unknown user"})
+		return
+	case err != nil:
+		lumo.Error("Failed to change password of user %d: %v", userID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to change password"})
+		return
+	}
+
+	fmt.Fprint(w, `{"status": "success"}`)
+}
+
+// DeleteUserHandler removes account from {id} path value. Signed in users may only remove their own account.
+func (a *Authenticator) DeleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, ok := a.targetUser(w, r)
+	if !ok {
+		return
+	}
+
+	err := a.DeleteUser(userID)
+	if errors.Is(err, ErrUnknownUser) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "unknown user"})
+		return
+	}
+	if err != nil {
+		lumo.Error("Failed to delete user %d: %v", userID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to delete user"})
+		return
+	}
+
+	fmt.Fprint(w, `{"status": "success"}`)
+}
+
+// APITokensHandler lists API tokens of signed in user (or all of them, for exempt local requests).
+func (a *Authenticator) APITokensHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var userID int64
+	if user, ok := UserFromContext(r.Context()); ok {
+		userID = user.ID
+	}
+
+	tokens, err := a.APITokens(userID)
+	if err != nil {
+		lumo.Error("Failed to read API tokens: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to read API tokens"})
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(tokens); err != nil {
+		lumo.Error("Failed to encode API tokens: %v", err)
+	}
+}
+
+// CreateAPITokenHandler issues token for signed in user. Exempt local requests must name owner with "user_id" field.
+func (a *Authenticator) CreateAPITokenHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var body struct {
+		Name   string `json:"name"`
+		UserID int64  `json:"user_id"`
+	}
+	json.NewDecoder(r.Body).Decode(&body)
+
+	if user, ok := UserFromContext(r.Context()); ok {
+		body.UserID = user.ID
+	}
+
+	secret, token, err := a.CreateAPIToken(body.UserID, body.Name)
+	if errors.Is(err, ErrUnknownUser) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "unknown user"})
+		return
+	}
+	if err != nil {
+		lumo.Error("Failed to create API token: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to create API token"})
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]any{
+		"token":  secret,
+		"detail": token,
+	})
+}
+
+// RevokeAPITokenHandler deletes API token from {id} path value.
+func (a *Authenticator) RevokeAPITokenHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	tokenID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || tokenID <= 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid token id"})
+		return
+	}
+
+	var userID int64
+	if user, ok := UserFromContext(r.Context()); ok {
+		userID = user.ID
+	}
+
+	err = a.RevokeAPIToken(userID, tokenID)
+	if errors.Is(err, ErrInvalidToken) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "unknown token"})
+		return
+	}
+	if err != nil {
+		lumo.Error("Failed to revoke API token %d: %v", tokenID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to revoke API token"})
+		return
+	}
+
+	fmt.Fprint(w, `{"status": "success"}`)
+}
+
+// targetUser parses {id} path value and makes sure signed in user doesn't touch other accounts.
+func (a *Authenticator) targetUser(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	userID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || userID <= 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid user id"})
+		return 0, false
+	}
+
+	if user, ok := UserFromContext(r.Context()); ok && user.ID != userID {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": "cannot modify other accounts"})
+		return 0, false
+	}
+	return userID, true
+}
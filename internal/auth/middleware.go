@@ -0,0 +1,154 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/amatsagu/lumo"
+)
+
+// Names of this machine that DNS can't point anywhere else.
+var loopbackHosts = []string{"localhost", "127.0.0.1", "::1"}
+
+// Routes reachable without credentials. Calendar feed and OAuth callback are protected by their own secrets.
+var publicRoutes = map[string]bool{
+	"POST /api/auth/login":   true,
+	"GET /api/auth/session":  true,
+	"GET /api/timetable.ics": true,
+	"GET /api/mal/callback":  true,
+	"GET /view/login.html":   true,
+	"GET /script/login.js":   true,
+	"GET /css/main.css":      true,
+	"GET /favicon.ico":       true,
+}
+
+// Middleware rejects requests that are neither authenticated (by API token or session cookie) nor exempt.
+// Session authenticated requests that modify state must also carry matching CSRF token header.
+func (a *Authenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if publicRoutes[r.Method+" "+r.URL.Path] || (r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/asset/")) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if secret, ok := bearerToken(r); ok {
+			user, err := a.VerifyAPIToken(secret)
+			if err != nil {
+				if err != ErrInvalidToken {
+					lumo.Error("Failed to verify API token: %v", err)
+				}
+				unauthorized(w, r)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(withUser(r.Context(), user)))
+			return
+		}
+
+		if cookie, err := r.Cookie(SessionCookie); err == nil {
+			session, err := a.Session(cookie.Value)
+			if err == nil {
+				if !isSafeMethod(r.Method) && subtle.ConstantTimeCompare([]byte(r.Header.Get(CSRFHeader)), []byte(session.CSRFToken)) != 1 {
+					forbidden(w, "missing or invalid csrf token")
+					return
+				}
+
+				next.ServeHTTP(w, r.WithContext(withUser(r.Context(), session.User)))
+				return
+			}
+
+			if err != ErrInvalidToken {
+				lumo.Error("Failed to read session: %v", err)
+			}
+		}
+
+		if a.isExempt(r) {
+			// Any website opened on this machine can send requests to localhost, so reject cross-origin writes
+			// and cross-site API calls, as even some GET routes change state
+			if (!isSafeMethod(r.Method) || strings.HasPrefix(r.URL.Path, "/api/")) && !sameOrigin(r) {
+				forbidden(w, "cross-origin request rejected")
+				return
+			}
+
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		unauthorized(w, r)
+	})
+}
+
+// isExempt reports whether request may skip authentication thanks to loopback exemption. Besides coming from
+// this machine, request must address server by literal loopback name, since any domain can be rebound to 127.0.0.1.
+func (a *Authenticator) isExempt(r *http.Request) bool {
+	return a.LoopbackExempt && IsLoopback(r) && isLoopbackHost(r.Host, a.port)
+}
+
+// isLoopbackHost reports whether Host header names this machine and server port, e.g. "localhost:5580" or "[::1]:5580".
+func isLoopbackHost(host string, port int) bool {
+	name, p, err := net.SplitHostPort(host)
+	if err != nil {
+		name, p = strings.Trim(host, "[]"), "80"
+	}
+	return slices.Contains(loopbackHosts, strings.ToLower(name)) && p == strconv.Itoa(port)
+}
+
+// IsLoopback reports whether request came directly from this machine.
+// Note that requests forwarded by local reverse proxy look exactly the same.
+func IsLoopback(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	if len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+		return strings.TrimSpace(header[7:]), true
+	}
+	return "", false
+}
+
+func isSafeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// sameOrigin accepts requests without Origin header, since browsers always send it for cross-origin writes.
+// Other requests are checked by fetch metadata, which also tells apart pages served from other local ports.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		site := r.Header.Get("Sec-Fetch-Site")
+		return site == "" || site == "same-origin" || site == "none"
+	}
+
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+func unauthorized(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet && !strings.HasPrefix(r.URL.Path, "/api/") {
+		http.Redirect(w, r, "/view/login.html", http.StatusSeeOther)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnauthorized)
+	json.NewEncoder(w).Encode(map[string]string{"error": "authentication required"})
+}
+
+func forbidden(w http.ResponseWriter, reason string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(w).Encode(map[string]string{"error": reason})
+}
@@ -1,56 +1,368 @@
 package config
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
+	"net"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 
 	"github.com/amatsagu/lumo"
 )
 
-var (
-	HTTP_PORT      string
-	APP_FILES_PATH string
-)
+// FileName of configuration file stored in config directory.
+const FileName = "config.json"
+
+// DatabaseFileName of SQLite database stored in data directory.
+const DatabaseFileName = "data.db"
+
+// Config is complete application configuration. Values are resolved in order:
+// built-in defaults, config file, JUBAKO_* environment variables and finally command line flags.
+type Config struct {
+	Host               string `json:"host"`
+	Port               int    `json:"port"`
+	ConfigDir          string `json:"-"` // Holds config file itself, so it can only come from environment or flags
+	DataDir            string `json:"data_dir"`
+	CacheDir           string `json:"cache_dir"`
+	AniListURL         string `json:"anilist_url"`
+	MalClientID        string `json:"mal_client_id"`
+	Headless           bool   `json:"headless"`
+	AuthLoopbackExempt bool   `json:"auth_loopback_exempt"`
+
+	// Requested only from command line
+	Magnets               []string `json:"-"` // Passed as arguments, e.g. by browser through registered URI handler
+	Play                  string   `json:"-"` // Absolute path of video file to open in player
+	RegisterMagnetHandler bool     `json:"-"`
+
+	movedDownloads []string // Set by PrepareDirs, see RelocateDownloads
+
+	Settings
+}
 
-func init() {
+// Settings are part of configuration that can be changed while application is running.
+type Settings struct {
+	DownloadDir      string   `json:"download_dir"`
+	DownloadLimit    int64    `json:"download_limit"` // Bytes per second, 0 means unlimited
+	UploadLimit      int64    `json:"upload_limit"`   // Bytes per second, 0 means unlimited
+	PreferredPlayers []string `json:"preferred_players"`
+	TrustedGroups    []string `json:"trusted_groups"`
+
+	SpeedProfiles []SpeedProfile `json:"speed_profiles"`
+	Seeding       SeedPolicy     `json:"seeding"`
+	Network       Network        `json:"network"`
+	Storage       Storage        `json:"storage"`
+	Organize      Organize       `json:"organize"`
+	Disk          Disk           `json:"disk"`
+	Retention     Retention      `json:"retention"`
+	Trackers      Trackers       `json:"trackers"`
+}
+
+// Default returns configuration used when nothing else is provided.
+func Default() Config {
+	return Config{
+		Host:               "127.0.0.1",
+		Port:               5578,
+		ConfigDir:          appDir("configuration", os.UserConfigDir),
+		DataDir:            appDir("data", userDataDir),
+		CacheDir:           appDir("cache", os.UserCacheDir),
+		AniListURL:         "https://graphql.anilist.co",
+		AuthLoopbackExempt: true,
+		Settings: Settings{
+			PreferredPlayers: []string{"mpv", "haruna", "vlc"},
+			TrustedGroups:    []string{},
+			SpeedProfiles:    []SpeedProfile{},
+			Seeding:          SeedPolicy{Ratio: 1},
+			Network:          DefaultNetwork(),
+			Storage:          DefaultStorage(),
+			Organize:         DefaultOrganize(),
+			Disk:             DefaultDisk(),
+			Trackers:         DefaultTrackers(),
+		},
+	}
+}
+
+// Load resolves configuration from all sources. Args are command line arguments without program name.
+func Load(args []string) (*Config, error) {
 	lumo.Debug("Loading configuration...")
+	cfg := Default()
+
+	// Flags are parsed into separate values first, since they must override config file that isn't read yet
+	var flags Config
+	fs := flag.NewFlagSet("jubako", flag.ContinueOnError)
+	fs.StringVar(&flags.Host, "host", cfg.Host, "HTTP Server bind address (use 0.0.0.0 to allow access from other devices)")
+	fs.IntVar(&flags.Port, "port", cfg.Port, "HTTP Server Port")
+	var portable string
+	fs.StringVar(&portable, "download_path", "", "Portable mode - keep settings, DB, cache and downloads together under single path")
+	fs.StringVar(&flags.ConfigDir, "config_dir", cfg.ConfigDir, "Path to directory with config file")
+	fs.StringVar(&flags.DataDir, "data_dir", cfg.DataDir, "Path to directory with database")
+	fs.StringVar(&flags.CacheDir, "cache_dir", cfg.CacheDir, "Path to directory with disposable cache files")
+	fs.StringVar(&flags.AniListURL, "anilist_url", cfg.AniListURL, "AniList GraphQL API endpoint")
+	fs.StringVar(&flags.MalClientID, "mal_client_id", "", "MyAnimeList API client ID used for account linking")
+	fs.BoolVar(&flags.Headless, "headless", false, "Run only HTTP server, without opening application window")
+	fs.BoolVar(&flags.AuthLoopbackExempt, "auth_loopback_exempt", cfg.AuthLoopbackExempt, "Allow requests from this machine without signing in (disable when behind local reverse proxy)")
+	fs.StringVar(&flags.Play, "play", "", "Open video file in preferred player")
+	fs.BoolVar(&flags.RegisterMagnetHandler, "register_magnet_handler", false, "Make Jubako default application for magnet links and exit (Linux only)")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	for _, arg := range fs.Args() {
+		if !strings.HasPrefix(arg, "magnet:") {
+			return nil, fmt.Errorf("unexpected argument %q, only magnet links can be passed", arg)
+		}
+	}
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	// Portable path keeps the old single-directory layout, it only provides defaults for other directories
+	if !set["download_path"] {
+		portable = getEnv("JUBAKO_DOWNLOAD_PATH", "")
+	}
+
+	if portable != "" {
+		cfg.ConfigDir = portable
+		cfg.DataDir = portable
+		cfg.CacheDir = filepath.Join(portable, "cache")
+	}
+
+	cfg.ConfigDir = getEnv("JUBAKO_CONFIG_DIR", cfg.ConfigDir)
+	if set["config_dir"] {
+		cfg.ConfigDir = flags.ConfigDir
+	}
+	cfg.ConfigDir = filepath.Clean(cfg.ConfigDir)
+
+	if err := cfg.readFile(); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.applyEnv(); err != nil {
+		return nil, err
+	}
+
+	if set["data_dir"] {
+		cfg.DataDir = flags.DataDir
+	}
+	if set["cache_dir"] {
+		cfg.CacheDir = flags.CacheDir
+	}
+	if set["host"] {
+		cfg.Host = flags.Host
+	}
+	if set["port"] {
+		cfg.Port = flags.Port
+	}
+	if set["anilist_url"] {
+		cfg.AniListURL = flags.AniListURL
+	}
+	if set["mal_client_id"] {
+		cfg.MalClientID = flags.MalClientID
+	}
+	if set["headless"] {
+		cfg.Headless = flags.Headless
+	}
+	if set["auth_loopback_exempt"] {
+		cfg.AuthLoopbackExempt = flags.AuthLoopbackExempt
+	}
+
+	if cfg.DownloadDir == "" {
+		cfg.DownloadDir = filepath.Join(cfg.DataDir, "downloads")
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	if flags.Play != "" {
+		// Running instance may have different working directory
+		play, err := filepath.Abs(flags.Play)
+		if err != nil {
+			return nil, fmt.Errorf("play: %w", err)
+		}
+		cfg.Play = play
+	}
+
+	cfg.Magnets = fs.Args()
+	cfg.RegisterMagnetHandler = flags.RegisterMagnetHandler
+	return &cfg, nil
+}
+
+// Path returns location of config file.
+func (cfg *Config) Path() string {
+	return filepath.Join(cfg.ConfigDir, FileName)
+}
+
+// DatabasePath returns location of SQLite database.
+func (cfg *Config) DatabasePath() string {
+	return filepath.Join(cfg.DataDir, DatabaseFileName)
+}
+
+func (cfg *Config) readFile() error {
+	data, err := os.ReadFile(cfg.Path())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
 
-	// Determine OS-specific default path
-	// Linux:   ~/.config/jubako
-	// Windows: %APPDATA%/jubako
-	// macOS:   ~/Library/Application Support/jubako
-	userConfigDir, err := os.UserConfigDir()
-	defaultBasePath := "./jubako"
+	if err := decodeStrict(bytes.NewReader(data), cfg); err != nil {
+		return fmt.Errorf("invalid config file %s: %w", cfg.Path(), err)
+	}
+
+	lumo.Debug("Loaded configuration file: %s", cfg.Path())
+	return nil
+}
+
+func (cfg *Config) applyEnv() error {
+	cfg.DataDir = getEnv("JUBAKO_DATA_DIR", cfg.DataDir)
+	cfg.CacheDir = getEnv("JUBAKO_CACHE_DIR", cfg.CacheDir)
+	cfg.Host = getEnv("JUBAKO_HOST", cfg.Host)
+	cfg.AniListURL = getEnv("JUBAKO_ANILIST_URL", cfg.AniListURL)
+	cfg.MalClientID = getEnv("JUBAKO_MAL_CLIENT_ID", cfg.MalClientID)
+
+	var errs []error
+	if v, ok := os.LookupEnv("JUBAKO_PORT"); ok && v != "" {
+		port, err := strconv.Atoi(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("JUBAKO_PORT: %q is not a number", v))
+		}
+		cfg.Port = port
+	}
+
+	if v, ok := os.LookupEnv("JUBAKO_HEADLESS"); ok && v != "" {
+		headless, err := strconv.ParseBool(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("JUBAKO_HEADLESS: %q is not a boolean", v))
+		}
+		cfg.Headless = headless
+	}
+
+	if v, ok := os.LookupEnv("JUBAKO_AUTH_LOOPBACK_EXEMPT"); ok && v != "" {
+		exempt, err := strconv.ParseBool(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("JUBAKO_AUTH_LOOPBACK_EXEMPT: %q is not a boolean", v))
+		}
+		cfg.AuthLoopbackExempt = exempt
+	}
+	return errors.Join(errs...)
+}
 
-	if err == nil {
-		defaultBasePath = filepath.Join(userConfigDir, "jubako")
-	} else {
-		lumo.Warn("Could not resolve OS configuration path: %v. Using local fallback.", err)
+// Validate reports every invalid value at once.
+func (cfg *Config) Validate() error {
+	var errs []error
+	if cfg.Port <= 0 || cfg.Port > 65535 {
+		errs = append(errs, fmt.Errorf("port: %d is outside of 1-65535 range", cfg.Port))
 	}
 
-	defaultPort := getEnv("JUBAKO_PORT", "5578")
-	defaultPath := getEnv("JUBAKO_DOWNLOAD_PATH", defaultBasePath)
+	if cfg.Host != "localhost" && net.ParseIP(cfg.Host) == nil {
+		errs = append(errs, fmt.Errorf("host: %q is not an IP address", cfg.Host))
+	}
+
+	if cfg.DataDir == "" {
+		errs = append(errs, errors.New("data_dir: cannot be empty"))
+	}
+
+	if cfg.CacheDir == "" {
+		errs = append(errs, errors.New("cache_dir: cannot be empty"))
+	}
+
+	if cfg.AniListURL == "" {
+		errs = append(errs, errors.New("anilist_url: cannot be empty"))
+	}
 
-	flag.StringVar(&HTTP_PORT, "port", defaultPort, "HTTP Server Port")
-	flag.StringVar(&APP_FILES_PATH, "download_path", defaultPath, "Path to store downloaded files, settings, and DB")
-	flag.Parse()
+	if err := cfg.Settings.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// Validate reports every invalid setting at once.
+func (s *Settings) Validate() error {
+	var errs []error
+	if s.DownloadDir == "" {
+		errs = append(errs, errors.New("download_dir: cannot be empty"))
+	}
 
-	if !isValidPort(HTTP_PORT) {
-		lumo.Warn("Provided invalid custom port number (%s). Reverted to default 5578.", HTTP_PORT)
-		HTTP_PORT = "5578"
+	if s.DownloadLimit < 0 {
+		errs = append(errs, fmt.Errorf("download_limit: %d cannot be negative", s.DownloadLimit))
 	}
 
-	APP_FILES_PATH = filepath.Clean(APP_FILES_PATH)
-	if _, err := os.Stat(APP_FILES_PATH); os.IsNotExist(err) {
-		lumo.Debug("Creating application data directory: %s", APP_FILES_PATH)
-		if err := os.MkdirAll(APP_FILES_PATH, 0755); err != nil {
-			lumo.Panic("Failed to prepare application directory: %v", err)
+	if s.UploadLimit < 0 {
+		errs = append(errs, fmt.Errorf("upload_limit: %d cannot be negative", s.UploadLimit))
+	}
+
+	for _, player := range s.PreferredPlayers {
+		if player == "" {
+			errs = append(errs, errors.New("preferred_players: player name cannot be empty"))
+			break
 		}
-	} else {
-		lumo.Debug("Using existing application directory: %s", APP_FILES_PATH)
 	}
+
+	if err := s.Seeding.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("seeding: %w", err))
+	}
+
+	if err := s.Network.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("network: %w", err))
+	}
+
+	if err := s.Storage.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("storage: %w", err))
+	}
+
+	if err := s.Organize.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("organize: %w", err))
+	}
+
+	if err := s.Disk.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("disk: %w", err))
+	}
+
+	if err := s.Retention.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("retention: %w", err))
+	}
+
+	if err := s.Trackers.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("trackers: %w", err))
+	}
+
+	for i := range s.SpeedProfiles {
+		if err := s.SpeedProfiles[i].Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("speed_profiles[%d]: %w", i, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ListenAddr returns address HTTP server should bind to.
+func (cfg *Config) ListenAddr() string {
+	return net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port))
+}
+
+// LocalURL returns base url under which HTTP server is reachable from this machine.
+func (cfg *Config) LocalURL() string {
+	host := cfg.Host
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	return "http://" + net.JoinHostPort(host, strconv.Itoa(cfg.Port))
+}
+
+// IsLoopbackHost reports whether HTTP server is reachable only from this machine.
+func (cfg *Config) IsLoopbackHost() bool {
+	if cfg.Host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(cfg.Host)
+	return ip != nil && ip.IsLoopback()
 }
 
 func getEnv(key, fallback string) string {
@@ -60,10 +372,9 @@ func getEnv(key, fallback string) string {
 	return fallback
 }
 
-func isValidPort(p string) bool {
-	port, err := strconv.Atoi(p)
-	if err != nil {
-		return false
-	}
-	return port > 0 && port <= 65535
+// decodeStrict rejects unknown fields, so typos in config file don't go unnoticed.
+func decodeStrict(r io.Reader, v any) error {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
 }
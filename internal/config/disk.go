@@ -0,0 +1,30 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Disk guards free space of the download drive.
+type Disk struct {
+	Reserve int64 `json:"reserve"` // Bytes always left free, downloads are paused or refused below it
+	Quota   int64 `json:"quota"`   // Bytes library downloads may use before oldest watched episodes are deleted, 0 means unlimited
+}
+
+// DefaultDisk returns disk settings used when nothing else is provided.
+func DefaultDisk() Disk {
+	return Disk{Reserve: 2 << 30}
+}
+
+// Validate reports every invalid disk setting at once.
+func (d *Disk) Validate() error {
+	var errs []error
+	if d.Reserve < 0 {
+		errs = append(errs, fmt.Errorf("reserve: %d cannot be negative", d.Reserve))
+	}
+
+	if d.Quota < 0 {
+		errs = append(errs, fmt.Errorf("quota: %d cannot be negative", d.Quota))
+	}
+	return errors.Join(errs...)
+}
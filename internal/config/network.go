@@ -0,0 +1,71 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+)
+
+// Network holds settings of torrent client connections. Changing them restarts the client.
+type Network struct {
+	ListenPort        int    `json:"listen_port"` // 0 picks random port
+	IPv6              bool   `json:"ipv6"`
+	DHT               bool   `json:"dht"`
+	PEX               bool   `json:"pex"`
+	UTP               bool   `json:"utp"`
+	RequireEncryption bool   `json:"require_encryption"` // Refuse peers that don't support header obfuscation
+	UPnP              bool   `json:"upnp"`
+	Proxy             string `json:"proxy"`       // socks5://[user:password@]host:port used for peers and trackers
+	Interface         string `json:"interface"`   // Name or address of network interface all traffic must use (e.g. VPN)
+	KillSwitch        bool   `json:"kill_switch"` // Pause all torrents while interface is gone
+}
+
+// DefaultNetwork returns network settings used when nothing else is provided.
+func DefaultNetwork() Network {
+	return Network{
+		ListenPort: 42069,
+		DHT:        true,
+		PEX:        true,
+		UTP:        true,
+		UPnP:       true,
+	}
+}
+
+// ProxyURL returns parsed proxy address or nil, when proxy is not set.
+func (n *Network) ProxyURL() (*url.URL, error) {
+	if n.Proxy == "" {
+		return nil, nil
+	}
+
+	u, err := url.Parse(n.Proxy)
+	if err != nil {
+		return nil, errors.New("proxy: not a valid url")
+	}
+
+	if u.Scheme != "socks5" && u.Scheme != "socks5h" {
+		return nil, fmt.Errorf("proxy: %q scheme is not supported (use socks5)", u.Scheme)
+	}
+
+	if _, port, err := net.SplitHostPort(u.Host); err != nil || port == "" {
+		return nil, errors.New("proxy: expected host:port address")
+	}
+	return u, nil
+}
+
+// Validate reports every invalid network setting at once.
+func (n *Network) Validate() error {
+	var errs []error
+	if n.ListenPort < 0 || n.ListenPort > 65535 {
+		errs = append(errs, fmt.Errorf("listen_port: %d is outside of 0-65535 range", n.ListenPort))
+	}
+
+	if _, err := n.ProxyURL(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if n.KillSwitch && n.Interface == "" {
+		errs = append(errs, errors.New("kill_switch: requires interface to be set"))
+	}
+	return errors.Join(errs...)
+}
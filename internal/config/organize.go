@@ -0,0 +1,125 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Modes of organizing finished downloads.
+const (
+	OrganizeOff      = "off"
+	OrganizeMove     = "move"     // Files are moved once torrent stops seeding
+	OrganizeHardlink = "hardlink" // Files are linked right after download, so torrent keeps seeding original
+)
+
+var (
+	templateField  = regexp.MustCompile(`\{([a-z_]+)(?::(0[1-9]))?\}`)
+	emptyBrackets  = regexp.MustCompile(`\[\s*\]|\(\s*\)`)
+	spaceBeforeExt = regexp.MustCompile(`\s+(\.[^.\s]+)$`)
+
+	// Characters that are not allowed in file names on some systems
+	unsafeChars = strings.NewReplacer("/", "-", `\`, "-", ": ", " - ", ":", "-", "|", "-", "*", "", "?", "", `"`, "", "<", "", ">", "")
+)
+
+var templateFields = []string{"series_title", "season", "episode", "group", "ext"}
+
+// Organize decides how finished downloads are renamed into series folder layout.
+type Organize struct {
+	Mode     string `json:"mode"`      // "off", "move" or "hardlink"
+	Dir      string `json:"dir"`       // Library root, download directory is used when empty
+	Template string `json:"template"`  // Path relative to library root with {field} or {field:02} placeholders
+	WriteNFO bool   `json:"write_nfo"` // Write Kodi/Jellyfin .nfo files and series poster
+}
+
+// OrganizeFields are values available to organize template.
+type OrganizeFields struct {
+	SeriesTitle string
+	Season      int
+	Episode     int
+	Group       string
+	Ext         string // Without leading dot
+}
+
+// DefaultOrganize returns organize settings used when nothing else is provided.
+func DefaultOrganize() Organize {
+	return Organize{
+		Mode:     OrganizeOff,
+		Template: "{series_title}/Season {season}/{series_title} - S{season:02}E{episode:02} [{group}].{ext}",
+	}
+}
+
+// Path renders template into path relative to library root. Placeholders without value leave
+// no empty brackets behind, so missing release group doesn't end up as "[]" in file name.
+func (o *Organize) Path(f OrganizeFields) string {
+	rendered := templateField.ReplaceAllStringFunc(o.Template, func(m string) string {
+		match := templateField.FindStringSubmatch(m)
+		width, _ := strconv.Atoi(match[2])
+
+		switch match[1] {
+		case "series_title":
+			return unsafeChars.Replace(f.SeriesTitle)
+		case "season":
+			return fmt.Sprintf("%0*d", width, f.Season)
+		case "episode":
+			return fmt.Sprintf("%0*d", width, f.Episode)
+		case "group":
+			return unsafeChars.Replace(f.Group)
+		case "ext":
+			return unsafeChars.Replace(f.Ext)
+		}
+		return ""
+	})
+
+	segments := strings.Split(rendered, "/")
+	for i, s := range segments {
+		s = emptyBrackets.ReplaceAllString(s, "")
+		s = strings.Join(strings.Fields(s), " ")
+		s = spaceBeforeExt.ReplaceAllString(s, "$1")
+		segments[i] = strings.Trim(s, " .")
+	}
+	return filepath.Join(segments...)
+}
+
+// Validate reports every invalid organize setting at once.
+func (o *Organize) Validate() error {
+	var errs []error
+	if o.Mode != OrganizeOff && o.Mode != OrganizeMove && o.Mode != OrganizeHardlink {
+		errs = append(errs, fmt.Errorf("mode: %q is not supported (use %s, %s or %s)", o.Mode, OrganizeOff, OrganizeMove, OrganizeHardlink))
+	}
+
+	if o.Dir != "" && !filepath.IsAbs(o.Dir) {
+		errs = append(errs, fmt.Errorf("dir: %q is not an absolute path", o.Dir))
+	}
+
+	if err := validateTemplate(o.Template); err != nil {
+		errs = append(errs, fmt.Errorf("template: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+func validateTemplate(template string) error {
+	if template == "" {
+		return errors.New("cannot be empty")
+	}
+
+	if path.IsAbs(template) || slices.Contains(strings.Split(template, "/"), "..") {
+		return errors.New("must stay inside library directory")
+	}
+
+	for _, m := range templateField.FindAllStringSubmatch(template, -1) {
+		if !slices.Contains(templateFields, m[1]) {
+			return fmt.Errorf("unknown field {%s} (use %s)", m[1], strings.Join(templateFields, ", "))
+		}
+	}
+
+	if rest := templateField.ReplaceAllString(template, ""); strings.ContainsAny(rest, "{}") {
+		return errors.New("placeholders must look like {field} or {field:02}")
+	}
+	return nil
+}
@@ -0,0 +1,297 @@
+package config
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+
+	"github.com/amatsagu/lumo"
+)
+
+// layoutFileName of file in config directory that remembers directories used by previous run.
+const layoutFileName = "layout.json"
+
+// layout records where data was stored, so it can follow configuration when directories change.
+type layout struct {
+	DataDir     string `json:"data_dir"`
+	CacheDir    string `json:"cache_dir"`
+	DownloadDir string `json:"download_dir"`
+
+	// Directories downloads were moved from, while database still points at them
+	MovedDownloads []string `json:"moved_downloads,omitempty"`
+}
+
+// appDir returns jubako directory inside OS-specific base directory.
+func appDir(kind string, base func() (string, error)) string {
+	dir, err := base()
+	if err != nil {
+		lumo.Warn("Could not resolve OS %s path: %v. Using local fallback.", kind, err)
+		return "./jubako"
+	}
+	return filepath.Join(dir, "jubako")
+}
+
+// userDataDir is data files counterpart of os.UserConfigDir, which standard library doesn't provide.
+// Linux:   $XDG_DATA_HOME or ~/.local/share
+// Windows: %LocalAppData%
+// macOS:   ~/Library/Application Support
+func userDataDir() (string, error) {
+	switch runtime.GOOS {
+	case "windows":
+		dir := os.Getenv("LocalAppData")
+		if dir == "" {
+			return "", errors.New("%LocalAppData% is not defined")
+		}
+		return dir, nil
+	case "darwin", "ios", "plan9":
+		return os.UserConfigDir()
+	}
+
+	if dir := os.Getenv("XDG_DATA_HOME"); dir != "" {
+		if !filepath.IsAbs(dir) {
+			return "", errors.New("path in $XDG_DATA_HOME is relative")
+		}
+		return dir, nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".local", "share"), nil
+}
+
+// PrepareDirs creates all application directories and moves existing data into them, when they changed
+// since previous run. It must be called before database is opened. Only failure to move database is
+// returned as error - leftover downloads or cache files are reported and moving them is retried on next start.
+func (cfg *Config) PrepareDirs() error {
+	for _, dir := range []string{cfg.ConfigDir, cfg.DataDir, cfg.CacheDir, cfg.DownloadDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create directory %s: %w", dir, err)
+		}
+	}
+
+	layoutPath := filepath.Join(cfg.ConfigDir, layoutFileName)
+	prev, err := readLayout(layoutPath)
+	if err != nil {
+		return err
+	}
+
+	if prev == nil {
+		// Before directories were separated, everything was stored next to config file
+		prev = &layout{
+			DataDir:     cfg.ConfigDir,
+			DownloadDir: filepath.Join(cfg.ConfigDir, "downloads"),
+		}
+	}
+
+	complete := true
+
+	// Downloads go first, since by default they are nested in data directory
+	if err := moveDir(prev.DownloadDir, cfg.DownloadDir); err != nil {
+		lumo.Warn("Failed to move some downloads from %s: %v", prev.DownloadDir, err)
+		complete = false
+	} else {
+		cfg.movedDownloads = prev.MovedDownloads
+		if !sameDir(prev.DownloadDir, cfg.DownloadDir) && !slices.Contains(cfg.movedDownloads, prev.DownloadDir) {
+			cfg.movedDownloads = append(cfg.movedDownloads, prev.DownloadDir)
+		}
+	}
+
+	if err := moveDir(prev.CacheDir, cfg.CacheDir); err != nil {
+		lumo.Warn("Failed to move some cache files from %s: %v", prev.CacheDir, err)
+		complete = false
+	}
+
+	if !sameDir(prev.DataDir, cfg.DataDir) {
+		// Data directory may be shared with config file, so only database files are moved
+		for _, name := range []string{DatabaseFileName, DatabaseFileName + "-wal", DatabaseFileName + "-shm"} {
+			if err := moveEntry(filepath.Join(prev.DataDir, name), filepath.Join(cfg.DataDir, name)); err != nil {
+				return fmt.Errorf("failed to move database to %s: %w", cfg.DataDir, err)
+			}
+		}
+		if !sameDir(prev.DataDir, cfg.ConfigDir) {
+			_ = os.Remove(prev.DataDir) // Succeeds only when nothing else was left there
+		}
+	}
+
+	if !complete {
+		return nil
+	}
+
+	// Moved downloads are remembered until RelocateDownloads updates database, in case it never gets to run
+	return writeLayout(layoutPath, layout{
+		DataDir:        cfg.DataDir,
+		CacheDir:       cfg.CacheDir,
+		DownloadDir:    cfg.DownloadDir,
+		MovedDownloads: cfg.movedDownloads,
+	})
+}
+
+// RelocateDownloads rewrites paths of downloads that PrepareDirs moved to new download directory,
+// so they keep pointing at their files. It must be called once downloads table exists.
+func (cfg *Config) RelocateDownloads(db *sql.DB) error {
+	if len(cfg.movedDownloads) == 0 {
+		return nil
+	}
+
+	dst := filepath.Clean(cfg.DownloadDir) + string(filepath.Separator)
+	for _, dir := range cfg.movedDownloads {
+		src := filepath.Clean(dir) + string(filepath.Separator)
+		res, err := db.Exec("UPDATE downloads SET path = ? || substr(path, length(?) + 1) WHERE substr(path, 1, length(?)) = ?", dst, src, src, src)
+		if err != nil {
+			return fmt.Errorf("failed to update paths of downloads moved from %s: %w", dir, err)
+		}
+
+		if n, _ := res.RowsAffected(); n > 0 {
+			lumo.Info("Updated paths of %d downloads moved from %s.", n, dir)
+		}
+	}
+
+	layoutPath := filepath.Join(cfg.ConfigDir, layoutFileName)
+	l, err := readLayout(layoutPath)
+	if err != nil || l == nil {
+		return err
+	}
+
+	cfg.movedDownloads = nil
+	l.MovedDownloads = nil
+	return writeLayout(layoutPath, *l)
+}
+
+func readLayout(path string) (*layout, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	var l layout
+	if err := json.Unmarshal(data, &l); err != nil {
+		return nil, fmt.Errorf("%s is malformed: %w", path, err)
+	}
+	return &l, nil
+}
+
+func writeLayout(path string, l layout) error {
+	data, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// moveDir moves all entries of src directory into dst. Entries that already exist in dst are left in src.
+func moveDir(src, dst string) error {
+	if src == "" || sameDir(src, dst) {
+		return nil
+	}
+
+	entries, err := os.ReadDir(src)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if isWithin(dst, src) || isWithin(src, dst) {
+		return fmt.Errorf("cannot move %s into %s, as one contains the other", src, dst)
+	}
+
+	lumo.Info("Moving %d entries from %s to %s...", len(entries), src, dst)
+	var errs []error
+	for _, e := range entries {
+		if err := moveEntry(filepath.Join(src, e.Name()), filepath.Join(dst, e.Name())); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) == 0 {
+		_ = os.Remove(src)
+	}
+	return errors.Join(errs...)
+}
+
+// moveEntry moves file or directory. When rename is not possible (e.g. destination is on external drive),
+// entry is copied and source is removed only after copy fully succeeded.
+func moveEntry(src, dst string) error {
+	info, err := os.Lstat(src)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Lstat(dst); err == nil {
+		return fmt.Errorf("%s already exists", dst)
+	}
+
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+
+	if info.IsDir() {
+		err = os.CopyFS(dst, os.DirFS(src))
+	} else {
+		err = copyFile(src, dst, info.Mode().Perm())
+	}
+
+	if err != nil {
+		_ = os.RemoveAll(dst) // Didn't exist before, so only partial copy is removed
+		return fmt.Errorf("failed to copy %s: %w", src, err)
+	}
+	return os.RemoveAll(src)
+}
+
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func sameDir(a, b string) bool {
+	return filepath.Clean(a) == filepath.Clean(b)
+}
+
+// isWithin reports whether path is located inside dir.
+func isWithin(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
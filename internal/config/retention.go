@@ -0,0 +1,30 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Retention decides when watched episodes are deleted from disk. Episodes that weren't watched are always kept.
+type Retention struct {
+	DeleteAfterDays int `json:"delete_after_days"` // Days after episode was watched, 0 disables
+	KeepLast        int `json:"keep_last"`         // Newest episodes of series that are kept, 0 disables
+}
+
+// Enabled reports whether retention deletes anything at all.
+func (r Retention) Enabled() bool {
+	return r.DeleteAfterDays > 0 || r.KeepLast > 0
+}
+
+// Validate reports every invalid retention setting at once.
+func (r *Retention) Validate() error {
+	var errs []error
+	if r.DeleteAfterDays < 0 {
+		errs = append(errs, fmt.Errorf("delete_after_days: %d cannot be negative", r.DeleteAfterDays))
+	}
+
+	if r.KeepLast < 0 {
+		errs = append(errs, fmt.Errorf("keep_last: %d cannot be negative", r.KeepLast))
+	}
+	return errors.Join(errs...)
+}
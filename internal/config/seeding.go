@@ -0,0 +1,39 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// SeedPolicy decides how long completed downloads keep uploading to other peers.
+// Seeding stops once any of set targets is reached. Policy without targets disables seeding.
+type SeedPolicy struct {
+	Ratio float64 `json:"ratio"` // Uploaded to downloaded bytes, 0 means no ratio target
+	Hours float64 `json:"hours"` // Time since completion, 0 means no time target
+}
+
+// Reached reports whether download that uploaded given amount of bytes can stop seeding.
+func (p SeedPolicy) Reached(uploaded, size int64, seeded time.Duration) bool {
+	if p.Ratio <= 0 && p.Hours <= 0 {
+		return true
+	}
+
+	if p.Ratio > 0 && size > 0 && float64(uploaded)/float64(size) >= p.Ratio {
+		return true
+	}
+	return p.Hours > 0 && seeded.Hours() >= p.Hours
+}
+
+// Validate reports every invalid value of seeding policy at once.
+func (p SeedPolicy) Validate() error {
+	var errs []error
+	if p.Ratio < 0 {
+		errs = append(errs, fmt.Errorf("ratio: %v cannot be negative", p.Ratio))
+	}
+
+	if p.Hours < 0 {
+		errs = append(errs, fmt.Errorf("hours: %v cannot be negative", p.Hours))
+	}
+	return errors.Join(errs...)
+}
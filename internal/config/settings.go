@@ -0,0 +1,164 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"github.com/amatsagu/lumo"
+)
+
+// EventType of event published after settings were changed.
+const EventType = "settings"
+
+// ChangeHook is called after settings were changed at runtime.
+type ChangeHook func(old, new Settings)
+
+// Store holds settings that can be changed while application is running and persists them in config file.
+type Store struct {
+	path string
+
+	settings Settings
+	hooks    []ChangeHook
+	mu       sync.RWMutex // Protects settings & hooks
+}
+
+func NewStore(cfg *Config) *Store {
+	return &Store{
+		path:     cfg.Path(),
+		settings: cfg.Settings,
+	}
+}
+
+// Settings returns copy of current settings.
+func (s *Store) Settings() Settings {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return cloneSettings(s.settings)
+}
+
+// OnChange registers hook called after every settings update.
+func (s *Store) OnChange(hook ChangeHook) {
+	s.mu.Lock()
+	s.hooks = append(s.hooks, hook)
+	s.mu.Unlock()
+}
+
+// Update validates and persists new settings, then notifies registered hooks.
+func (s *Store) Update(next Settings) error {
+	if err := next.Validate(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	old := s.settings
+	if err := s.persist(next); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+
+	s.settings = cloneSettings(next)
+	hooks := s.hooks
+	s.mu.Unlock()
+
+	lumo.Info("Updated application settings.")
+	for _, hook := range hooks {
+		hook(old, cloneSettings(next))
+	}
+	return nil
+}
+
+// persist merges settings into config file, keeping all other values user put there.
+func (s *Store) persist(settings Settings) error {
+	file := make(map[string]json.RawMessage)
+	data, err := os.ReadFile(s.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &file); err != nil {
+			return fmt.Errorf("config file is malformed: %w", err)
+		}
+	}
+
+	encoded, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(encoded, &fields); err != nil {
+		return err
+	}
+
+	for k, v := range fields {
+		file[k] = v
+	}
+
+	out, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write to temporary file first, so crash in the middle doesn't leave broken config behind
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, append(out, '\n'), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Clean(s.path))
+}
+
+func cloneSettings(s Settings) Settings {
+	s.PreferredPlayers = slices.Clone(s.PreferredPlayers)
+	s.TrustedGroups = slices.Clone(s.TrustedGroups)
+	s.SpeedProfiles = slices.Clone(s.SpeedProfiles)
+	s.Trackers.Extra = slices.Clone(s.Trackers.Extra)
+	for i := range s.SpeedProfiles {
+		s.SpeedProfiles[i].Days = slices.Clone(s.SpeedProfiles[i].Days)
+	}
+	return s
+}
+
+// SettingsHandler returns current runtime settings.
+func (s *Store) SettingsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(s.Settings()); err != nil {
+		lumo.Error("Failed to encode settings: %v", err)
+	}
+}
+
+// UpdateSettingsHandler applies fields present in json body on top of current settings.
+func (s *Store) UpdateSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	next := s.Settings()
+	if err := decodeStrict(r.Body, &next); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid settings: " + err.Error()})
+		return
+	}
+
+	if err := next.Validate(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	if err := s.Update(next); err != nil {
+		lumo.Error("Failed to update settings: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to save settings"})
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(s.Settings()); err != nil {
+		lumo.Error("Failed to encode settings: %v", err)
+	}
+}
@@ -0,0 +1,120 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// SpeedProfile overrides global bandwidth limits during part of the day (in local time).
+type SpeedProfile struct {
+	Name          string   `json:"name"`
+	Days          []string `json:"days"`           // Short day names (e.g. "mon"), empty means every day
+	Start         string   `json:"start"`          // HH:MM
+	End           string   `json:"end"`            // HH:MM, earlier than start for profiles spanning midnight
+	DownloadLimit int64    `json:"download_limit"` // Bytes per second, 0 means unlimited
+	UploadLimit   int64    `json:"upload_limit"`   // Bytes per second, 0 means unlimited
+}
+
+// LimitsAt returns bandwidth limits in effect at given time together with name of applied speed profile.
+// First matching profile wins, global limits are used when none matches.
+func (s *Settings) LimitsAt(now time.Time) (download, upload int64, profile string) {
+	for i := range s.SpeedProfiles {
+		p := &s.SpeedProfiles[i]
+		if p.ActiveAt(now) {
+			return p.DownloadLimit, p.UploadLimit, p.Name
+		}
+	}
+	return s.DownloadLimit, s.UploadLimit, ""
+}
+
+// ActiveAt reports whether profile applies at given time. Profile spanning midnight belongs to the day it starts on.
+func (p *SpeedProfile) ActiveAt(now time.Time) bool {
+	start, err := parseClock(p.Start)
+	if err != nil {
+		return false
+	}
+
+	end, err := parseClock(p.End)
+	if err != nil {
+		return false
+	}
+
+	minute := now.Hour()*60 + now.Minute()
+	day := now.Weekday()
+
+	switch {
+	case start == end:
+		return p.onDay(day)
+	case start < end:
+		return minute >= start && minute < end && p.onDay(day)
+	case minute >= start:
+		return p.onDay(day)
+	case minute < end:
+		return p.onDay((day + 6) % 7)
+	}
+	return false
+}
+
+func (p *SpeedProfile) onDay(day time.Weekday) bool {
+	if len(p.Days) == 0 {
+		return true
+	}
+
+	return slices.ContainsFunc(p.Days, func(name string) bool {
+		d, ok := weekdays[strings.ToLower(name)]
+		return ok && d == day
+	})
+}
+
+// Validate reports every invalid value of speed profile at once.
+func (p *SpeedProfile) Validate() error {
+	var errs []error
+	if strings.TrimSpace(p.Name) == "" {
+		errs = append(errs, errors.New("name cannot be empty"))
+	}
+
+	for _, name := range p.Days {
+		if _, ok := weekdays[strings.ToLower(name)]; !ok {
+			errs = append(errs, fmt.Errorf("%q is not a day name (use mon, tue, ...)", name))
+		}
+	}
+
+	if _, err := parseClock(p.Start); err != nil {
+		errs = append(errs, fmt.Errorf("start: %w", err))
+	}
+
+	if _, err := parseClock(p.End); err != nil {
+		errs = append(errs, fmt.Errorf("end: %w", err))
+	}
+
+	if p.DownloadLimit < 0 {
+		errs = append(errs, fmt.Errorf("download_limit: %d cannot be negative", p.DownloadLimit))
+	}
+
+	if p.UploadLimit < 0 {
+		errs = append(errs, fmt.Errorf("upload_limit: %d cannot be negative", p.UploadLimit))
+	}
+	return errors.Join(errs...)
+}
+
+// parseClock returns minutes since midnight of HH:MM time.
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not HH:MM time", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
@@ -0,0 +1,42 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Storage backends of library downloads.
+const (
+	StorageFile = "file" // Regular reads and writes
+	StorageMMap = "mmap" // Memory mapped files, faster on systems with plenty of memory
+)
+
+// minStreamCacheSize must fit a few of the largest pieces, otherwise pieces are evicted before they're read.
+const minStreamCacheSize = 256 << 20
+
+// Storage decides how torrent data is kept on disk.
+type Storage struct {
+	Backend         string `json:"backend"`           // Storage of library downloads, "file" or "mmap"
+	StreamCacheSize int64  `json:"stream_cache_size"` // Bytes of pieces kept for torrents streamed without keeping
+}
+
+// DefaultStorage returns storage settings used when nothing else is provided.
+func DefaultStorage() Storage {
+	return Storage{
+		Backend:         StorageFile,
+		StreamCacheSize: 4 << 30,
+	}
+}
+
+// Validate reports every invalid storage setting at once.
+func (s *Storage) Validate() error {
+	var errs []error
+	if s.Backend != StorageFile && s.Backend != StorageMMap {
+		errs = append(errs, fmt.Errorf("backend: %q is not supported (use %s or %s)", s.Backend, StorageFile, StorageMMap))
+	}
+
+	if s.StreamCacheSize < minStreamCacheSize {
+		errs = append(errs, fmt.Errorf("stream_cache_size: %d is below minimum of %d bytes", s.StreamCacheSize, minStreamCacheSize))
+	}
+	return errors.Join(errs...)
+}
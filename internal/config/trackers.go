@@ -0,0 +1,57 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// minMetadataTimeout leaves magnet enough time to reach at least a few peers.
+const minMetadataTimeout = 5
+
+// trackerSchemes are announce protocols supported by torrent client.
+var trackerSchemes = []string{"udp", "http", "https", "ws", "wss"}
+
+// Trackers help magnets find peers, since many of them come with only few working trackers.
+type Trackers struct {
+	MetadataTimeout int      `json:"metadata_timeout"` // Seconds magnet may look for peers that know its metadata
+	Extra           []string `json:"extra"`            // Announce urls added to every torrent
+}
+
+// DefaultTrackers returns tracker settings used when nothing else is provided.
+func DefaultTrackers() Trackers {
+	return Trackers{
+		MetadataTimeout: 60,
+		Extra:           []string{},
+	}
+}
+
+// ValidateTracker reports whether announce url can be used by torrent client.
+func ValidateTracker(announce string) error {
+	u, err := url.Parse(announce)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("%q is not a valid tracker url", announce)
+	}
+
+	if !slices.Contains(trackerSchemes, u.Scheme) {
+		return fmt.Errorf("%q scheme is not supported (use %s)", u.Scheme, strings.Join(trackerSchemes, ", "))
+	}
+	return nil
+}
+
+// Validate reports every invalid tracker setting at once.
+func (t *Trackers) Validate() error {
+	var errs []error
+	if t.MetadataTimeout < minMetadataTimeout {
+		errs = append(errs, fmt.Errorf("metadata_timeout: %d is below minimum of %d seconds", t.MetadataTimeout, minMetadataTimeout))
+	}
+
+	for i, announce := range t.Extra {
+		if err := ValidateTracker(announce); err != nil {
+			errs = append(errs, fmt.Errorf("extra[%d]: %w", i, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,90 @@
+//go:build linux
+
+package desktop
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	entryFileName  = "jubako.desktop"
+	magnetMimeType = "x-scheme-handler/magnet"
+)
+
+// RegisterMagnetHandler installs desktop entry, which starts executable with given arguments and clicked magnet link,
+// then makes it default handler of magnet links through xdg-mime.
+func RegisterMagnetHandler(executable string, args ...string) error {
+	dir, err := applicationsDir()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	entry := fmt.Sprintf(`[Desktop Entry]
+Type=Application
+Name=Jubako
+Comment=Watch and download anime
+Exec=%s %%u
+Terminal=false
+NoDisplay=true
+MimeType=%s;
+Categories=AudioVideo;Network;P2P;
+`, execLine(executable, args), magnetMimeType)
+
+	path := filepath.Join(dir, entryFileName)
+	if err := os.WriteFile(path, []byte(entry), 0644); err != nil {
+		return err
+	}
+
+	out, err := exec.Command("xdg-mime", "default", entryFileName, magnetMimeType).CombinedOutput()
+	if err != nil {
+		if out = bytes.TrimSpace(out); len(out) > 0 {
+			err = fmt.Errorf("%w: %s", err, out)
+		}
+		return fmt.Errorf("xdg-mime failed: %w", err)
+	}
+
+	// Some desktop environments look up handlers only in desktop database cache
+	if _, err := exec.LookPath("update-desktop-database"); err == nil {
+		_ = exec.Command("update-desktop-database", dir).Run()
+	}
+	return nil
+}
+
+// applicationsDir returns directory with desktop entries of current user.
+func applicationsDir() (string, error) {
+	if dir := os.Getenv("XDG_DATA_HOME"); dir != "" {
+		if !filepath.IsAbs(dir) {
+			return "", errors.New("path in $XDG_DATA_HOME is relative")
+		}
+		return filepath.Join(dir, "applications"), nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".local", "share", "applications"), nil
+}
+
+// execLine quotes command, following quoting and escaping rules of desktop entry specification.
+func execLine(executable string, args []string) string {
+	quoter := strings.NewReplacer(`"`, `\"`, "`", "\\`", `$`, `\$`, `\`, `\\`)
+
+	parts := make([]string, 0, len(args)+1)
+	for _, arg := range append([]string{executable}, args...) {
+		parts = append(parts, `"`+quoter.Replace(arg)+`"`)
+	}
+
+	// Backslashes are unescaped once more as part of string value and % starts field codes
+	return strings.NewReplacer(`\`, `\\`, `%`, `%%`).Replace(strings.Join(parts, " "))
+}
@@ -0,0 +1,13 @@
+//go:build linux
+
+package desktop
+
+import "testing"
+
+func TestExecLineQuotesArguments(t *testing.T) {
+	got := execLine("/opt/Jubako App/jubako", []string{"-config_dir", `/home/hana/100% "anime"\$HOME`})
+	want := `"/opt/Jubako App/jubako" "-config_dir" "/home/hana/100%% \\"anime\\"\\\\\\$HOME"`
+	if got != want {
+		t.Errorf("unexpected exec line:\n got: %s\nwant: %s", got, want)
+	}
+}
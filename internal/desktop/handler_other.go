@@ -0,0 +1,10 @@
+//go:build !linux
+
+package desktop
+
+import "errors"
+
+// RegisterMagnetHandler is not supported, magnet links can only be registered on Linux for now.
+func RegisterMagnetHandler(executable string, args ...string) error {
+	return errors.New("registering magnet link handler is only supported on Linux")
+}
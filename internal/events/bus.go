@@ -0,0 +1,118 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/amatsagu/lumo"
+)
+
+// Buffer size of every subscriber. Slow subscribers lose events instead of blocking publishers.
+const subscriberBuffer = 64
+
+type Event struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	Data any       `json:"data,omitempty"`
+}
+
+// Bus fans out application events to in-process subscribers and connected frontends.
+type Bus struct {
+	ctx context.Context
+
+	subs map[chan Event]struct{}
+	mu   sync.RWMutex // Protects subs
+}
+
+func NewBus(ctx context.Context) *Bus {
+	return &Bus{
+		ctx:  ctx,
+		subs: make(map[chan Event]struct{}),
+	}
+}
+
+// Publish sends event to all current subscribers without blocking.
+func (b *Bus) Publish(eventType string, data any) {
+	ev := Event{
+		Type: eventType,
+		Time: time.Now(),
+		Data: data,
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for ch := range b.subs {
+		select {
+		case ch <- ev:
+		default:
+			lumo.Debug("Dropped \"%s\" event for slow subscriber.", eventType)
+		}
+	}
+}
+
+// Subscribe returns channel with all future events and function that must be called to unsubscribe.
+func (b *Bus) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, subscriberBuffer)
+
+	b.mu.Lock()
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs, ch)
+			b.mu.Unlock()
+		})
+	}
+}
+
+// StreamHandler streams events to the client using server-sent events.
+func (b *Bus) StreamHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	ch, unsubscribe := b.Subscribe()
+	defer unsubscribe()
+
+	// Keeps connection alive through proxies and lets us notice closed clients
+	ping := time.NewTicker(30 * time.Second)
+	defer ping.Stop()
+
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	for {
+		select {
+		case <-b.ctx.Done():
+			return
+		case <-r.Context().Done():
+			return
+		case <-ping.C:
+			fmt.Fprint(w, ": ping\n\n")
+			flusher.Flush()
+		case ev := <-ch:
+			data, err := json.Marshal(ev)
+			if err != nil {
+				lumo.Error("Failed to marshal \"%s\" event: %v", ev.Type, err)
+				continue
+			}
+
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data)
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package instance
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/amatsagu/lumo"
+)
+
+const (
+	lockFileName   = "jubako.lock"
+	socketFileName = "jubako.sock"
+	requestTimeout = 5 * time.Second
+)
+
+// ErrRunning is returned by Acquire when another instance already uses the same data directory.
+var ErrRunning = errors.New("another instance is already running")
+
+// Request holds arguments later launch forwards to the running instance.
+type Request struct {
+	Magnets []string `json:"magnets,omitempty"`
+	Play    string   `json:"play,omitempty"` // Absolute path of video file
+}
+
+type response struct {
+	Error string `json:"error,omitempty"`
+}
+
+// Handler is called for every request forwarded by later launch.
+type Handler func(req Request) error
+
+// Instance holds lock of data directory for as long as application runs,
+// so database is never opened by two processes at once.
+type Instance struct {
+	lock       *os.File
+	listener   net.Listener
+	socketPath string
+}
+
+// Acquire locks data directory and starts listening for requests from later launches.
+// When directory is already locked, ErrRunning is returned and request should be forwarded instead.
+func Acquire(dir string) (*Instance, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, lockFileName), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := lockFile(f); err != nil {
+		f.Close()
+		if errors.Is(err, errLocked) {
+			return nil, ErrRunning
+		}
+		return nil, fmt.Errorf("failed to lock %s: %w", f.Name(), err)
+	}
+
+	// Process id is only informative, lock itself is released by OS even when process crashes
+	if err := f.Truncate(0); err == nil {
+		_, _ = f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+
+	in := &Instance{lock: f, socketPath: filepath.Join(dir, socketFileName)}
+
+	// Socket left behind by crashed instance would make listen fail, and nobody else can use it while we hold the lock
+	_ = os.Remove(in.socketPath)
+	if in.listener, err = net.Listen("unix", in.socketPath); err != nil {
+		// Application works without it, later launches just can't reach it
+		lumo.Warn("Failed to listen for requests from other launches: %v", err)
+	} else if err := os.Chmod(in.socketPath, 0600); err != nil {
+		lumo.Warn("Failed to restrict access to %s: %v", in.socketPath, err)
+	}
+	return in, nil
+}
+
+// Serve passes requests from later launches to handler until instance is closed.
+func (in *Instance) Serve(handler Handler) {
+	if in.listener == nil {
+		return
+	}
+
+	go func() {
+		for {
+			conn, err := in.listener.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil {
+				lumo.Warn("Failed to accept request from another launch: %v", err)
+				continue
+			}
+			go serveConn(conn, handler)
+		}
+	}()
+}
+
+func serveConn(conn net.Conn, handler Handler) {
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(requestTimeout))
+
+	var req Request
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		lumo.Warn("Received malformed request from another launch: %v", err)
+		return
+	}
+
+	var res response
+	if err := handler(req); err != nil {
+		res.Error = err.Error()
+	}
+
+	if err := json.NewEncoder(conn).Encode(res); err != nil {
+		lumo.Warn("Failed to respond to another launch: %v", err)
+	}
+}
+
+// Close stops listening and releases the lock.
+func (in *Instance) Close() {
+	if in.listener != nil {
+		in.listener.Close()
+		_ = os.Remove(in.socketPath)
+	}
+
+	// Lock file itself stays, removing it would let next launch lock a different file than the one still locked
+	if err := unlockFile(in.lock); err != nil {
+		lumo.Warn("Failed to release %s: %v", in.lock.Name(), err)
+	}
+	in.lock.Close()
+}
+
+// Forward passes request to instance running with the same data directory.
+func Forward(dir string, req Request) error {
+	conn, err := net.DialTimeout("unix", filepath.Join(dir, socketFileName), requestTimeout)
+	if err != nil {
+		return fmt.Errorf("running instance is not reachable: %w", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(requestTimeout))
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return err
+	}
+
+	var res response
+	if err := json.NewDecoder(conn).Decode(&res); err != nil {
+		return fmt.Errorf("no response from running instance: %w", err)
+	}
+
+	if res.Error != "" {
+		return errors.New(res.Error)
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package instance
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSecondAcquireForwardsToRunningInstance(t *testing.T) {
+	dir := t.TempDir()
+
+	first, err := Acquire(dir)
+	if err != nil {
+		t.Fatalf("failed to acquire lock: %v", err)
+	}
+
+	received := make(chan Request, 1)
+	first.Serve(func(req Request) error {
+		received <- req
+		return nil
+	})
+
+	if _, err := Acquire(dir); !errors.Is(err, ErrRunning) {
+		t.Fatalf("expected ErrRunning, got %v", err)
+	}
+
+	magnet := "magnet:?xt=urn:btih:c9e15763f722f23e98a29decdfae341b98d53056"
+	if err := Forward(dir, Request{Magnets: []string{magnet}}); err != nil {
+		t.Fatalf("failed to forward request: %v", err)
+	}
+
+	if req := <-received; len(req.Magnets) != 1 || req.Magnets[0] != magnet {
+		t.Errorf("unexpected forwarded request: %+v", req)
+	}
+
+	first.Close()
+	second, err := Acquire(dir)
+	if err != nil {
+		t.Fatalf("expected lock to be free after close, got %v", err)
+	}
+	second.Close()
+}
@@ -0,0 +1,52 @@
+package jobs
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/amatsagu/lumo"
+)
+
+// StatusHandler returns a json list with state of every registered job.
+func (s *Scheduler) StatusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(s.Status()); err != nil {
+		lumo.Error("Failed to encode jobs status: %v", err)
+	}
+}
+
+// RunHandler manually triggers job named by {name} path value, ignoring its cooldown.
+func (s *Scheduler) RunHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	name := r.PathValue("name")
+
+	err := s.Trigger(name, true)
+	switch {
+	case errors.Is(err, ErrUnknownJob):
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "unknown job " + name})
+		return
+	case errors.Is(err, ErrAlreadyRunning):
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "job " + name + " is already running"})
+		return
+	case errors.Is(err, ErrCoolingDown):
+		w.WriteHeader(http.StatusTooManyRequests)
+		json.NewEncoder(w).Encode(map[string]string{"error": "job " + name + " ran too recently"})
+		return
+	case errors.Is(err, ErrNotStarted):
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{"error": "job scheduler is not running yet"})
+		return
+	case err != nil:
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	lumo.Info("Manually triggered \"%s\" background job.", name)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"status": "started", "job": name})
+}
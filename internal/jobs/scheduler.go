@@ -0,0 +1,353 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/amatsagu/lumo"
+)
+
+var (
+	ErrUnknownJob     = errors.New("unknown job")
+	ErrAlreadyRunning = errors.New("job is already running")
+	ErrCoolingDown    = errors.New("job ran too recently")
+	ErrNotStarted     = errors.New("scheduler is not started")
+)
+
+// Func is the unit of work executed by the scheduler. Implementations must
+// return early once ctx is cancelled so the application can shut down.
+type Func func(ctx context.Context) error
+
+// Job describes a named piece of background work.
+// Jobs with zero Interval are one-off: they run once after Delay and afterwards only when triggered manually.
+type Job struct {
+	Name     string
+	Interval time.Duration // Time between runs, 0 for one-off jobs
+	Delay    time.Duration // Initial delay before first run (one-off jobs or jobs with no persisted schedule)
+	Jitter   time.Duration // Random extra delay added to every scheduled run
+	Cooldown time.Duration // Minimum gap between runs for non-forced triggers
+	Run      Func
+}
+
+type Status struct {
+	Name      string     `json:"name"`
+	Interval  string     `json:"interval,omitempty"`
+	Running   bool       `json:"running"`
+	LastRunAt *time.Time `json:"last_run_at"`
+	NextRunAt *time.Time `json:"next_run_at"`
+	LastError string     `json:"last_error,omitempty"`
+}
+
+type entry struct {
+	job     Job
+	running bool
+	lastRun time.Time
+	nextRun time.Time // Zero when nothing is scheduled
+	lastErr string
+	wake    chan struct{}
+}
+
+// Scheduler runs registered jobs until its context is cancelled.
+// Every job is single-flight: a run is skipped if the previous one did not finish yet.
+type Scheduler struct {
+	ctx     context.Context
+	db      *sql.DB
+	started bool
+
+	jobs map[string]*entry
+	mu   sync.Mutex // Protects jobs & started
+	wg   sync.WaitGroup
+}
+
+func NewScheduler(ctx context.Context, db *sql.DB) *Scheduler {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS jobs (
+		name TEXT PRIMARY KEY,
+		last_run_at DATETIME,
+		next_run_at DATETIME,
+		last_error TEXT
+	)`)
+	if err != nil {
+		lumo.Error("Failed to create jobs table: %v", err)
+	}
+
+	return &Scheduler{
+		ctx:  ctx,
+		db:   db,
+		jobs: make(map[string]*entry),
+	}
+}
+
+// Register adds job to the scheduler. Jobs registered after Start are started immediately.
+func (s *Scheduler) Register(job Job) {
+	if job.Name == "" || job.Run == nil {
+		lumo.Panic("Attempted to register job without name or run function.")
+		return
+	}
+
+	e := &entry{
+		job:  job,
+		wake: make(chan struct{}, 1),
+	}
+	s.loadState(e)
+
+	s.mu.Lock()
+	if _, exists := s.jobs[job.Name]; exists {
+		s.mu.Unlock()
+		lumo.Warn("Job \"%s\" is already registered. Ignored.", job.Name)
+		return
+	}
+	s.jobs[job.Name] = e
+	started := s.started
+	s.mu.Unlock()
+
+	lumo.Debug("Registered \"%s\" background job.", job.Name)
+	if started {
+		s.spawn(e)
+	}
+}
+
+// Start launches scheduling loops for every registered job.
+func (s *Scheduler) Start() {
+	s.mu.Lock()
+	if s.started {
+		s.mu.Unlock()
+		return
+	}
+	s.started = true
+	entries := make([]*entry, 0, len(s.jobs))
+	for _, e := range s.jobs {
+		entries = append(entries, e)
+	}
+	s.mu.Unlock()
+
+	lumo.Debug("Starting background job scheduler with %d jobs.", len(entries))
+	for _, e := range entries {
+		s.spawn(e)
+	}
+}
+
+// Wait blocks until all scheduling loops and in-flight runs exit. Call it after cancelling the context.
+func (s *Scheduler) Wait() {
+	s.wg.Wait()
+}
+
+// Trigger requests an immediate run of the named job in the background.
+// Unless force is set, the job's cooldown is respected. Nil error means the job really started, skipped
+// runs are reported with ErrAlreadyRunning or ErrCoolingDown.
+func (s *Scheduler) Trigger(name string, force bool) error {
+	s.mu.Lock()
+	e, ok := s.jobs[name]
+	if !ok {
+		s.mu.Unlock()
+		return ErrUnknownJob
+	}
+	if !s.started {
+		s.mu.Unlock()
+		return ErrNotStarted
+	}
+	if e.running {
+		s.mu.Unlock()
+		return ErrAlreadyRunning
+	}
+	if !force && e.job.Cooldown > 0 && time.Since(e.lastRun) < e.job.Cooldown {
+		s.mu.Unlock()
+		return ErrCoolingDown
+	}
+	e.running = true // Claimed before returning, so scheduled run can't take it over in between
+	s.mu.Unlock()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.execute(e)
+	}()
+	return nil
+}
+
+// Status returns a snapshot of all registered jobs sorted by name.
+func (s *Scheduler) Status() []Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := make([]Status, 0, len(s.jobs))
+	for _, e := range s.jobs {
+		list = append(list, e.status())
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+func (s *Scheduler) spawn(e *entry) {
+	s.mu.Lock()
+	if e.nextRun.IsZero() || e.job.Interval == 0 {
+		e.nextRun = time.Now().Add(e.job.Delay + jitter(e.job.Jitter))
+	}
+	s.mu.Unlock()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.loop(e)
+	}()
+}
+
+func (s *Scheduler) loop(e *entry) {
+	for {
+		s.mu.Lock()
+		next := e.nextRun
+		s.mu.Unlock()
+
+		if next.IsZero() {
+			// Nothing scheduled (finished one-off job), only manual triggers can wake it up again
+			select {
+			case <-s.ctx.Done():
+				return
+			case <-e.wake:
+				continue
+			}
+		}
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-s.ctx.Done():
+			timer.Stop()
+			return
+		case <-e.wake:
+			timer.Stop()
+		case <-timer.C:
+			if !s.run(e) {
+				// Manual run is in progress and will reschedule once it's done
+				select {
+				case <-s.ctx.Done():
+					return
+				case <-e.wake:
+				}
+			}
+		}
+	}
+}
+
+// run executes the job once. It returns false if the job was already running.
+func (s *Scheduler) run(e *entry) bool {
+	s.mu.Lock()
+	if e.running {
+		s.mu.Unlock()
+		return false
+	}
+	e.running = true
+	s.mu.Unlock()
+
+	s.execute(e)
+	return true
+}
+
+// execute runs job already marked as running and schedules its next run.
+func (s *Scheduler) execute(e *entry) {
+	startedAt := time.Now()
+	lumo.Debug("Running \"%s\" background job...", e.job.Name)
+	err := safeRun(s.ctx, e.job.Run)
+
+	s.mu.Lock()
+	e.running = false
+	e.lastRun = startedAt
+	e.lastErr = ""
+	if err != nil {
+		e.lastErr = err.Error()
+	}
+
+	if e.job.Interval > 0 {
+		e.nextRun = startedAt.Add(e.job.Interval + jitter(e.job.Jitter))
+	} else {
+		e.nextRun = time.Time{}
+	}
+	s.mu.Unlock()
+
+	if err != nil && s.ctx.Err() == nil {
+		werr := lumo.WrapError(err).Include("job", e.job.Name)
+		lumo.Error("Background job failed: %v", werr)
+	} else {
+		lumo.Debug("Finished \"%s\" background job in %v.", e.job.Name, time.Since(startedAt))
+	}
+
+	s.saveState(e)
+	select {
+	case e.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Scheduler) loadState(e *entry) {
+	var lastRun, nextRun sql.NullTime
+	var lastErr sql.NullString
+
+	err := s.db.QueryRow("SELECT last_run_at, next_run_at, last_error FROM jobs WHERE name = ?", e.job.Name).Scan(&lastRun, &nextRun, &lastErr)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			lumo.Warn("Failed to load persisted state of \"%s\" job: %v", e.job.Name, err)
+		}
+		return
+	}
+
+	e.lastRun = lastRun.Time
+	e.nextRun = nextRun.Time
+	e.lastErr = lastErr.String
+}
+
+func (s *Scheduler) saveState(e *entry) {
+	s.mu.Lock()
+	lastRun, nextRun, lastErr := nullTime(e.lastRun), nullTime(e.nextRun), e.lastErr
+	s.mu.Unlock()
+
+	_, err := s.db.Exec("INSERT OR REPLACE INTO jobs (name, last_run_at, next_run_at, last_error) VALUES (?, ?, ?, ?)", e.job.Name, lastRun, nextRun, lastErr)
+	if err != nil {
+		lumo.Error("Failed to persist state of \"%s\" job: %v", e.job.Name, err)
+	}
+}
+
+func (e *entry) status() Status {
+	st := Status{
+		Name:      e.job.Name,
+		Running:   e.running,
+		LastError: e.lastErr,
+	}
+
+	if e.job.Interval > 0 {
+		st.Interval = e.job.Interval.String()
+	}
+	if !e.lastRun.IsZero() {
+		t := e.lastRun
+		st.LastRunAt = &t
+	}
+	if !e.nextRun.IsZero() {
+		t := e.nextRun
+		st.NextRunAt = &t
+	}
+	return st
+}
+
+func safeRun(ctx context.Context, fn Func) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("job panicked: %v", r)
+		}
+	}()
+	return fn(ctx)
+}
+
+func jitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return rand.N(max)
+}
+
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
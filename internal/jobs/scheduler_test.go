@@ -0,0 +1,219 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	db, err := sql.Open("sqlite", t.TempDir()+"/data.db")
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// newTestScheduler returns started scheduler, which is stopped before database closes.
+func newTestScheduler(t *testing.T, db *sql.DB, jobs ...Job) *Scheduler {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := NewScheduler(ctx, db)
+	for _, job := range jobs {
+		s.Register(job)
+	}
+	s.Start()
+
+	t.Cleanup(func() {
+		cancel()
+		s.Wait()
+	})
+	return s
+}
+
+// waitFor polls job status until cond holds or test times out.
+func waitFor(t *testing.T, s *Scheduler, name string, cond func(Status) bool) Status {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, st := range s.Status() {
+			if st.Name == name && cond(st) {
+				return st
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("job %q didn't reach expected state", name)
+	return Status{}
+}
+
+func finished(st Status) bool {
+	return !st.Running && st.LastRunAt != nil
+}
+
+func TestTriggerIsSingleFlight(t *testing.T) {
+	release := make(chan struct{})
+	var runs atomic.Int32
+	s := newTestScheduler(t, openTestDB(t), Job{
+		Name:  "sync",
+		Delay: time.Hour,
+		Run: func(ctx context.Context) error {
+			runs.Add(1)
+			<-release
+			return nil
+		},
+	})
+
+	if err := s.Trigger("sync", true); err != nil {
+		t.Fatalf("expected job to start, got %v", err)
+	}
+
+	if err := s.Trigger("sync", true); !errors.Is(err, ErrAlreadyRunning) {
+		t.Errorf("expected second trigger to report running job, got %v", err)
+	}
+
+	close(release)
+	waitFor(t, s, "sync", finished)
+
+	if err := s.Trigger("sync", true); err != nil {
+		t.Errorf("expected job to start again once finished, got %v", err)
+	}
+	waitFor(t, s, "sync", func(st Status) bool { return !st.Running && runs.Load() == 2 })
+
+	if err := s.Trigger("missing", true); !errors.Is(err, ErrUnknownJob) {
+		t.Errorf("expected unknown job error, got %v", err)
+	}
+}
+
+func TestTriggerRespectsCooldown(t *testing.T) {
+	s := newTestScheduler(t, openTestDB(t), Job{
+		Name:     "refresh",
+		Delay:    time.Hour,
+		Cooldown: time.Hour,
+		Run:      func(ctx context.Context) error { return nil },
+	})
+
+	if err := s.Trigger("refresh", false); err != nil {
+		t.Fatalf("expected first run to start, got %v", err)
+	}
+	waitFor(t, s, "refresh", finished)
+
+	if err := s.Trigger("refresh", false); !errors.Is(err, ErrCoolingDown) {
+		t.Errorf("expected run within cooldown to be refused, got %v", err)
+	}
+
+	if err := s.Trigger("refresh", true); err != nil {
+		t.Errorf("expected forced run to ignore cooldown, got %v", err)
+	}
+}
+
+func TestStatePersistsAcrossRestarts(t *testing.T) {
+	db := openTestDB(t)
+	job := Job{
+		Name:     "timetable",
+		Interval: time.Hour,
+		Delay:    time.Hour,
+		Run:      func(ctx context.Context) error { return errors.New("anilist is down") },
+	}
+
+	first := newTestScheduler(t, db, job)
+	if err := first.Trigger("timetable", true); err != nil {
+		t.Fatalf("expected job to start, got %v", err)
+	}
+	ran := waitFor(t, first, "timetable", finished)
+
+	second := newTestScheduler(t, db, job)
+	st := second.Status()[0]
+	if st.LastRunAt == nil || !st.LastRunAt.Equal(*ran.LastRunAt) {
+		t.Errorf("expected last run %v to be restored, got %v", ran.LastRunAt, st.LastRunAt)
+	}
+
+	// Persisted schedule is kept instead of starting over with initial delay
+	if st.NextRunAt == nil || !st.NextRunAt.Equal(*ran.NextRunAt) {
+		t.Errorf("expected next run %v to be restored, got %v", ran.NextRunAt, st.NextRunAt)
+	}
+
+	if st.LastError != "anilist is down" {
+		t.Errorf("expected last error to be restored, got %q", st.LastError)
+	}
+}
+
+func TestOneOffJobRunsOnceAfterDelay(t *testing.T) {
+	var runs atomic.Int32
+	s := newTestScheduler(t, openTestDB(t), Job{
+		Name:  "migrate",
+		Delay: 10 * time.Millisecond,
+		Run: func(ctx context.Context) error {
+			runs.Add(1)
+			return nil
+		},
+	})
+
+	st := waitFor(t, s, "migrate", finished)
+	if st.NextRunAt != nil {
+		t.Errorf("expected nothing scheduled after one-off run, got %v", st.NextRunAt)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if n := runs.Load(); n != 1 {
+		t.Fatalf("expected one-off job to run once, ran %d times", n)
+	}
+
+	if err := s.Trigger("migrate", true); err != nil {
+		t.Fatalf("expected one-off job to run on trigger, got %v", err)
+	}
+	waitFor(t, s, "migrate", func(st Status) bool { return !st.Running && runs.Load() == 2 })
+}
+
+func TestJitterBounds(t *testing.T) {
+	for _, max := range []time.Duration{0, -time.Second} {
+		if d := jitter(max); d != 0 {
+			t.Errorf("expected no jitter for %v, got %v", max, d)
+		}
+	}
+
+	for range 1000 {
+		if d := jitter(10 * time.Millisecond); d < 0 || d >= 10*time.Millisecond {
+			t.Fatalf("expected jitter within [0, 10ms), got %v", d)
+		}
+	}
+}
+
+func TestRunHandlerEncodesJobName(t *testing.T) {
+	s := newTestScheduler(t, openTestDB(t))
+
+	// Go quoting of control characters isn't valid JSON, so body must come from encoder
+	name := "sync\x01"
+	r := httptest.NewRequest(http.MethodPost, "/api/jobs/run", nil)
+	r.SetPathValue("name", name)
+	w := httptest.NewRecorder()
+	s.RunHandler(w, r)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for unknown job, got %d", w.Code)
+	}
+
+	var body struct {
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("expected json error body, got %q: %v", w.Body.String(), err)
+	}
+
+	if body.Error != "unknown job "+name {
+		t.Errorf("expected error naming the job, got %q", body.Error)
+	}
+}
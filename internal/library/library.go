@@ -0,0 +1,420 @@
+package library
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"jubako/internal/profile"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/amatsagu/lumo"
+)
+
+// WatchHook is called after an episode was marked as watched locally by given profile.
+type WatchHook func(profileID int64, mediaID, episode int)
+
+// Library keeps per-profile watch history and subscriptions shared by all tracker integrations.
+type Library struct {
+	db *sql.DB
+
+	hooks []WatchHook
+	mu    sync.RWMutex // Protects hooks
+}
+
+type Subscription struct {
+	MediaID   int       `json:"media_id"`
+	Title     string    `json:"title"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type WatchRecord struct {
+	MediaID   int       `json:"media_id"`
+	Episode   int       `json:"episode"`
+	WatchedAt time.Time `json:"watched_at"`
+}
+
+// Deletion records episode file removed from disk to free space, so it's clear why it's gone.
+type Deletion struct {
+	MediaID   int       `json:"media_id"`
+	Episode   int       `json:"episode"`
+	Path      string    `json:"path"`
+	Size      int64     `json:"size"`
+	Reason    string    `json:"reason"`
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+// ContinueEntry points at the next episode of series that profile watched recently.
+type ContinueEntry struct {
+	MediaID     int       `json:"media_id"`
+	LastEpisode int       `json:"last_episode"`
+	NextEpisode int       `json:"next_episode"`
+	WatchedAt   time.Time `json:"watched_at"`
+}
+
+const watchHistorySchema = `CREATE TABLE IF NOT EXISTS watch_history (
+	profile_id INTEGER NOT NULL,
+	media_id INTEGER NOT NULL,
+	episode INTEGER NOT NULL,
+	watched_at DATETIME NOT NULL,
+	PRIMARY KEY (profile_id, media_id, episode)
+)`
+
+const subscriptionsSchema = `CREATE TABLE IF NOT EXISTS subscriptions (
+	profile_id INTEGER NOT NULL,
+	media_id INTEGER NOT NULL,
+	title TEXT NOT NULL,
+	created_at DATETIME NOT NULL,
+	PRIMARY KEY (profile_id, media_id)
+)`
+
+// Deleted files are shared by all profiles, so deletions are not owned by any of them
+const deletionsSchema = `CREATE TABLE IF NOT EXISTS deletions (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	media_id INTEGER NOT NULL,
+	episode INTEGER NOT NULL,
+	path TEXT NOT NULL,
+	size INTEGER NOT NULL,
+	reason TEXT NOT NULL,
+	deleted_at DATETIME NOT NULL
+)`
+
+func NewLibrary(db *sql.DB) *Library {
+	if _, err := db.Exec(watchHistorySchema); err != nil {
+		lumo.Error("Failed to create watch_history table: %v", err)
+	}
+
+	if err := profile.MigrateTable(db, "watch_history", watchHistorySchema, "media_id, episode, watched_at"); err != nil {
+		lumo.Error("Failed to migrate watch_history table: %v", err)
+	}
+
+	if _, err := db.Exec(subscriptionsSchema); err != nil {
+		lumo.Error("Failed to create subscriptions table: %v", err)
+	}
+
+	if err := profile.MigrateTable(db, "subscriptions", subscriptionsSchema, "media_id, title, created_at"); err != nil {
+		lumo.Error("Failed to migrate subscriptions table: %v", err)
+	}
+
+	if _, err := db.Exec(deletionsSchema); err != nil {
+		lumo.Error("Failed to create deletions table: %v", err)
+	}
+
+	return &Library{db: db}
+}
+
+// OnWatched registers hook that will be called for every newly watched episode.
+func (l *Library) OnWatched(hook WatchHook) {
+	l.mu.Lock()
+	l.hooks = append(l.hooks, hook)
+	l.mu.Unlock()
+}
+
+// MarkWatched stores episode in watch history of profile and notifies registered hooks.
+func (l *Library) MarkWatched(profileID int64, mediaID, episode int) error {
+	_, err := l.db.Exec("INSERT OR REPLACE INTO watch_history (profile_id, media_id, episode, watched_at) VALUES (?, ?, ?, ?)", profileID, mediaID, episode, time.Now())
+	if err != nil {
+		return lumo.WrapError(err).Include("profile_id", profileID).Include("media_id", mediaID).Include("episode", episode)
+	}
+
+	l.mu.RLock()
+	hooks := l.hooks
+	l.mu.RUnlock()
+
+	for _, hook := range hooks {
+		hook(profileID, mediaID, episode)
+	}
+	return nil
+}
+
+// LastWatched reports whether any profile watched the episode and when it was watched most recently.
+func (l *Library) LastWatched(mediaID, episode int) (time.Time, bool, error) {
+	var watchedAt time.Time
+	err := l.db.QueryRow("SELECT watched_at FROM watch_history WHERE media_id = ? AND episode = ? ORDER BY watched_at DESC LIMIT 1", mediaID, episode).Scan(&watchedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, false, nil
+	}
+	return watchedAt, err == nil, err
+}
+
+// History returns watch records of profile ordered from the most recent one.
+func (l *Library) History(profileID int64, limit int) ([]WatchRecord, error) {
+	rows, err := l.db.Query("SELECT media_id, episode, watched_at FROM watch_history WHERE profile_id = ? ORDER BY watched_at DESC LIMIT ?", profileID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := make([]WatchRecord, 0)
+	for rows.Next() {
+		var rec WatchRecord
+		if err := rows.Scan(&rec.MediaID, &rec.Episode, &rec.WatchedAt); err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+	return records, rows.Err()
+}
+
+// ContinueWatching returns series watched by profile, starting with the most recently watched one.
+func (l *Library) ContinueWatching(profileID int64, limit int) ([]ContinueEntry, error) {
+	rows, err := l.db.Query("SELECT media_id, episode, watched_at FROM watch_history WHERE profile_id = ? ORDER BY watched_at DESC", profileID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	byMedia := make(map[int]*ContinueEntry)
+	entries := make([]*ContinueEntry, 0)
+	for rows.Next() {
+		var rec WatchRecord
+		if err := rows.Scan(&rec.MediaID, &rec.Episode, &rec.WatchedAt); err != nil {
+			return nil, err
+		}
+
+		entry, ok := byMedia[rec.MediaID]
+		if !ok {
+			entry = &ContinueEntry{MediaID: rec.MediaID, WatchedAt: rec.WatchedAt}
+			byMedia[rec.MediaID] = entry
+			entries = append(entries, entry)
+		}
+		entry.LastEpisode = max(entry.LastEpisode, rec.Episode)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	res := make([]ContinueEntry, 0, min(limit, len(entries)))
+	for _, entry := range entries[:min(limit, len(entries))] {
+		entry.NextEpisode = entry.LastEpisode + 1
+		res = append(res, *entry)
+	}
+	return res, nil
+}
+
+// Subscribe marks series as followed by profile.
+func (l *Library) Subscribe(profileID int64, mediaID int, title string) error {
+	_, err := l.db.Exec("INSERT INTO subscriptions (profile_id, media_id, title, created_at) VALUES (?, ?, ?, ?) ON CONFLICT (profile_id, media_id) DO UPDATE SET title = excluded.title", profileID, mediaID, title, time.Now())
+	return err
+}
+
+func (l *Library) Unsubscribe(profileID int64, mediaID int) error {
+	_, err := l.db.Exec("DELETE FROM subscriptions WHERE profile_id = ? AND media_id = ?", profileID, mediaID)
+	return err
+}
+
+// Subscriptions returns series followed by profile ordered by title.
+func (l *Library) Subscriptions(profileID int64) ([]Subscription, error) {
+	rows, err := l.db.Query("SELECT media_id, title, created_at FROM subscriptions WHERE profile_id = ? ORDER BY title", profileID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	subs := make([]Subscription, 0)
+	for rows.Next() {
+		var sub Subscription
+		if err := rows.Scan(&sub.MediaID, &sub.Title, &sub.CreatedAt); err != nil {
+			return nil, err
+		}
+		subs = append(subs, sub)
+	}
+	return subs, rows.Err()
+}
+
+// SubscribedIDs returns set of media ids followed by profile, or by any profile when profileID is 0.
+func (l *Library) SubscribedIDs(profileID int64) (map[int]bool, error) {
+	rows, err := l.db.Query("SELECT DISTINCT media_id FROM subscriptions WHERE ? = 0 OR profile_id = ?", profileID, profileID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make(map[int]bool)
+	for rows.Next() {
+		var mediaID int
+		if err := rows.Scan(&mediaID); err != nil {
+			return nil, err
+		}
+		ids[mediaID] = true
+	}
+	return ids, rows.Err()
+}
+
+// RecordDeletion stores that episode file was deleted from disk for given reason.
+func (l *Library) RecordDeletion(mediaID, episode int, path string, size int64, reason string) error {
+	_, err := l.db.Exec("INSERT INTO deletions (media_id, episode, path, size, reason, deleted_at) VALUES (?, ?, ?, ?, ?, ?)", mediaID, episode, path, size, reason, time.Now())
+	return err
+}
+
+// Deletions returns deleted episode files starting with the most recent one.
+func (l *Library) Deletions(limit int) ([]Deletion, error) {
+	rows, err := l.db.Query("SELECT media_id, episode, path, size, reason, deleted_at FROM deletions ORDER BY deleted_at DESC LIMIT ?", limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deletions := make([]Deletion, 0)
+	for rows.Next() {
+		var d Deletion
+		if err := rows.Scan(&d.MediaID, &d.Episode, &d.Path, &d.Size, &d.Reason, &d.DeletedAt); err != nil {
+			return nil, err
+		}
+		deletions = append(deletions, d)
+	}
+	return deletions, rows.Err()
+}
+
+// DeleteProfile drops watch history and subscriptions of removed profile. It's meant to be used as profile.DeleteHook.
+func (l *Library) DeleteProfile(profileID int64) {
+	for _, table := range []string{"watch_history", "subscriptions"} {
+		if _, err := l.db.Exec("DELETE FROM "+table+" WHERE profile_id = ?", profileID); err != nil {
+			lumo.Error("Failed to delete %s of profile %d: %v", table, profileID, err)
+		}
+	}
+}
+
+// WatchedHandler marks episode from json body ({"media_id": 1, "episode": 2}) as watched.
+func (l *Library) WatchedHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var body struct {
+		MediaID int `json:"media_id"`
+		Episode int `json:"episode"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.MediaID <= 0 || body.Episode <= 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "expected positive media_id and episode"})
+		return
+	}
+
+	if err := l.MarkWatched(profile.FromContext(r.Context()), body.MediaID, body.Episode); err != nil {
+		lumo.Error("Failed to mark episode as watched: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to store watch history"})
+		return
+	}
+
+	fmt.Fprint(w, `{"status": "success"}`)
+}
+
+// HistoryHandler returns the most recent watch records of selected profile.
+func (l *Library) HistoryHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	records, err := l.History(profile.FromContext(r.Context()), 100)
+	if err != nil {
+		lumo.Error("Failed to read watch history: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to read watch history"})
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(records); err != nil {
+		lumo.Error("Failed to encode watch history: %v", err)
+	}
+}
+
+// ContinueWatchingHandler returns next episodes of series recently watched by selected profile.
+func (l *Library) ContinueWatchingHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	entries, err := l.ContinueWatching(profile.FromContext(r.Context()), 20)
+	if err != nil {
+		lumo.Error("Failed to read continue watching list: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to read continue watching list"})
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(entries); err != nil {
+		lumo.Error("Failed to encode continue watching list: %v", err)
+	}
+}
+
+// DeletionsHandler returns the most recently deleted episode files.
+func (l *Library) DeletionsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	deletions, err := l.Deletions(100)
+	if err != nil {
+		lumo.Error("Failed to read deletions: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to read deletions"})
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(deletions); err != nil {
+		lumo.Error("Failed to encode deletions: %v", err)
+	}
+}
+
+// SubscriptionsHandler returns series followed by selected profile.
+func (l *Library) SubscriptionsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	subs, err := l.Subscriptions(profile.FromContext(r.Context()))
+	if err != nil {
+		lumo.Error("Failed to read subscriptions: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to read subscriptions"})
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(subs); err != nil {
+		lumo.Error("Failed to encode subscriptions: %v", err)
+	}
+}
+
+// SubscribeHandler follows series from {media_id} path value. Optional json body may carry its title ({"title": "..."}).
+func (l *Library) SubscribeHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	mediaID, err := strconv.Atoi(r.PathValue("media_id"))
+	if err != nil || mediaID <= 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid media id"})
+		return
+	}
+
+	var body struct {
+		Title string `json:"title"`
+	}
+	json.NewDecoder(r.Body).Decode(&body)
+
+	if err := l.Subscribe(profile.FromContext(r.Context()), mediaID, body.Title); err != nil {
+		lumo.Error("Failed to subscribe to media %d: %v", mediaID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to store subscription"})
+		return
+	}
+
+	fmt.Fprint(w, `{"status": "success"}`)
+}
+
+// UnsubscribeHandler stops following series from {media_id} path value.
+func (l *Library) UnsubscribeHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	mediaID, err := strconv.Atoi(r.PathValue("media_id"))
+	if err != nil || mediaID <= 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid media id"})
+		return
+	}
+
+	if err := l.Unsubscribe(profile.FromContext(r.Context()), mediaID); err != nil {
+		lumo.Error("Failed to unsubscribe from media %d: %v", mediaID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to remove subscription"})
+		return
+	}
+
+	fmt.Fprint(w, `{"status": "success"}`)
+}
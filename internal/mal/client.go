@@ -0,0 +1,229 @@
+package mal
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultAuthURL = "https://myanimelist.net/v1/oauth2"
+	DefaultAPIURL  = "https://api.myanimelist.net/v2"
+	DefaultTimeout = 15 * time.Second
+)
+
+// APIError describes non-successful response returned by MyAnimeList.
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("MyAnimeList API returned status %d: %s", e.StatusCode, e.Message)
+}
+
+// Token is OAuth token pair issued by MyAnimeList.
+type Token struct {
+	AccessToken  string
+	RefreshToken string
+	ExpiresAt    time.Time
+}
+
+// Client talks with MyAnimeList OAuth server and v2 API.
+// All exported fields may be changed before first use.
+type Client struct {
+	AuthURL     string
+	APIURL      string
+	ClientID    string
+	RedirectURI string
+	HTTP        *http.Client
+}
+
+// NewClient creates MyAnimeList client. Nil httpClient falls back to default client with timeout.
+func NewClient(clientID, redirectURI string, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: DefaultTimeout}
+	}
+
+	return &Client{
+		AuthURL:     DefaultAuthURL,
+		APIURL:      DefaultAPIURL,
+		ClientID:    clientID,
+		RedirectURI: redirectURI,
+		HTTP:        httpClient,
+	}
+}
+
+// NewCodeVerifier generates random PKCE code verifier. MyAnimeList only supports "plain" challenge method,
+// so the verifier is also used as code challenge.
+func NewCodeVerifier() (string, error) {
+	buf := make([]byte, 64)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// AuthorizeURL returns url user has to open in order to grant access to their account.
+func (c *Client) AuthorizeURL(verifier, state string) string {
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", c.ClientID)
+	q.Set("code_challenge", verifier)
+	q.Set("code_challenge_method", "plain")
+	q.Set("state", state)
+	if c.RedirectURI != "" {
+		q.Set("redirect_uri", c.RedirectURI)
+	}
+	return c.AuthURL + "/authorize?" + q.Encode()
+}
+
+// ExchangeCode trades authorization code for token pair.
+func (c *Client) ExchangeCode(ctx context.Context, code, verifier string) (*Token, error) {
+	form := url.Values{}
+	form.Set("client_id", c.ClientID)
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("code_verifier", verifier)
+	if c.RedirectURI != "" {
+		form.Set("redirect_uri", c.RedirectURI)
+	}
+	return c.requestToken(ctx, form)
+}
+
+// RefreshToken obtains new token pair using refresh token.
+func (c *Client) RefreshToken(ctx context.Context, refreshToken string) (*Token, error) {
+	form := url.Values{}
+	form.Set("client_id", c.ClientID)
+	form.Set("grant_type", "refresh_token")
+	form.Set("refresh_token", refreshToken)
+	return c.requestToken(ctx, form)
+}
+
+func (c *Client) requestToken(ctx context.Context, form url.Values) (*Token, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.AuthURL+"/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	var resp struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		ExpiresIn    int    `json:"expires_in"`
+	}
+
+	if err := c.do(req, &resp); err != nil {
+		return nil, err
+	}
+
+	return &Token{
+		AccessToken:  resp.AccessToken,
+		RefreshToken: resp.RefreshToken,
+		ExpiresAt:    time.Now().Add(time.Duration(resp.ExpiresIn) * time.Second),
+	}, nil
+}
+
+// Me returns id and name of the account that owns access token.
+func (c *Client) Me(ctx context.Context, accessToken string) (int, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.APIURL+"/users/@me", nil)
+	if err != nil {
+		return 0, "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+
+	var resp struct {
+		ID   int    `json:"id"`
+		Name string `json:"name"`
+	}
+
+	if err := c.do(req, &resp); err != nil {
+		return 0, "", err
+	}
+	return resp.ID, resp.Name, nil
+}
+
+// ListStatus is entry of anime on user's list.
+type ListStatus struct {
+	Status  string `json:"status"` // watching, completed, on_hold, dropped or plan_to_watch
+	Watched int    `json:"num_episodes_watched"`
+}
+
+// Anime returns episode count of anime (0 when not known yet) and its entry on list of the account that owns
+// access token, or nil when anime isn't on the list.
+func (c *Client) Anime(ctx context.Context, accessToken string, malID int) (int, *ListStatus, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/anime/%d?fields=num_episodes,my_list_status", c.APIURL, malID), nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+
+	var resp struct {
+		Episodes   int         `json:"num_episodes"`
+		ListStatus *ListStatus `json:"my_list_status"`
+	}
+
+	if err := c.do(req, &resp); err != nil {
+		return 0, nil, err
+	}
+	return resp.Episodes, resp.ListStatus, nil
+}
+
+// UpdateProgress sets number of watched episodes of anime on user's list. Empty status keeps current one.
+func (c *Client) UpdateProgress(ctx context.Context, accessToken string, malID, watched int, status string) error {
+	form := url.Values{}
+	form.Set("num_watched_episodes", strconv.Itoa(watched))
+	if status != "" {
+		form.Set("status", status)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPatch, fmt.Sprintf("%s/anime/%d/my_list_status", c.APIURL, malID), strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+
+	return c.do(req, nil)
+}
+
+func (c *Client) do(req *http.Request, out any) error {
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var envelope struct {
+			Error   string `json:"error"`
+			Message string `json:"message"`
+		}
+
+		msg := string(body)
+		if json.Unmarshal(body, &envelope) == nil && envelope.Error != "" {
+			msg = strings.TrimSpace(envelope.Error + " " + envelope.Message)
+		}
+		return &APIError{StatusCode: resp.StatusCode, Message: msg}
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(body, out)
+}
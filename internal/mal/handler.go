@@ -0,0 +1,93 @@
+package mal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"jubako/internal/profile"
+	"net/http"
+
+	"github.com/amatsagu/lumo"
+)
+
+// AccountHandler returns details of MyAnimeList account linked to selected profile (never the tokens themselves).
+func (s *Syncer) AccountHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	profileID := profile.FromContext(r.Context())
+	account, _, err := s.Account(profileID)
+	if errors.Is(err, ErrNotLinked) {
+		fmt.Fprintf(w, `{"linked": false, "configured": %t}`, s.client.ClientID != "")
+		return
+	}
+	if err != nil {
+		lumo.Error("Failed to read MyAnimeList account: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to read account"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]any{
+		"linked":            true,
+		"configured":        true,
+		"account":           account,
+		"pending_mutations": s.PendingMutations(profileID),
+	})
+}
+
+// AuthorizeHandler starts linking account to selected profile and returns url that should be opened by user.
+func (s *Syncer) AuthorizeHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	authURL, err := s.Authorize(profile.FromContext(r.Context()))
+	if errors.Is(err, ErrNotConfigured) {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "MyAnimeList client id is not configured"})
+		return
+	}
+	if err != nil {
+		lumo.Error("Failed to start MyAnimeList authorization: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to start authorization"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"url": authURL})
+}
+
+// CallbackHandler is OAuth redirect target. It renders a tiny html page, since it's opened directly by the browser.
+func (s *Syncer) CallbackHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	query := r.URL.Query()
+	if reason := query.Get("error"); reason != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "<p>MyAnimeList authorization failed: %s</p>", html.EscapeString(reason))
+		return
+	}
+
+	account, err := s.Callback(r.Context(), query.Get("code"), query.Get("state"))
+	if err != nil {
+		lumo.Error("Failed to finish MyAnimeList authorization: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "<p>MyAnimeList authorization failed: %s</p>", html.EscapeString(err.Error()))
+		return
+	}
+
+	fmt.Fprintf(w, "<p>Linked MyAnimeList account <strong>%s</strong>. You can close this window.</p>", html.EscapeString(account.Name))
+}
+
+// UnlinkHandler removes MyAnimeList account linked to selected profile.
+func (s *Syncer) UnlinkHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := s.Unlink(profile.FromContext(r.Context())); err != nil {
+		lumo.Error("Failed to unlink MyAnimeList account: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to unlink account"})
+		return
+	}
+
+	fmt.Fprint(w, `{"linked": false}`)
+}
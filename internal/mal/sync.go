@@ -0,0 +1,467 @@
+package mal
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"jubako/internal/jobs"
+	"jubako/internal/model"
+	"jubako/internal/profile"
+	"net/http"
+	"time"
+
+	"github.com/amatsagu/lumo"
+)
+
+// SyncJob is name of the background job that replays queued progress updates to MyAnimeList.
+const SyncJob = "mal-sync"
+
+var (
+	ErrNotLinked     = errors.New("myanimelist account is not linked")
+	ErrNotConfigured = errors.New("myanimelist client id is not configured")
+	ErrUnknownState  = errors.New("unknown or expired authorization state")
+)
+
+// Syncer pushes locally watched episodes to MyAnimeList accounts - each profile may link its own one.
+// Like AniList integration, progress updates are queued in database first, so they survive being offline.
+type Syncer struct {
+	db        *sql.DB
+	client    *Client
+	scheduler *jobs.Scheduler
+}
+
+const accountSchema = `CREATE TABLE IF NOT EXISTS mal_account (
+	profile_id INTEGER PRIMARY KEY,
+	access_token TEXT NOT NULL,
+	refresh_token TEXT NOT NULL,
+	expires_at DATETIME NOT NULL,
+	user_id INTEGER NOT NULL,
+	name TEXT NOT NULL,
+	linked_at DATETIME NOT NULL
+)`
+
+const authRequestsSchema = `CREATE TABLE IF NOT EXISTS mal_auth_requests (
+	state TEXT PRIMARY KEY,
+	profile_id INTEGER NOT NULL,
+	verifier TEXT NOT NULL,
+	created_at DATETIME NOT NULL
+)`
+
+const mutationsSchema = `CREATE TABLE IF NOT EXISTS mal_mutations (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	profile_id INTEGER NOT NULL,
+	media_id INTEGER NOT NULL,
+	progress INTEGER NOT NULL,
+	created_at DATETIME NOT NULL,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	last_error TEXT
+)`
+
+func NewSyncer(db *sql.DB, client *Client, scheduler *jobs.Scheduler) *Syncer {
+	tables := []struct {
+		name, schema, columns string
+	}{
+		{"mal_account", accountSchema, "access_token, refresh_token, expires_at, user_id, name, linked_at"},
+		{"mal_auth_requests", authRequestsSchema, "state, verifier, created_at"},
+		{"mal_mutations", mutationsSchema, "id, media_id, progress, created_at, attempts, last_error"},
+	}
+
+	for _, table := range tables {
+		if _, err := db.Exec(table.schema); err != nil {
+			lumo.Error("Failed to create %s table: %v", table.name, err)
+		}
+
+		if err := profile.MigrateTable(db, table.name, table.schema, table.columns); err != nil {
+			lumo.Error("Failed to migrate %s table: %v", table.name, err)
+		}
+	}
+
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS mal_id_map (
+		media_id INTEGER PRIMARY KEY,
+		mal_id INTEGER NOT NULL
+	)`)
+	if err != nil {
+		lumo.Error("Failed to create mal_id_map table: %v", err)
+	}
+
+	s := &Syncer{
+		db:        db,
+		client:    client,
+		scheduler: scheduler,
+	}
+
+	scheduler.Register(jobs.Job{
+		Name:     SyncJob,
+		Interval: 5 * time.Minute,
+		Delay:    15 * time.Second,
+		Jitter:   30 * time.Second,
+		Run:      s.Sync,
+	})
+	return s
+}
+
+// Authorize starts PKCE flow for given profile and returns url that user has to visit.
+func (s *Syncer) Authorize(profileID int64) (string, error) {
+	if s.client.ClientID == "" {
+		return "", ErrNotConfigured
+	}
+
+	verifier, err := NewCodeVerifier()
+	if err != nil {
+		return "", err
+	}
+
+	stateBuf := make([]byte, 16)
+	if _, err := rand.Read(stateBuf); err != nil {
+		return "", err
+	}
+	state := hex.EncodeToString(stateBuf)
+
+	// Forget abandoned attempts
+	if _, err := s.db.Exec("DELETE FROM mal_auth_requests WHERE created_at < ?", time.Now().Add(-time.Hour)); err != nil {
+		lumo.Warn("Failed to clean up old MyAnimeList authorization requests: %v", err)
+	}
+
+	_, err = s.db.Exec("INSERT INTO mal_auth_requests (state, profile_id, verifier, created_at) VALUES (?, ?, ?, ?)", state, profileID, verifier, time.Now())
+	if err != nil {
+		return "", err
+	}
+	return s.client.AuthorizeURL(verifier, state), nil
+}
+
+// Callback finishes PKCE flow by exchanging authorization code and storing tokens for profile that started it.
+func (s *Syncer) Callback(ctx context.Context, code, state string) (*model.TrackerAccount, error) {
+	var verifier string
+	var profileID int64
+	err := s.db.QueryRow("SELECT verifier, profile_id FROM mal_auth_requests WHERE state = ? AND created_at >= ?", state, time.Now().Add(-time.Hour)).Scan(&verifier, &profileID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrUnknownState
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := s.db.Exec("DELETE FROM mal_auth_requests WHERE state = ?", state); err != nil {
+		lumo.Warn("Failed to delete used MyAnimeList authorization request: %v", err)
+	}
+
+	token, err := s.client.ExchangeCode(ctx, code, verifier)
+	if err != nil {
+		return nil, err
+	}
+
+	userID, name, err := s.client.Me(ctx, token.AccessToken)
+	if err != nil {
+		return nil, err
+	}
+
+	account := &model.TrackerAccount{
+		UserID:   userID,
+		Name:     name,
+		LinkedAt: time.Now(),
+	}
+
+	_, err = s.db.Exec("INSERT OR REPLACE INTO mal_account (profile_id, access_token, refresh_token, expires_at, user_id, name, linked_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		profileID, token.AccessToken, token.RefreshToken, token.ExpiresAt, account.UserID, account.Name, account.LinkedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	lumo.Info("Linked MyAnimeList account \"%s\" (%d) to profile %d.", account.Name, account.UserID, profileID)
+	return account, nil
+}
+
+// Unlink forgets stored tokens and all pending mutations of given profile.
+func (s *Syncer) Unlink(profileID int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, table := range []string{"mal_account", "mal_mutations"} {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE profile_id = ?", profileID); err != nil {
+			return err
+		}
+	}
+
+	lumo.Info("Unlinked MyAnimeList account of profile %d.", profileID)
+	return tx.Commit()
+}
+
+// Account returns account linked to profile with its current token or ErrNotLinked.
+func (s *Syncer) Account(profileID int64) (*model.TrackerAccount, *Token, error) {
+	var account model.TrackerAccount
+	var token Token
+
+	err := s.db.QueryRow("SELECT access_token, refresh_token, expires_at, user_id, name, linked_at FROM mal_account WHERE profile_id = ?", profileID).
+		Scan(&token.AccessToken, &token.RefreshToken, &token.ExpiresAt, &account.UserID, &account.Name, &account.LinkedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil, ErrNotLinked
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return &account, &token, nil
+}
+
+// QueueProgress stores progress update to be pushed during next sync. It's meant to be used as library.WatchHook.
+func (s *Syncer) QueueProgress(profileID int64, mediaID, episode int) {
+	if _, _, err := s.Account(profileID); err != nil {
+		return
+	}
+
+	_, err := s.db.Exec("INSERT INTO mal_mutations (profile_id, media_id, progress, created_at) VALUES (?, ?, ?, ?)", profileID, mediaID, episode, time.Now())
+	if err != nil {
+		werr := lumo.WrapError(err).Include("profile_id", profileID).Include("media_id", mediaID).Include("episode", episode)
+		lumo.Error("Failed to queue MyAnimeList progress update: %v", werr)
+		return
+	}
+
+	if err := s.scheduler.Trigger(SyncJob, true); err != nil && !errors.Is(err, jobs.ErrAlreadyRunning) && !errors.Is(err, jobs.ErrNotStarted) {
+		lumo.Warn("Failed to trigger MyAnimeList sync: %v", err)
+	}
+}
+
+// RememberMalIDs caches AniList -> MyAnimeList id pairs of loaded media, with 0 for media that has no counterpart.
+// It's meant to be used as anilist.MalIDHook, so progress updates never need to look ids up on their own.
+func (s *Syncer) RememberMalIDs(ids map[int]int) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		lumo.Warn("Failed to cache MyAnimeList ids: %v", err)
+		return
+	}
+	defer tx.Rollback()
+
+	for mediaID, malID := range ids {
+		if mediaID <= 0 || malID < 0 {
+			continue
+		}
+
+		if _, err := tx.Exec("INSERT OR REPLACE INTO mal_id_map (media_id, mal_id) VALUES (?, ?)", mediaID, malID); err != nil {
+			lumo.Warn("Failed to cache MyAnimeList id of media %d: %v", mediaID, err)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		lumo.Warn("Failed to cache MyAnimeList ids: %v", err)
+	}
+}
+
+// Sync refreshes access tokens when needed and replays queued mutations of every linked profile.
+func (s *Syncer) Sync(ctx context.Context) error {
+	profiles, err := s.linkedProfiles()
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, profileID := range profiles {
+		if err := s.syncProfile(ctx, profileID); err != nil {
+			errs = append(errs, fmt.Errorf("profile %d: %w", profileID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Syncer) linkedProfiles() ([]int64, error) {
+	rows, err := s.db.Query("SELECT profile_id FROM mal_account ORDER BY profile_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make([]int64, 0)
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func (s *Syncer) syncProfile(ctx context.Context, profileID int64) error {
+	_, token, err := s.Account(profileID)
+	if errors.Is(err, ErrNotLinked) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if time.Until(token.ExpiresAt) < time.Hour {
+		refreshed, err := s.client.RefreshToken(ctx, token.RefreshToken)
+		if err != nil {
+			return fmt.Errorf("failed to refresh MyAnimeList token: %w", err)
+		}
+
+		_, err = s.db.Exec("UPDATE mal_account SET access_token = ?, refresh_token = ?, expires_at = ? WHERE profile_id = ?", refreshed.AccessToken, refreshed.RefreshToken, refreshed.ExpiresAt, profileID)
+		if err != nil {
+			return err
+		}
+
+		lumo.Debug("Refreshed MyAnimeList access token of profile %d.", profileID)
+		token = refreshed
+	}
+
+	return s.replayMutations(ctx, profileID, token.AccessToken)
+}
+
+type queuedMutation struct {
+	ids      []int64
+	mediaID  int
+	progress int
+}
+
+func (s *Syncer) replayMutations(ctx context.Context, profileID int64, accessToken string) error {
+	rows, err := s.db.Query("SELECT id, media_id, progress FROM mal_mutations WHERE profile_id = ? ORDER BY id", profileID)
+	if err != nil {
+		return err
+	}
+
+	// Collapse queue, so only the highest progress per media is pushed
+	byMedia := make(map[int]*queuedMutation)
+	order := make([]*queuedMutation, 0)
+	for rows.Next() {
+		var id int64
+		var mediaID, progress int
+		if err := rows.Scan(&id, &mediaID, &progress); err != nil {
+			rows.Close()
+			return err
+		}
+
+		m, ok := byMedia[mediaID]
+		if !ok {
+			m = &queuedMutation{mediaID: mediaID}
+			byMedia[mediaID] = m
+			order = append(order, m)
+		}
+		m.ids = append(m.ids, id)
+		m.progress = max(m.progress, progress)
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, m := range order {
+		malID, known, err := s.malID(m.mediaID)
+		if err != nil {
+			s.markAttempt(m.ids, err)
+			return fmt.Errorf("failed to look up MyAnimeList id: %w", err)
+		}
+
+		if !known {
+			// Id arrives with the media next time it's loaded from AniList, e.g. by timetable refresh
+			lumo.Debug("MyAnimeList id of media %d isn't known yet, keeping progress update queued.", m.mediaID)
+			continue
+		}
+
+		if malID == 0 {
+			lumo.Debug("Media %d has no MyAnimeList counterpart, skipping progress update.", m.mediaID)
+			s.deleteMutations(m.ids)
+			continue
+		}
+
+		err = s.push(ctx, accessToken, malID, m.progress)
+		if err == nil {
+			s.deleteMutations(m.ids)
+			continue
+		}
+
+		var apiErr *APIError
+		if errors.As(err, &apiErr) && apiErr.StatusCode >= 400 && apiErr.StatusCode < 500 && apiErr.StatusCode != http.StatusUnauthorized && apiErr.StatusCode != http.StatusTooManyRequests {
+			// MyAnimeList rejected this mutation, retrying won't help
+			werr := lumo.WrapError(err).Include("media_id", m.mediaID).Include("mal_id", malID).Include("progress", m.progress)
+			lumo.Warn("Dropping rejected MyAnimeList progress update: %v", werr)
+			s.deleteMutations(m.ids)
+			continue
+		}
+
+		// Offline, rate limited or token revoked - keep mutation queued for next run
+		s.markAttempt(m.ids, err)
+		return fmt.Errorf("failed to push queued progress update: %w", err)
+	}
+	return nil
+}
+
+// push sets progress of anime on MyAnimeList list, unless the list is already further. Status is only changed
+// when anime gets finished or starts being watched, so e.g. anime put on hold stays there.
+func (s *Syncer) push(ctx context.Context, accessToken string, malID, progress int) error {
+	episodes, current, err := s.client.Anime(ctx, accessToken, malID)
+	if err != nil {
+		return err
+	}
+
+	if current != nil && current.Watched >= progress {
+		lumo.Debug("MyAnimeList progress of anime %d is already %d, skipping queued %d.", malID, current.Watched, progress)
+		return nil
+	}
+
+	var status string
+	switch {
+	case episodes > 0 && progress >= episodes:
+		status = "completed"
+	case current == nil || current.Status == "plan_to_watch":
+		status = "watching"
+	}
+
+	if err := s.client.UpdateProgress(ctx, accessToken, malID, progress, status); err != nil {
+		return err
+	}
+
+	lumo.Debug("Pushed MyAnimeList progress %d for anime %d.", progress, malID)
+	return nil
+}
+
+// malID returns cached MyAnimeList id of media and whether it's known at all.
+func (s *Syncer) malID(mediaID int) (int, bool, error) {
+	var malID int
+	err := s.db.QueryRow("SELECT mal_id FROM mal_id_map WHERE media_id = ?", mediaID).Scan(&malID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return malID, true, nil
+}
+
+func (s *Syncer) deleteMutations(ids []int64) {
+	for _, id := range ids {
+		if _, err := s.db.Exec("DELETE FROM mal_mutations WHERE id = ?", id); err != nil {
+			lumo.Error("Failed to delete MyAnimeList mutation %d: %v", id, err)
+		}
+	}
+}
+
+func (s *Syncer) markAttempt(ids []int64, cause error) {
+	for _, id := range ids {
+		if _, err := s.db.Exec("UPDATE mal_mutations SET attempts = attempts + 1, last_error = ? WHERE id = ?", cause.Error(), id); err != nil {
+			lumo.Error("Failed to update MyAnimeList mutation %d: %v", id, err)
+		}
+	}
+}
+
+// PendingMutations returns number of progress updates of profile waiting to be pushed.
+func (s *Syncer) PendingMutations(profileID int64) int {
+	var count int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM mal_mutations WHERE profile_id = ?", profileID).Scan(&count); err != nil {
+		lumo.Error("Failed to count pending MyAnimeList mutations: %v", err)
+	}
+	return count
+}
+
+// DeleteProfile unlinks account of removed profile. It's meant to be used as profile.DeleteHook.
+func (s *Syncer) DeleteProfile(profileID int64) {
+	if err := s.Unlink(profileID); err != nil {
+		lumo.Error("Failed to unlink MyAnimeList account of deleted profile %d: %v", profileID, err)
+	}
+}
@@ -0,0 +1,231 @@
+package mal
+
+import (
+	"context"
+	"fmt"
+	"jubako/internal/jobs"
+	"jubako/internal/testutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type fakeMAL struct {
+	online     atomic.Bool
+	refreshes  atomic.Int32
+	updates    atomic.Int32
+	lastBody   atomic.Value
+	listStatus atomic.Value // my_list_status of anime 59027, not on the list when empty
+}
+
+func (f *fakeMAL) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !f.online.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	r.ParseForm()
+	switch {
+	case r.URL.Path == "/oauth2/token" && r.PostForm.Get("grant_type") == "authorization_code":
+		if r.PostForm.Get("code_verifier") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": "invalid_request", "message": "missing verifier"}`))
+			return
+		}
+		w.Write([]byte(`{"access_token": "access-1", "refresh_token": "refresh-1", "expires_in": 60}`))
+	case r.URL.Path == "/oauth2/token" && r.PostForm.Get("grant_type") == "refresh_token":
+		f.refreshes.Add(1)
+		w.Write([]byte(`{"access_token": "access-2", "refresh_token": "refresh-2", "expires_in": 2678400}`))
+	case r.URL.Path == "/v2/users/@me":
+		w.Write([]byte(`{"id": 7, "name": "jubako"}`))
+	case strings.HasPrefix(r.URL.Path, "/v2/anime/59027") && r.Header.Get("Authorization") != "Bearer access-2":
+		w.WriteHeader(http.StatusUnauthorized)
+	case r.URL.Path == "/v2/anime/59027" && r.Method == http.MethodGet:
+		if status, _ := f.listStatus.Load().(string); status != "" {
+			fmt.Fprintf(w, `{"id": 59027, "num_episodes": 12, "my_list_status": %s}`, status)
+			return
+		}
+		w.Write([]byte(`{"id": 59027, "num_episodes": 12}`))
+	case r.URL.Path == "/v2/anime/59027/my_list_status" && r.Method == http.MethodPatch:
+		f.updates.Add(1)
+		f.lastBody.Store(r.PostForm.Encode())
+		w.Write([]byte(`{"status": "watching", "num_episodes_watched": 4}`))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func newTestSyncer(t *testing.T, fake *fakeMAL) *Syncer {
+	t.Helper()
+
+	db := testutil.OpenDB(t)
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+
+	client := NewClient("client-id", "http://127.0.0.1/api/mal/callback", srv.Client())
+	client.AuthURL = srv.URL + "/oauth2"
+	client.APIURL = srv.URL + "/v2"
+
+	s := NewSyncer(db, client, jobs.NewScheduler(context.Background(), db))
+	s.RememberMalIDs(map[int]int{178025: 59027, 1: 0})
+	return s
+}
+
+// linkAccount stores account of profile 1 with given access token.
+func linkAccount(t *testing.T, s *Syncer, accessToken string, expiresAt time.Time) {
+	t.Helper()
+
+	_, err := s.db.Exec("INSERT INTO mal_account (profile_id, access_token, refresh_token, expires_at, user_id, name, linked_at) VALUES (1, ?, 'refresh-1', ?, 7, 'jubako', ?)", accessToken, expiresAt, time.Now())
+	if err != nil {
+		t.Fatalf("failed to seed account: %v", err)
+	}
+}
+
+func TestAuthorizeAndCallbackLinkAccount(t *testing.T) {
+	fake := &fakeMAL{}
+	fake.online.Store(true)
+	s := newTestSyncer(t, fake)
+
+	authURL, err := s.Authorize(1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	parsed, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatalf("invalid authorize url: %v", err)
+	}
+
+	q := parsed.Query()
+	if q.Get("code_challenge_method") != "plain" || len(q.Get("code_challenge")) < 43 || q.Get("state") == "" {
+		t.Fatalf("unexpected authorize query: %v", q)
+	}
+
+	if _, err := s.Callback(context.Background(), "code", "bogus"); err != ErrUnknownState {
+		t.Errorf("expected ErrUnknownState for unknown state, got %v", err)
+	}
+
+	account, err := s.Callback(context.Background(), "code", q.Get("state"))
+	if err != nil {
+		t.Fatalf("unexpected callback error: %v", err)
+	}
+
+	if account.UserID != 7 || account.Name != "jubako" {
+		t.Errorf("unexpected account: %+v", account)
+	}
+
+	// State can be used only once
+	if _, err := s.Callback(context.Background(), "code", q.Get("state")); err != ErrUnknownState {
+		t.Errorf("expected ErrUnknownState for reused state, got %v", err)
+	}
+}
+
+func TestSyncRefreshesTokenAndReplaysQueue(t *testing.T) {
+	fake := &fakeMAL{}
+	s := newTestSyncer(t, fake)
+
+	linkAccount(t, s, "access-1", time.Now().Add(time.Minute))
+
+	s.QueueProgress(1, 178025, 3)
+	s.QueueProgress(1, 178025, 4)
+	s.QueueProgress(1, 1, 1)    // No MyAnimeList counterpart
+	s.QueueProgress(1, 5114, 2) // MyAnimeList id not known yet
+
+	if err := s.Sync(context.Background()); err == nil {
+		t.Fatal("expected sync to fail while offline")
+	}
+
+	if got := s.PendingMutations(1); got != 4 {
+		t.Fatalf("expected 4 queued mutations while offline, got %d", got)
+	}
+
+	fake.online.Store(true)
+	if err := s.Sync(context.Background()); err != nil {
+		t.Fatalf("unexpected sync error: %v", err)
+	}
+
+	if fake.refreshes.Load() != 1 {
+		t.Errorf("expected single token refresh, got %d", fake.refreshes.Load())
+	}
+
+	if fake.updates.Load() != 1 {
+		t.Errorf("expected single collapsed update, got %d", fake.updates.Load())
+	}
+
+	if body, _ := fake.lastBody.Load().(string); body != "num_watched_episodes=4&status=watching" {
+		t.Errorf("unexpected update body: %q", body)
+	}
+
+	if got := s.PendingMutations(1); got != 1 {
+		t.Errorf("expected only update with unknown id to stay queued, got %d", got)
+	}
+}
+
+func TestSyncRespectsProgressOnMyAnimeList(t *testing.T) {
+	cases := []struct {
+		name       string
+		listStatus string
+		progress   int
+		body       string // Empty when nothing should be pushed
+	}{
+		{"not on list", "", 4, "num_watched_episodes=4&status=watching"},
+		{"planned", `{"status": "plan_to_watch", "num_episodes_watched": 0}`, 1, "num_watched_episodes=1&status=watching"},
+		{"behind", `{"status": "on_hold", "num_episodes_watched": 2}`, 4, "num_watched_episodes=4"},
+		{"ahead", `{"status": "watching", "num_episodes_watched": 6}`, 4, ""},
+		{"completed", `{"status": "completed", "num_episodes_watched": 12}`, 3, ""},
+		{"last episode", `{"status": "watching", "num_episodes_watched": 11}`, 12, "num_watched_episodes=12&status=completed"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			fake := &fakeMAL{}
+			fake.online.Store(true)
+			fake.listStatus.Store(c.listStatus)
+			s := newTestSyncer(t, fake)
+			linkAccount(t, s, "access-2", time.Now().Add(24*time.Hour))
+
+			s.QueueProgress(1, 178025, c.progress)
+			if err := s.Sync(context.Background()); err != nil {
+				t.Fatalf("unexpected sync error: %v", err)
+			}
+
+			body, _ := fake.lastBody.Load().(string)
+			if body != c.body {
+				t.Errorf("expected update %q, got %q", c.body, body)
+			}
+
+			if got := s.PendingMutations(1); got != 0 {
+				t.Errorf("expected empty queue after sync, got %d", got)
+			}
+		})
+	}
+}
+
+func TestSyncKeepsQueueWhenTokenIsRejected(t *testing.T) {
+	fake := &fakeMAL{}
+	fake.online.Store(true)
+	s := newTestSyncer(t, fake)
+	linkAccount(t, s, "revoked", time.Now().Add(24*time.Hour))
+
+	s.QueueProgress(1, 178025, 4)
+	if err := s.Sync(context.Background()); err == nil {
+		t.Fatal("expected sync to fail with rejected token")
+	}
+
+	if got := s.PendingMutations(1); got != 1 {
+		t.Fatalf("expected mutation to stay queued, got %d", got)
+	}
+
+	var attempts int
+	if err := s.db.QueryRow("SELECT attempts FROM mal_mutations").Scan(&attempts); err != nil || attempts != 1 {
+		t.Errorf("expected single recorded attempt, got %d (%v)", attempts, err)
+	}
+
+	if fake.updates.Load() != 0 {
+		t.Errorf("expected no update with rejected token, got %d", fake.updates.Load())
+	}
+}
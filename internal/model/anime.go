@@ -38,25 +38,34 @@ type Media struct {
 		Color string `json:"color"`
 	} `json:"coverImage"`
 	Description  string   `json:"description"`
+	Episodes     int      `json:"episodes"`
+	Duration     int      `json:"duration"` // Minutes per episode
 	Genres       []string `json:"genres"`
 	AverageScore int      `json:"averageScore"`
+	IsAdult      bool     `json:"isAdult"`
 }
 
 // Application-level structures
 type Timetable struct {
 	UpdatedAt time.Time `json:"updated_at"`
+	WeekStart time.Time `json:"week_start"`
+	WeekEnd   time.Time `json:"week_end"`
+	Timezone  string    `json:"timezone,omitempty"`
 	Anime     []Anime   `json:"anime"`
 }
 
 type Anime struct {
 	ID           int      `json:"id"`
+	ScheduleID   int      `json:"schedule_id"`
 	IDMal        int      `json:"id_mal"`
 	Title        string   `json:"title"`
 	Image        string   `json:"image"`
 	Color        string   `json:"color"`
 	AirTime      int64    `json:"air_time"`
 	Episode      int      `json:"episode"`
+	Duration     int      `json:"duration"`
 	Genres       []string `json:"genres"`
 	AverageScore int      `json:"average_score"`
 	Description  string   `json:"description"`
+	IsAdult      bool     `json:"is_adult"`
 }
@@ -0,0 +1,42 @@
+package model
+
+import "time"
+
+// AniList media list structures
+type MediaListCollectionResponse struct {
+	Data struct {
+		MediaListCollection struct {
+			Lists []struct {
+				Name    string           `json:"name"`
+				Status  string           `json:"status"`
+				Entries []MediaListEntry `json:"entries"`
+			} `json:"lists"`
+		} `json:"MediaListCollection"`
+	} `json:"data"`
+}
+
+type MediaListEntry struct {
+	ID       int    `json:"id"`
+	MediaID  int    `json:"mediaId"`
+	Status   string `json:"status"`
+	Progress int    `json:"progress"`
+	Media    Media  `json:"media"`
+}
+
+// Application-level structures
+type TrackerAccount struct {
+	UserID   int       `json:"user_id"`
+	Name     string    `json:"name"`
+	LinkedAt time.Time `json:"linked_at"`
+}
+
+type ListEntry struct {
+	MediaID  int    `json:"media_id"`
+	IDMal    int    `json:"id_mal"`
+	Title    string `json:"title"`
+	Image    string `json:"image"`
+	Color    string `json:"color"`
+	Status   string `json:"status"`
+	Progress int    `json:"progress"`
+	Episodes int    `json:"episodes"`
+}
@@ -0,0 +1,7 @@
+package notify
+
+// NopBackend drops all notifications. Used on platforms without native notifications support.
+type NopBackend struct{}
+
+func (NopBackend) Send(n Notification) error { return nil }
+func (NopBackend) Close() error              { return nil }
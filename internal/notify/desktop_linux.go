@@ -0,0 +1,58 @@
+//go:build linux
+
+package notify
+
+import (
+	"github.com/amatsagu/lumo"
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	notificationsDest  = "org.freedesktop.Notifications"
+	notificationsPath  = "/org/freedesktop/Notifications"
+	notificationsCall  = "org.freedesktop.Notifications.Notify"
+	notificationExpire = int32(-1) // Let notification server decide
+)
+
+// dbusBackend sends notifications through freedesktop notifications specification.
+type dbusBackend struct {
+	conn *dbus.Conn
+}
+
+// NewDesktopBackend connects to session D-Bus. It falls back to no-op backend when there is no session bus (e.g. headless servers).
+func NewDesktopBackend() Backend {
+	conn, err := dbus.ConnectSessionBus()
+	if err != nil {
+		lumo.Warn("Desktop notifications are disabled, failed to connect to session D-Bus: %v", err)
+		return NopBackend{}
+	}
+
+	return &dbusBackend{conn: conn}
+}
+
+func (b *dbusBackend) Send(n Notification) error {
+	hints := map[string]dbus.Variant{}
+	if c := category(n.Kind); c != "" {
+		hints["category"] = dbus.MakeVariant(c)
+	}
+
+	obj := b.conn.Object(notificationsDest, notificationsPath)
+	call := obj.Call(notificationsCall, 0, "Jubako", uint32(0), "video-x-generic", n.Title, n.Body, []string{}, hints, notificationExpire)
+	return call.Err
+}
+
+func (b *dbusBackend) Close() error {
+	return b.conn.Close()
+}
+
+// category maps notification kind to freedesktop notification category, if there is a matching one.
+func category(kind string) string {
+	switch kind {
+	case KindDownloadComplete:
+		return "transfer.complete"
+	case KindDownloadFailed:
+		return "transfer.error"
+	default:
+		return ""
+	}
+}
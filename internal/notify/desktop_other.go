@@ -0,0 +1,8 @@
+//go:build !linux
+
+package notify
+
+// NewDesktopBackend returns no-op backend, desktop notifications are only supported on Linux for now.
+func NewDesktopBackend() Backend {
+	return NopBackend{}
+}
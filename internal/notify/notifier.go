@@ -0,0 +1,111 @@
+package notify
+
+import (
+	"jubako/internal/events"
+	"sync"
+
+	"github.com/amatsagu/lumo"
+)
+
+// Kinds of notifications emitted by the application.
+const (
+	KindEpisodeAired     = "episode_aired"
+	KindDownloadComplete = "download_complete"
+	KindDownloadFailed   = "download_failed"
+	KindNetworkDown      = "network_down"
+	KindNetworkRestored  = "network_restored"
+	KindDiskLow          = "disk_low"
+)
+
+// EventType is the type of events published on the in-app event stream for every notification.
+const EventType = "notification"
+
+// Notifications waiting for slow backend. Once it's full, new ones are only published on the event stream.
+const queueSize = 32
+
+type Notification struct {
+	Kind  string `json:"kind"`
+	Title string `json:"title"`
+	Body  string `json:"body"`
+}
+
+// Backend delivers notifications outside of the application window (e.g. desktop notifications).
+type Backend interface {
+	Send(n Notification) error
+	Close() error
+}
+
+// Notifier delivers notifications both to the in-app event stream and to the native backend.
+// Backend is called from a single worker, so callers never wait for it.
+type Notifier struct {
+	bus     *events.Bus
+	backend Backend
+
+	queue  chan Notification
+	done   chan struct{} // Closed once worker delivered everything left in queue
+	closed bool
+	mu     sync.RWMutex // Protects closed, so nothing is queued after queue is closed
+}
+
+func NewNotifier(bus *events.Bus, backend Backend) *Notifier {
+	if backend == nil {
+		backend = NopBackend{}
+	}
+
+	n := &Notifier{
+		bus:     bus,
+		backend: backend,
+		queue:   make(chan Notification, queueSize),
+		done:    make(chan struct{}),
+	}
+
+	go n.deliver()
+	return n
+}
+
+// Notify publishes notification on the event stream right away and queues it for the backend.
+func (n *Notifier) Notify(notification Notification) {
+	lumo.Debug("Sending \"%s\" notification: %s", notification.Kind, notification.Title)
+	n.bus.Publish(EventType, notification)
+
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	if n.closed {
+		return
+	}
+
+	select {
+	case n.queue <- notification:
+	default:
+		lumo.Warn("Dropped \"%s\" desktop notification, because previous ones are still being delivered.", notification.Kind)
+	}
+}
+
+func (n *Notifier) deliver() {
+	defer close(n.done)
+
+	for notification := range n.queue {
+		if err := n.backend.Send(notification); err != nil {
+			werr := lumo.WrapError(err).Include("kind", notification.Kind)
+			lumo.Warn("Failed to deliver desktop notification: %v", werr)
+		}
+	}
+}
+
+// Close delivers notifications that are still queued, then closes the backend.
+func (n *Notifier) Close() {
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return
+	}
+	n.closed = true
+	close(n.queue)
+	n.mu.Unlock()
+
+	<-n.done
+	if err := n.backend.Close(); err != nil {
+		lumo.Warn("Failed to close notification backend: %v", err)
+	}
+}
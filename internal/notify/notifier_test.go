@@ -0,0 +1,114 @@
+package notify
+
+import (
+	"context"
+	"jubako/internal/events"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockBackend records all sent notifications. When block is set, every send waits until it's closed.
+type mockBackend struct {
+	block   chan struct{}
+	started chan struct{} // Receives once for every send that started
+	sent    []Notification
+	mu      sync.Mutex
+}
+
+func (m *mockBackend) Send(n Notification) error {
+	if m.started != nil {
+		m.started <- struct{}{}
+	}
+
+	if m.block != nil {
+		<-m.block
+	}
+
+	m.mu.Lock()
+	m.sent = append(m.sent, n)
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *mockBackend) Close() error { return nil }
+
+// Sent returns copy of all recorded notifications.
+func (m *mockBackend) Sent() []Notification {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Notification(nil), m.sent...)
+}
+
+func TestNotifyDeliversToBackendAndEventStream(t *testing.T) {
+	bus := events.NewBus(context.Background())
+	ch, unsubscribe := bus.Subscribe()
+	defer unsubscribe()
+
+	backend := &mockBackend{}
+	n := NewNotifier(bus, backend)
+
+	n.Notify(Notification{
+		Kind:  KindDownloadComplete,
+		Title: "Download complete",
+		Body:  "[SubsPlease] Gachiakuta - 03 (1080p).mkv",
+	})
+	n.Close()
+
+	sent := backend.Sent()
+	if len(sent) != 1 || sent[0].Kind != KindDownloadComplete {
+		t.Fatalf("unexpected notifications sent to backend: %+v", sent)
+	}
+
+	select {
+	case ev := <-ch:
+		if ev.Type != EventType {
+			t.Errorf("expected %q event, got %q", EventType, ev.Type)
+		}
+
+		if got, ok := ev.Data.(Notification); !ok || got.Title != "Download complete" {
+			t.Errorf("unexpected event data: %+v", ev.Data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected notification event on bus")
+	}
+}
+
+func TestNewNotifierFallsBackToNopBackend(t *testing.T) {
+	n := NewNotifier(events.NewBus(context.Background()), nil)
+	n.Notify(Notification{Kind: KindDownloadFailed, Title: "Download failed"})
+	n.Close()
+}
+
+func TestNotifyDoesNotWaitForSlowBackend(t *testing.T) {
+	backend := &mockBackend{block: make(chan struct{}), started: make(chan struct{}, queueSize+10)}
+	n := NewNotifier(events.NewBus(context.Background()), backend)
+
+	n.Notify(Notification{Kind: KindEpisodeAired, Title: "Gachiakuta - 03"})
+	<-backend.started
+
+	// Worker is stuck on the first one, so queue fills up and the rest is dropped
+	returned := make(chan struct{})
+	go func() {
+		for range queueSize + 5 {
+			n.Notify(Notification{Kind: KindEpisodeAired, Title: "Dandadan - 12"})
+		}
+		close(returned)
+	}()
+
+	select {
+	case <-returned:
+	case <-time.After(time.Second):
+		t.Fatal("expected notify to return while backend is busy")
+	}
+
+	close(backend.block)
+	n.Close()
+
+	if sent := len(backend.Sent()); sent != queueSize+1 {
+		t.Errorf("expected %d delivered notifications, got %d", queueSize+1, sent)
+	}
+
+	// Notifications after close only reach the event stream
+	n.Notify(Notification{Kind: KindDiskLow, Title: "Disk space is low"})
+}
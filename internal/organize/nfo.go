@@ -0,0 +1,149 @@
+package organize
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"jubako/internal/config"
+	"jubako/internal/model"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/amatsagu/lumo"
+)
+
+// Names of series files media servers look for in series folder.
+const (
+	showNFOFileName = "tvshow.nfo"
+	posterFileName  = "poster.jpg"
+)
+
+// maxPosterSize protects against downloading something else than cover image.
+const maxPosterSize = 10 << 20
+
+var htmlTags = regexp.MustCompile(`<[^>]*>`)
+
+type uniqueID struct {
+	Type    string `xml:"type,attr"`
+	Default bool   `xml:"default,attr,omitempty"`
+	Value   string `xml:",chardata"`
+}
+
+// showNFO is Kodi/Jellyfin description of whole series.
+type showNFO struct {
+	XMLName       xml.Name   `xml:"tvshow"`
+	Title         string     `xml:"title"`
+	OriginalTitle string     `xml:"originaltitle,omitempty"`
+	Plot          string     `xml:"plot,omitempty"`
+	Genres        []string   `xml:"genre"`
+	Rating        string     `xml:"rating,omitempty"`
+	UniqueIDs     []uniqueID `xml:"uniqueid"`
+}
+
+// episodeNFO is Kodi/Jellyfin description of single episode file.
+type episodeNFO struct {
+	XMLName   xml.Name `xml:"episodedetails"`
+	Title     string   `xml:"title"`
+	ShowTitle string   `xml:"showtitle"`
+	Season    int      `xml:"season"`
+	Episode   int      `xml:"episode"`
+}
+
+// writeMetadata writes episode .nfo next to organized file and, when template places it in series folder,
+// series .nfo with poster into that folder. Existing series files are kept, so user edits survive.
+// Metadata is optional, so failures are only logged.
+func (o *Organizer) writeMetadata(ctx context.Context, root, rel string, fields config.OrganizeFields, media *model.Media) {
+	dest := filepath.Join(root, rel)
+	episode := episodeNFO{
+		Title:     "Episode " + strconv.Itoa(fields.Episode),
+		ShowTitle: fields.SeriesTitle,
+		Season:    fields.Season,
+		Episode:   fields.Episode,
+	}
+
+	if err := writeNFO(strings.TrimSuffix(dest, filepath.Ext(dest))+".nfo", episode); err != nil {
+		lumo.Warn("Failed to write episode metadata of %s: %v", dest, err)
+	}
+
+	// Series folder is the top one, e.g. "Frieren" in "Frieren/Season 1/Frieren - S01E01.mkv"
+	segments := strings.Split(rel, string(filepath.Separator))
+	if len(segments) < 2 || media == nil {
+		return
+	}
+	seriesDir := filepath.Join(root, segments[0])
+
+	showPath := filepath.Join(seriesDir, showNFOFileName)
+	if _, err := os.Stat(showPath); errors.Is(err, os.ErrNotExist) {
+		show := showNFO{
+			Title:         fields.SeriesTitle,
+			OriginalTitle: media.Title.Native,
+			Plot:          strings.TrimSpace(htmlTags.ReplaceAllString(media.Description, "")),
+			Genres:        media.Genres,
+			UniqueIDs: []uniqueID{
+				{Type: "anilist", Default: true, Value: strconv.Itoa(media.ID)},
+			},
+		}
+
+		if media.AverageScore > 0 {
+			show.Rating = strconv.FormatFloat(float64(media.AverageScore)/10, 'f', 1, 64)
+		}
+
+		if media.IDMal > 0 {
+			show.UniqueIDs = append(show.UniqueIDs, uniqueID{Type: "mal", Value: strconv.Itoa(media.IDMal)})
+		}
+
+		if err := writeNFO(showPath, show); err != nil {
+			lumo.Warn("Failed to write series metadata of %s: %v", seriesDir, err)
+		}
+	}
+
+	posterPath := filepath.Join(seriesDir, posterFileName)
+	if _, err := os.Stat(posterPath); errors.Is(err, os.ErrNotExist) && media.CoverImage.Large != "" {
+		if err := o.downloadPoster(ctx, media.CoverImage.Large, posterPath); err != nil {
+			lumo.Warn("Failed to download poster of %s: %v", seriesDir, err)
+		}
+	}
+}
+
+func writeNFO(path string, v any) error {
+	data, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	data = append([]byte(xml.Header), data...)
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+func (o *Organizer) downloadPoster(ctx context.Context, url, path string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := o.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxPosterSize+1))
+	if err != nil {
+		return err
+	}
+
+	if len(data) > maxPosterSize {
+		return errors.New("poster is too large")
+	}
+	return os.WriteFile(path, data, 0644)
+}
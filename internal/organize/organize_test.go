@@ -0,0 +1,82 @@
+package organize
+
+import (
+	"context"
+	"jubako/internal/config"
+	"jubako/internal/model"
+	"jubako/internal/swarm"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseRelease(t *testing.T) {
+	cases := []struct {
+		name string
+		want Release
+	}{
+		{"[SubsPlease] Gachiakuta - 05 (1080p) [A1B2C3D4].mkv", Release{Title: "Gachiakuta", Season: 1, Episode: 5, Group: "SubsPlease"}},
+		{"[Erai-raws] Dandadan 2nd Season - 03 [1080p][Multiple Subtitle].mkv", Release{Title: "Dandadan", Season: 2, Episode: 3, Group: "Erai-raws"}},
+		{"[EMBER] Re Zero S3 - 07v2.mkv", Release{Title: "Re Zero", Season: 3, Episode: 7, Group: "EMBER"}},
+		{"Frieren.S01E12.1080p.WEB.H264-VARYG.mkv", Release{Title: "Frieren", Season: 1, Episode: 12, Group: "VARYG"}},
+		{"Kaiju No. 8 - S02E04.mp4", Release{Title: "Kaiju No. 8", Season: 2, Episode: 4}},
+		{"Sousou no Frieren Episode 28.mkv", Release{Title: "Sousou no Frieren", Season: 1, Episode: 28}},
+	}
+
+	for _, c := range cases {
+		if got := ParseRelease(c.name); got != c.want {
+			t.Errorf("%s:\n got: %+v\nwant: %+v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestOrganizeLinksEpisodeIntoSeriesFolder(t *testing.T) {
+	downloads, library := t.TempDir(), t.TempDir()
+	src := filepath.Join(downloads, "[SubsPlease] Dandadan - 03 (1080p) [A1B2C3D4].mkv")
+	if err := os.WriteFile(src, []byte("video"), 0644); err != nil {
+		t.Fatalf("failed to create download: %v", err)
+	}
+
+	var relocated string
+	o := NewOrganizer(func(hash, path string) error {
+		relocated = path
+		return nil
+	}, func(ctx context.Context, mediaID int) (*model.Media, error) {
+		m := &model.Media{ID: mediaID}
+		m.Title.Romaji = "Dandadan 2nd Season"
+		return m, nil
+	}, nil)
+
+	settings := config.DefaultOrganize()
+	settings.Mode = config.OrganizeHardlink
+	settings.Dir = library
+	settings.WriteNFO = true
+	o.SetSettings(config.Settings{DownloadDir: downloads, Organize: settings})
+
+	o.Completed(swarm.Download{InfoHash: "abc", Path: src, MediaID: 185660})
+
+	want := filepath.Join(library, "Dandadan", "Season 2", "Dandadan - S02E03 [SubsPlease].mkv")
+	if relocated != want {
+		t.Fatalf("expected download relocated to %s, got %q", want, relocated)
+	}
+
+	if _, err := os.Stat(src); err != nil {
+		t.Errorf("expected original file to stay for seeding, got %v", err)
+	}
+
+	if _, err := os.Stat(strings.TrimSuffix(want, ".mkv") + ".nfo"); err != nil {
+		t.Errorf("expected episode nfo, got %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(library, "Dandadan", showNFOFileName)); err != nil {
+		t.Errorf("expected series nfo, got %v", err)
+	}
+
+	// Mode doesn't match, so finished seeding must not touch anything
+	relocated = ""
+	o.Finished(swarm.Download{InfoHash: "abc", Path: src, MediaID: 185660})
+	if relocated != "" {
+		t.Errorf("expected no relocation in hardlink mode, got %s", relocated)
+	}
+}
@@ -0,0 +1,238 @@
+package organize
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"jubako/internal/config"
+	"jubako/internal/model"
+	"jubako/internal/swarm"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/amatsagu/lumo"
+)
+
+// DefaultTimeout for fetching series details and poster of single download.
+const DefaultTimeout = 30 * time.Second
+
+// MediaFunc returns AniList details of series, which download was linked to.
+type MediaFunc func(ctx context.Context, mediaID int) (*model.Media, error)
+
+// RelocateFunc records new path of organized download.
+type RelocateFunc func(hash, path string) error
+
+// Organizer renames finished downloads into series folder layout of media servers like Kodi or Jellyfin.
+type Organizer struct {
+	relocate RelocateFunc
+	media    MediaFunc
+	http     *http.Client
+
+	settings    config.Organize
+	downloadDir string
+	mu          sync.RWMutex // Protects settings & download dir
+
+	running sync.Mutex // Downloads of the same series share folder and metadata files, so only one is organized at a time
+}
+
+// NewOrganizer creates organizer. Nil httpClient falls back to default client with timeout.
+func NewOrganizer(relocate RelocateFunc, media MediaFunc, httpClient *http.Client) *Organizer {
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: DefaultTimeout}
+	}
+
+	return &Organizer{
+		relocate: relocate,
+		media:    media,
+		http:     httpClient,
+		settings: config.DefaultOrganize(),
+	}
+}
+
+// SetSettings applies organize settings to downloads finished from now on.
+func (o *Organizer) SetSettings(s config.Settings) {
+	o.mu.Lock()
+	o.settings = s.Organize
+	o.downloadDir = s.DownloadDir
+	o.mu.Unlock()
+}
+
+// Completed links freshly downloaded file into library, when hardlink mode is enabled.
+// Torrent keeps seeding from original file, so it must be called right after download completes.
+func (o *Organizer) Completed(d swarm.Download) {
+	o.run(d, config.OrganizeHardlink)
+}
+
+// Finished moves file of download that stopped seeding into library, when move mode is enabled.
+func (o *Organizer) Finished(d swarm.Download) {
+	o.run(d, config.OrganizeMove)
+}
+
+func (o *Organizer) run(d swarm.Download, mode string) {
+	o.mu.RLock()
+	settings, downloadDir := o.settings, o.downloadDir
+	o.mu.RUnlock()
+
+	if settings.Mode != mode || d.Path == "" {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+	defer cancel()
+
+	o.running.Lock()
+	defer o.running.Unlock()
+
+	dest, err := o.organize(ctx, d, settings, downloadDir)
+	if err != nil {
+		werr := lumo.WrapError(err).Include("info_hash", d.InfoHash).Include("path", d.Path)
+		lumo.Error("Failed to organize finished download: %v", werr)
+		return
+	}
+
+	if dest != "" {
+		lumo.Info("Organized \"%s\" into %s.", filepath.Base(d.Path), dest)
+	}
+}
+
+// organize places download into library and returns its new path, or empty string when download was skipped.
+func (o *Organizer) organize(ctx context.Context, d swarm.Download, settings config.Organize, downloadDir string) (string, error) {
+	release := ParseRelease(filepath.Base(d.Path))
+	fields := config.OrganizeFields{
+		SeriesTitle: release.Title,
+		Season:      release.Season,
+		Episode:     release.Episode,
+		Group:       release.Group,
+		Ext:         strings.TrimPrefix(filepath.Ext(d.Path), "."),
+	}
+
+	if d.Episode > 0 {
+		fields.Episode = d.Episode
+	}
+
+	var media *model.Media
+	if d.MediaID > 0 {
+		var err error
+		if media, err = o.media(ctx, d.MediaID); err != nil {
+			lumo.Warn("Failed to fetch details of media %d, falling back to release name: %v", d.MediaID, err)
+			media = nil
+		} else if title, season := splitSeason(mediaTitle(media)); title != "" {
+			// AniList lists every season as separate media, so the title may carry season itself
+			fields.SeriesTitle = title
+			if season > 0 {
+				fields.Season = season
+			}
+		}
+	}
+
+	if fields.SeriesTitle == "" || fields.Episode == 0 {
+		lumo.Debug("Not organizing \"%s\", as its series or episode is unknown.", filepath.Base(d.Path))
+		return "", nil
+	}
+
+	root := settings.Dir
+	if root == "" {
+		root = downloadDir
+	}
+
+	rel := settings.Path(fields)
+	dest := filepath.Join(root, rel)
+	if dest == filepath.Clean(d.Path) {
+		return "", nil
+	}
+
+	if _, err := os.Lstat(dest); err == nil {
+		return "", fmt.Errorf("%s already exists", dest)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return "", err
+	}
+
+	switch settings.Mode {
+	case config.OrganizeHardlink:
+		if err := os.Link(d.Path, dest); err != nil {
+			return "", fmt.Errorf("failed to link file (library must be on the same drive as downloads): %w", err)
+		}
+	case config.OrganizeMove:
+		if err := moveFile(d.Path, dest); err != nil {
+			return "", err
+		}
+		removeEmptyDirs(filepath.Dir(d.Path), downloadDir)
+	}
+
+	if err := o.relocate(d.InfoHash, dest); err != nil {
+		return "", fmt.Errorf("failed to record new path: %w", err)
+	}
+
+	if settings.WriteNFO {
+		o.writeMetadata(ctx, root, rel, fields, media)
+	}
+	return dest, nil
+}
+
+// mediaTitle prefers English title, same as the rest of the application.
+func mediaTitle(m *model.Media) string {
+	if m.Title.English != "" {
+		return m.Title.English
+	}
+	return m.Title.Romaji
+}
+
+// moveFile renames file. When rename is not possible (e.g. library is on external drive),
+// file is copied and source is removed only after copy fully succeeded.
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	if err := copyFile(src, dst, info.Mode().Perm()); err != nil {
+		_ = os.Remove(dst) // Didn't exist before, so only partial copy is removed
+		return fmt.Errorf("failed to copy %s: %w", src, err)
+	}
+	return os.Remove(src)
+}
+
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// removeEmptyDirs removes directories left empty by moved file (e.g. folder of multi-file torrent), up to root.
+func removeEmptyDirs(dir, root string) {
+	root = filepath.Clean(root)
+	for dir = filepath.Clean(dir); dir != root && strings.HasPrefix(dir, root+string(filepath.Separator)); dir = filepath.Dir(dir) {
+		if err := os.Remove(dir); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return // Not empty
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package organize
+
+import (
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	leadingGroup   = regexp.MustCompile(`^\[([^\]]+)\]`)
+	trailingGroup  = regexp.MustCompile(`-([A-Za-z0-9]+)$`) // Scene style, e.g. Show.S01E05.1080p.WEB-GROUP
+	bracketed      = regexp.MustCompile(`\[[^\]]*\]|\([^)]*\)`)
+	seasonEpisode  = regexp.MustCompile(`(?i)\bS(\d{1,2})\s?E(\d{1,4})(?:v\d)?\b`)
+	dashEpisode    = regexp.MustCompile(`\s-\s(\d{1,4})(?:v\d)?\b`)
+	labelEpisode   = regexp.MustCompile(`(?i)\b(?:Ep|Episode)\.?\s?(\d{1,4})\b`)
+	titleSeason    = regexp.MustCompile(`(?i)\s(?:S(\d{1,2})|Season\s(\d{1,2})|(\d{1,2})(?:st|nd|rd|th)\sSeason)$`)
+	titleSeparator = regexp.MustCompile(`[\s\-_.]+$`)
+)
+
+// Release holds what could be recognized from release file name.
+type Release struct {
+	Title   string
+	Season  int // 1 when name doesn't mention season
+	Episode int // 0 when not recognized
+	Group   string
+}
+
+// ParseRelease recognizes series title, season, episode and release group in usual fansub and scene file names,
+// e.g. "[SubsPlease] Gachiakuta - 05 (1080p) [A1B2C3D4].mkv" or "Frieren.S01E12.1080p.WEB.H264-VARYG.mkv".
+func ParseRelease(name string) Release {
+	name = strings.TrimSuffix(name, filepath.Ext(name))
+	r := Release{Season: 1}
+
+	if m := leadingGroup.FindStringSubmatch(name); m != nil {
+		r.Group = strings.TrimSpace(m[1])
+		name = name[len(m[0]):]
+	}
+
+	name = bracketed.ReplaceAllString(name, " ")
+	name = strings.ReplaceAll(name, "_", " ")
+	if !strings.Contains(strings.TrimSpace(name), " ") {
+		if r.Group == "" {
+			if m := trailingGroup.FindStringSubmatch(name); m != nil {
+				r.Group = m[1]
+				name = strings.TrimSuffix(name, m[0])
+			}
+		}
+		name = strings.ReplaceAll(name, ".", " ")
+	}
+	name = " " + strings.Join(strings.Fields(name), " ")
+
+	if m := seasonEpisode.FindStringSubmatchIndex(name); m != nil {
+		r.Season, _ = strconv.Atoi(name[m[2]:m[3]])
+		r.Episode, _ = strconv.Atoi(name[m[4]:m[5]])
+		name = name[:m[0]]
+	} else if m := dashEpisode.FindStringSubmatchIndex(name); m != nil {
+		r.Episode, _ = strconv.Atoi(name[m[2]:m[3]])
+		name = name[:m[0]]
+	} else if m := labelEpisode.FindStringSubmatchIndex(name); m != nil {
+		r.Episode, _ = strconv.Atoi(name[m[2]:m[3]])
+		name = name[:m[0]]
+	}
+
+	title, season := splitSeason(name)
+	r.Title = title
+	if season > 0 {
+		r.Season = season
+	}
+	return r
+}
+
+// splitSeason separates season marker from the end of series title, e.g. "Dandadan 2nd Season" or "Re Zero S3".
+// Returned season is 0 when title has no such marker.
+func splitSeason(title string) (string, int) {
+	title = titleSeparator.ReplaceAllString(title, "")
+	m := titleSeason.FindStringSubmatch(title)
+	if m == nil {
+		return strings.TrimSpace(title), 0
+	}
+
+	season, _ := strconv.Atoi(m[1] + m[2] + m[3])
+	return strings.TrimSpace(titleSeparator.ReplaceAllString(strings.TrimSuffix(title, m[0]), "")), season
+}
@@ -0,0 +1,65 @@
+package player
+
+import (
+	"os"
+	"os/exec"
+	"slices"
+
+	"github.com/amatsagu/lumo"
+)
+
+// Launch opens target (video file path or stream URL) in external video player and waits until it's closed.
+// Players are tried in order given by preferred list, followed by remaining known ones.
+func Launch(target string, preferred []string) {
+	type player struct {
+		Name string
+		Cmd  string
+		Args []string
+	}
+
+	players := []player{
+		{
+			"MPV", "mpv",
+			[]string{
+				"--fs",
+				"--force-window=immediate",
+				target,
+			},
+		},
+		{
+			"Haruna", "haruna",
+			[]string{target},
+		},
+		{
+			"VLC", "vlc",
+			[]string{"--fullscreen", target},
+		},
+	}
+
+	slices.SortStableFunc(players, func(a, b player) int {
+		return rank(preferred, a.Cmd) - rank(preferred, b.Cmd)
+	})
+
+	for _, p := range players {
+		_, err := exec.LookPath(p.Cmd)
+		if err == nil {
+			lumo.Info("Found %s as available video player.", p.Name)
+			cmd := exec.Command(p.Cmd, p.Args...)
+			cmd.Stderr = os.Stderr
+			if err := cmd.Run(); err != nil {
+				lumo.Warn("Detected that %s was closed.", p.Name)
+			}
+			return
+		}
+	}
+
+	lumo.Warn("Found no available video player to open %s.", target)
+}
+
+// rank returns position of player in preferred list, placing unknown ones at the end.
+func rank(preferred []string, cmd string) int {
+	if i := slices.Index(preferred, cmd); i >= 0 {
+		return i
+	}
+	return len(preferred)
+}
@@ -0,0 +1,244 @@
+package profile
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/amatsagu/lumo"
+)
+
+// Routes that work without selected profile - profile picker itself, sign in and feeds carrying their own context.
+var profileFreePrefixes = []string{"/api/profiles", "/api/auth/", "/api/timetable.ics", "/api/mal/callback"}
+
+// Middleware resolves profile from header (used by scripts) or cookie (set by profile picker).
+// Requests without any selection use default profile, as long as it isn't protected by pin.
+func (m *Manager) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.Header.Get(Header)
+		if token == "" {
+			if cookie, err := r.Cookie(Cookie); err == nil {
+				token = cookie.Value
+			}
+		}
+
+		if token == "" {
+			token = strconv.FormatInt(DefaultID, 10)
+		}
+
+		id, err := m.Resolve(token)
+		if err == nil {
+			next.ServeHTTP(w, r.WithContext(WithID(r.Context(), id)))
+			return
+		}
+
+		if !strings.HasPrefix(r.URL.Path, "/api/") || hasAnyPrefix(r.URL.Path, profileFreePrefixes) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !errors.Is(err, ErrUnknownProfile) && !errors.Is(err, ErrPINRequired) {
+			lumo.Error("Failed to resolve profile: %v", err)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]any{"error": "profile selection required", "profile_required": true})
+	})
+}
+
+type profileBody struct {
+	Name   *string `json:"name"`
+	Avatar *string `json:"avatar"`
+	PIN    *string `json:"pin"`
+}
+
+// ListHandler returns all profiles together with id of currently selected one (null when nothing is selected).
+func (m *Manager) ListHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	profiles, err := m.List()
+	if err != nil {
+		lumo.Error("Failed to read profiles: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to read profiles"})
+		return
+	}
+
+	var current *int64
+	if id, ok := selectedID(r.Context()); ok {
+		current = &id
+	}
+
+	json.NewEncoder(w).Encode(map[string]any{
+		"current":  current,
+		"profiles": profiles,
+	})
+}
+
+// CreateHandler adds profile from json body ({"name": "...", "avatar": "...", "pin": "1234"}).
+func (m *Manager) CreateHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var body profileBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Name == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "expected json body with profile name"})
+		return
+	}
+
+	var avatar, pin string
+	if body.Avatar != nil {
+		avatar = *body.Avatar
+	}
+	if body.PIN != nil {
+		pin = *body.PIN
+	}
+
+	p, err := m.Create(*body.Name, avatar, pin)
+	if writeProfileError(w, err) {
+		return
+	}
+
+	lumo.Info("Created profile \"%s\".", p.Name)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(p)
+}
+
+// UpdateHandler changes fields present in json body of profile from {id} path value.
+func (m *Manager) UpdateHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, ok := m.guardedProfile(w, r)
+	if !ok {
+		return
+	}
+
+	var body profileBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "expected json body"})
+		return
+	}
+
+	p, err := m.Update(id, body.Name, body.Avatar, body.PIN)
+	if writeProfileError(w, err) {
+		return
+	}
+
+	json.NewEncoder(w).Encode(p)
+}
+
+// DeleteHandler removes profile from {id} path value together with its history, subscriptions and tracker links.
+func (m *Manager) DeleteHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, ok := m.guardedProfile(w, r)
+	if !ok {
+		return
+	}
+
+	if writeProfileError(w, m.Delete(id)) {
+		return
+	}
+
+	fmt.Fprint(w, `{"status": "success"}`)
+}
+
+// SelectHandler switches to profile from {id} path value. Pin protected profiles need it in json body ({"pin": "1234"}).
+func (m *Manager) SelectHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || id <= 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid profile id"})
+		return
+	}
+
+	var body struct {
+		PIN string `json:"pin"`
+	}
+	json.NewDecoder(r.Body).Decode(&body)
+
+	token, err := m.Select(id, body.PIN)
+	if writeProfileError(w, err) {
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     Cookie,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   365 * 24 * 60 * 60,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	json.NewEncoder(w).Encode(map[string]any{
+		"token":   token,
+		"profile": id,
+	})
+}
+
+// guardedProfile parses {id} path value. Pin protected profiles can only be changed while being selected.
+func (m *Manager) guardedProfile(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || id <= 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid profile id"})
+		return 0, false
+	}
+
+	p, err := m.Get(id)
+	if writeProfileError(w, err) {
+		return 0, false
+	}
+
+	if current, ok := selectedID(r.Context()); p.HasPIN && (!ok || current != id) {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": "select profile with its pin first"})
+		return 0, false
+	}
+	return id, true
+}
+
+// writeProfileError writes response matching given error and reports whether there was any.
+func writeProfileError(w http.ResponseWriter, err error) bool {
+	var locked *LockedError
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, ErrUnknownProfile):
+		w.WriteHeader(http.StatusNotFound)
+	case errors.Is(err, ErrWrongPIN):
+		w.WriteHeader(http.StatusUnauthorized)
+	case errors.As(err, &locked):
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(locked.RetryAfter.Seconds()))))
+		w.WriteHeader(http.StatusTooManyRequests)
+	case errors.Is(err, ErrInvalidName), errors.Is(err, ErrInvalidPIN), errors.Is(err, ErrDefaultProfile):
+		w.WriteHeader(http.StatusBadRequest)
+	default:
+		lumo.Error("Failed to process profile request: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to process profile request"})
+		return true
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+	return true
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,48 @@
+package profile
+
+import (
+	"database/sql"
+
+	"github.com/amatsagu/lumo"
+)
+
+// MigrateTable rebuilds table created before profiles existed, assigning all of its rows to default profile.
+// Schema must (re)create table with profile_id column, while columns lists remaining columns copied from old table.
+// It's a no-op for tables that already have profile_id column.
+func MigrateTable(db *sql.DB, table, schema, columns string) error {
+	var migrated bool
+	err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM pragma_table_info(?) WHERE name = 'profile_id')", table).Scan(&migrated)
+	if err != nil || migrated {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	legacy := table + "_legacy"
+	if _, err := tx.Exec("ALTER TABLE " + table + " RENAME TO " + legacy); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(schema); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("INSERT INTO "+table+" (profile_id, "+columns+") SELECT ?, "+columns+" FROM "+legacy, DefaultID); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DROP TABLE " + legacy); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	lumo.Info("Migrated \"%s\" table to per-profile layout.", table)
+	return nil
+}
@@ -0,0 +1,377 @@
+package profile
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/amatsagu/lumo"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	Header = "X-Jubako-Profile"
+	Cookie = "jubako_profile"
+
+	// DefaultID is profile that owns all data created before profiles existed. It cannot be deleted.
+	DefaultID int64 = 1
+
+	// Wrong pins allowed before profile is locked. Every further lockout lasts twice as long, up to a day.
+	maxPINAttempts = 5
+	pinLockout     = time.Minute
+	maxPINLockout  = 24 * time.Hour
+)
+
+var (
+	ErrUnknownProfile = errors.New("unknown profile")
+	ErrInvalidName    = errors.New("profile name must be 1-32 characters long")
+	ErrInvalidPIN     = errors.New("pin must consist of 4-8 digits")
+	ErrWrongPIN       = errors.New("wrong pin")
+	ErrPINRequired    = errors.New("profile is protected by pin")
+	ErrDefaultProfile = errors.New("default profile cannot be deleted")
+)
+
+// LockedError is returned when profile is locked after too many wrong pins.
+type LockedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("too many wrong pins, try again in %v", e.RetryAfter.Round(time.Second))
+}
+
+type Profile struct {
+	ID        int64     `json:"id"`
+	Name      string    `json:"name"`
+	Avatar    string    `json:"avatar"`
+	HasPIN    bool      `json:"has_pin"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// DeleteHook is called after profile was removed, so subsystems can drop its data.
+type DeleteHook func(profileID int64)
+
+// Manager keeps household profiles. Each profile has its own watch history, subscriptions and tracker links,
+// while downloaded files and metadata stay shared.
+type Manager struct {
+	db     *sql.DB
+	secret []byte // Signs selection tokens of pin protected profiles
+
+	hooks []DeleteHook
+	mu    sync.RWMutex // Protects hooks
+
+	attempts   map[int64]*pinAttempts // Key: profile id
+	attemptsMu sync.Mutex
+	now        func() time.Time
+}
+
+// pinAttempts counts wrong pins entered since the last successful selection of profile.
+type pinAttempts struct {
+	failures    int
+	lockouts    int
+	lockedUntil time.Time
+}
+
+type contextKey struct{}
+
+func NewManager(db *sql.DB) *Manager {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS profiles (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		avatar TEXT NOT NULL DEFAULT '',
+		pin_hash TEXT,
+		created_at DATETIME NOT NULL
+	)`)
+	if err != nil {
+		lumo.Error("Failed to create profiles table: %v", err)
+	}
+
+	_, err = db.Exec("INSERT OR IGNORE INTO profiles (id, name, created_at) VALUES (?, 'Default', ?)", DefaultID, time.Now())
+	if err != nil {
+		lumo.Error("Failed to create default profile: %v", err)
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS profile_secret (
+		id INTEGER PRIMARY KEY CHECK (id = 1),
+		secret TEXT NOT NULL
+	)`)
+	if err != nil {
+		lumo.Error("Failed to create profile_secret table: %v", err)
+	}
+
+	return &Manager{
+		db:       db,
+		secret:   loadSecret(db),
+		attempts: make(map[int64]*pinAttempts),
+		now:      time.Now,
+	}
+}
+
+func loadSecret(db *sql.DB) []byte {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		lumo.Panic("Failed to generate profile secret: %v", err)
+	}
+
+	if _, err := db.Exec("INSERT OR IGNORE INTO profile_secret (id, secret) VALUES (1, ?)", hex.EncodeToString(buf)); err != nil {
+		lumo.Error("Failed to store profile secret: %v", err)
+		return buf
+	}
+
+	var secret string
+	if err := db.QueryRow("SELECT secret FROM profile_secret WHERE id = 1").Scan(&secret); err != nil {
+		lumo.Error("Failed to read profile secret: %v", err)
+		return buf
+	}
+
+	decoded, err := hex.DecodeString(secret)
+	if err != nil {
+		lumo.Error("Stored profile secret is malformed: %v", err)
+		return buf
+	}
+	return decoded
+}
+
+// FromContext returns id of profile selected for request, falling back to default profile.
+func FromContext(ctx context.Context) int64 {
+	if id, ok := selectedID(ctx); ok {
+		return id
+	}
+	return DefaultID
+}
+
+func selectedID(ctx context.Context) (int64, bool) {
+	id, ok := ctx.Value(contextKey{}).(int64)
+	return id, ok
+}
+
+// WithID returns context carrying given profile id.
+func WithID(ctx context.Context, id int64) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// OnDelete registers hook that will be called for every removed profile.
+func (m *Manager) OnDelete(hook DeleteHook) {
+	m.mu.Lock()
+	m.hooks = append(m.hooks, hook)
+	m.mu.Unlock()
+}
+
+func (m *Manager) List() ([]Profile, error) {
+	rows, err := m.db.Query("SELECT id, name, avatar, pin_hash IS NOT NULL, created_at FROM profiles ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	profiles := make([]Profile, 0)
+	for rows.Next() {
+		var p Profile
+		if err := rows.Scan(&p.ID, &p.Name, &p.Avatar, &p.HasPIN, &p.CreatedAt); err != nil {
+			return nil, err
+		}
+		profiles = append(profiles, p)
+	}
+	return profiles, rows.Err()
+}
+
+func (m *Manager) Get(id int64) (Profile, error) {
+	var p Profile
+	err := m.db.QueryRow("SELECT id, name, avatar, pin_hash IS NOT NULL, created_at FROM profiles WHERE id = ?", id).Scan(&p.ID, &p.Name, &p.Avatar, &p.HasPIN, &p.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Profile{}, ErrUnknownProfile
+	}
+	return p, err
+}
+
+// Create adds new profile. Empty pin leaves profile unprotected.
+func (m *Manager) Create(name, avatar, pin string) (Profile, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || utf8.RuneCountInString(name) > 32 {
+		return Profile{}, ErrInvalidName
+	}
+
+	pinHash, err := hashPIN(pin)
+	if err != nil {
+		return Profile{}, err
+	}
+
+	p := Profile{Name: name, Avatar: avatar, HasPIN: pinHash.Valid, CreatedAt: time.Now()}
+	res, err := m.db.Exec("INSERT INTO profiles (name, avatar, pin_hash, created_at) VALUES (?, ?, ?, ?)", p.Name, p.Avatar, pinHash, p.CreatedAt)
+	if err != nil {
+		return Profile{}, err
+	}
+
+	p.ID, err = res.LastInsertId()
+	return p, err
+}
+
+// Update changes provided fields of profile. Pin set to empty string removes protection.
+func (m *Manager) Update(id int64, name, avatar, pin *string) (Profile, error) {
+	p, err := m.Get(id)
+	if err != nil {
+		return Profile{}, err
+	}
+
+	if name != nil {
+		p.Name = strings.TrimSpace(*name)
+		if p.Name == "" || utf8.RuneCountInString(p.Name) > 32 {
+			return Profile{}, ErrInvalidName
+		}
+	}
+
+	if avatar != nil {
+		p.Avatar = *avatar
+	}
+
+	if _, err := m.db.Exec("UPDATE profiles SET name = ?, avatar = ? WHERE id = ?", p.Name, p.Avatar, id); err != nil {
+		return Profile{}, err
+	}
+
+	if pin != nil {
+		pinHash, err := hashPIN(*pin)
+		if err != nil {
+			return Profile{}, err
+		}
+
+		if _, err := m.db.Exec("UPDATE profiles SET pin_hash = ? WHERE id = ?", pinHash, id); err != nil {
+			return Profile{}, err
+		}
+		p.HasPIN = pinHash.Valid
+	}
+	return p, nil
+}
+
+// Delete removes profile and lets registered hooks drop its data.
+func (m *Manager) Delete(id int64) error {
+	if id == DefaultID {
+		return ErrDefaultProfile
+	}
+
+	res, err := m.db.Exec("DELETE FROM profiles WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrUnknownProfile
+	}
+
+	m.attemptsMu.Lock()
+	delete(m.attempts, id)
+	m.attemptsMu.Unlock()
+
+	m.mu.RLock()
+	hooks := m.hooks
+	m.mu.RUnlock()
+
+	for _, hook := range hooks {
+		hook(id)
+	}
+
+	lumo.Info("Deleted profile %d.", id)
+	return nil
+}
+
+// Select verifies pin (if profile has one) and returns token identifying profile in requests.
+func (m *Manager) Select(id int64, pin string) (string, error) {
+	var pinHash sql.NullString
+	err := m.db.QueryRow("SELECT pin_hash FROM profiles WHERE id = ?", id).Scan(&pinHash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrUnknownProfile
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if !pinHash.Valid {
+		return strconv.FormatInt(id, 10), nil
+	}
+
+	m.attemptsMu.Lock()
+	defer m.attemptsMu.Unlock()
+
+	// Locked profile doesn't even check the pin, otherwise guessing would just go on slower
+	a := m.attempts[id]
+	if a != nil && m.now().Before(a.lockedUntil) {
+		return "", &LockedError{RetryAfter: a.lockedUntil.Sub(m.now())}
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(pinHash.String), []byte(pin)) != nil {
+		if a == nil {
+			a = &pinAttempts{}
+			m.attempts[id] = a
+		}
+
+		a.failures++
+		if a.failures < maxPINAttempts {
+			return "", ErrWrongPIN
+		}
+
+		lockout := min(pinLockout<<a.lockouts, maxPINLockout)
+		a.failures = 0
+		a.lockouts++
+		a.lockedUntil = m.now().Add(lockout)
+		lumo.Warn("Locked profile %d for %v after %d wrong pins.", id, lockout, maxPINAttempts)
+		return "", &LockedError{RetryAfter: lockout}
+	}
+
+	delete(m.attempts, id)
+	return strconv.FormatInt(id, 10) + "." + m.sign(id, pinHash.String), nil
+}
+
+// Resolve returns profile id from token created by Select. Profiles without pin may be selected by their plain id.
+func (m *Manager) Resolve(token string) (int64, error) {
+	rawID, signature, signed := strings.Cut(token, ".")
+	id, err := strconv.ParseInt(rawID, 10, 64)
+	if err != nil {
+		return 0, ErrUnknownProfile
+	}
+
+	var pinHash sql.NullString
+	err = m.db.QueryRow("SELECT pin_hash FROM profiles WHERE id = ?", id).Scan(&pinHash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrUnknownProfile
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if pinHash.Valid && (!signed || !hmac.Equal([]byte(signature), []byte(m.sign(id, pinHash.String)))) {
+		return 0, ErrPINRequired
+	}
+	return id, nil
+}
+
+// Signature covers pin hash too, so changing pin invalidates previously issued tokens.
+func (m *Manager) sign(id int64, pinHash string) string {
+	mac := hmac.New(sha256.New, m.secret)
+	mac.Write([]byte(strconv.FormatInt(id, 10) + ":" + pinHash))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func hashPIN(pin string) (sql.NullString, error) {
+	if pin == "" {
+		return sql.NullString{}, nil
+	}
+
+	if len(pin) < 4 || len(pin) > 8 || strings.Trim(pin, "0123456789") != "" {
+		return sql.NullString{}, ErrInvalidPIN
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(pin), bcrypt.DefaultCost)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	return sql.NullString{String: string(hash), Valid: true}, nil
+}
@@ -0,0 +1,190 @@
+package profile
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	db, err := sql.Open("sqlite", t.TempDir()+"/data.db")
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestMigrateTableAssignsLegacyRowsToDefaultProfile(t *testing.T) {
+	db := openTestDB(t)
+
+	_, err := db.Exec(`CREATE TABLE subscriptions (media_id INTEGER PRIMARY KEY, title TEXT NOT NULL)`)
+	if err != nil {
+		t.Fatalf("failed to create legacy table: %v", err)
+	}
+
+	if _, err := db.Exec("INSERT INTO subscriptions (media_id, title) VALUES (178025, 'Gachiakuta'), (171018, 'Dandadan')"); err != nil {
+		t.Fatalf("failed to seed legacy table: %v", err)
+	}
+
+	schema := `CREATE TABLE IF NOT EXISTS subscriptions (
+		profile_id INTEGER NOT NULL,
+		media_id INTEGER NOT NULL,
+		title TEXT NOT NULL,
+		PRIMARY KEY (profile_id, media_id)
+	)`
+
+	for range 2 { // Second run must be a no-op
+		if err := MigrateTable(db, "subscriptions", schema, "media_id, title"); err != nil {
+			t.Fatalf("unexpected migration error: %v", err)
+		}
+	}
+
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM subscriptions WHERE profile_id = ?", DefaultID).Scan(&count); err != nil || count != 2 {
+		t.Fatalf("expected 2 rows owned by default profile, got %d (%v)", count, err)
+	}
+
+	// Same series can now be followed by another profile
+	if _, err := db.Exec("INSERT INTO subscriptions (profile_id, media_id, title) VALUES (2, 178025, 'Gachiakuta')"); err != nil {
+		t.Errorf("expected per-profile primary key, got %v", err)
+	}
+}
+
+func TestSelectAndResolvePinProtectedProfile(t *testing.T) {
+	m := NewManager(openTestDB(t))
+
+	if _, err := m.Resolve("1"); err != nil {
+		t.Fatalf("expected default profile to resolve by plain id, got %v", err)
+	}
+
+	p, err := m.Create("Hana", "", "2468")
+	if err != nil {
+		t.Fatalf("failed to create profile: %v", err)
+	}
+
+	if _, err := m.Create("Bad", "", "12ab"); err != ErrInvalidPIN {
+		t.Errorf("expected ErrInvalidPIN, got %v", err)
+	}
+
+	if _, err := m.Select(p.ID, "0000"); err != ErrWrongPIN {
+		t.Errorf("expected ErrWrongPIN, got %v", err)
+	}
+
+	token, err := m.Select(p.ID, "2468")
+	if err != nil {
+		t.Fatalf("unexpected select error: %v", err)
+	}
+
+	if id, err := m.Resolve(token); err != nil || id != p.ID {
+		t.Errorf("expected token to resolve to profile %d, got %d (%v)", p.ID, id, err)
+	}
+
+	if _, err := m.Resolve("2"); err != ErrPINRequired {
+		t.Errorf("expected plain id of protected profile to be rejected, got %v", err)
+	}
+
+	newPIN := "1357"
+	if _, err := m.Update(p.ID, nil, nil, &newPIN); err != nil {
+		t.Fatalf("failed to change pin: %v", err)
+	}
+
+	if _, err := m.Resolve(token); err != ErrPINRequired {
+		t.Errorf("expected token issued for old pin to be rejected, got %v", err)
+	}
+
+	if err := m.Delete(DefaultID); err != ErrDefaultProfile {
+		t.Errorf("expected ErrDefaultProfile, got %v", err)
+	}
+}
+
+func TestSelectLocksProfileAfterWrongPins(t *testing.T) {
+	m := NewManager(openTestDB(t))
+	now := time.Now()
+	m.now = func() time.Time { return now }
+
+	p, err := m.Create("Hana", "", "2468")
+	if err != nil {
+		t.Fatalf("failed to create profile: %v", err)
+	}
+
+	guess := func() error {
+		_, err := m.Select(p.ID, "0000")
+		return err
+	}
+
+	for i := 1; i < maxPINAttempts; i++ {
+		if err := guess(); err != ErrWrongPIN {
+			t.Fatalf("attempt %d: expected ErrWrongPIN, got %v", i, err)
+		}
+	}
+
+	var locked *LockedError
+	if err := guess(); !errors.As(err, &locked) || locked.RetryAfter != pinLockout {
+		t.Fatalf("expected lockout for %v, got %v", pinLockout, err)
+	}
+
+	// Even the right pin is refused while locked
+	if _, err := m.Select(p.ID, "2468"); !errors.As(err, &locked) {
+		t.Errorf("expected locked profile to refuse correct pin, got %v", err)
+	}
+
+	other, err := m.Create("Sora", "", "1357")
+	if err != nil {
+		t.Fatalf("failed to create profile: %v", err)
+	}
+
+	if _, err := m.Select(other.ID, "1357"); err != nil {
+		t.Errorf("expected other profile to stay unlocked, got %v", err)
+	}
+
+	// Next lockout lasts twice as long
+	now = now.Add(pinLockout)
+	for range maxPINAttempts {
+		err = guess()
+	}
+	if !errors.As(err, &locked) || locked.RetryAfter != 2*pinLockout {
+		t.Fatalf("expected lockout for %v, got %v", 2*pinLockout, err)
+	}
+
+	now = now.Add(2 * pinLockout)
+	if _, err := m.Select(p.ID, "2468"); err != nil {
+		t.Fatalf("expected correct pin to work after lockout, got %v", err)
+	}
+
+	// Successful selection starts counting from scratch
+	for range maxPINAttempts - 1 {
+		if err := guess(); err != ErrWrongPIN {
+			t.Fatalf("expected ErrWrongPIN after successful selection, got %v", err)
+		}
+	}
+}
+
+func TestSelectHandlerReportsLockout(t *testing.T) {
+	m := NewManager(openTestDB(t))
+	p, err := m.Create("Hana", "", "2468")
+	if err != nil {
+		t.Fatalf("failed to create profile: %v", err)
+	}
+
+	var rec *httptest.ResponseRecorder
+	for range maxPINAttempts {
+		r := httptest.NewRequest(http.MethodPost, "/api/profiles/select", strings.NewReader(`{"pin": "0000"}`))
+		r.SetPathValue("id", strconv.FormatInt(p.ID, 10))
+		rec = httptest.NewRecorder()
+		m.SelectHandler(rec, r)
+	}
+
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "60" {
+		t.Errorf("expected 429 with Retry-After, got %d %q (%s)", rec.Code, rec.Header().Get("Retry-After"), rec.Body)
+	}
+}
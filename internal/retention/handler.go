@@ -0,0 +1,101 @@
+package retention
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/amatsagu/lumo"
+)
+
+// RulesHandler returns retention rules of individual series.
+func (m *Manager) RulesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	rules, err := m.Rules()
+	if err != nil {
+		lumo.Error("Failed to read retention rules: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to read retention rules"})
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(rules); err != nil {
+		lumo.Error("Failed to encode retention rules: %v", err)
+	}
+}
+
+// SetRuleHandler stores rule of series from {media_id} path value, e.g. {"delete_after_days": 7, "keep_last": 0, "favorite": false}.
+func (m *Manager) SetRuleHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	mediaID, err := strconv.Atoi(r.PathValue("media_id"))
+	if err != nil || mediaID <= 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid media id"})
+		return
+	}
+
+	var rule SeriesRule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid retention rule"})
+		return
+	}
+
+	rule.MediaID = mediaID
+	if err := rule.Validate(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	if err := m.SetSeriesRule(rule); err != nil {
+		lumo.Error("Failed to store retention rule of media %d: %v", mediaID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to store retention rule"})
+		return
+	}
+
+	fmt.Fprint(w, `{"status": "success"}`)
+}
+
+// DeleteRuleHandler makes series from {media_id} path value follow global retention again.
+func (m *Manager) DeleteRuleHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	mediaID, err := strconv.Atoi(r.PathValue("media_id"))
+	if err != nil || mediaID <= 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid media id"})
+		return
+	}
+
+	if err := m.DeleteSeriesRule(mediaID); err != nil {
+		lumo.Error("Failed to delete retention rule of media %d: %v", mediaID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to delete retention rule"})
+		return
+	}
+
+	fmt.Fprint(w, `{"status": "success"}`)
+}
+
+// PreviewHandler returns episodes that would be deleted by next run of retention job, without deleting them.
+func (m *Manager) PreviewHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	candidates, err := m.Plan(time.Now())
+	if err != nil {
+		lumo.Error("Failed to plan retention: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to plan retention"})
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(candidates); err != nil {
+		lumo.Error("Failed to encode retention preview: %v", err)
+	}
+}
@@ -0,0 +1,236 @@
+package retention
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"errors"
+	"jubako/internal/config"
+	"jubako/internal/jobs"
+	"jubako/internal/swarm"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/amatsagu/lumo"
+)
+
+// JobName of the background job that deletes watched episodes according to retention rules.
+const JobName = "retention"
+
+const rulesSchema = `CREATE TABLE IF NOT EXISTS retention_rules (
+	media_id INTEGER PRIMARY KEY,
+	delete_after_days INTEGER NOT NULL,
+	keep_last INTEGER NOT NULL,
+	favorite INTEGER NOT NULL
+)`
+
+// DownloadsFunc returns all recorded downloads.
+type DownloadsFunc func() ([]swarm.Download, error)
+
+// DeleteFunc deletes file of download for given reason.
+type DeleteFunc func(hash, reason string) (*swarm.Download, error)
+
+// SeriesRule overrides global retention of single series.
+type SeriesRule struct {
+	MediaID int `json:"media_id"`
+	config.Retention
+	Favorite bool `json:"favorite"` // Episodes of favorite series are never deleted
+}
+
+// Candidate is downloaded episode that retention rules would delete.
+type Candidate struct {
+	InfoHash  string    `json:"info_hash"`
+	MediaID   int       `json:"media_id"`
+	Episode   int       `json:"episode"`
+	Path      string    `json:"path"`
+	Size      int64     `json:"size"`
+	WatchedAt time.Time `json:"watched_at"`
+	Reason    string    `json:"reason"`
+}
+
+// Manager applies retention rules to downloaded episodes.
+type Manager struct {
+	db        *sql.DB
+	downloads DownloadsFunc
+	watched   swarm.WatchedFunc
+	delete    DeleteFunc
+
+	global config.Retention
+	mu     sync.RWMutex // Protects global rule
+}
+
+func NewManager(db *sql.DB, downloads DownloadsFunc, watched swarm.WatchedFunc, delete DeleteFunc) *Manager {
+	if _, err := db.Exec(rulesSchema); err != nil {
+		lumo.Error("Failed to create retention_rules table: %v", err)
+	}
+
+	return &Manager{
+		db:        db,
+		downloads: downloads,
+		watched:   watched,
+		delete:    delete,
+	}
+}
+
+// SetRule changes retention of series without their own rule.
+func (m *Manager) SetRule(rule config.Retention) {
+	m.mu.Lock()
+	m.global = rule
+	m.mu.Unlock()
+}
+
+// NewJob returns recurring job that deletes episodes according to retention rules.
+func NewJob(m *Manager) jobs.Job {
+	return jobs.Job{
+		Name:     JobName,
+		Interval: time.Hour,
+		Run: func(ctx context.Context) error {
+			_, err := m.Apply(ctx)
+			return err
+		},
+	}
+}
+
+// Rules returns retention rules of individual series.
+func (m *Manager) Rules() ([]SeriesRule, error) {
+	rows, err := m.db.Query("SELECT media_id, delete_after_days, keep_last, favorite FROM retention_rules ORDER BY media_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := make([]SeriesRule, 0)
+	for rows.Next() {
+		var r SeriesRule
+		if err := rows.Scan(&r.MediaID, &r.DeleteAfterDays, &r.KeepLast, &r.Favorite); err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, rows.Err()
+}
+
+// SetSeriesRule stores rule that replaces global retention for series.
+func (m *Manager) SetSeriesRule(r SeriesRule) error {
+	if err := r.Validate(); err != nil {
+		return err
+	}
+
+	_, err := m.db.Exec("INSERT OR REPLACE INTO retention_rules (media_id, delete_after_days, keep_last, favorite) VALUES (?, ?, ?, ?)", r.MediaID, r.DeleteAfterDays, r.KeepLast, r.Favorite)
+	return err
+}
+
+// DeleteSeriesRule makes series follow global retention again.
+func (m *Manager) DeleteSeriesRule(mediaID int) error {
+	_, err := m.db.Exec("DELETE FROM retention_rules WHERE media_id = ?", mediaID)
+	return err
+}
+
+// Plan returns episodes that retention rules would delete now, without deleting anything.
+// Only complete downloads linked to watched series episode are ever deleted.
+func (m *Manager) Plan(now time.Time) ([]Candidate, error) {
+	rules, err := m.Rules()
+	if err != nil {
+		return nil, err
+	}
+
+	byMedia := make(map[int]SeriesRule, len(rules))
+	for _, r := range rules {
+		byMedia[r.MediaID] = r
+	}
+
+	m.mu.RLock()
+	global := m.global
+	m.mu.RUnlock()
+
+	downloads, err := m.downloads()
+	if err != nil {
+		return nil, err
+	}
+
+	series := make(map[int][]swarm.Download)
+	for _, d := range downloads {
+		if d.MediaID > 0 && d.Episode > 0 && (d.Status == swarm.StatusSeeding || d.Status == swarm.StatusFinished) {
+			series[d.MediaID] = append(series[d.MediaID], d)
+		}
+	}
+
+	candidates := make([]Candidate, 0)
+	for mediaID, episodes := range series {
+		rule := SeriesRule{Retention: global}
+		if r, ok := byMedia[mediaID]; ok {
+			rule = r
+		}
+
+		if rule.Favorite || !rule.Enabled() {
+			continue
+		}
+
+		// Newest episodes first, so everything past keep_last is older than the kept ones
+		slices.SortFunc(episodes, func(a, b swarm.Download) int {
+			return cmp.Compare(b.Episode, a.Episode)
+		})
+
+		for i, d := range episodes {
+			watchedAt, ok, err := m.watched(d.MediaID, d.Episode)
+			if err != nil {
+				return nil, err
+			}
+
+			if !ok {
+				continue
+			}
+
+			var reason string
+			switch {
+			case rule.KeepLast > 0 && i >= rule.KeepLast:
+				reason = swarm.DeletedOverKeepLimit
+			case rule.DeleteAfterDays > 0 && now.Sub(watchedAt) >= time.Duration(rule.DeleteAfterDays)*24*time.Hour:
+				reason = swarm.DeletedAfterWatched
+			default:
+				continue
+			}
+
+			candidates = append(candidates, Candidate{
+				InfoHash:  d.InfoHash,
+				MediaID:   d.MediaID,
+				Episode:   d.Episode,
+				Path:      d.Path,
+				Size:      d.Size,
+				WatchedAt: watchedAt,
+				Reason:    reason,
+			})
+		}
+	}
+
+	slices.SortFunc(candidates, func(a, b Candidate) int {
+		return cmp.Or(cmp.Compare(a.MediaID, b.MediaID), cmp.Compare(a.Episode, b.Episode))
+	})
+	return candidates, nil
+}
+
+// Apply deletes episodes selected by retention rules and returns the ones that were deleted.
+func (m *Manager) Apply(ctx context.Context) ([]Candidate, error) {
+	candidates, err := m.Plan(time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	deleted := make([]Candidate, 0, len(candidates))
+	var errs []error
+	for _, c := range candidates {
+		if err := ctx.Err(); err != nil {
+			return deleted, err
+		}
+
+		if _, err := m.delete(c.InfoHash, c.Reason); err != nil {
+			errs = append(errs, lumo.WrapError(err).Include("path", c.Path))
+			continue
+		}
+
+		lumo.Info("Deleted watched episode %d of media %d (%s).", c.Episode, c.MediaID, c.Reason)
+		deleted = append(deleted, c)
+	}
+	return deleted, errors.Join(errs...)
+}
@@ -0,0 +1,78 @@
+package retention
+
+import (
+	"context"
+	"database/sql"
+	"jubako/internal/config"
+	"jubako/internal/swarm"
+	"testing"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+func TestPlanFollowsSeriesAndGlobalRules(t *testing.T) {
+	db, err := sql.Open("sqlite", t.TempDir()+"/data.db")
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	now := time.Now()
+	downloads := []swarm.Download{
+		{InfoHash: "a1", MediaID: 1, Episode: 1, Status: swarm.StatusFinished},
+		{InfoHash: "a2", MediaID: 1, Episode: 2, Status: swarm.StatusSeeding},
+		{InfoHash: "a3", MediaID: 1, Episode: 3, Status: swarm.StatusFinished}, // Not watched yet
+		{InfoHash: "b1", MediaID: 2, Episode: 1, Status: swarm.StatusFinished},
+		{InfoHash: "b2", MediaID: 2, Episode: 2, Status: swarm.StatusFinished},
+		{InfoHash: "c1", MediaID: 3, Episode: 1, Status: swarm.StatusFinished},
+		{InfoHash: "d1", MediaID: 4, Episode: 1, Status: swarm.StatusDownloading},
+	}
+
+	watched := func(mediaID, episode int) (time.Time, bool, error) {
+		if mediaID == 1 && episode == 3 {
+			return time.Time{}, false, nil
+		}
+		if episode == 2 {
+			return now.Add(-time.Hour), true, nil
+		}
+		return now.Add(-10 * 24 * time.Hour), true, nil
+	}
+
+	var deleted []string
+	m := NewManager(db, func() ([]swarm.Download, error) { return downloads, nil }, watched, func(hash, reason string) (*swarm.Download, error) {
+		deleted = append(deleted, hash+":"+reason)
+		return nil, nil
+	})
+	m.SetRule(config.Retention{DeleteAfterDays: 7})
+
+	// Series 2 keeps only the newest episode and series 3 is favorite
+	if err := m.SetSeriesRule(SeriesRule{MediaID: 2, Retention: config.Retention{KeepLast: 1}}); err != nil {
+		t.Fatalf("failed to store series rule: %v", err)
+	}
+	if err := m.SetSeriesRule(SeriesRule{MediaID: 3, Retention: config.Retention{DeleteAfterDays: 1}, Favorite: true}); err != nil {
+		t.Fatalf("failed to store series rule: %v", err)
+	}
+
+	preview, err := m.Plan(now)
+	if err != nil {
+		t.Fatalf("unexpected plan error: %v", err)
+	}
+
+	if len(deleted) != 0 {
+		t.Fatalf("expected preview to delete nothing, got %v", deleted)
+	}
+
+	if len(preview) != 2 || preview[0].InfoHash != "a1" || preview[0].Reason != swarm.DeletedAfterWatched ||
+		preview[1].InfoHash != "b1" || preview[1].Reason != swarm.DeletedOverKeepLimit {
+		t.Fatalf("unexpected preview: %+v", preview)
+	}
+
+	if _, err := m.Apply(context.Background()); err != nil {
+		t.Fatalf("unexpected apply error: %v", err)
+	}
+
+	if len(deleted) != 2 || deleted[0] != "a1:"+swarm.DeletedAfterWatched || deleted[1] != "b1:"+swarm.DeletedOverKeepLimit {
+		t.Errorf("unexpected deletions: %v", deleted)
+	}
+}
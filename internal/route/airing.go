@@ -0,0 +1,84 @@
+package route
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"jubako/internal/jobs"
+	"jubako/internal/library"
+	"jubako/internal/notify"
+	"time"
+
+	"github.com/amatsagu/lumo"
+)
+
+const (
+	// AiringNotificationJob is name of the background job that notifies about newly aired episodes of followed series.
+	AiringNotificationJob = "airing-notifications"
+
+	// Episodes that aired earlier than that (e.g. while app was closed for days) are not announced anymore.
+	airingNotificationWindow = 6 * time.Hour
+)
+
+// NewAiringNotificationJob returns recurring job that sends notification for every aired episode of series followed by any profile.
+func NewAiringNotificationJob(db *sql.DB, lib *library.Library, notifier *notify.Notifier) jobs.Job {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS notified_airings (
+		schedule_id INTEGER PRIMARY KEY,
+		aired_at INTEGER NOT NULL
+	)`)
+	if err != nil {
+		lumo.Error("Failed to create notified_airings table: %v", err)
+	}
+
+	return jobs.Job{
+		Name:     AiringNotificationJob,
+		Interval: time.Minute,
+		Delay:    5 * time.Second,
+		Run: func(ctx context.Context) error {
+			return notifyAiredEpisodes(db, lib, notifier, time.Now())
+		},
+	}
+}
+
+func notifyAiredEpisodes(db *sql.DB, lib *library.Library, notifier *notify.Notifier, now time.Time) error {
+	subscribed, err := lib.SubscribedIDs(0)
+	if err != nil {
+		return err
+	}
+
+	if len(subscribed) == 0 {
+		return nil
+	}
+
+	anime, err := cachedAiringSchedules(db)
+	if err != nil {
+		return err
+	}
+
+	since := now.Add(-airingNotificationWindow).Unix()
+	for _, a := range anime {
+		if !subscribed[a.ID] || a.AirTime > now.Unix() || a.AirTime < since {
+			continue
+		}
+
+		res, err := db.Exec("INSERT OR IGNORE INTO notified_airings (schedule_id, aired_at) VALUES (?, ?)", a.ScheduleID, a.AirTime)
+		if err != nil {
+			return err
+		}
+
+		if n, _ := res.RowsAffected(); n == 0 {
+			continue // Already announced
+		}
+
+		notifier.Notify(notify.Notification{
+			Kind:  notify.KindEpisodeAired,
+			Title: a.Title,
+			Body:  fmt.Sprintf("Episode %d has just aired.", a.Episode),
+		})
+	}
+
+	if _, err := db.Exec("DELETE FROM notified_airings WHERE aired_at < ?", now.AddDate(0, 0, -30).Unix()); err != nil {
+		lumo.Warn("Failed to prune notified airings: %v", err)
+	}
+	return nil
+}
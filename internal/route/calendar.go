@@ -0,0 +1,297 @@
+package route
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"jubako/internal/library"
+	"jubako/internal/model"
+	"jubako/internal/profile"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/amatsagu/lumo"
+)
+
+// Used when AniList doesn't know episode length yet (typical for freshly announced series).
+const defaultEpisodeDuration = 24 * time.Minute
+
+var htmlTagPattern = regexp.MustCompile(`<[^>]*>`)
+
+// NewCalendarTokenHandler returns url of calendar feed (with its access token) that can be added to calendar apps.
+// Each profile has its own token, which also selects whose subscriptions the feed follows. POST request rotates
+// token of selected profile, invalidating urls it shared before.
+func NewCalendarTokenHandler(db *sql.DB) func(w http.ResponseWriter, r *http.Request) {
+	initCalendarTable(db)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		profileID := profile.FromContext(r.Context())
+		var token string
+		var err error
+		if r.Method == http.MethodPost {
+			token, err = rotateCalendarToken(db, profileID)
+		} else {
+			token, err = calendarToken(db, profileID)
+		}
+
+		if err != nil {
+			lumo.Error("Failed to prepare calendar token: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "failed to prepare calendar token"})
+			return
+		}
+
+		path := "/api/timetable.ics?token=" + token
+		json.NewEncoder(w).Encode(map[string]string{
+			"token":      token,
+			"url":        "http://" + r.Host + path,
+			"webcal_url": "webcal://" + r.Host + path,
+		})
+	}
+}
+
+// NewTimetableCalendarHandler renders all cached airing schedules as iCalendar (RFC 5545) feed.
+// Requires "token" query parameter, since calendar apps cannot send any other credentials.
+// With "subscribed=true" only series followed by profile that owns the token are included.
+func NewTimetableCalendarHandler(db *sql.DB, lib *library.Library) func(w http.ResponseWriter, r *http.Request) {
+	initCalendarTable(db)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		profileID, err := calendarProfile(db, r.URL.Query().Get("token"))
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "Invalid calendar token", http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			lumo.Error("Failed to read calendar token: %v", err)
+			http.Error(w, "Failed to read calendar token", http.StatusInternalServerError)
+			return
+		}
+
+		var subscribed map[int]bool
+		if r.URL.Query().Get("subscribed") == "true" {
+			subscribed, err = lib.SubscribedIDs(profileID)
+			if err != nil {
+				lumo.Error("Failed to read subscriptions: %v", err)
+				http.Error(w, "Failed to read subscriptions", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		anime, err := cachedAiringSchedules(db)
+		if err != nil {
+			lumo.Error("Failed to read cached timetables: %v", err)
+			http.Error(w, "Failed to read cached timetables", http.StatusInternalServerError)
+			return
+		}
+
+		if subscribed != nil {
+			filtered := make([]model.Anime, 0, len(anime))
+			for _, a := range anime {
+				if subscribed[a.ID] {
+					filtered = append(filtered, a)
+				}
+			}
+			anime = filtered
+		}
+
+		w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+		w.Header().Set("Content-Disposition", `inline; filename="jubako.ics"`)
+		w.Write([]byte(renderCalendar(anime, time.Now())))
+	}
+}
+
+// NewCalendarTokenCleanup returns profile.DeleteHook that revokes calendar feed of removed profile.
+func NewCalendarTokenCleanup(db *sql.DB) profile.DeleteHook {
+	initCalendarTable(db)
+
+	return func(profileID int64) {
+		if _, err := db.Exec("DELETE FROM calendar_tokens WHERE profile_id = ?", profileID); err != nil {
+			lumo.Error("Failed to revoke calendar token of deleted profile %d: %v", profileID, err)
+		}
+	}
+}
+
+func initCalendarTable(db *sql.DB) {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS calendar_tokens (
+		profile_id INTEGER PRIMARY KEY,
+		token TEXT NOT NULL UNIQUE,
+		created_at DATETIME NOT NULL
+	)`)
+	if err != nil {
+		lumo.Error("Failed to create calendar_tokens table: %v", err)
+	}
+
+	// Single token shared by all profiles used to exist, keep urls that use it working for default profile
+	var legacy int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'calendar_token'").Scan(&legacy); err != nil || legacy == 0 {
+		return
+	}
+
+	if _, err := db.Exec("INSERT OR IGNORE INTO calendar_tokens (profile_id, token, created_at) SELECT ?, token, created_at FROM calendar_token", profile.DefaultID); err != nil {
+		lumo.Error("Failed to migrate calendar token: %v", err)
+		return
+	}
+
+	if _, err := db.Exec("DROP TABLE calendar_token"); err != nil {
+		lumo.Error("Failed to drop legacy calendar_token table: %v", err)
+	}
+}
+
+// calendarToken returns current calendar token of profile, generating one on first use.
+func calendarToken(db *sql.DB, profileID int64) (string, error) {
+	var token string
+	err := db.QueryRow("SELECT token FROM calendar_tokens WHERE profile_id = ?", profileID).Scan(&token)
+	if errors.Is(err, sql.ErrNoRows) {
+		return rotateCalendarToken(db, profileID)
+	}
+	return token, err
+}
+
+func rotateCalendarToken(db *sql.DB, profileID int64) (string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	token := hex.EncodeToString(buf)
+	_, err := db.Exec("INSERT OR REPLACE INTO calendar_tokens (profile_id, token, created_at) VALUES (?, ?, ?)", profileID, token, time.Now())
+	return token, err
+}
+
+// calendarProfile returns id of profile that owns calendar token, or sql.ErrNoRows for unknown token.
+func calendarProfile(db *sql.DB, token string) (int64, error) {
+	if token == "" {
+		return 0, sql.ErrNoRows
+	}
+
+	var profileID int64
+	err := db.QueryRow("SELECT profile_id FROM calendar_tokens WHERE token = ?", token).Scan(&profileID)
+	return profileID, err
+}
+
+// cachedAiringSchedules merges all cached weeks, deduplicating episodes by airing schedule id.
+func cachedAiringSchedules(db *sql.DB) ([]model.Anime, error) {
+	rows, err := db.Query("SELECT data FROM anime_timetable_weeks ORDER BY week_start")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	seen := make(map[int]bool)
+	anime := make([]model.Anime, 0)
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+
+		var timetable model.Timetable
+		if err := json.Unmarshal([]byte(data), &timetable); err != nil {
+			return nil, err
+		}
+
+		for _, a := range timetable.Anime {
+			if a.ScheduleID == 0 || seen[a.ScheduleID] || a.IsAdult {
+				continue
+			}
+			seen[a.ScheduleID] = true
+			anime = append(anime, a)
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(anime, func(i, j int) bool { return anime[i].AirTime < anime[j].AirTime })
+	return anime, nil
+}
+
+func renderCalendar(anime []model.Anime, now time.Time) string {
+	var b strings.Builder
+	stamp := now.UTC().Format("20060102T150405Z")
+
+	writeLine(&b, "BEGIN:VCALENDAR")
+	writeLine(&b, "VERSION:2.0")
+	writeLine(&b, "PRODID:-//Jubako//Anime Timetable//EN")
+	writeLine(&b, "CALSCALE:GREGORIAN")
+	writeLine(&b, "METHOD:PUBLISH")
+	writeLine(&b, "X-WR-CALNAME:Jubako - Anime Timetable")
+
+	for _, a := range anime {
+		duration := defaultEpisodeDuration
+		if a.Duration > 0 {
+			duration = time.Duration(a.Duration) * time.Minute
+		}
+
+		start := time.Unix(a.AirTime, 0).UTC()
+		description := strings.TrimSpace(html.UnescapeString(htmlTagPattern.ReplaceAllString(a.Description, "")))
+
+		writeLine(&b, "BEGIN:VEVENT")
+		writeLine(&b, "UID:airing-"+strconv.Itoa(a.ScheduleID)+"@jubako")
+		writeLine(&b, "DTSTAMP:"+stamp)
+		writeLine(&b, "DTSTART:"+start.Format("20060102T150405Z"))
+		writeLine(&b, "DTEND:"+start.Add(duration).Format("20060102T150405Z"))
+		writeLine(&b, "SUMMARY:"+escapeText(fmt.Sprintf("%s - Episode %d", a.Title, a.Episode)))
+		if description != "" {
+			writeLine(&b, "DESCRIPTION:"+escapeText(description))
+		}
+		if len(a.Genres) > 0 {
+			categories := make([]string, len(a.Genres))
+			for i, genre := range a.Genres {
+				categories[i] = escapeText(genre)
+			}
+			writeLine(&b, "CATEGORIES:"+strings.Join(categories, ","))
+		}
+		writeLine(&b, "URL:https://anilist.co/anime/"+strconv.Itoa(a.ID))
+		writeLine(&b, "TRANSP:TRANSPARENT")
+		writeLine(&b, "END:VEVENT")
+	}
+
+	writeLine(&b, "END:VCALENDAR")
+	return b.String()
+}
+
+// escapeText escapes TEXT value according to RFC 5545 section 3.3.11.
+func escapeText(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, ";", `\;`)
+	s = strings.ReplaceAll(s, ",", `\,`)
+	s = strings.ReplaceAll(s, "\r\n", `\n`)
+	return strings.ReplaceAll(s, "\n", `\n`)
+}
+
+// writeLine writes content line folded at 75 octets (without splitting utf-8 characters) and terminated by CRLF.
+func writeLine(b *strings.Builder, line string) {
+	limit := 75
+
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && !isRuneStart(line[cut]) {
+			cut--
+		}
+
+		b.WriteString(line[:cut])
+		b.WriteString("\r\n ")
+		line = line[cut:]
+		limit = 74 // Leading space of continuation line counts too
+	}
+
+	b.WriteString(line)
+	b.WriteString("\r\n")
+}
+
+func isRuneStart(c byte) bool {
+	return c&0xC0 != 0x80
+}
@@ -0,0 +1,156 @@
+package route
+
+import (
+	"encoding/json"
+	"jubako/internal/library"
+	"jubako/internal/model"
+	"jubako/internal/profile"
+	"jubako/internal/testutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestRenderCalendar(t *testing.T) {
+	anime := []model.Anime{
+		{
+			ID:          178025,
+			ScheduleID:  401234,
+			Title:       "Gachiakuta",
+			AirTime:     1760889600,
+			Episode:     3,
+			Duration:    23,
+			Genres:      []string{"Action", "Fantasy"},
+			Description: "Rudo lives in the slums;<br>of a floating town, with <i>trash</i>.",
+		},
+		{
+			ID:         171018,
+			ScheduleID: 401235,
+			Title:      "Dandadan 2nd Season",
+			AirTime:    1760976000,
+			Episode:    12,
+		},
+	}
+
+	ics := renderCalendar(anime, time.Unix(1760800000, 0))
+
+	for _, line := range strings.Split(strings.TrimSuffix(ics, "\r\n"), "\r\n") {
+		if len(line) > 75 {
+			t.Errorf("line exceeds 75 octets: %q", line)
+		}
+	}
+
+	unfolded := strings.ReplaceAll(ics, "\r\n ", "")
+	expected := []string{
+		"BEGIN:VCALENDAR\r\n",
+		"UID:airing-401234@jubako\r\n",
+		"DTSTART:20251019T160000Z\r\n",
+		"DTEND:20251019T162300Z\r\n",
+		"SUMMARY:Gachiakuta - Episode 3\r\n",
+		"DESCRIPTION:Rudo lives in the slums\\;of a floating town\\, with trash.\r\n",
+		"CATEGORIES:Action,Fantasy\r\n",
+		"UID:airing-401235@jubako\r\n",
+		"DTEND:20251020T162400Z\r\n", // Default duration
+		"END:VCALENDAR\r\n",
+	}
+
+	for _, want := range expected {
+		if !strings.Contains(unfolded, want) {
+			t.Errorf("calendar is missing %q", want)
+		}
+	}
+
+	if got := strings.Count(ics, "BEGIN:VEVENT"); got != 2 {
+		t.Errorf("expected 2 events, got %d", got)
+	}
+}
+
+func TestWriteLineFoldsWithoutSplittingRunes(t *testing.T) {
+	var b strings.Builder
+	writeLine(&b, "SUMMARY:"+strings.Repeat("薬屋のひとりごと", 10))
+
+	for i, line := range strings.Split(strings.TrimSuffix(b.String(), "\r\n"), "\r\n") {
+		if len(line) > 75 {
+			t.Errorf("line %d exceeds 75 octets: %d", i, len(line))
+		}
+
+		if !utf8.ValidString(line) {
+			t.Errorf("line %d contains split utf-8 sequence", i)
+		}
+	}
+}
+
+func TestCalendarTokenSelectsProfile(t *testing.T) {
+	db := testutil.OpenDB(t)
+	lib := library.NewLibrary(db)
+	tokens := NewCalendarTokenHandler(db)
+	feed := NewTimetableCalendarHandler(db, lib)
+
+	initTimetableTable(db)
+	err := storeTimetable(db, &model.Timetable{
+		WeekStart: time.Unix(1760832000, 0),
+		WeekEnd:   time.Unix(1761436800, 0),
+		Anime: []model.Anime{
+			{ID: 178025, ScheduleID: 401234, Title: "Gachiakuta", AirTime: 1760889600, Episode: 3},
+			{ID: 171018, ScheduleID: 401235, Title: "Dandadan 2nd Season", AirTime: 1760976000, Episode: 12},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to seed timetable: %v", err)
+	}
+
+	if err := lib.Subscribe(2, 178025, "Gachiakuta"); err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+
+	tokenOf := func(method string, profileID int64) string {
+		r := httptest.NewRequest(method, "/api/calendar", nil)
+		w := httptest.NewRecorder()
+		tokens(w, r.WithContext(profile.WithID(r.Context(), profileID)))
+
+		var body map[string]string
+		if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+			t.Fatalf("failed to decode token response: %v", err)
+		}
+
+		if strings.Contains(body["url"], "profile=") {
+			t.Errorf("expected profile to be implied by token, got %q", body["url"])
+		}
+		return body["token"]
+	}
+
+	fetch := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		feed(w, httptest.NewRequest(http.MethodGet, "/api/timetable.ics?"+query, nil))
+		return w
+	}
+
+	first, second := tokenOf(http.MethodGet, 1), tokenOf(http.MethodGet, 2)
+	if first == second || tokenOf(http.MethodGet, 2) != second {
+		t.Fatalf("expected stable token per profile, got %q and %q", first, second)
+	}
+
+	// Profile parameter can't be used to read feed of someone else
+	w := fetch("token=" + second + "&subscribed=true&profile=1")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "airing-401234") || strings.Contains(w.Body.String(), "airing-401235") {
+		t.Errorf("expected subscriptions of token owner, got %d %q", w.Code, w.Body.String())
+	}
+
+	rotated := tokenOf(http.MethodPost, 2)
+	if w := fetch("token=" + second); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected rotated token to be rejected, got %d", w.Code)
+	}
+
+	for _, token := range []string{first, rotated} {
+		if w := fetch("token=" + token); w.Code != http.StatusOK {
+			t.Errorf("expected token %q to keep working, got %d", token, w.Code)
+		}
+	}
+
+	if w := fetch("token="); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected missing token to be rejected, got %d", w.Code)
+	}
+}
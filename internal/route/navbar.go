@@ -2,6 +2,7 @@ package route
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"net/http"
 )
@@ -13,13 +14,13 @@ func NewNavSearchHandler(db *sql.DB) func(w http.ResponseWriter, r *http.Request
 		if query == "" {
 			fmt.Println("Received empty search request")
 			w.WriteHeader(http.StatusBadRequest)
-			fmt.Fprint(w, `{"error": "no query provided"}`)
+			json.NewEncoder(w).Encode(map[string]string{"error": "no query provided"})
 			return
 		}
 
 		fmt.Printf("🔍 Search received: %s\n", query)
 
 		w.Header().Set("Content-Type", "application/json")
-		fmt.Fprintf(w, `{"status": "success", "received": "%s"}`, query)
+		json.NewEncoder(w).Encode(map[string]string{"status": "success", "received": query})
 	}
 }
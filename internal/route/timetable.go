@@ -1,110 +1,92 @@
 package route
 
 import (
-	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
+	"jubako/internal/anilist"
+	"jubako/internal/jobs"
 	"jubako/internal/model"
 	"net/http"
-	"sync"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/amatsagu/lumo"
 )
 
-const aniListAPI = "https://graphql.anilist.co"
-
-const timetableQuery = `
-query ($airingAt_greater: Int, $airingAt_lesser: Int, $page: Int) {
-  Page(page: $page, perPage: 50) {
-    pageInfo {
-      total
-      perPage
-      currentPage
-      lastPage
-      hasNextPage
-    }
-    airingSchedules(airingAt_greater: $airingAt_greater, airingAt_lesser: $airingAt_lesser, sort: TIME) {
-      id
-      airingAt
-      episode
-      media {
-        id
-        idMal
-        title {
-          romaji
-          english
-          native
-        }
-        coverImage {
-          large
-          color
-        }
-        description
-        genres
-        averageScore
-        isAdult
-      }
-    }
-  }
-}
-`
+const (
+	// TimetableRefreshJob is name of the background job that keeps anime timetable cache up to date.
+	TimetableRefreshJob = "anime-timetable-refresh"
 
-var (
-	isRefreshing     bool
-	refreshMutex     sync.Mutex
-	lastRefreshTried time.Time
+	timetableFreshness = 10 * time.Minute
+	maxWeekOffset      = 4
 )
 
-const maxRetries = 3
+// timetableQuery describes parsed query parameters of timetable endpoint.
+type timetableQuery struct {
+	location     *time.Location
+	weekStart    time.Time
+	weekEnd      time.Time
+	genres       []string
+	minScore     int
+	includeAdult bool
+}
 
-// NewAnimeTimetableHandler fetches information & returns a json that contains a list of anime series that are airing this week.
-func NewAnimeTimetableHandler(db *sql.DB) func(w http.ResponseWriter, r *http.Request) {
-	// Initialize cache table
-	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS anime_timetable (
-		id INTEGER PRIMARY KEY CHECK (id = 1),
-		data TEXT,
-		updated_at DATETIME
-	)`)
-	if err != nil {
-		lumo.Error("Failed to create anime_timetable table: %v", err)
+// NewTimetableRefreshJob returns recurring job that refreshes cached anime timetables.
+func NewTimetableRefreshJob(db *sql.DB, client *anilist.Client) jobs.Job {
+	return jobs.Job{
+		Name:     TimetableRefreshJob,
+		Interval: timetableFreshness,
+		Jitter:   30 * time.Second,
+		Cooldown: 5 * time.Minute,
+		Run: func(ctx context.Context) error {
+			return refreshTimetables(ctx, db, client)
+		},
 	}
+}
+
+// NewAnimeTimetableHandler fetches information & returns a json that contains a list of anime series that are airing in selected week.
+// Supported query parameters:
+//   - week: offset from current week (e.g. -1, 0, 1)
+//   - tz: IANA time zone used to determine week boundaries (defaults to local one)
+//   - genre: comma separated list of genres that all must be present
+//   - min_score: minimal average score (0-100)
+//   - include_adult: whether to include adult series (false by default)
+func NewAnimeTimetableHandler(db *sql.DB, client *anilist.Client, scheduler *jobs.Scheduler) func(w http.ResponseWriter, r *http.Request) {
+	initTimetableTable(db)
 
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 
-		var cachedData string
-		var updatedAt time.Time
-		err := db.QueryRow("SELECT data, updated_at FROM anime_timetable WHERE id = 1").Scan(&cachedData, &updatedAt)
-
-		if err == nil {
-			// If cache is still fresh (< 10 mins), serve it
-			if time.Since(updatedAt) < 10*time.Minute {
-				lumo.Debug("Serving fresh anime timetable from cache.")
-				w.Write([]byte(cachedData))
-				return
-			}
-
-			// If cache is stale (> 10 mins), serve it but trigger background refresh
-			lumo.Info("Serving stale anime timetable, triggering background refresh...")
-			w.Write([]byte(cachedData))
-
-			go triggerBackgroundRefresh(db)
+		q, err := parseTimetableQuery(r, time.Now())
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
 			return
 		}
 
-		// No cache at all - must wait for fresh data
-		lumo.Info("No cache found, fetching fresh anime timetable from AniList...")
-		timetable, err := fetchTimetableFromAniList()
+		timetable, stale, err := loadTimetable(r.Context(), db, client, q.weekStart, q.weekEnd)
 		if err != nil {
-			lumo.Error("Failed to fetch timetable from AniList: %v", err)
+			lumo.Error("Failed to load anime timetable: %v", err)
 			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprintf(w, `{"error": "failed to fetch timetable: %v"}`, err)
+			json.NewEncoder(w).Encode(map[string]string{"error": "failed to fetch timetable: " + err.Error()})
 			return
 		}
 
+		if stale {
+			// Stale cache is served anyway, while background refresh brings it up to date
+			lumo.Info("Serving stale anime timetable, triggering background refresh...")
+			if err := scheduler.Trigger(TimetableRefreshJob, false); err != nil && !errors.Is(err, jobs.ErrAlreadyRunning) && !errors.Is(err, jobs.ErrCoolingDown) && !errors.Is(err, jobs.ErrNotStarted) {
+				lumo.Warn("Failed to trigger anime timetable refresh: %v", err)
+			}
+		}
+
+		timetable.Timezone = q.location.String()
+		timetable.Anime = filterAnime(timetable.Anime, q)
+
 		jsonData, err := json.Marshal(timetable)
 		if err != nil {
 			lumo.Error("Failed to marshal timetable: %v", err)
@@ -112,156 +94,288 @@ func NewAnimeTimetableHandler(db *sql.DB) func(w http.ResponseWriter, r *http.Re
 			return
 		}
 
-		// Update cache
-		_, err = db.Exec("INSERT OR REPLACE INTO anime_timetable (id, data, updated_at) VALUES (1, ?, ?)", string(jsonData), time.Now())
-		if err != nil {
-			lumo.Error("Failed to update anime_timetable cache: %v", err)
-		}
-
 		w.Write(jsonData)
 	}
 }
 
-func triggerBackgroundRefresh(db *sql.DB) {
-	refreshMutex.Lock()
-	if isRefreshing || time.Since(lastRefreshTried) < 5*time.Minute {
-		refreshMutex.Unlock()
-		return
+func parseTimetableQuery(r *http.Request, now time.Time) (*timetableQuery, error) {
+	params := r.URL.Query()
+	q := &timetableQuery{location: time.Local}
+
+	if tz := params.Get("tz"); tz != "" {
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			return nil, fmt.Errorf("unknown time zone %q", tz)
+		}
+		q.location = loc
 	}
-	isRefreshing = true
-	lastRefreshTried = time.Now()
-	refreshMutex.Unlock()
 
-	defer func() {
-		refreshMutex.Lock()
-		isRefreshing = false
-		refreshMutex.Unlock()
-	}()
+	week := 0
+	if v := params.Get("week"); v != "" {
+		offset, err := strconv.Atoi(v)
+		if err != nil || offset < -maxWeekOffset || offset > maxWeekOffset {
+			return nil, fmt.Errorf("week must be a number between %d and %d", -maxWeekOffset, maxWeekOffset)
+		}
+		week = offset
+	}
 
-	timetable, err := fetchTimetableFromAniList()
-	if err != nil {
-		lumo.Error("Background refresh failed: %v", err)
-		return
+	if v := params.Get("min_score"); v != "" {
+		score, err := strconv.Atoi(v)
+		if err != nil || score < 0 || score > 100 {
+			return nil, errors.New("min_score must be a number between 0 and 100")
+		}
+		q.minScore = score
 	}
 
-	jsonData, err := json.Marshal(timetable)
-	if err != nil {
-		lumo.Error("Failed to marshal timetable in background: %v", err)
-		return
+	if v := params.Get("include_adult"); v != "" {
+		include, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, errors.New("include_adult must be a boolean")
+		}
+		q.includeAdult = include
 	}
 
-	_, err = db.Exec("INSERT OR REPLACE INTO anime_timetable (id, data, updated_at) VALUES (1, ?, ?)", string(jsonData), time.Now())
-	if err != nil {
-		lumo.Error("Failed to update cache in background: %v", err)
-	} else {
-		lumo.Info("Background refresh of anime timetable successful.")
+	for _, v := range params["genre"] {
+		for _, genre := range strings.Split(v, ",") {
+			if genre = strings.TrimSpace(genre); genre != "" {
+				q.genres = append(q.genres, genre)
+			}
+		}
 	}
+
+	q.weekStart, q.weekEnd = weekBounds(now, q.location, week)
+	return q, nil
 }
 
-func fetchTimetableFromAniList() (*model.Timetable, error) {
-	now := time.Now().UTC()
+// utcWeek returns start of UTC week that contains t. Cache holds whole UTC weeks, so every time zone shares them.
+func utcWeek(t time.Time) time.Time {
+	start, _ := weekBounds(t, time.UTC, 0)
+	return start
+}
+
+// weekBounds returns start (Monday midnight) and end of the week that is offset weeks away from now in given location.
+func weekBounds(now time.Time, loc *time.Location, offset int) (time.Time, time.Time) {
+	now = now.In(loc)
 	daysSinceMonday := int(now.Weekday()) - 1
 	if daysSinceMonday < 0 {
 		daysSinceMonday = 6 // Sunday
 	}
 
-	startOfWeek := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC).AddDate(0, 0, -daysSinceMonday)
-	start := startOfWeek.Unix()
-	end := start + (7 * 24 * 60 * 60)
+	start := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc).AddDate(0, 0, -daysSinceMonday+7*offset)
+	return start, start.AddDate(0, 0, 7)
+}
 
-	allAnime := make([]model.Anime, 0)
-	page := 1
+func filterAnime(list []model.Anime, q *timetableQuery) []model.Anime {
+	filtered := make([]model.Anime, 0, len(list))
+	for _, anime := range list {
+		if anime.IsAdult && !q.includeAdult {
+			continue
+		}
 
-	for {
-		lumo.Debug("Fetching page %d...", page)
-		resp, err := fetchPageWithRetry(int(start), int(end), page)
-		if err != nil {
-			return nil, err
+		if anime.AverageScore < q.minScore {
+			continue
 		}
 
-		schedules := resp.Data.Page.AiringSchedules
-		allAnime = append(allAnime, processSchedules(schedules)...)
+		if !hasGenres(anime.Genres, q.genres) {
+			continue
+		}
+		filtered = append(filtered, anime)
+	}
+	return filtered
+}
 
-		if !resp.Data.Page.PageInfo.HasNextPage || page >= 10 { // Safety cap at 10 pages
-			break
+func hasGenres(genres []string, required []string) bool {
+	for _, req := range required {
+		found := false
+		for _, genre := range genres {
+			if strings.EqualFold(genre, req) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
 		}
-		
-		page++
-		// Sequential delay to be super safe with rate limits
-		time.Sleep(500 * time.Millisecond)
 	}
+	return true
+}
 
-	lumo.Info("Successfully fetched %d total anime episodes for the week.", len(allAnime))
+func initTimetableTable(db *sql.DB) {
+	// Older versions cached just a single week, it's only a cache so it's safe to drop
+	if _, err := db.Exec("DROP TABLE IF EXISTS anime_timetable"); err != nil {
+		lumo.Warn("Failed to drop legacy anime_timetable table: %v", err)
+	}
 
-	return &model.Timetable{
-		UpdatedAt: time.Now(),
-		Anime:     allAnime,
-	}, nil
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS anime_timetable_weeks (
+		week_start INTEGER NOT NULL,
+		week_end INTEGER NOT NULL,
+		data TEXT,
+		updated_at DATETIME,
+		PRIMARY KEY (week_start, week_end)
+	)`)
+	if err != nil {
+		lumo.Error("Failed to create anime_timetable_weeks table: %v", err)
+	}
+
+	// Weeks used to be cached per time zone, those not starting on Monday midnight in UTC are never read again
+	monday := utcWeek(time.Unix(0, 0)).Unix()
+	if _, err := db.Exec("DELETE FROM anime_timetable_weeks WHERE (week_start - ?) % ? != 0", monday, 7*24*60*60); err != nil {
+		lumo.Warn("Failed to drop anime timetables cached per time zone: %v", err)
+	}
 }
 
-func fetchPageWithRetry(start, end, page int) (*model.AniListResponse, error) {
-	var lastErr error
-	for attempt := 0; attempt < maxRetries; attempt++ {
-		if attempt > 0 {
-			backoff := time.Duration(1<<attempt) * time.Second
-			lumo.Debug("Retrying page %d (attempt %d/%d) in %v...", page, attempt+1, maxRetries, backoff)
-			time.Sleep(backoff)
+// loadTimetable assembles timetable of given range from cached UTC weeks it overlaps, fetching weeks that are missing.
+// It also reports whether any of these weeks should be refreshed.
+func loadTimetable(ctx context.Context, db *sql.DB, client *anilist.Client, start, end time.Time) (*model.Timetable, bool, error) {
+	timetable := &model.Timetable{WeekStart: start, WeekEnd: end, Anime: make([]model.Anime, 0)}
+	stale := false
+
+	for week := utcWeek(start); week.Before(end); week = week.AddDate(0, 0, 7) {
+		cached, err := cachedTimetable(db, week)
+		if errors.Is(err, sql.ErrNoRows) {
+			lumo.Info("No cache found for week of %s, fetching fresh anime timetable from AniList...", week.Format(time.DateOnly))
+			if cached, err = fetchTimetableFromAniList(ctx, client, week, week.AddDate(0, 0, 7)); err == nil {
+				if err := storeTimetable(db, cached); err != nil {
+					lumo.Error("Failed to update anime timetable cache: %v", err)
+				}
+			}
 		}
 
-		resp, err := fetchPage(start, end, page)
-		if err == nil {
-			return resp, nil
+		if err != nil {
+			return nil, false, err
 		}
 
-		lastErr = err
-		if !isRateLimitError(err) {
-			return nil, err
+		if time.Since(cached.UpdatedAt) >= timetableFreshness {
+			stale = true
+		}
+
+		// Oldest week tells how old is the whole timetable
+		if timetable.UpdatedAt.IsZero() || cached.UpdatedAt.Before(timetable.UpdatedAt) {
+			timetable.UpdatedAt = cached.UpdatedAt
+		}
+
+		for _, anime := range cached.Anime {
+			if anime.AirTime >= start.Unix() && anime.AirTime < end.Unix() {
+				timetable.Anime = append(timetable.Anime, anime)
+			}
 		}
 	}
-	return nil, fmt.Errorf("failed after %d attempts: %v", maxRetries, lastErr)
+	return timetable, stale, nil
 }
 
-func isRateLimitError(err error) bool {
-	if err == nil {
-		return false
+// cachedTimetable returns cached timetable of UTC week starting at given time, or sql.ErrNoRows when it's not cached.
+func cachedTimetable(db *sql.DB, week time.Time) (*model.Timetable, error) {
+	var data string
+	if err := db.QueryRow("SELECT data FROM anime_timetable_weeks WHERE week_start = ?", week.Unix()).Scan(&data); err != nil {
+		return nil, err
+	}
+
+	var timetable model.Timetable
+	if err := json.Unmarshal([]byte(data), &timetable); err != nil {
+		return nil, fmt.Errorf("cached timetable is invalid: %w", err)
 	}
-	return bytes.Contains([]byte(err.Error()), []byte("429"))
+	return &timetable, nil
 }
 
-func fetchPage(start, end, page int) (*model.AniListResponse, error) {
-	variables := map[string]interface{}{
-		"airingAt_greater": start,
-		"airingAt_lesser":  end,
-		"page":             page,
+func storeTimetable(db *sql.DB, timetable *model.Timetable) error {
+	jsonData, err := json.Marshal(timetable)
+	if err != nil {
+		return err
 	}
 
-	payload := map[string]interface{}{
-		"query":     timetableQuery,
-		"variables": variables,
+	_, err = db.Exec("INSERT OR REPLACE INTO anime_timetable_weeks (week_start, week_end, data, updated_at) VALUES (?, ?, ?, ?)",
+		timetable.WeekStart.Unix(), timetable.WeekEnd.Unix(), string(jsonData), time.Now())
+	return err
+}
+
+// cachedWeeks returns range of UTC weeks that may be cached. Week offsets are limited in every time zone, but far
+// ones reach into one more UTC week.
+func cachedWeeks(now time.Time) (oldest, newest time.Time) {
+	current := utcWeek(now)
+	return current.AddDate(0, 0, -7*(maxWeekOffset+1)), current.AddDate(0, 0, 7*(maxWeekOffset+1))
+}
+
+// refreshTimetables prunes weeks out of reach, then refreshes current week and every stale cached week that is left.
+func refreshTimetables(ctx context.Context, db *sql.DB, client *anilist.Client) error {
+	now := time.Now()
+	oldest, newest := cachedWeeks(now)
+	if _, err := db.Exec("DELETE FROM anime_timetable_weeks WHERE week_start < ? OR week_start > ?", oldest.Unix(), newest.Unix()); err != nil {
+		lumo.Warn("Failed to prune old anime timetables: %v", err)
 	}
 
-	body, err := json.Marshal(payload)
+	current := utcWeek(now)
+	weeks := []time.Time{current}
+
+	rows, err := db.Query("SELECT week_start FROM anime_timetable_weeks WHERE updated_at < ?", now.Add(-timetableFreshness))
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	resp, err := http.Post(aniListAPI, "application/json", bytes.NewBuffer(body))
-	if err != nil {
-		return nil, err
+	for rows.Next() {
+		var start int64
+		if err := rows.Scan(&start); err != nil {
+			rows.Close()
+			return err
+		}
+
+		if week := time.Unix(start, 0).UTC(); !week.Equal(current) {
+			weeks = append(weeks, week)
+		}
 	}
-	defer resp.Body.Close()
+	rows.Close()
+
+	for _, week := range weeks {
+		timetable, err := fetchTimetableFromAniList(ctx, client, week, week.AddDate(0, 0, 7))
+		if err != nil {
+			return err
+		}
 
-	if resp.StatusCode != http.StatusOK {
-		respBody, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("AniList API returned status %d: %s", resp.StatusCode, string(respBody))
+		if err := storeTimetable(db, timetable); err != nil {
+			return err
+		}
 	}
 
-	var aniResp model.AniListResponse
-	if err := json.NewDecoder(resp.Body).Decode(&aniResp); err != nil {
-		return nil, err
+	lumo.Info("Background refresh of %d anime timetables successful.", len(weeks))
+	return nil
+}
+
+func fetchTimetableFromAniList(ctx context.Context, client *anilist.Client, weekStart, weekEnd time.Time) (*model.Timetable, error) {
+	start := weekStart.Unix()
+	end := weekEnd.Unix()
+
+	allAnime := make([]model.Anime, 0)
+	page := 1
+
+	for {
+		lumo.Debug("Fetching page %d...", page)
+		resp, err := client.AiringSchedules(ctx, start, end, page)
+		if err != nil {
+			return nil, err
+		}
+
+		schedules := resp.Data.Page.AiringSchedules
+		allAnime = append(allAnime, processSchedules(schedules)...)
+
+		if !resp.Data.Page.PageInfo.HasNextPage || page >= 10 { // Safety cap at 10 pages
+			break
+		}
+
+		page++
+		// Sequential delay to be super safe with rate limits
+		if err := sleepCtx(ctx, 500*time.Millisecond); err != nil {
+			return nil, err
+		}
 	}
 
-	return &aniResp, nil
+	lumo.Info("Successfully fetched %d total anime episodes for the week.", len(allAnime))
+
+	return &model.Timetable{
+		UpdatedAt: time.Now(),
+		WeekStart: weekStart,
+		WeekEnd:   weekEnd,
+		Anime:     allAnime,
+	}, nil
 }
 
 func processSchedules(schedules []model.AiringSchedule) []model.Anime {
@@ -274,16 +388,31 @@ func processSchedules(schedules []model.AiringSchedule) []model.Anime {
 
 		animeList = append(animeList, model.Anime{
 			ID:           s.Media.ID,
+			ScheduleID:   s.ID,
 			IDMal:        s.Media.IDMal,
 			Title:        title,
 			Image:        s.Media.CoverImage.Large,
 			Color:        s.Media.CoverImage.Color,
 			AirTime:      s.AiringAt,
 			Episode:      s.Episode,
+			Duration:     s.Media.Duration,
 			Genres:       s.Media.Genres,
 			AverageScore: s.Media.AverageScore,
 			Description:  s.Media.Description,
+			IsAdult:      s.Media.IsAdult,
 		})
 	}
 	return animeList
 }
+
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
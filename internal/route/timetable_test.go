@@ -0,0 +1,257 @@
+package route
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"jubako/internal/anilist"
+	"jubako/internal/model"
+	"jubako/internal/testutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"slices"
+	"testing"
+	"time"
+)
+
+func newFixtureAniList(t *testing.T) *anilist.Client {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload struct {
+			Variables struct {
+				Page int `json:"page"`
+			} `json:"variables"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Errorf("failed to decode request payload: %v", err)
+		}
+
+		data, err := os.ReadFile(fmt.Sprintf("testdata/airing_schedules_page%d.json", payload.Variables.Page))
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(data)
+	}))
+	t.Cleanup(srv.Close)
+
+	return anilist.NewClient(srv.URL, srv.Client())
+}
+
+func TestFetchTimetableFromAniListFollowsPages(t *testing.T) {
+	timetable, err := fetchTimetableFromAniList(context.Background(), newFixtureAniList(t), time.Unix(1760918400, 0), time.Unix(1761523200, 0))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(timetable.Anime) != 3 {
+		t.Fatalf("expected 3 anime from 2 pages, got %d", len(timetable.Anime))
+	}
+
+	last := timetable.Anime[2]
+	if last.Title != "The Apothecary Diaries Season 3" || last.Episode != 1 || last.IDMal != 60022 {
+		t.Errorf("unexpected anime from second page: %+v", last)
+	}
+}
+
+func TestFetchTimetableFromAniListMapsMedia(t *testing.T) {
+	timetable, err := fetchTimetableFromAniList(context.Background(), newFixtureAniList(t), time.Unix(1760918400, 0), time.Unix(1761523200, 0))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if got := timetable.Anime[1].Title; got != "Dandadan 2nd Season" {
+		t.Errorf("expected romaji fallback title, got %q", got)
+	}
+
+	if got := timetable.Anime[0].Color; got != "#e4a150" {
+		t.Errorf("expected cover color to be passed through, got %q", got)
+	}
+}
+
+func TestWeekBoundsRespectTimezone(t *testing.T) {
+	tokyo, _ := time.LoadLocation("Asia/Tokyo")
+	la, _ := time.LoadLocation("America/Los_Angeles")
+
+	// Sunday 20:00 UTC is already Monday in Tokyo, but still Sunday in Los Angeles
+	now := time.Date(2025, time.October, 19, 20, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		loc    *time.Location
+		offset int
+		want   time.Time
+	}{
+		{"utc", time.UTC, 0, time.Date(2025, time.October, 13, 0, 0, 0, 0, time.UTC)},
+		{"tokyo", tokyo, 0, time.Date(2025, time.October, 20, 0, 0, 0, 0, tokyo)},
+		{"los angeles", la, 0, time.Date(2025, time.October, 13, 0, 0, 0, 0, la)},
+		{"next week", time.UTC, 1, time.Date(2025, time.October, 20, 0, 0, 0, 0, time.UTC)},
+		{"previous week", time.UTC, -1, time.Date(2025, time.October, 6, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end := weekBounds(now, tt.loc, tt.offset)
+			if !start.Equal(tt.want) {
+				t.Errorf("expected week start %v, got %v", tt.want, start)
+			}
+
+			if !end.Equal(tt.want.AddDate(0, 0, 7)) {
+				t.Errorf("expected week end 7 days after start, got %v", end)
+			}
+		})
+	}
+}
+
+func TestParseTimetableQueryRejectsInvalidParams(t *testing.T) {
+	for _, query := range []string{"tz=Mars/Olympus", "week=12", "week=abc", "min_score=101", "include_adult=maybe"} {
+		r := httptest.NewRequest(http.MethodGet, "/api/anime-timetable?"+query, nil)
+		if _, err := parseTimetableQuery(r, time.Now()); err == nil {
+			t.Errorf("expected error for %q", query)
+		}
+	}
+}
+
+func TestFilterAnime(t *testing.T) {
+	params := url.Values{}
+	params.Set("genre", "action, fantasy")
+	params.Set("min_score", "70")
+
+	r := httptest.NewRequest(http.MethodGet, "/api/anime-timetable?"+params.Encode(), nil)
+	q, err := parseTimetableQuery(r, time.Now())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	list := []model.Anime{
+		{ID: 1, Genres: []string{"Action", "Fantasy"}, AverageScore: 79},
+		{ID: 2, Genres: []string{"Action", "Comedy"}, AverageScore: 84},
+		{ID: 3, Genres: []string{"Action", "Fantasy"}, AverageScore: 60},
+		{ID: 4, Genres: []string{"Action", "Fantasy"}, AverageScore: 90, IsAdult: true},
+	}
+
+	filtered := filterAnime(list, q)
+	if len(filtered) != 1 || filtered[0].ID != 1 {
+		t.Errorf("unexpected filtered list: %+v", filtered)
+	}
+
+	q.includeAdult = true
+	if filtered := filterAnime(list, q); len(filtered) != 2 {
+		t.Errorf("expected adult entry to be included, got %+v", filtered)
+	}
+}
+
+// seedWeek caches UTC week starting at given time with episodes airing at given times.
+func seedWeek(t *testing.T, db *sql.DB, start time.Time, updatedAt time.Time, airTimes ...int64) {
+	t.Helper()
+
+	timetable := &model.Timetable{UpdatedAt: updatedAt, WeekStart: start, WeekEnd: start.AddDate(0, 0, 7), Anime: []model.Anime{}}
+	for i, airTime := range airTimes {
+		timetable.Anime = append(timetable.Anime, model.Anime{ID: i + 1, ScheduleID: int(airTime), AirTime: airTime})
+	}
+
+	if err := storeTimetable(db, timetable); err != nil {
+		t.Fatalf("failed to seed timetable: %v", err)
+	}
+
+	if _, err := db.Exec("UPDATE anime_timetable_weeks SET updated_at = ? WHERE week_start = ?", updatedAt, start.Unix()); err != nil {
+		t.Fatalf("failed to age timetable: %v", err)
+	}
+}
+
+func TestLoadTimetableCombinesUTCWeeks(t *testing.T) {
+	db := testutil.OpenDB(t)
+	initTimetableTable(db)
+
+	stale := time.Now().Add(-time.Hour)
+	seedWeek(t, db, time.Date(2025, time.October, 13, 0, 0, 0, 0, time.UTC), stale, 1760882400, 1760889600)
+	seedWeek(t, db, time.Date(2025, time.October, 20, 0, 0, 0, 0, time.UTC), time.Now(), 1760976000, 1761494400)
+
+	// Week in Tokyo starts on Sunday 15:00 UTC, so it's made of both cached UTC weeks and no fetch is needed
+	tokyo, _ := time.LoadLocation("Asia/Tokyo")
+	start := time.Date(2025, time.October, 20, 0, 0, 0, 0, tokyo)
+	timetable, isStale, err := loadTimetable(context.Background(), db, nil, start, start.AddDate(0, 0, 7))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var airTimes []int64
+	for _, anime := range timetable.Anime {
+		airTimes = append(airTimes, anime.AirTime)
+	}
+
+	if want := []int64{1760889600, 1760976000}; !slices.Equal(airTimes, want) {
+		t.Errorf("expected episodes airing at %v, got %v", want, airTimes)
+	}
+
+	if !isStale || !timetable.UpdatedAt.Equal(stale) {
+		t.Errorf("expected timetable to be as old as its stale week, got %v (stale %v)", timetable.UpdatedAt, isStale)
+	}
+
+	var rows int
+	db.QueryRow("SELECT COUNT(*) FROM anime_timetable_weeks").Scan(&rows)
+	if rows != 2 {
+		t.Errorf("expected Tokyo week to reuse UTC weeks, got %d cached weeks", rows)
+	}
+}
+
+func TestRefreshTimetablesKeepsWeeksInReach(t *testing.T) {
+	db := testutil.OpenDB(t)
+	initTimetableTable(db)
+
+	current := utcWeek(time.Now())
+	hourAgo := time.Now().Add(-time.Hour)
+	week := func(offset int) time.Time { return current.AddDate(0, 0, 7*offset) }
+
+	seedWeek(t, db, week(-10), hourAgo)
+	seedWeek(t, db, week(-2), time.Now())
+	seedWeek(t, db, week(3), hourAgo)
+	seedWeek(t, db, week(12), hourAgo)
+
+	if err := refreshTimetables(context.Background(), db, newFixtureAniList(t)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	rows, err := db.Query("SELECT week_start, updated_at FROM anime_timetable_weeks ORDER BY week_start")
+	if err != nil {
+		t.Fatalf("failed to read cache: %v", err)
+	}
+	defer rows.Close()
+
+	var weeks []time.Time
+	for rows.Next() {
+		var start int64
+		var updatedAt time.Time
+		if err := rows.Scan(&start, &updatedAt); err != nil {
+			t.Fatalf("failed to read cache: %v", err)
+		}
+
+		weeks = append(weeks, time.Unix(start, 0).UTC())
+		if time.Since(updatedAt) >= timetableFreshness {
+			t.Errorf("expected week of %s to be refreshed", time.Unix(start, 0).UTC().Format(time.DateOnly))
+		}
+	}
+
+	if want := []time.Time{week(-2), week(0), week(3)}; !slices.EqualFunc(weeks, want, time.Time.Equal) {
+		t.Errorf("expected cached weeks %v, got %v", want, weeks)
+	}
+}
+
+func TestInitTimetableTableDropsWeeksOfTimeZones(t *testing.T) {
+	db := testutil.OpenDB(t)
+	initTimetableTable(db)
+
+	tokyo, _ := time.LoadLocation("Asia/Tokyo")
+	seedWeek(t, db, time.Date(2025, time.October, 20, 0, 0, 0, 0, tokyo), time.Now())
+	seedWeek(t, db, time.Date(2025, time.October, 20, 0, 0, 0, 0, time.UTC), time.Now())
+	initTimetableTable(db)
+
+	var rows, start int64
+	if err := db.QueryRow("SELECT COUNT(*), MAX(week_start) FROM anime_timetable_weeks").Scan(&rows, &start); err != nil || rows != 1 || start != 1760918400 {
+		t.Errorf("expected only UTC week to be kept, got %d weeks up to %d (%v)", rows, start, err)
+	}
+}
@@ -0,0 +1,98 @@
+package swarm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"jubako/internal/jobs"
+	"net/http"
+	"time"
+
+	"github.com/amatsagu/lumo"
+	"golang.org/x/time/rate"
+)
+
+// BandwidthJob is name of the background job that applies scheduled speed profiles.
+const BandwidthJob = "bandwidth-schedule"
+
+// minRateBurst must fit whole chunk (16 KiB) and single read from peer connection, otherwise limited transfers stall.
+const minRateBurst = 256 << 10
+
+// Limits of transfer speed in bytes per second, 0 means unlimited.
+type Limits struct {
+	Download int64  `json:"download"`
+	Upload   int64  `json:"upload"`
+	Profile  string `json:"profile,omitempty"` // Name of speed profile in effect, empty when global limits apply
+}
+
+// NewBandwidthJob returns recurring job that applies limits resolved for current time, so speed profiles
+// start and end on schedule.
+func NewBandwidthJob(s *SwarmClient, resolve func(now time.Time) Limits) jobs.Job {
+	return jobs.Job{
+		Name:     BandwidthJob,
+		Interval: time.Minute,
+		Run: func(ctx context.Context) error {
+			s.SetLimits(resolve(time.Now()))
+			return nil
+		},
+	}
+}
+
+// newRateLimiter returns unlimited limiter. It must exist from the start, since client can't attach one later.
+func newRateLimiter() *rate.Limiter {
+	return rate.NewLimiter(rate.Inf, minRateBurst)
+}
+
+func setRateLimit(l *rate.Limiter, bytesPerSecond int64) {
+	if bytesPerSecond <= 0 {
+		l.SetLimit(rate.Inf)
+		return
+	}
+
+	l.SetBurst(max(int(bytesPerSecond), minRateBurst))
+	l.SetLimit(rate.Limit(bytesPerSecond))
+}
+
+// SetLimits changes transfer speed limits shared by all torrents.
+func (s *SwarmClient) SetLimits(l Limits) {
+	s.mu.Lock()
+	changed := s.limits != l
+	s.limits = l
+	s.mu.Unlock()
+
+	if !changed {
+		return
+	}
+
+	setRateLimit(s.downloadLimiter, l.Download)
+	setRateLimit(s.uploadLimiter, l.Upload)
+
+	if l.Profile != "" {
+		lumo.Info("Applied \"%s\" speed profile (download: %s, upload: %s).", l.Profile, formatRate(l.Download), formatRate(l.Upload))
+	} else {
+		lumo.Info("Applied global speed limits (download: %s, upload: %s).", formatRate(l.Download), formatRate(l.Upload))
+	}
+}
+
+// Limits returns transfer speed limits currently in effect.
+func (s *SwarmClient) Limits() Limits {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.limits
+}
+
+// BandwidthHandler returns transfer speed limits currently in effect.
+func (s *SwarmClient) BandwidthHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(s.Limits()); err != nil {
+		lumo.Error("Failed to encode bandwidth limits: %v", err)
+	}
+}
+
+func formatRate(bytesPerSecond int64) string {
+	if bytesPerSecond <= 0 {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%.1f KiB/s", float64(bytesPerSecond)/1024)
+}
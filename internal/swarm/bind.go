@@ -0,0 +1,283 @@
+package swarm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/amatsagu/lumo"
+	"github.com/anacrolix/torrent"
+	"golang.org/x/net/proxy"
+)
+
+// NetworkEventType of event published when binding to network interface changes.
+const NetworkEventType = "network"
+
+const interfaceCheckInterval = 3 * time.Second
+
+var errInterfaceDown = errors.New("bound network interface is not available")
+
+// defaultMaxConns restores connection limit of torrents resumed after kill-switch.
+var defaultMaxConns = torrent.NewDefaultClientConfig().EstablishedConnsPerTorrent
+
+// NetworkStatus describes binding of torrent traffic to network interface.
+type NetworkStatus struct {
+	Interface  string `json:"interface,omitempty"` // Configured interface name or address, empty when traffic is not bound
+	Address    string `json:"address,omitempty"`   // Address all connections originate from
+	Available  bool   `json:"available"`
+	KillSwitch bool   `json:"kill_switch"`
+	Paused     bool   `json:"paused"` // Torrents don't transfer any data, because interface is not available
+}
+
+// NetworkHook is called whenever availability of bound network interface changes.
+type NetworkHook func(status NetworkStatus)
+
+// dialer covers both ways of dialing used by torrent client and proxy package.
+type dialer interface {
+	proxy.Dialer
+	proxy.ContextDialer
+}
+
+// blockedDialer refuses every connection, so nothing leaks while bound interface is gone.
+type blockedDialer struct{}
+
+func (blockedDialer) Dial(network, addr string) (net.Conn, error) {
+	return nil, errInterfaceDown
+}
+
+func (blockedDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return nil, errInterfaceDown
+}
+
+// resolveInterface returns address of network interface given by name or by one of its addresses.
+func resolveInterface(name string, ipv6 bool) (net.IP, error) {
+	if ip := net.ParseIP(name); ip != nil {
+		addrs, err := net.InterfaceAddrs()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+				return ip, nil
+			}
+		}
+		return nil, errInterfaceDown
+	}
+
+	iface, err := net.InterfaceByName(name)
+	if err != nil || iface.Flags&net.FlagUp == 0 {
+		return nil, errInterfaceDown
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+
+	var v6 net.IP
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+
+		if ip4 := ipnet.IP.To4(); ip4 != nil {
+			return ip4, nil // IPv4 is preferred, as most peers can't be reached over IPv6
+		}
+
+		if v6 == nil {
+			v6 = ipnet.IP
+		}
+	}
+
+	if v6 != nil && ipv6 {
+		return v6, nil
+	}
+	return nil, errInterfaceDown
+}
+
+// bindTo makes all client traffic originate from given address and returns dialer for peer connections.
+// Without address client still starts, but can't reach anyone until interface comes back.
+func bindTo(cfg *torrent.ClientConfig, ip net.IP) (d dialer, network string) {
+	cfg.DialForPeerConns = false
+
+	if ip == nil {
+		cfg.ListenHost = func(string) string { return "127.0.0.1" }
+		cfg.DisableIPv6 = true
+		cfg.NoDHT = true
+		cfg.NoDefaultPortForwarding = true
+		cfg.TrackerDialContext = blockedDialer{}.DialContext
+		cfg.HTTPDialContext = blockedDialer{}.DialContext
+		cfg.TrackerListenPacket = func(network, addr string) (net.PacketConn, error) {
+			return nil, errInterfaceDown
+		}
+		return blockedDialer{}, ""
+	}
+
+	network = "tcp4"
+	if ip.To4() != nil {
+		cfg.DisableIPv6 = true
+	} else {
+		cfg.DisableIPv4 = true
+		network = "tcp6"
+	}
+
+	bound := &net.Dialer{LocalAddr: &net.TCPAddr{IP: ip}}
+	cfg.ListenHost = func(string) string { return ip.String() }
+	cfg.TrackerDialContext = bound.DialContext
+	cfg.HTTPDialContext = bound.DialContext
+	cfg.TrackerListenPacket = func(network, addr string) (net.PacketConn, error) {
+		_, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			port = "0"
+		}
+		return net.ListenPacket(network, net.JoinHostPort(ip.String(), port))
+	}
+	return bound, network
+}
+
+// OnNetworkChange registers hook called when bound network interface disappears or comes back.
+func (s *SwarmClient) OnNetworkChange(hook NetworkHook) {
+	s.mu.Lock()
+	s.onNetwork = append(s.onNetwork, hook)
+	s.mu.Unlock()
+}
+
+// NetworkStatus returns current binding of torrent traffic.
+func (s *SwarmClient) NetworkStatus() NetworkStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.networkStatus()
+}
+
+func (s *SwarmClient) networkStatus() NetworkStatus {
+	status := NetworkStatus{
+		Interface:  s.network.Interface,
+		Available:  s.network.Interface == "" || s.bindIP != nil && s.available,
+		KillSwitch: s.network.KillSwitch,
+		Paused:     s.paused,
+	}
+
+	if s.bindIP != nil {
+		status.Address = s.bindIP.String()
+	}
+	return status
+}
+
+// watchInterface follows configured network interface until client is closed. Client is restarted when
+// interface comes back with different address and, with kill-switch enabled, torrents are paused while it's gone.
+func (s *SwarmClient) watchInterface() {
+	ticker := time.NewTicker(interfaceCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.checkInterface()
+		}
+	}
+}
+
+func (s *SwarmClient) checkInterface() {
+	s.mu.RLock()
+	network, bound, available := s.network, s.bindIP, s.available
+	s.mu.RUnlock()
+
+	if network.Interface == "" {
+		return
+	}
+
+	ip, _ := s.resolve(network.Interface, network.IPv6)
+	switch {
+	case ip == nil && available:
+		lumo.Warn("Network interface %s is not available anymore.", network.Interface)
+
+		s.mu.Lock()
+		s.available = false
+		s.mu.Unlock()
+
+		if network.KillSwitch {
+			s.pauseAll()
+		}
+	case ip != nil && ip.Equal(bound) && !available:
+		lumo.Info("Network interface %s is available again.", network.Interface)
+
+		s.mu.Lock()
+		s.available = true
+		s.mu.Unlock()
+		s.resumeAll()
+	case ip != nil && !ip.Equal(bound):
+		// Sockets are bound to previous address, so only new client can use the interface
+		lumo.Info("Network interface %s is available with %s address.", network.Interface, ip)
+		if err := s.Restart(network); err != nil {
+			lumo.Error("Failed to bind torrent client to %s: %v", network.Interface, err)
+		}
+	default:
+		return
+	}
+
+	status := s.NetworkStatus()
+	s.mu.RLock()
+	hooks := s.onNetwork
+	s.mu.RUnlock()
+
+	for _, hook := range hooks {
+		hook(status)
+	}
+}
+
+// pauseAll stops all data transfer and drops peer connections of every torrent.
+func (s *SwarmClient) pauseAll() {
+	s.mu.Lock()
+	s.paused = true
+	s.mu.Unlock()
+
+	torrents := s.torrentClient().Torrents()
+	for _, t := range torrents {
+		pauseTorrent(t)
+	}
+	lumo.Warn("Kill-switch paused %d torrents.", len(torrents))
+}
+
+func (s *SwarmClient) resumeAll() {
+	s.mu.Lock()
+	wasPaused := s.paused
+	diskPaused := s.diskPaused
+	s.paused = false
+	s.mu.Unlock()
+
+	if !wasPaused {
+		return
+	}
+
+	torrents := s.torrentClient().Torrents()
+	for _, t := range torrents {
+		if !diskPaused {
+			t.AllowDataDownload()
+		}
+		t.AllowDataUpload()
+		t.SetMaxEstablishedConns(defaultMaxConns)
+	}
+	lumo.Info("Resumed %d torrents paused by kill-switch.", len(torrents))
+}
+
+func pauseTorrent(t *torrent.Torrent) {
+	t.DisallowDataDownload()
+	t.DisallowDataUpload()
+	t.SetMaxEstablishedConns(0)
+}
+
+// NetworkStatusHandler returns current binding of torrent traffic to network interface.
+func (s *SwarmClient) NetworkStatusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(s.NetworkStatus()); err != nil {
+		lumo.Error("Failed to encode network status: %v", err)
+	}
+}
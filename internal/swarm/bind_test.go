@@ -0,0 +1,122 @@
+package swarm
+
+import (
+	"jubako/internal/config"
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+// interfaceStep changes address of bound interface ("" when it's gone) and describes state after the next check.
+type interfaceStep struct {
+	address   string
+	available bool
+	paused    bool
+	hooks     int // Network hooks called so far
+}
+
+func TestCheckInterfaceTransitions(t *testing.T) {
+	tests := []struct {
+		name       string
+		killSwitch bool
+		steps      []interfaceStep
+	}{
+		{
+			name:       "kill-switch pauses torrents while interface is gone",
+			killSwitch: true,
+			steps: []interfaceStep{
+				{address: "", available: false, paused: true, hooks: 1},
+				{address: "", available: false, paused: true, hooks: 1},
+				{address: "127.0.0.1", available: true, paused: false, hooks: 2},
+			},
+		},
+		{
+			name: "without kill-switch torrents keep running",
+			steps: []interfaceStep{
+				{address: "", available: false, paused: false, hooks: 1},
+				{address: "127.0.0.1", available: true, paused: false, hooks: 2},
+			},
+		},
+		{
+			name: "unchanged interface is left alone",
+			steps: []interfaceStep{
+				{address: "127.0.0.1", available: true, paused: false, hooks: 0},
+			},
+		},
+		{
+			name:       "new address binds restarted client and releases kill-switch",
+			killSwitch: true,
+			steps: []interfaceStep{
+				{address: "", available: false, paused: true, hooks: 1},
+				{address: "127.0.0.2", available: true, paused: false, hooks: 2},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestClient(t)
+
+			// Background watcher checks interface as well, so address is shared with it
+			var address atomic.Value
+			s.resolve = func(name string, ipv6 bool) (net.IP, error) {
+				if ip := net.ParseIP(address.Load().(string)); ip != nil {
+					return ip.To4(), nil
+				}
+				return nil, errInterfaceDown
+			}
+
+			address.Store("127.0.0.1")
+			if err := s.Restart(config.Network{Interface: "wg0", KillSwitch: tt.killSwitch}); err != nil {
+				t.Fatalf("failed to bind client: %v", err)
+			}
+
+			var hooks atomic.Int32
+			s.OnNetworkChange(func(status NetworkStatus) { hooks.Add(1) })
+
+			for i, step := range tt.steps {
+				address.Store(step.address)
+				s.checkInterface()
+
+				status := s.NetworkStatus()
+				if status.Available != step.available || status.Paused != step.paused {
+					t.Errorf("step %d: expected available=%v paused=%v, got available=%v paused=%v", i, step.available, step.paused, status.Available, status.Paused)
+				}
+
+				if step.available && status.Address != step.address {
+					t.Errorf("step %d: expected traffic bound to %s, got %q", i, step.address, status.Address)
+				}
+
+				if n := int(hooks.Load()); n != step.hooks {
+					t.Errorf("step %d: expected %d network hook calls, got %d", i, step.hooks, n)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckInterfaceIgnoresUnboundClient(t *testing.T) {
+	s := newTestClient(t)
+	s.resolve = func(name string, ipv6 bool) (net.IP, error) {
+		t.Errorf("expected no interface lookup, got one for %q", name)
+		return nil, errInterfaceDown
+	}
+
+	s.checkInterface()
+	if status := s.NetworkStatus(); !status.Available || status.Paused {
+		t.Errorf("expected unbound client to stay available, got %+v", status)
+	}
+}
+
+func TestMissingInterfaceStartsPaused(t *testing.T) {
+	s := newTestClient(t)
+	s.resolve = func(name string, ipv6 bool) (net.IP, error) { return nil, errInterfaceDown }
+
+	if err := s.Restart(config.Network{Interface: "wg0", KillSwitch: true}); err != nil {
+		t.Fatalf("expected client to start without interface, got %v", err)
+	}
+
+	if status := s.NetworkStatus(); status.Available || !status.Paused || status.Address != "" {
+		t.Errorf("expected paused client without address, got %+v", status)
+	}
+}
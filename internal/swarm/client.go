@@ -1,8 +1,13 @@
 package swarm
 
 import (
+	"crypto/sha1"
+	"database/sql"
+	"errors"
+	"fmt"
 	"io"
 	"jubako/internal/config"
+	"net"
 	"net/http"
 	"path/filepath"
 	"strings"
@@ -10,21 +15,81 @@ import (
 	"time"
 
 	"github.com/amatsagu/lumo"
-	alog "github.com/anacrolix/log"
+	"github.com/anacrolix/missinggo/v2/filecache"
 	"github.com/anacrolix/torrent"
 	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+	"golang.org/x/time/rate"
 )
 
+// ErrInvalidTorrent is returned for .torrent file that can't be read.
+var ErrInvalidTorrent = errors.New("invalid torrent file")
+
 type SwarmClient struct {
-	client          *torrent.Client
+	client    *torrent.Client
+	network   config.Network
+	restartMu sync.Mutex    // Serializes client restarts
+	done      chan struct{} // Closed once client is shut down
+
+	// Binding to network interface, see watchInterface
+	bindIP          net.IP
+	available       bool
+	resolve         func(name string, ipv6 bool) (net.IP, error) // Looks up address of interface, see resolveInterface
+	paused          bool
+	db              *sql.DB
 	activeDownloads int
+	closing         bool // Set once client is shutting down, so torrents closed by it are not reported as failures
+	seedPolicy      config.SeedPolicy
+	disk            config.Disk
+	trackers        config.Trackers
+	diskPaused      bool     // Downloads are paused until enough disk space is free, see watchDisk
+	interrupted     []string // Complete downloads active at unexpected shutdown, see VerifyInterrupted
+
+	// Torrents currently added to the client, needed to add them again when client restarts
+	// Key: InfoHash (HexString)
+	active map[string]*activeDownload
+
+	// Download directory and storage backend can be changed at runtime - torrents added afterwards use separate storage,
+	// while already running ones finish in their original location.
+	defaultDir   string
+	downloadDir  string
+	storageCfg   config.Storage
+	storages     map[storageKey]storage.ClientImplCloser
+	completions  map[string]storage.PieceCompletion // Key: directory
+	cacheDir     string
+	pieceCache   *filecache.Cache // Created on first stream, see streamStorage
+	pieceStorage storage.ClientImpl
+
+	limits          Limits
+	downloadLimiter *rate.Limiter
+	uploadLimiter   *rate.Limiter
 
 	// Registry tracks where files are located after they are "Dropped" from the client
 	// Key: InfoHash (HexString), Value: Absolute Path on Disk
 	readyFiles map[string]string
-	mu         sync.RWMutex // Protects the map
+	cancelled  map[string]bool // InfoHashes dropped on user request, so they are not reported as failures
+	mu         sync.RWMutex    // Protects the maps, hooks, download dir, storage, limits, disk, trackers & policy
+
+	onComplete []CompleteHook
+	onFinish   []FinishHook
+	onFailure  []FailureHook
+	onNetwork  []NetworkHook
+	onDisk     []DiskHook
+	onDelete   []DeleteHook
 }
 
+// CompleteHook is called once download of the video file finishes.
+type CompleteHook func(identifier string, details DownloadDetails)
+
+// FinishHook is called once completed torrent stops seeding and its files are no longer used by the client.
+type FinishHook func(d Download)
+
+// DeleteHook is called after files of complete download were deleted from disk.
+type DeleteHook func(d Download, reason string)
+
+// FailureHook is called when download could not be started or was interrupted (but not cancelled by user).
+type FailureHook func(identifier string, err error)
+
 type DownloadDetails struct {
 	InfoHash           string
 	Path               string
@@ -32,32 +97,263 @@ type DownloadDetails struct {
 	ActivePeers        int
 }
 
-func NewSwarmClient() *SwarmClient {
-	cfg := torrent.NewDefaultClientConfig()
-	cfg.DataDir = filepath.Join(config.APP_FILES_PATH, "downloads")
-	cfg.Debug = false
-	cfg.DisableIPv6 = true // Fix "network unreachable" spam
-	cfg.Logger = cfg.Logger.WithFilterLevel(alog.Disabled)
+// activeDownload holds everything needed to add torrent again after client restart.
+type activeDownload struct {
+	t          *torrent.Torrent
+	tr         *transfer
+	magnet     string
+	metaInfo   *metainfo.MetaInfo // Set when added from .torrent file or stored metainfo, so metadata doesn't have to be fetched again
+	identifier string
+	callback   func(data *DownloadDetails, err error)
+	storage    storage.ClientImpl
+	dir        string // Directory of the storage, downloads keep it across restarts
+	path       string // Existing video file the storage points at, when it's not in dir (see repair)
+	stream     bool   // Pieces are only fetched for streaming and kept in bounded cache
+	repair     bool   // Complete download fetching its bad pieces again, it's not reported as completed twice
+}
 
-	c, err := torrent.NewClient(cfg)
+// spec returns torrent spec needed to add download to the client.
+func (d *activeDownload) spec() (*torrent.TorrentSpec, error) {
+	if d.metaInfo != nil {
+		return torrent.TorrentSpecFromMetaInfoErr(d.metaInfo)
+	}
+	return torrent.TorrentSpecFromMagnetUri(d.magnet)
+}
+
+func NewSwarmClient(db *sql.DB, downloadDir, cacheDir string, network config.Network) *SwarmClient {
+	s := &SwarmClient{
+		db:              db,
+		interrupted:     initDownloadsTable(db),
+		done:            make(chan struct{}),
+		active:          make(map[string]*activeDownload),
+		defaultDir:      downloadDir,
+		downloadDir:     downloadDir,
+		storages:        make(map[storageKey]storage.ClientImplCloser),
+		completions:     make(map[string]storage.PieceCompletion),
+		cacheDir:        cacheDir,
+		storageCfg:      config.DefaultStorage(),
+		disk:            config.DefaultDisk(),
+		trackers:        config.DefaultTrackers(),
+		downloadLimiter: newRateLimiter(),
+		uploadLimiter:   newRateLimiter(),
+		readyFiles:      make(map[string]string),
+		cancelled:       make(map[string]bool),
+		resolve:         resolveInterface,
+	}
+
+	c, bindIP, err := s.newTorrentClient(network)
 	if err != nil {
 		werr := lumo.WrapError(err)
 		lumo.Panic("Failed to create SwarmClient: %v", werr)
 	}
 
-	return &SwarmClient{
-		client:     c,
-		readyFiles: make(map[string]string),
+	s.client = c
+	s.setNetwork(network, bindIP)
+	go s.watchInterface()
+	go s.watchDisk()
+	return s
+}
+
+// setNetwork records settings of newly created client. Caller must hold the lock.
+func (s *SwarmClient) setNetwork(network config.Network, bindIP net.IP) {
+	s.network = network
+	s.bindIP = bindIP
+	s.available = bindIP != nil
+
+	// Client without bound address can't transfer anything, so it's reported as paused even without kill-switch
+	s.paused = network.Interface != "" && bindIP == nil
+}
+
+// torrentClient returns current torrent client, which is replaced on every restart.
+func (s *SwarmClient) torrentClient() *torrent.Client {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.client
+}
+
+func (s *SwarmClient) track(d *activeDownload) {
+	s.mu.Lock()
+	s.active[d.tr.hash] = d
+	s.mu.Unlock()
+}
+
+// untrack forgets download and reports whether it was still tracked. Downloads taken over by restart are not.
+func (s *SwarmClient) untrack(d *activeDownload) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.active[d.tr.hash] != d {
+		return false
+	}
+	delete(s.active, d.tr.hash)
+	return true
+}
+
+// SetDownloadDir changes directory used by torrents added from now on.
+func (s *SwarmClient) SetDownloadDir(dir string) {
+	s.mu.Lock()
+	s.downloadDir = dir
+	s.mu.Unlock()
+	lumo.Debug("Swarm download directory changed to: %s", dir)
+}
+
+// Close stops all torrents and releases all storages.
+func (s *SwarmClient) Close() {
+	s.restartMu.Lock()
+	defer s.restartMu.Unlock()
+
+	s.mu.Lock()
+	s.closing = true
+	c := s.client
+	s.mu.Unlock()
+
+	close(s.done)
+	c.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, st := range s.storages {
+		if err := st.Close(); err != nil {
+			lumo.Warn("Failed to close %s storage for %s: %v", key.backend, key.dir, err)
+		}
+	}
+	clear(s.storages)
+
+	for dir, pc := range s.completions {
+		if err := pc.Close(); err != nil {
+			lumo.Warn("Failed to close piece completion for %s: %v", dir, err)
+		}
 	}
+	clear(s.completions)
+}
+
+// OnComplete registers hook called after every successfully finished download.
+func (s *SwarmClient) OnComplete(hook CompleteHook) {
+	s.mu.Lock()
+	s.onComplete = append(s.onComplete, hook)
+	s.mu.Unlock()
+}
+
+// OnFinish registers hook called after every download that finished seeding.
+func (s *SwarmClient) OnFinish(hook FinishHook) {
+	s.mu.Lock()
+	s.onFinish = append(s.onFinish, hook)
+	s.mu.Unlock()
 }
 
+// OnDelete registers hook called after every deleted download.
+func (s *SwarmClient) OnDelete(hook DeleteHook) {
+	s.mu.Lock()
+	s.onDelete = append(s.onDelete, hook)
+	s.mu.Unlock()
+}
+
+// OnFailure registers hook called after every failed download.
+func (s *SwarmClient) OnFailure(hook FailureHook) {
+	s.mu.Lock()
+	s.onFailure = append(s.onFailure, hook)
+	s.mu.Unlock()
+}
+
+// AddMagnet starts downloading largest video file of magnet torrent. Callback may be nil.
 func (s *SwarmClient) AddMagnet(magnet string, identifier string, callback func(data *DownloadDetails, err error)) {
+	_, _ = s.addMagnet(magnet, identifier, false, callback)
+}
+
+// StreamMagnet adds magnet torrent without downloading it. Its video is fetched only as it's streamed,
+// into bounded cache shared by all streamed torrents, so nothing is kept in the library. Callback may be nil.
+func (s *SwarmClient) StreamMagnet(magnet string, identifier string, callback func(data *DownloadDetails, err error)) {
+	_, _ = s.addMagnet(magnet, identifier, true, callback)
+}
+
+func (s *SwarmClient) addMagnet(magnet string, identifier string, stream bool, callback func(data *DownloadDetails, err error)) (string, error) {
 	if identifier == "" {
 		identifier = magnet
 	}
 
+	st, dir, err := s.storage(stream)
+	if err != nil {
+		return "", fmt.Errorf("failed to open storage: %w", err)
+	}
+
+	// Metadata of torrent added before is already stored, so it doesn't have to be fetched from peers again
+	var mi *metainfo.MetaInfo
+	if m, err := metainfo.ParseMagnetV2Uri(magnet); err == nil && m.InfoHash.Ok {
+		mi, _ = s.storedMetaInfo(m.InfoHash.Value.HexString(), magnet)
+	}
+
 	lumo.Debug("Added \"%s\" magnet to swarm queue.", identifier)
-	t, err := s.client.AddMagnet(magnet)
+	return s.add(&activeDownload{magnet: magnet, metaInfo: mi, identifier: identifier, callback: callback, storage: st, dir: dir, stream: stream})
+}
+
+// AddTorrentFile starts downloading largest video file of torrent described by .torrent metainfo, or only prepares
+// it for streaming (see StreamMagnet). Unlike magnet, metadata is already known, so invalid file is reported right away.
+// Callback may be nil.
+func (s *SwarmClient) AddTorrentFile(r io.Reader, identifier string, stream bool, callback func(data *DownloadDetails, err error)) (string, error) {
+	mi, err := metainfo.Load(r)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrInvalidTorrent, err)
+	}
+
+	info, err := mi.UnmarshalInfo()
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrInvalidTorrent, err)
+	}
+
+	// Client rejects such info only while adding torrent, where it can't be told apart from other failures
+	// Length of v2 torrents doesn't count padding of v1 pieces, so only their hashes are checked
+	if len(info.Pieces)%sha1.Size != 0 || info.PieceLength <= 0 ||
+		!info.HasV2() && (info.TotalLength()+info.PieceLength-1)/info.PieceLength != int64(info.NumPieces()) {
+		return "", fmt.Errorf("%w: piece hashes don't match length of files", ErrInvalidTorrent)
+	}
+
+	// Magnet is still recorded, so download can be recognized and added again without the file
+	m, err := mi.MagnetV2()
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrInvalidTorrent, err)
+	}
+
+	if identifier == "" {
+		identifier = info.BestName()
+	}
+
+	st, dir, err := s.storage(stream)
+	if err != nil {
+		return "", fmt.Errorf("failed to open storage: %w", err)
+	}
+
+	lumo.Debug("Added \"%s\" torrent file to swarm queue.", identifier)
+	return s.add(&activeDownload{magnet: m.String(), metaInfo: mi, identifier: identifier, callback: callback, storage: st, dir: dir, stream: stream})
+}
+
+// add puts download into the client and watches it until it finishes. It returns info hash of added torrent.
+// Torrent that is already in the client is left to the download that added it first.
+func (s *SwarmClient) add(d *activeDownload) (string, error) {
+	if d.callback == nil {
+		d.callback = func(*DownloadDetails, error) {}
+	}
+	identifier, magnet, callback := d.identifier, d.magnet, d.callback
+
+	fail := func(werr *lumo.LumoError) {
+		callback(nil, werr)
+
+		s.mu.RLock()
+		hooks := s.onFailure
+		s.mu.RUnlock()
+
+		for _, hook := range hooks {
+			hook(identifier, werr)
+		}
+	}
+
+	spec, err := s.torrentSpec(d)
+	var t *torrent.Torrent
+	var added bool
+	if err == nil {
+		spec.Storage = d.storage
+		t, added, err = s.torrentClient().AddTorrentSpec(spec)
+	}
+
 	if err != nil {
 		werr := lumo.WrapError(err)
 		if identifier != magnet {
@@ -65,32 +361,94 @@ func (s *SwarmClient) AddMagnet(magnet string, identifier string, callback func(
 		}
 
 		werr.Include("magnet", magnet)
-		callback(nil, werr)
-		return
+		fail(werr)
+		return "", werr
+	}
+
+	hash := t.InfoHash().HexString()
+	if !added {
+		lumo.Debug("Torrent of \"%s\" is already in the swarm. Ignored.", identifier)
+		return hash, nil
+	}
+
+	s.mu.RLock()
+	paused, diskPaused := s.paused, s.diskPaused
+	s.mu.RUnlock()
+
+	if paused {
+		pauseTorrent(t)
+	} else if diskPaused && !d.stream {
+		t.DisallowDataDownload()
+	}
+
+	status := StatusDownloading
+	if d.stream {
+		status = StatusStreaming
+	}
+
+	var tr *transfer
+	if d.repair {
+		tr = s.recordRepair(hash)
+	} else {
+		tr = s.recordAdded(hash, identifier, magnet, status)
 	}
+	d.t, d.tr = t, tr
+	s.track(d)
 
 	go func() {
 		select {
 		case <-t.GotInfo():
 			// lumo.Debug("Successfully obtained metadata for \"%s\" magnet.", identifier)
+			s.saveInfo(hash, t.Metainfo().InfoBytes)
 
 			s.mu.Lock()
 			s.activeDownloads++
 			s.mu.Unlock()
-		case <-time.After(60 * time.Second):
-			t.Drop()
+		case <-t.Closed():
+			// Dropped before metadata arrived, e.g. cancelled by user
+			if !s.untrack(d) {
+				return // Download continues in restarted client
+			}
 
 			s.mu.Lock()
-			s.activeDownloads--
+			cancelled := s.cancelled[hash]
+			delete(s.cancelled, hash)
+			closing := s.closing
 			s.mu.Unlock()
 
+			switch {
+			case d.repair:
+				s.setStatus(hash, StatusFinished)
+			case cancelled:
+				s.setStatus(hash, StatusCancelled)
+				callback(nil, lumo.WrapString("download was cancelled").Include("identifier", identifier))
+			case closing:
+				s.setStatus(hash, StatusInterrupted)
+			default:
+				s.setStatus(hash, StatusFailed)
+				werr := lumo.WrapString("torrent connection closed before fetching metadata")
+				if identifier != magnet {
+					werr.Include("identifier", identifier)
+				}
+
+				werr.Include("magnet", magnet)
+				fail(werr)
+			}
+			return
+		case <-time.After(s.metadataTimeout()):
+			t.Drop()
+			if !s.untrack(d) {
+				return
+			}
+			s.setStatus(hash, StatusFailed)
+
 			werr := lumo.WrapString("reached timeout for fetching metadata")
 			if identifier != magnet {
 				werr.Include("identifier", identifier)
 			}
 
 			werr.Include("magnet", magnet)
-			callback(nil, werr)
+			fail(werr)
 			return
 		}
 
@@ -106,6 +464,8 @@ func (s *SwarmClient) AddMagnet(magnet string, identifier string, callback func(
 
 		if target == nil {
 			t.Drop()
+			s.untrack(d)
+			s.setStatus(hash, StatusFailed)
 
 			s.mu.Lock()
 			s.activeDownloads--
@@ -117,12 +477,42 @@ func (s *SwarmClient) AddMagnet(magnet string, identifier string, callback func(
 			}
 
 			werr.Include("magnet", magnet)
-			callback(nil, werr)
+			fail(werr)
 			return
 		}
 
-		lumo.Debug("Started downloading \"%s\" magnet to: %s", identifier, target.DisplayPath())
-		target.Download()
+		tr.size = target.Length()
+		if d.stream {
+			// Pieces are fetched only as stream reads them and may be evicted again, so streamed torrent never completes
+			lumo.Debug("Ready to stream \"%s\" magnet: %s", identifier, target.DisplayPath())
+		} else {
+			if err := s.checkSpace(d.dir, target.Length()-target.BytesCompleted()); err != nil {
+				t.Drop()
+				s.untrack(d)
+				s.setStatus(hash, StatusFailed)
+
+				s.mu.Lock()
+				s.activeDownloads--
+				s.mu.Unlock()
+
+				werr := lumo.WrapError(err)
+				if identifier != magnet {
+					werr.Include("identifier", identifier)
+				}
+
+				werr.Include("magnet", magnet)
+				fail(werr)
+				return
+			}
+
+			lumo.Debug("Started downloading \"%s\" magnet to: %s", identifier, target.DisplayPath())
+			target.Download()
+			tr.path = d.path
+			if tr.path == "" {
+				tr.path = filepath.Join(d.dir, target.Path())
+			}
+			s.saveTransfer(tr, t.Stats(), status) // Path is needed to resume download after unexpected shutdown
+		}
 
 		ticker := time.NewTicker(1 * time.Second)
 		defer ticker.Stop()
@@ -139,7 +529,7 @@ func (s *SwarmClient) AddMagnet(magnet string, identifier string, callback func(
 
 				stats := t.Stats()
 				details := DownloadDetails{
-					InfoHash:           t.InfoHash().String(),
+					InfoHash:           hash,
 					Path:               target.DisplayPath(),
 					PercentageProgress: (float64(got) / float64(total)) * 100,
 					ActivePeers:        stats.ActivePeers,
@@ -147,34 +537,91 @@ func (s *SwarmClient) AddMagnet(magnet string, identifier string, callback func(
 
 				callback(&details, nil)
 
-				if got >= total {
+				if got >= total && d.repair {
+					s.mu.Lock()
+					s.activeDownloads--
+					s.mu.Unlock()
+
+					// Download was complete before, so it goes straight back to finished without hooks or seeding
+					s.untrack(d)
+					s.saveTransfer(tr, stats, StatusFinished)
+					t.Drop()
+					lumo.Info("Repaired bad pieces of \"%s\".", identifier)
+					return
+				}
+
+				if got >= total && !d.stream {
 					lumo.Debug("Successfully finished downloading \"%s\" magnet.", identifier)
 
 					s.mu.Lock()
 					s.activeDownloads--
-					s.readyFiles[t.InfoHash().String()] = target.Path()
+					s.readyFiles[hash] = tr.path
+					hooks := s.onComplete
 					s.mu.Unlock()
 					details.PercentageProgress = 100
 					callback(&details, nil)
+
+					tr.completedAt = time.Now()
+					s.saveTransfer(tr, stats, StatusSeeding)
+
+					for _, hook := range hooks {
+						hook(identifier, details)
+					}
+
+					s.seed(d)
 					return
 				}
 
+				if time.Since(tr.savedAt) >= transferSaveInterval {
+					s.saveTransfer(tr, stats, status)
+				}
+
 			case <-t.Closed():
+				if !s.untrack(d) {
+					// Client was restarted and download continues in the new one
+					s.mu.Lock()
+					s.activeDownloads--
+					s.mu.Unlock()
+					return
+				}
+
 				s.mu.Lock()
 				s.activeDownloads--
+				cancelled := s.cancelled[hash]
+				delete(s.cancelled, hash)
+				closing := s.closing
 				s.mu.Unlock()
 
+				if d.repair {
+					// Download stays complete, pieces still bad are found by next verification
+					s.saveTransfer(tr, t.Stats(), StatusFinished)
+					return
+				}
+
+				if cancelled {
+					s.saveTransfer(tr, t.Stats(), StatusCancelled)
+					callback(nil, lumo.WrapString("download was cancelled").Include("identifier", identifier))
+					return
+				}
+
+				if closing {
+					s.saveTransfer(tr, t.Stats(), StatusInterrupted)
+					return
+				}
+
+				s.saveTransfer(tr, t.Stats(), StatusFailed)
 				werr := lumo.WrapString("torrent connection closed unexpectedly")
 				if identifier != magnet {
 					werr.Include("identifier", identifier)
 				}
 
 				werr.Include("magnet", magnet)
-				callback(nil, werr)
+				fail(werr)
 				return
 			}
 		}
 	}()
+	return hash, nil
 }
 
 func (s *SwarmClient) CancelMagnet(magnet string) error {
@@ -185,13 +632,16 @@ func (s *SwarmClient) CancelMagnet(magnet string) error {
 		return werr
 	}
 
-	t, ok := s.client.Torrent(m.InfoHash.Value)
+	t, ok := s.torrentClient().Torrent(m.InfoHash.Value)
 	if !ok {
 		lumo.Debug("Attempted to cancel \"%s\" magnet, but it was not found in active magnets. Ignored.", magnet)
 		return nil
 	}
 
 	lumo.Debug("Requested to cancel \"%s\" magnet.", t.Name())
+	s.mu.Lock()
+	s.cancelled[t.InfoHash().String()] = true
+	s.mu.Unlock()
 	t.Drop()
 	return nil
 }
@@ -219,7 +669,7 @@ func (s *SwarmClient) StreamHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	hashInfo := metainfo.NewHashFromHex(hash)
-	t, ok := s.client.Torrent(hashInfo)
+	t, ok := s.torrentClient().Torrent(hashInfo)
 	if !ok {
 		http.Error(w, "Torrent not found (maybe queued but no metadata yet?)", 404)
 		return
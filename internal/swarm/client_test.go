@@ -0,0 +1,60 @@
+package swarm
+
+import (
+	"jubako/internal/config"
+	"jubako/internal/testutil"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestClient returns client with DHT, PEX, uTP and UPnP disabled, so tests never reach outside network.
+func newTestClient(t *testing.T) *SwarmClient {
+	t.Helper()
+
+	s := NewSwarmClient(testutil.OpenDB(t), t.TempDir(), t.TempDir(), config.Network{})
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestCancelBeforeMetadataIsNotReportedAsFailure(t *testing.T) {
+	s := newTestClient(t)
+	s.SetTrackers(config.Trackers{MetadataTimeout: 3600})
+
+	var failures atomic.Int32
+	s.OnFailure(func(identifier string, err error) { failures.Add(1) })
+
+	hash := strings.Repeat("ab", 20)
+	magnet := "magnet:?xt=urn:btih:" + hash
+	done := make(chan error, 1)
+	s.AddMagnet(magnet, "Gachiakuta - 03", func(d *DownloadDetails, err error) { done <- err })
+
+	if err := s.CancelMagnet(magnet); err != nil {
+		t.Fatalf("unexpected cancel error: %v", err)
+	}
+
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "cancelled") {
+			t.Errorf("expected cancellation to be reported to callback, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected cancelled download to stop without waiting for metadata timeout")
+	}
+
+	d, err := s.Download(hash)
+	if err != nil || d.Status != StatusCancelled {
+		t.Errorf("expected cancelled status, got %+v (%v)", d, err)
+	}
+
+	if n := failures.Load(); n != 0 {
+		t.Errorf("expected no failure notification, got %d", n)
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.cancelled) != 0 || len(s.active) != 0 {
+		t.Errorf("expected download to be forgotten, got cancelled %v and active %v", s.cancelled, s.active)
+	}
+}
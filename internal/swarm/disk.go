@@ -0,0 +1,327 @@
+package swarm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"jubako/internal/config"
+	"jubako/internal/jobs"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/amatsagu/lumo"
+)
+
+// DiskEventType of event published when downloads are paused or resumed because of free space.
+const DiskEventType = "disk"
+
+// QuotaJob is name of the background job that deletes watched episodes over library quota.
+const QuotaJob = "library-quota"
+
+const diskCheckInterval = 10 * time.Second
+
+// diskResumeMargin must be free on top of reserve before paused downloads continue, so they don't flap around it.
+const diskResumeMargin = 512 << 20
+
+// DiskStatus describes space of the download drive.
+type DiskStatus struct {
+	Free    int64 `json:"free"` // -1 when free space can't be checked on this system
+	Reserve int64 `json:"reserve"`
+	Quota   int64 `json:"quota"`  // 0 means unlimited
+	Used    int64 `json:"used"`   // Bytes of complete downloads still kept on disk
+	Paused  bool  `json:"paused"` // Downloads don't fetch any data, because free space dropped below reserve
+}
+
+// DiskHook is called when downloads are paused or resumed because of free space.
+type DiskHook func(status DiskStatus)
+
+// WatchedFunc reports whether episode was watched and when it was watched last time.
+type WatchedFunc func(mediaID, episode int) (time.Time, bool, error)
+
+// SetDisk changes free space reserve and library quota.
+func (s *SwarmClient) SetDisk(cfg config.Disk) {
+	s.mu.Lock()
+	s.disk = cfg
+	s.mu.Unlock()
+}
+
+// OnDiskChange registers hook called after downloads are paused or resumed because of free space.
+func (s *SwarmClient) OnDiskChange(hook DiskHook) {
+	s.mu.Lock()
+	s.onDisk = append(s.onDisk, hook)
+	s.mu.Unlock()
+}
+
+// checkSpace reports error when writing needed bytes into dir would leave less than reserve free.
+// Systems where free space can't be checked are not guarded.
+func (s *SwarmClient) checkSpace(dir string, needed int64) error {
+	free, err := freeSpace(dir)
+	if errors.Is(err, errors.ErrUnsupported) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	s.mu.RLock()
+	reserve := s.disk.Reserve
+	s.mu.RUnlock()
+
+	if free-needed < reserve {
+		return fmt.Errorf("not enough free disk space (needs %s, %s free, %s reserved)", formatSize(needed), formatSize(free), formatSize(reserve))
+	}
+	return nil
+}
+
+// watchDisk pauses downloads while free space of download drive is below reserve, until client is closed.
+func (s *SwarmClient) watchDisk() {
+	ticker := time.NewTicker(diskCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.checkDisk()
+		}
+	}
+}
+
+func (s *SwarmClient) checkDisk() {
+	s.mu.RLock()
+	reserve, paused := s.disk.Reserve, s.diskPaused
+	dirs := []string{s.downloadDir}
+	for _, d := range s.active {
+		if !d.stream && !slices.Contains(dirs, d.dir) {
+			dirs = append(dirs, d.dir)
+		}
+	}
+	s.mu.RUnlock()
+
+	free, ok := minFreeSpace(dirs)
+	if !ok {
+		return
+	}
+
+	switch {
+	case !paused && free < reserve:
+		lumo.Warn("Only %s of disk space is left, pausing downloads until at least %s is free.", formatSize(free), formatSize(reserve+diskResumeMargin))
+		s.pauseDownloads()
+	case paused && free >= reserve+diskResumeMargin:
+		lumo.Info("%s of disk space is free again, resuming downloads.", formatSize(free))
+		s.resumeDownloads()
+	default:
+		return
+	}
+
+	status, err := s.DiskStatus()
+	if err != nil {
+		lumo.Error("Failed to read disk status: %v", err)
+		return
+	}
+
+	s.mu.RLock()
+	hooks := s.onDisk
+	s.mu.RUnlock()
+
+	for _, hook := range hooks {
+		hook(status)
+	}
+}
+
+// minFreeSpace returns the lowest free space among drives of given directories.
+func minFreeSpace(dirs []string) (int64, bool) {
+	lowest, ok := int64(0), false
+	for _, dir := range dirs {
+		free, err := freeSpace(dir)
+		if err != nil {
+			if !errors.Is(err, errors.ErrUnsupported) {
+				lumo.Warn("Failed to check free space of %s: %v", dir, err)
+			}
+			continue
+		}
+
+		if !ok || free < lowest {
+			lowest, ok = free, true
+		}
+	}
+	return lowest, ok
+}
+
+// pauseDownloads stops fetching data of every torrent, while seeding continues.
+func (s *SwarmClient) pauseDownloads() {
+	s.mu.Lock()
+	s.diskPaused = true
+	active := make([]*activeDownload, 0, len(s.active))
+	for _, d := range s.active {
+		if !d.stream {
+			active = append(active, d)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, d := range active {
+		d.t.DisallowDataDownload()
+	}
+}
+
+func (s *SwarmClient) resumeDownloads() {
+	s.mu.Lock()
+	s.diskPaused = false
+	networkPaused := s.paused
+	active := make([]*activeDownload, 0, len(s.active))
+	for _, d := range s.active {
+		active = append(active, d)
+	}
+	s.mu.Unlock()
+
+	if networkPaused {
+		return // Kill-switch resumes them once network is back
+	}
+
+	for _, d := range active {
+		d.t.AllowDataDownload()
+	}
+}
+
+// DiskStatus returns space of the download drive.
+func (s *SwarmClient) DiskStatus() (DiskStatus, error) {
+	s.mu.RLock()
+	status := DiskStatus{Reserve: s.disk.Reserve, Quota: s.disk.Quota, Paused: s.diskPaused}
+	dir := s.downloadDir
+	s.mu.RUnlock()
+
+	free, err := freeSpace(dir)
+	switch {
+	case errors.Is(err, errors.ErrUnsupported):
+		status.Free = -1
+	case err != nil:
+		return status, err
+	default:
+		status.Free = free
+	}
+
+	used, err := s.usedSpace()
+	status.Used = used
+	return status, err
+}
+
+// usedSpace returns bytes of complete downloads that are still kept on disk.
+func (s *SwarmClient) usedSpace() (int64, error) {
+	var used int64
+	err := s.db.QueryRow("SELECT COALESCE(SUM(size), 0) FROM downloads WHERE status IN (?, ?)", StatusSeeding, StatusFinished).Scan(&used)
+	return used, err
+}
+
+// NewQuotaJob returns recurring job that keeps library downloads within quota.
+func NewQuotaJob(s *SwarmClient, watched WatchedFunc) jobs.Job {
+	return jobs.Job{
+		Name:     QuotaJob,
+		Interval: 15 * time.Minute,
+		Run: func(ctx context.Context) error {
+			return s.EnforceQuota(ctx, watched)
+		},
+	}
+}
+
+// EnforceQuota deletes files of watched episodes, starting with ones watched longest ago, until library downloads
+// fit into quota. Only downloads linked to series episode that no longer seed are considered.
+func (s *SwarmClient) EnforceQuota(ctx context.Context, watched WatchedFunc) error {
+	s.mu.RLock()
+	quota := s.disk.Quota
+	s.mu.RUnlock()
+
+	if quota <= 0 {
+		return nil
+	}
+
+	used, err := s.usedSpace()
+	if err != nil || used <= quota {
+		return err
+	}
+
+	rows, err := s.db.Query("SELECT "+downloadColumns+" FROM downloads WHERE status = ? AND media_id IS NOT NULL AND episode IS NOT NULL", StatusFinished)
+	if err != nil {
+		return err
+	}
+
+	type candidate struct {
+		Download
+		watchedAt time.Time
+	}
+
+	var candidates []candidate
+	for rows.Next() {
+		d, err := scanDownload(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+
+		at, ok, err := watched(d.MediaID, d.Episode)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+
+		if ok {
+			candidates = append(candidates, candidate{*d, at})
+		}
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	slices.SortFunc(candidates, func(a, b candidate) int {
+		return a.watchedAt.Compare(b.watchedAt)
+	})
+
+	for _, c := range candidates {
+		if used <= quota {
+			break
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if _, err := s.DeleteDownload(c.InfoHash, DeletedByQuota); err != nil {
+			lumo.Warn("Failed to delete %s to keep library within quota: %v", c.Path, err)
+			continue
+		}
+
+		used -= c.Size
+		lumo.Info("Deleted watched \"%s\" to keep library within %s quota.", c.Identifier, formatSize(quota))
+	}
+
+	if used > quota {
+		lumo.Warn("Library downloads use %s, which is over %s quota, but no more watched episodes can be deleted.", formatSize(used), formatSize(quota))
+	}
+	return nil
+}
+
+// DiskStatusHandler returns space of the download drive.
+func (s *SwarmClient) DiskStatusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	status, err := s.DiskStatus()
+	if err != nil {
+		lumo.Error("Failed to read disk status: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to read disk status"})
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		lumo.Error("Failed to encode disk status: %v", err)
+	}
+}
+
+func formatSize(bytes int64) string {
+	return fmt.Sprintf("%.1f GiB", float64(bytes)/(1<<30))
+}
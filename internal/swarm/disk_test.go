@@ -0,0 +1,97 @@
+package swarm
+
+import (
+	"context"
+	"jubako/internal/config"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// seedDownload records download with file of its size in download directory.
+func seedDownload(t *testing.T, s *SwarmClient, d Download) {
+	t.Helper()
+
+	d.Path = filepath.Join(s.downloadDir, d.InfoHash+".mkv")
+	if err := os.WriteFile(d.Path, make([]byte, d.Size), 0600); err != nil {
+		t.Fatalf("failed to write download: %v", err)
+	}
+
+	var mediaID, episode any
+	if d.MediaID > 0 {
+		mediaID, episode = d.MediaID, d.Episode
+	}
+
+	_, err := s.db.Exec("INSERT INTO downloads (info_hash, identifier, magnet, path, status, size, added_at, media_id, episode) VALUES (?, ?, '', ?, ?, ?, ?, ?, ?)",
+		d.InfoHash, d.InfoHash, d.Path, d.Status, d.Size, time.Now(), mediaID, episode)
+	if err != nil {
+		t.Fatalf("failed to seed download: %v", err)
+	}
+}
+
+func TestEnforceQuotaDeletesOldestWatchedFirst(t *testing.T) {
+	now := time.Now()
+	watchedAt := map[int]time.Time{
+		1: now.Add(-72 * time.Hour),
+		2: now.Add(-24 * time.Hour),
+		3: now.Add(-48 * time.Hour),
+		5: now.Add(-96 * time.Hour), // Still seeding
+	}
+
+	downloads := []Download{
+		{InfoHash: "ep1", Status: StatusFinished, Size: 100, MediaID: 178025, Episode: 1},
+		{InfoHash: "ep2", Status: StatusFinished, Size: 100, MediaID: 178025, Episode: 2},
+		{InfoHash: "ep3", Status: StatusFinished, Size: 100, MediaID: 178025, Episode: 3},
+		{InfoHash: "ep4", Status: StatusFinished, Size: 100, MediaID: 178025, Episode: 4}, // Not watched yet
+		{InfoHash: "ep5", Status: StatusSeeding, Size: 100, MediaID: 178025, Episode: 5},
+		{InfoHash: "movie", Status: StatusFinished, Size: 100}, // Not linked to series
+	}
+
+	cases := []struct {
+		quota   int64
+		deleted []string
+	}{
+		{0, nil}, // Unlimited
+		{600, nil},
+		{550, []string{"ep1"}},
+		{400, []string{"ep1", "ep3"}},
+		{100, []string{"ep1", "ep3", "ep2"}}, // Over quota, but nothing else may be deleted
+	}
+
+	for _, c := range cases {
+		s := newTestClient(t)
+		s.SetDisk(config.Disk{Quota: c.quota})
+		for _, d := range downloads {
+			seedDownload(t, s, d)
+		}
+
+		var deleted []string
+		s.OnDelete(func(d Download, reason string) {
+			if reason != DeletedByQuota {
+				t.Errorf("expected quota deletion, got %q", reason)
+			}
+			deleted = append(deleted, d.InfoHash)
+		})
+
+		watched := func(mediaID, episode int) (time.Time, bool, error) {
+			at, ok := watchedAt[episode]
+			return at, ok, nil
+		}
+
+		if err := s.EnforceQuota(context.Background(), watched); err != nil {
+			t.Fatalf("quota %d: unexpected error: %v", c.quota, err)
+		}
+
+		if !slices.Equal(deleted, c.deleted) {
+			t.Errorf("quota %d: expected %v to be deleted, got %v", c.quota, c.deleted, deleted)
+		}
+
+		for _, hash := range deleted {
+			if _, err := os.Stat(filepath.Join(s.downloadDir, hash+".mkv")); !os.IsNotExist(err) {
+				t.Errorf("quota %d: expected file of %s to be removed, got %v", c.quota, hash, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,571 @@
+package swarm
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"jubako/internal/config"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/amatsagu/lumo"
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// Statuses of downloads stored in downloads table.
+const (
+	StatusDownloading = "downloading"
+	StatusSeeding     = "seeding"
+	StatusStreaming   = "streaming" // Added without keeping, pieces are fetched only while streaming
+	StatusFinished    = "finished"  // Complete and no longer active in the swarm
+	StatusFailed      = "failed"
+	StatusCancelled   = "cancelled"
+	StatusInterrupted = "interrupted" // Application was closed before download finished
+	StatusDeleted     = "deleted"     // File was deleted by quota or retention policy
+)
+
+// Reasons of deleting downloads, passed to DeleteHook.
+const (
+	DeletedByQuota       = "quota"
+	DeletedAfterWatched  = "retention_days"
+	DeletedOverKeepLimit = "retention_keep_last"
+)
+
+const (
+	transferSaveInterval = 30 * time.Second
+	seedCheckInterval    = 30 * time.Second
+)
+
+// maxTorrentFileSize limits uploaded .torrent files. Metainfo holds only piece hashes, so even huge torrents fit easily.
+const maxTorrentFileSize = 10 << 20
+
+var ErrUnknownDownload = errors.New("unknown download")
+
+// Download is persisted record of single torrent download.
+type Download struct {
+	InfoHash    string             `json:"info_hash"`
+	Identifier  string             `json:"identifier"`
+	Magnet      string             `json:"magnet"`
+	Path        string             `json:"path,omitempty"`
+	Status      string             `json:"status"`
+	Size        int64              `json:"size"`
+	Downloaded  int64              `json:"downloaded"`
+	Uploaded    int64              `json:"uploaded"`
+	SeedPolicy  *config.SeedPolicy `json:"seed_policy"`        // Per-download override, nil when global policy applies
+	MediaID     int                `json:"media_id,omitempty"` // AniList media, when download was linked to series
+	Episode     int                `json:"episode,omitempty"`
+	AddedAt     time.Time          `json:"added_at"`
+	CompletedAt *time.Time         `json:"completed_at"`
+}
+
+// transfer tracks totals of download while its torrent is active in the client.
+type transfer struct {
+	hash        string
+	path        string
+	size        int64
+	baseDown    int64 // Totals from previous sessions of the same torrent
+	baseUp      int64
+	completedAt time.Time
+	savedAt     time.Time
+}
+
+// initDownloadsTable creates downloads table and returns complete downloads that were still active when
+// previous run ended - only unexpected shutdown leaves them like that.
+func initDownloadsTable(db *sql.DB) []string {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS downloads (
+		info_hash TEXT PRIMARY KEY,
+		identifier TEXT NOT NULL,
+		magnet TEXT NOT NULL,
+		path TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL,
+		size INTEGER NOT NULL DEFAULT 0,
+		downloaded INTEGER NOT NULL DEFAULT 0,
+		uploaded INTEGER NOT NULL DEFAULT 0,
+		seed_ratio REAL,
+		seed_hours REAL,
+		added_at DATETIME NOT NULL,
+		completed_at DATETIME,
+		media_id INTEGER,
+		episode INTEGER,
+		info BLOB
+	)`)
+	if err != nil {
+		lumo.Error("Failed to create downloads table: %v", err)
+	}
+
+	for column, definition := range map[string]string{"media_id": "INTEGER", "episode": "INTEGER", "info": "BLOB"} {
+		if err := addColumn(db, "downloads", column, definition); err != nil {
+			lumo.Error("Failed to add %s column to downloads table: %v", column, err)
+		}
+	}
+
+	var interrupted []string
+	rows, err := db.Query("SELECT info_hash FROM downloads WHERE status IN (?, ?) AND completed_at IS NOT NULL", StatusDownloading, StatusSeeding)
+	if err != nil {
+		lumo.Error("Failed to read downloads interrupted by unexpected shutdown: %v", err)
+	} else {
+		for rows.Next() {
+			var hash string
+			if err := rows.Scan(&hash); err == nil {
+				interrupted = append(interrupted, hash)
+			}
+		}
+		rows.Close()
+	}
+
+	// Nothing from previous run is active anymore. Torrents still seeding after unexpected shutdown keep their status,
+	// so they're seeded again once ResumeDownloads adds them back, while unfinished ones wait for it as interrupted.
+	// Complete downloads that were being repaired are finished again, their bad pieces are found by verification.
+	_, err = db.Exec("UPDATE downloads SET status = CASE WHEN completed_at IS NULL THEN ? ELSE ? END WHERE status IN (?, ?)",
+		StatusInterrupted, StatusFinished, StatusDownloading, StatusStreaming)
+	if err != nil {
+		lumo.Error("Failed to reset status of unfinished downloads: %v", err)
+	}
+	return interrupted
+}
+
+// SetSeedPolicy changes global seeding policy. It applies to all seeding torrents without own override.
+func (s *SwarmClient) SetSeedPolicy(policy config.SeedPolicy) {
+	s.mu.Lock()
+	s.seedPolicy = policy
+	s.mu.Unlock()
+}
+
+// SetDownloadSeedPolicy overrides seeding policy of single download. Nil policy restores global one.
+func (s *SwarmClient) SetDownloadSeedPolicy(hash string, policy *config.SeedPolicy) error {
+	var ratio, hours sql.NullFloat64
+	if policy != nil {
+		if err := policy.Validate(); err != nil {
+			return err
+		}
+		ratio = sql.NullFloat64{Float64: policy.Ratio, Valid: true}
+		hours = sql.NullFloat64{Float64: policy.Hours, Valid: true}
+	}
+
+	res, err := s.db.Exec("UPDATE downloads SET seed_ratio = ?, seed_hours = ? WHERE info_hash = ?", ratio, hours, hash)
+	if err != nil {
+		return err
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrUnknownDownload
+	}
+	return nil
+}
+
+const downloadColumns = "info_hash, identifier, magnet, path, status, size, downloaded, uploaded, seed_ratio, seed_hours, added_at, completed_at, media_id, episode"
+
+// Downloads returns all recorded downloads starting with the most recently added one.
+func (s *SwarmClient) Downloads() ([]Download, error) {
+	rows, err := s.db.Query("SELECT " + downloadColumns + " FROM downloads ORDER BY added_at DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	downloads := make([]Download, 0)
+	for rows.Next() {
+		d, err := scanDownload(rows)
+		if err != nil {
+			return nil, err
+		}
+		downloads = append(downloads, *d)
+	}
+	return downloads, rows.Err()
+}
+
+// Download returns recorded download of given torrent.
+func (s *SwarmClient) Download(hash string) (*Download, error) {
+	d, err := scanDownload(s.db.QueryRow("SELECT "+downloadColumns+" FROM downloads WHERE info_hash = ?", hash))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrUnknownDownload
+	}
+	return d, err
+}
+
+func scanDownload(row interface{ Scan(dest ...any) error }) (*Download, error) {
+	var d Download
+	var ratio, hours sql.NullFloat64
+	var completedAt sql.NullTime
+	var mediaID, episode sql.NullInt64
+	if err := row.Scan(&d.InfoHash, &d.Identifier, &d.Magnet, &d.Path, &d.Status, &d.Size, &d.Downloaded, &d.Uploaded, &ratio, &hours, &d.AddedAt, &completedAt, &mediaID, &episode); err != nil {
+		return nil, err
+	}
+
+	if ratio.Valid && hours.Valid {
+		d.SeedPolicy = &config.SeedPolicy{Ratio: ratio.Float64, Hours: hours.Float64}
+	}
+
+	if completedAt.Valid {
+		d.CompletedAt = &completedAt.Time
+	}
+
+	d.MediaID = int(mediaID.Int64)
+	d.Episode = int(episode.Int64)
+	return &d, nil
+}
+
+// SetDownloadMedia links download to episode of AniList media, so it can be organized and tracked as part of series.
+func (s *SwarmClient) SetDownloadMedia(hash string, mediaID, episode int) error {
+	res, err := s.db.Exec("UPDATE downloads SET media_id = ?, episode = ? WHERE info_hash = ?", nullInt(mediaID), nullInt(episode), hash)
+	if err != nil {
+		return err
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrUnknownDownload
+	}
+	return nil
+}
+
+// Relocate records that downloaded file was moved (or linked) to new path after torrent finished with it.
+func (s *SwarmClient) Relocate(hash, path string) error {
+	res, err := s.db.Exec("UPDATE downloads SET path = ? WHERE info_hash = ?", path, hash)
+	if err != nil {
+		return err
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrUnknownDownload
+	}
+
+	s.mu.Lock()
+	if _, ok := s.readyFiles[hash]; ok {
+		s.readyFiles[hash] = path
+	}
+	s.mu.Unlock()
+	return nil
+}
+
+// recordAdded stores new download, keeping totals and seeding override when the same torrent is added again.
+func (s *SwarmClient) recordAdded(hash, identifier, magnet, status string) *transfer {
+	tr := &transfer{hash: hash, savedAt: time.Now()}
+
+	_, err := s.db.Exec(`INSERT INTO downloads (info_hash, identifier, magnet, status, added_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (info_hash) DO UPDATE SET identifier = excluded.identifier, magnet = excluded.magnet, status = excluded.status, added_at = excluded.added_at, completed_at = NULL`,
+		hash, identifier, magnet, status, time.Now())
+	if err != nil {
+		lumo.Error("Failed to record \"%s\" download: %v", identifier, err)
+		return tr
+	}
+
+	if err := s.db.QueryRow("SELECT downloaded, uploaded FROM downloads WHERE info_hash = ?", hash).Scan(&tr.baseDown, &tr.baseUp); err != nil {
+		lumo.Error("Failed to read totals of \"%s\" download: %v", identifier, err)
+	}
+	return tr
+}
+
+// recordRepair marks complete download as downloading its bad pieces again. Unlike recordAdded, it keeps the rest of
+// the record, so download stays complete and its retention is counted from the original dates.
+func (s *SwarmClient) recordRepair(hash string) *transfer {
+	tr := &transfer{hash: hash, savedAt: time.Now()}
+	s.setStatus(hash, StatusDownloading)
+
+	if err := s.db.QueryRow("SELECT downloaded, uploaded FROM downloads WHERE info_hash = ?", hash).Scan(&tr.baseDown, &tr.baseUp); err != nil {
+		lumo.Error("Failed to read totals of %s download: %v", hash, err)
+	}
+	return tr
+}
+
+func (s *SwarmClient) setStatus(hash, status string) {
+	if _, err := s.db.Exec("UPDATE downloads SET status = ? WHERE info_hash = ?", status, hash); err != nil {
+		lumo.Error("Failed to update status of %s download: %v", hash, err)
+	}
+}
+
+// saveTransfer persists totals of current session on top of totals from previous ones.
+func (s *SwarmClient) saveTransfer(tr *transfer, stats torrent.TorrentStats, status string) {
+	var completedAt sql.NullTime
+	if !tr.completedAt.IsZero() {
+		completedAt = sql.NullTime{Time: tr.completedAt, Valid: true}
+	}
+
+	_, err := s.db.Exec("UPDATE downloads SET status = ?, path = ?, size = ?, downloaded = ?, uploaded = ?, completed_at = COALESCE(?, completed_at) WHERE info_hash = ?",
+		status, tr.path, tr.size, tr.baseDown+stats.BytesReadUsefulData.Int64(), tr.baseUp+stats.BytesWrittenData.Int64(), completedAt, tr.hash)
+	if err != nil {
+		lumo.Error("Failed to save transfer totals of %s download: %v", tr.hash, err)
+	}
+	tr.savedAt = time.Now()
+}
+
+// seedPolicyFor returns override of given download or global seeding policy.
+func (s *SwarmClient) seedPolicyFor(hash string) config.SeedPolicy {
+	var ratio, hours sql.NullFloat64
+	err := s.db.QueryRow("SELECT seed_ratio, seed_hours FROM downloads WHERE info_hash = ?", hash).Scan(&ratio, &hours)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		lumo.Error("Failed to read seeding policy of %s download: %v", hash, err)
+	}
+
+	if ratio.Valid && hours.Valid {
+		return config.SeedPolicy{Ratio: ratio.Float64, Hours: hours.Float64}
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.seedPolicy
+}
+
+// seed keeps completed torrent in the swarm until its seeding policy is met, then drops it from the client.
+// Downloaded file stays on disk and is served from there.
+func (s *SwarmClient) seed(d *activeDownload) {
+	t, tr := d.t, d.tr
+	ticker := time.NewTicker(seedCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		stats := t.Stats()
+		uploaded := tr.baseUp + stats.BytesWrittenData.Int64()
+		if s.seedPolicyFor(tr.hash).Reached(uploaded, tr.size, time.Since(tr.completedAt)) {
+			s.untrack(d)
+			s.saveTransfer(tr, stats, StatusFinished)
+			t.Drop()
+			lumo.Debug("Finished seeding \"%s\" after uploading %d bytes.", t.Name(), uploaded)
+			s.finished(tr.hash)
+			return
+		}
+
+		select {
+		case <-ticker.C:
+			s.saveTransfer(tr, stats, StatusSeeding)
+		case <-t.Closed():
+			if !s.untrack(d) {
+				return // Seeding continues in restarted client
+			}
+
+			s.mu.Lock()
+			delete(s.cancelled, tr.hash)
+			closing := s.closing
+			s.mu.Unlock()
+
+			if closing {
+				// Seeding target is kept, ResumeDownloads continues seeding on next start
+				s.saveTransfer(tr, t.Stats(), StatusInterrupted)
+				return
+			}
+
+			s.saveTransfer(tr, t.Stats(), StatusFinished)
+			s.finished(tr.hash) // Seeding was stopped by user
+			return
+		}
+	}
+}
+
+// finished passes download, which no longer seeds, to registered hooks.
+func (s *SwarmClient) finished(hash string) {
+	s.mu.RLock()
+	hooks := s.onFinish
+	s.mu.RUnlock()
+
+	if len(hooks) == 0 {
+		return
+	}
+
+	d, err := s.Download(hash)
+	if err != nil {
+		lumo.Error("Failed to read finished %s download: %v", hash, err)
+		return
+	}
+
+	for _, hook := range hooks {
+		hook(*d)
+	}
+}
+
+// DeleteDownload drops complete torrent from the swarm, if it still seeds, and deletes its file from disk.
+// Reason is passed to registered hooks, so they know why download was deleted.
+func (s *SwarmClient) DeleteDownload(hash, reason string) (*Download, error) {
+	d, err := s.Download(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.Status != StatusSeeding && d.Status != StatusFinished {
+		return nil, fmt.Errorf("%s download cannot be deleted", d.Status)
+	}
+
+	s.mu.Lock()
+	active := s.active[hash]
+	if active != nil {
+		delete(s.active, hash) // Seeding loop sees torrent closed by someone else and leaves it alone
+	}
+	delete(s.readyFiles, hash)
+	s.mu.Unlock()
+
+	if active != nil {
+		s.saveTransfer(active.tr, active.t.Stats(), StatusDeleted)
+		active.t.Drop()
+	}
+
+	if err := os.Remove(d.Path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	s.setStatus(hash, StatusDeleted)
+	d.Status = StatusDeleted
+
+	s.mu.RLock()
+	hooks := s.onDelete
+	s.mu.RUnlock()
+
+	for _, hook := range hooks {
+		hook(*d, reason)
+	}
+	return d, nil
+}
+
+// DownloadsHandler returns all recorded downloads.
+func (s *SwarmClient) DownloadsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	downloads, err := s.Downloads()
+	if err != nil {
+		lumo.Error("Failed to read downloads: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to read downloads"})
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(downloads); err != nil {
+		lumo.Error("Failed to encode downloads: %v", err)
+	}
+}
+
+// AddDownloadHandler starts new download. It accepts .torrent file as multipart "torrent" field,
+// raw metainfo (application/x-bittorrent) or json body with magnet ({"magnet": "magnet:?xt=..."}).
+// Optional identifier, stream flag (add for streaming without keeping), media_id and episode (link download
+// to AniList series) can be passed as form fields, query params or json fields of the same name.
+func (s *SwarmClient) AddDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	r.Body = http.MaxBytesReader(w, r.Body, maxTorrentFileSize)
+
+	var hash string
+	var mediaID, episode int
+	var err error
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "multipart/form-data":
+		file, _, ferr := r.FormFile("torrent")
+		if ferr != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "missing torrent file"})
+			return
+		}
+		defer file.Close()
+		stream, _ := strconv.ParseBool(r.FormValue("stream"))
+		mediaID, _ = strconv.Atoi(r.FormValue("media_id"))
+		episode, _ = strconv.Atoi(r.FormValue("episode"))
+		hash, err = s.AddTorrentFile(file, r.FormValue("identifier"), stream, nil)
+
+	case "application/json":
+		var body struct {
+			Magnet     string `json:"magnet"`
+			Identifier string `json:"identifier"`
+			Stream     bool   `json:"stream"`
+			MediaID    int    `json:"media_id"`
+			Episode    int    `json:"episode"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || !strings.HasPrefix(body.Magnet, "magnet:") {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "expected magnet link"})
+			return
+		}
+
+		if _, err := metainfo.ParseMagnetV2Uri(body.Magnet); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid magnet link: " + err.Error()})
+			return
+		}
+
+		mediaID, episode = body.MediaID, body.Episode
+		hash, err = s.addMagnet(body.Magnet, body.Identifier, body.Stream, nil)
+
+	default:
+		q := r.URL.Query()
+		stream, _ := strconv.ParseBool(q.Get("stream"))
+		mediaID, _ = strconv.Atoi(q.Get("media_id"))
+		episode, _ = strconv.Atoi(q.Get("episode"))
+		hash, err = s.AddTorrentFile(r.Body, q.Get("identifier"), stream, nil)
+	}
+
+	switch {
+	case errors.Is(err, ErrInvalidTorrent):
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	case err != nil:
+		lumo.Error("Failed to add download: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to add download: " + err.Error()})
+		return
+	}
+
+	if mediaID > 0 {
+		if err := s.SetDownloadMedia(hash, mediaID, episode); err != nil {
+			lumo.Error("Failed to link %s download to media %d: %v", hash, mediaID, err)
+		}
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"info_hash": hash})
+}
+
+// SeedPolicyHandler overrides seeding policy of download from {hash} path value.
+// Json body holds policy ({"ratio": 2, "hours": 0}) or null to restore global one.
+func (s *SwarmClient) SeedPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var policy *config.SeedPolicy
+	if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "expected seeding policy or null"})
+		return
+	}
+
+	if policy != nil {
+		if err := policy.Validate(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+	}
+
+	err := s.SetDownloadSeedPolicy(r.PathValue("hash"), policy)
+	switch {
+	case errors.Is(err, ErrUnknownDownload):
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "unknown download"})
+	case err != nil:
+		lumo.Error("Failed to update seeding policy: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to update seeding policy"})
+	default:
+		fmt.Fprint(w, `{"status": "success"}`)
+	}
+}
+
+// nullInt stores zero as NULL, so unknown values are not mistaken for real ones.
+func nullInt(v int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(v), Valid: v != 0}
+}
+
+// addColumn adds column to table created by older version.
+func addColumn(db *sql.DB, table, column, definition string) error {
+	var exists bool
+	if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM pragma_table_info(?) WHERE name = ?)", table, column).Scan(&exists); err != nil {
+		return err
+	}
+
+	if exists {
+		return nil
+	}
+
+	_, err := db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+	return err
+}
@@ -0,0 +1,132 @@
+package swarm
+
+import (
+	"bytes"
+	"encoding/json"
+	"jubako/internal/config"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// torrentFile returns .torrent file of single video with given number of piece hashes (4 fit its length)
+// and its info hash.
+func torrentFile(t *testing.T, pieces int) ([]byte, string) {
+	t.Helper()
+
+	info := metainfo.Info{Name: "Gachiakuta - 03.mkv", PieceLength: 32, Length: 100, Pieces: make([]byte, pieces*20)}
+	infoBytes, err := bencode.Marshal(info)
+	if err != nil {
+		t.Fatalf("failed to encode metainfo: %v", err)
+	}
+
+	data, err := bencode.Marshal(metainfo.MetaInfo{InfoBytes: infoBytes})
+	if err != nil {
+		t.Fatalf("failed to encode torrent file: %v", err)
+	}
+	return data, metainfo.HashBytes(infoBytes).HexString()
+}
+
+// multipartTorrent returns multipart form with torrent file in field of given name.
+func multipartTorrent(t *testing.T, field string, data []byte) (string, *bytes.Buffer) {
+	t.Helper()
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile(field, "Gachiakuta - 03.torrent")
+	if err != nil {
+		t.Fatalf("failed to create form file: %v", err)
+	}
+	fw.Write(data)
+	mw.WriteField("identifier", "Gachiakuta - 03")
+	mw.Close()
+	return mw.FormDataContentType(), &body
+}
+
+func TestAddDownloadHandler(t *testing.T) {
+	torrent, hash := torrentFile(t, 4)
+	brokenPieces, _ := torrentFile(t, 3)
+	magnetHash := strings.Repeat("ab", 20)
+	form, formBody := multipartTorrent(t, "torrent", torrent)
+	missingForm, missingBody := multipartTorrent(t, "file", torrent)
+	brokenForm, brokenBody := multipartTorrent(t, "torrent", []byte("not a torrent"))
+
+	tests := []struct {
+		name        string
+		url         string
+		contentType string
+		body        []byte
+		blocked     bool // Storage can't be opened, since download directory is a file
+		code        int
+		hash        string
+	}{
+		{"multipart torrent file", "/api/downloads", form, formBody.Bytes(), false, http.StatusAccepted, hash},
+		{"multipart without torrent file", "/api/downloads", missingForm, missingBody.Bytes(), false, http.StatusBadRequest, ""},
+		{"multipart invalid torrent file", "/api/downloads", brokenForm, brokenBody.Bytes(), false, http.StatusBadRequest, ""},
+		{"raw torrent file", "/api/downloads?media_id=21&episode=3", "application/x-bittorrent", torrent, false, http.StatusAccepted, hash},
+		{"raw invalid torrent file", "/api/downloads", "application/x-bittorrent", []byte("not a torrent"), false, http.StatusBadRequest, ""},
+		{"raw torrent file with wrong pieces", "/api/downloads", "application/x-bittorrent", brokenPieces, false, http.StatusBadRequest, ""},
+		{"raw torrent file too large", "/api/downloads", "application/x-bittorrent", append([]byte("20000000:"), make([]byte, maxTorrentFileSize)...), false, http.StatusBadRequest, ""},
+		{"raw torrent file without storage", "/api/downloads", "application/x-bittorrent", torrent, true, http.StatusInternalServerError, ""},
+		{"json magnet", "/api/downloads", "application/json", []byte(`{"magnet": "magnet:?xt=urn:btih:` + magnetHash + `", "media_id": 21, "episode": 3}`), false, http.StatusAccepted, magnetHash},
+		{"json invalid magnet", "/api/downloads", "application/json", []byte(`{"magnet": "magnet:?xt=urn:btih:zz"}`), false, http.StatusBadRequest, ""},
+		{"json without magnet", "/api/downloads", "application/json", []byte(`{"identifier": "Gachiakuta - 03"}`), false, http.StatusBadRequest, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestClient(t)
+			if tt.blocked {
+				dir := filepath.Join(t.TempDir(), "downloads")
+				if err := os.WriteFile(dir, nil, 0600); err != nil {
+					t.Fatalf("failed to block download directory: %v", err)
+				}
+				s.SetDownloadDir(dir)
+				s.storageCfg.Backend = config.StorageMMap // Unlike file storage, it opens files right away
+			}
+
+			r := httptest.NewRequest(http.MethodPost, tt.url, bytes.NewReader(tt.body))
+			r.Header.Set("Content-Type", tt.contentType)
+			rec := httptest.NewRecorder()
+			s.AddDownloadHandler(rec, r)
+
+			if rec.Code != tt.code {
+				t.Fatalf("expected %d, got %d (%s)", tt.code, rec.Code, rec.Body)
+			}
+
+			var body map[string]string
+			if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+				t.Fatalf("expected json body: %v", err)
+			}
+
+			if tt.code != http.StatusAccepted {
+				if body["error"] == "" {
+					t.Errorf("expected error message, got %v", body)
+				}
+				return
+			}
+
+			if body["info_hash"] != tt.hash {
+				t.Errorf("expected info hash %s, got %v", tt.hash, body)
+			}
+
+			d, err := s.Download(tt.hash)
+			if err != nil {
+				t.Fatalf("expected download to be recorded: %v", err)
+			}
+
+			if strings.Contains(tt.url, "media_id") || bytes.Contains(tt.body, []byte("media_id")) {
+				if d.MediaID != 21 || d.Episode != 3 {
+					t.Errorf("expected download linked to episode 3 of media 21, got %+v", d)
+				}
+			}
+		})
+	}
+}
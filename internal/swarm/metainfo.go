@@ -0,0 +1,220 @@
+package swarm
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/amatsagu/lumo"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+var ErrNoMetainfo = errors.New("metainfo of download is not stored")
+
+// TorrentFile is single file of recorded torrent.
+type TorrentFile struct {
+	Path     string `json:"path"`
+	Length   int64  `json:"length"`
+	Selected bool   `json:"selected"` // Only the video file is downloaded, other files of torrent are skipped
+}
+
+// saveInfo stores bencoded info dictionary of torrent, so it can be verified and added again without peers.
+func (s *SwarmClient) saveInfo(hash string, info []byte) {
+	if _, err := s.db.Exec("UPDATE downloads SET info = ? WHERE info_hash = ?", info, hash); err != nil {
+		lumo.Error("Failed to store metainfo of %s download: %v", hash, err)
+	}
+}
+
+// storedMetaInfo returns metainfo built from stored info dictionary and trackers of download magnet.
+func (s *SwarmClient) storedMetaInfo(hash, magnet string) (*metainfo.MetaInfo, error) {
+	var info []byte
+	if err := s.db.QueryRow("SELECT info FROM downloads WHERE info_hash = ?", hash).Scan(&info); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrUnknownDownload
+		}
+		return nil, err
+	}
+
+	if len(info) == 0 {
+		return nil, ErrNoMetainfo
+	}
+
+	mi := &metainfo.MetaInfo{InfoBytes: info}
+	if m, err := metainfo.ParseMagnetV2Uri(magnet); err == nil && len(m.Trackers) > 0 {
+		mi.AnnounceList = metainfo.AnnounceList{m.Trackers}
+	}
+	return mi, nil
+}
+
+// filePath returns path of file inside torrent, same as torrent.File.Path - files of multi-file torrents
+// are placed in directory named after the torrent.
+func filePath(info *metainfo.Info, f *metainfo.FileInfo) string {
+	if len(f.BestPath()) == 0 {
+		return info.BestName()
+	}
+	return strings.Join(append([]string{info.BestName()}, f.BestPath()...), "/")
+}
+
+// videoFile returns index of the file that is downloaded from torrent - the largest video, same as in add.
+func videoFile(info *metainfo.Info, files []metainfo.FileInfo) int {
+	target := -1
+	for i := range files {
+		f := &files[i]
+		name := strings.ToLower(filePath(info, f))
+		if strings.HasSuffix(name, ".mkv") || strings.HasSuffix(name, ".mp4") {
+			if target == -1 || f.Length > files[target].Length {
+				target = i
+			}
+		}
+	}
+	return target
+}
+
+// storageDir returns directory of storage that keeps video file of torrent at given path.
+func storageDir(path string, info *metainfo.Info) (string, bool) {
+	files := info.UpvertedFiles()
+	target := videoFile(info, files)
+	if target == -1 {
+		return "", false
+	}
+
+	suffix := string(filepath.Separator) + filepath.FromSlash(filePath(info, &files[target]))
+	if !strings.HasSuffix(path, suffix) {
+		return "", false
+	}
+	return strings.TrimSuffix(path, suffix), true
+}
+
+// ResumeDownloads adds downloads left unfinished or seeding by previous run back to the client. Only ones with stored
+// metainfo are resumed, so they continue right away from pieces already on disk, even without network.
+// Complete downloads are interrupted while seeding. When their seeding can't be resumed, it's given up, so finish
+// hooks still get the download.
+func (s *SwarmClient) ResumeDownloads() {
+	rows, err := s.db.Query("SELECT "+downloadColumns+" FROM downloads WHERE status = ? AND (completed_at IS NOT NULL OR path != '' AND info IS NOT NULL) OR status = ?",
+		StatusInterrupted, StatusSeeding)
+	if err != nil {
+		lumo.Error("Failed to read interrupted downloads: %v", err)
+		return
+	}
+
+	var interrupted []*Download
+	for rows.Next() {
+		d, err := scanDownload(rows)
+		if err != nil {
+			lumo.Error("Failed to read interrupted download: %v", err)
+			continue
+		}
+		interrupted = append(interrupted, d)
+	}
+	rows.Close()
+
+	var resumed, seeding int
+	for _, d := range interrupted {
+		active, err := s.resumable(d)
+		if err != nil {
+			lumo.Warn("Failed to resume \"%s\" download: %v", d.Identifier, err)
+			if d.CompletedAt != nil {
+				s.setStatus(d.InfoHash, StatusFinished)
+				s.finished(d.InfoHash)
+			}
+			continue
+		}
+
+		if d.CompletedAt != nil {
+			active.tr = &transfer{hash: d.InfoHash, path: d.Path, size: d.Size, baseDown: d.Downloaded, baseUp: d.Uploaded, completedAt: *d.CompletedAt, savedAt: time.Now()}
+			s.resumeSeeding(active)
+			seeding++
+			continue
+		}
+
+		if _, err := s.add(active); err == nil {
+			resumed++
+		}
+	}
+
+	if resumed > 0 || seeding > 0 {
+		lumo.Info("Resumed %d downloads and %d seeding torrents from previous run.", resumed, seeding)
+	}
+}
+
+// resumable returns download prepared to be added again from its stored metainfo and storage it was using.
+func (s *SwarmClient) resumable(d *Download) (*activeDownload, error) {
+	mi, err := s.storedMetaInfo(d.InfoHash, d.Magnet)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := mi.UnmarshalInfo()
+	if err != nil {
+		return nil, fmt.Errorf("stored metainfo is invalid: %w", err)
+	}
+
+	// Download continues in its original directory, even when download directory was changed since then
+	dir, ok := storageDir(d.Path, &info)
+	if !ok {
+		return nil, fmt.Errorf("%s doesn't belong to its torrent", d.Path)
+	}
+
+	s.mu.Lock()
+	st := s.dirStorage(s.storageCfg.Backend, dir)
+	s.mu.Unlock()
+
+	return &activeDownload{magnet: d.Magnet, metaInfo: mi, identifier: d.Identifier, storage: st, dir: dir}, nil
+}
+
+// Files returns files of recorded torrent. They are read from stored metainfo, so torrent doesn't have to be active.
+func (s *SwarmClient) Files(hash string) ([]TorrentFile, error) {
+	d, err := s.Download(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	mi, err := s.storedMetaInfo(hash, d.Magnet)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := mi.UnmarshalInfo()
+	if err != nil {
+		return nil, fmt.Errorf("stored metainfo is invalid: %w", err)
+	}
+
+	files := info.UpvertedFiles()
+	target := videoFile(&info, files)
+	list := make([]TorrentFile, 0, len(files))
+	for i := range files {
+		list = append(list, TorrentFile{Path: filePath(&info, &files[i]), Length: files[i].Length, Selected: i == target})
+	}
+	return list, nil
+}
+
+// FilesHandler returns files of torrent from {hash} path value.
+func (s *SwarmClient) FilesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	files, err := s.Files(r.PathValue("hash"))
+	switch {
+	case errors.Is(err, ErrUnknownDownload):
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "unknown download"})
+		return
+	case errors.Is(err, ErrNoMetainfo):
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	case err != nil:
+		lumo.Error("Failed to read files of %s download: %v", r.PathValue("hash"), err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to read files of download"})
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(files); err != nil {
+		lumo.Error("Failed to encode files of download: %v", err)
+	}
+}
@@ -0,0 +1,282 @@
+package swarm
+
+import (
+	"bytes"
+	"errors"
+	"jubako/internal/config"
+	"jubako/internal/testutil"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+func TestSaveInfoRoundTrip(t *testing.T) {
+	s := newTestClient(t)
+	hash, _ := seedTorrent(t, s)
+
+	mi, err := s.storedMetaInfo(hash, "magnet:?xt=urn:btih:"+hash)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	infoBytes := mi.InfoBytes
+
+	s.saveInfo(hash, nil)
+	if _, err := s.storedMetaInfo(hash, ""); !errors.Is(err, ErrNoMetainfo) {
+		t.Errorf("expected missing metainfo, got %v", err)
+	}
+
+	s.saveInfo(hash, infoBytes)
+	magnet := "magnet:?xt=urn:btih:" + hash + "&tr=udp%3A%2F%2Ftracker.example%3A1337%2Fannounce"
+	mi, err = s.storedMetaInfo(hash, magnet)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !bytes.Equal(mi.InfoBytes, infoBytes) || mi.HashInfoBytes().HexString() != hash {
+		t.Errorf("expected stored info of %s, got %s", hash, mi.HashInfoBytes().HexString())
+	}
+
+	if len(mi.AnnounceList) != 1 || !slices.Equal(mi.AnnounceList[0], []string{"udp://tracker.example:1337/announce"}) {
+		t.Errorf("expected trackers of magnet, got %v", mi.AnnounceList)
+	}
+
+	if _, err := s.storedMetaInfo("missing", ""); !errors.Is(err, ErrUnknownDownload) {
+		t.Errorf("expected unknown download, got %v", err)
+	}
+}
+
+func TestStorageDir(t *testing.T) {
+	multi := &metainfo.Info{Name: "Gachiakuta", Files: []metainfo.FileInfo{
+		{Path: []string{"a.nfo"}, Length: 10},
+		{Path: []string{"Season 1", "b.mkv"}, Length: 100},
+	}}
+	single := &metainfo.Info{Name: "Gachiakuta - 03.mkv", Length: 100}
+	noVideo := &metainfo.Info{Name: "Gachiakuta - 03.nfo", Length: 10}
+	root := filepath.FromSlash("/data/downloads")
+
+	tests := []struct {
+		name string
+		info *metainfo.Info
+		path string
+		dir  string
+		ok   bool
+	}{
+		{"multi-file", multi, filepath.Join(root, "Gachiakuta", "Season 1", "b.mkv"), root, true},
+		{"single file", single, filepath.Join(root, "Gachiakuta - 03.mkv"), root, true},
+		{"moved download directory", single, filepath.FromSlash("/mnt/anime/Gachiakuta - 03.mkv"), filepath.FromSlash("/mnt/anime"), true},
+		{"organized into library", single, filepath.FromSlash("/library/Gachiakuta/Gachiakuta - S01E03.mkv"), "", false},
+		{"file of other torrent", multi, filepath.Join(root, "Gachiakuta", "b.mkv"), "", false},
+		{"no video", noVideo, filepath.Join(root, "Gachiakuta - 03.nfo"), "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, ok := storageDir(tt.path, tt.info)
+			if dir != tt.dir || ok != tt.ok {
+				t.Errorf("expected (%q, %v), got (%q, %v)", tt.dir, tt.ok, dir, ok)
+			}
+		})
+	}
+}
+
+// activeTorrent returns torrent of download, once it's added to the client.
+func activeTorrent(s *SwarmClient, hash string) *activeDownload {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.active[hash]
+}
+
+func TestResumeDownloadsSkipsMetadataWait(t *testing.T) {
+	s := newTestClient(t)
+	s.SetTrackers(config.Trackers{MetadataTimeout: 3600})
+	hash, _ := seedTorrent(t, s)
+
+	if _, err := s.db.Exec("UPDATE downloads SET status = ?, completed_at = NULL", StatusInterrupted); err != nil {
+		t.Fatalf("failed to interrupt download: %v", err)
+	}
+
+	s.ResumeDownloads()
+
+	// Nobody to fetch metadata from, so only stored info lets download continue
+	d := activeTorrent(s, hash)
+	if d == nil {
+		t.Fatal("expected interrupted download to be resumed")
+	}
+
+	select {
+	case <-d.t.GotInfo():
+	case <-time.After(time.Second):
+		t.Fatal("expected resumed download to have metadata right away")
+	}
+
+	if d.dir != s.downloadDir {
+		t.Errorf("expected download to continue in %s, got %s", s.downloadDir, d.dir)
+	}
+}
+
+func TestResumeDownloadsSkipsFilesOutsideTheirTorrent(t *testing.T) {
+	s := newTestClient(t)
+	hash, video := seedTorrent(t, s)
+
+	moved := filepath.Join(t.TempDir(), "Gachiakuta - S01E03.mkv")
+	if err := os.Rename(video, moved); err != nil {
+		t.Fatalf("failed to move video: %v", err)
+	}
+
+	if _, err := s.db.Exec("UPDATE downloads SET status = ?, completed_at = NULL, path = ?", StatusInterrupted, moved); err != nil {
+		t.Fatalf("failed to interrupt download: %v", err)
+	}
+
+	s.ResumeDownloads()
+	if activeTorrent(s, hash) != nil {
+		t.Error("expected download relocated out of its torrent to stay interrupted")
+	}
+
+	if d, err := s.Download(hash); err != nil || d.Status != StatusInterrupted {
+		t.Errorf("expected interrupted download, got %+v (%v)", d, err)
+	}
+}
+
+func TestResumeDownloadsSeedsAgain(t *testing.T) {
+	tests := []struct {
+		name     string
+		relocate bool
+		policy   config.SeedPolicy
+		active   bool
+		status   string
+	}{
+		{"seeding target not reached", false, config.SeedPolicy{Hours: 100}, true, StatusSeeding},
+		{"seeding target reached", false, config.SeedPolicy{}, false, StatusFinished},
+		{"file moved out of torrent", true, config.SeedPolicy{Hours: 100}, false, StatusFinished},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestClient(t)
+			s.SetSeedPolicy(tt.policy)
+			hash, video := seedTorrent(t, s)
+
+			path := video
+			if tt.relocate {
+				path = filepath.Join(t.TempDir(), "Gachiakuta - S01E03.mkv")
+			}
+
+			if _, err := s.db.Exec("UPDATE downloads SET status = ?, path = ?", StatusSeeding, path); err != nil {
+				t.Fatalf("failed to record seeding download: %v", err)
+			}
+
+			finished := make(chan Download, 1)
+			var completed atomic.Int32
+			s.OnFinish(func(d Download) { finished <- d })
+			s.OnComplete(func(string, DownloadDetails) { completed.Add(1) })
+
+			s.ResumeDownloads()
+
+			if tt.active {
+				d := activeTorrent(s, hash)
+				if d == nil {
+					t.Fatal("expected seeding to be resumed")
+				}
+				<-d.t.GotInfo()
+			} else {
+				select {
+				case d := <-finished:
+					if d.InfoHash != hash {
+						t.Errorf("expected %s to finish, got %s", hash, d.InfoHash)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatal("expected finish hooks to get download that no longer seeds")
+				}
+			}
+
+			if d, err := s.Download(hash); err != nil || d.Status != tt.status || d.CompletedAt == nil {
+				t.Errorf("expected %s download that stays complete, got %+v (%v)", tt.status, d, err)
+			}
+
+			if completed.Load() != 0 {
+				t.Error("expected resumed seeding not to be reported as completed again")
+			}
+		})
+	}
+}
+
+func TestSeedingContinuesAfterRestart(t *testing.T) {
+	first := NewSwarmClient(testutil.OpenDB(t), t.TempDir(), t.TempDir(), config.Network{})
+	first.SetSeedPolicy(config.SeedPolicy{Hours: 100})
+	hash, _ := seedTorrent(t, first)
+
+	if _, err := first.db.Exec("UPDATE downloads SET status = ?", StatusSeeding); err != nil {
+		t.Fatalf("failed to record seeding download: %v", err)
+	}
+
+	first.ResumeDownloads()
+	if activeTorrent(first, hash) == nil {
+		t.Fatal("expected seeding to be resumed")
+	}
+	first.Close()
+
+	// Seeding stops in background once torrent is closed
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		d, err := first.Download(hash)
+		if err == nil && d.Status == StatusInterrupted {
+			if d.CompletedAt == nil {
+				t.Fatal("expected interrupted seeding to stay complete")
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected seeding to be interrupted by close, got %+v (%v)", d, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Next start has no seeding target left, so resumed seeding is done right away
+	second := NewSwarmClient(first.db, first.downloadDir, t.TempDir(), config.Network{})
+	t.Cleanup(second.Close)
+
+	finished := make(chan Download, 1)
+	second.OnFinish(func(d Download) { finished <- d })
+	second.ResumeDownloads()
+
+	select {
+	case d := <-finished:
+		if d.InfoHash != hash {
+			t.Errorf("expected %s to finish, got %s", hash, d.InfoHash)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected seeding interrupted by close to reach finish hooks")
+	}
+
+	if d, err := second.Download(hash); err != nil || d.Status != StatusFinished {
+		t.Errorf("expected finished download, got %+v (%v)", d, err)
+	}
+}
+
+func TestInitDownloadsTableKeepsSeedingDownloads(t *testing.T) {
+	s := newTestClient(t)
+	for hash, status := range map[string]string{"dl": StatusDownloading, "seed": StatusSeeding, "stream": StatusStreaming} {
+		seedDownload(t, s, Download{InfoHash: hash, Status: status, Size: 10})
+	}
+
+	// Complete download still downloading was being repaired
+	seedDownload(t, s, Download{InfoHash: "repair", Status: StatusDownloading, Size: 10})
+	if _, err := s.db.Exec("UPDATE downloads SET completed_at = ? WHERE info_hash = 'repair'", time.Now()); err != nil {
+		t.Fatalf("failed to complete download: %v", err)
+	}
+
+	if interrupted := initDownloadsTable(s.db); !slices.Equal(interrupted, []string{"repair"}) {
+		t.Errorf("expected repaired download to be verified again, got %v", interrupted)
+	}
+
+	for hash, want := range map[string]string{"dl": StatusInterrupted, "seed": StatusSeeding, "stream": StatusInterrupted, "repair": StatusFinished} {
+		if d, err := s.Download(hash); err != nil || d.Status != want {
+			t.Errorf("expected %s download to be %s, got %+v (%v)", hash, want, d, err)
+		}
+	}
+}
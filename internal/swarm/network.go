@@ -0,0 +1,217 @@
+package swarm
+
+import (
+	"errors"
+	"fmt"
+	"jubako/internal/config"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/amatsagu/lumo"
+	alog "github.com/anacrolix/log"
+	"github.com/anacrolix/torrent"
+	"golang.org/x/net/proxy"
+)
+
+var errProxyUDP = errors.New("udp trackers are not supported through proxy")
+
+// newTorrentClient creates torrent client that follows given network settings. It returns address the client
+// is bound to, which is nil when traffic is not bound or bound interface is not available.
+func (s *SwarmClient) newTorrentClient(network config.Network) (*torrent.Client, net.IP, error) {
+	cfg := torrent.NewDefaultClientConfig()
+	cfg.DataDir = s.defaultDir
+	s.mu.Lock()
+	cfg.DefaultStorage = s.dirStorage(config.StorageFile, s.defaultDir)
+	s.mu.Unlock()
+	cfg.DownloadRateLimiter = s.downloadLimiter
+	cfg.UploadRateLimiter = s.uploadLimiter
+	cfg.Debug = false
+	cfg.Logger = cfg.Logger.WithFilterLevel(alog.Disabled)
+
+	cfg.ListenPort = network.ListenPort
+	cfg.DisableIPv6 = !network.IPv6
+	cfg.NoDHT = !network.DHT
+	cfg.DisablePEX = !network.PEX
+	cfg.DisableUTP = !network.UTP
+	cfg.NoDefaultPortForwarding = !network.UPnP
+	cfg.HeaderObfuscationPolicy = torrent.HeaderObfuscationPolicy{
+		Preferred:        network.RequireEncryption || cfg.HeaderObfuscationPolicy.Preferred,
+		RequirePreferred: network.RequireEncryption,
+	}
+
+	var bindIP net.IP
+	var peerDialer proxy.ContextDialer
+	var peerNetwork string
+	var forward proxy.Dialer = proxy.Direct
+	if network.Interface != "" {
+		bindIP, _ = s.resolve(network.Interface, network.IPv6)
+		if bindIP == nil {
+			lumo.Warn("Network interface %s is not available - torrents will wait until it comes back.", network.Interface)
+		}
+
+		d, n := bindTo(cfg, bindIP)
+		forward, peerDialer, peerNetwork = d, d, n
+	}
+
+	proxyURL, err := network.ProxyURL()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if proxyURL != nil {
+		d, err := proxy.FromURL(proxyURL, forward)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create proxy dialer: %w", err)
+		}
+
+		var ok bool
+		if peerDialer, ok = d.(proxy.ContextDialer); !ok {
+			return nil, nil, errors.New("proxy dialer doesn't support cancellation")
+		}
+		peerNetwork = "tcp"
+
+		// Only TCP can go through SOCKS5, so everything using UDP would reveal real address
+		cfg.NoDHT = true
+		cfg.DisableUTP = true
+		cfg.NoDefaultPortForwarding = true
+		cfg.DialForPeerConns = false
+		cfg.HTTPProxy = http.ProxyURL(proxyURL)
+		cfg.TrackerListenPacket = func(network, addr string) (net.PacketConn, error) {
+			return nil, errProxyUDP
+		}
+		lumo.Info("Routing peer and tracker connections through %s proxy (DHT, uTP and UPnP are disabled).", proxyURL.Redacted())
+	}
+
+	c, err := torrent.NewClient(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if peerDialer != nil && peerNetwork != "" {
+		c.AddDialer(torrent.NetworkDialer{Network: peerNetwork, Dialer: peerDialer})
+	}
+	return c, bindIP, nil
+}
+
+// Restart recreates torrent client with new network settings. Active downloads are added again and resume
+// from data already stored on disk. When new settings can't be applied, previous ones are restored.
+func (s *SwarmClient) Restart(network config.Network) error {
+	s.restartMu.Lock()
+	defer s.restartMu.Unlock()
+
+	s.mu.Lock()
+	old := s.client
+	previous := s.network
+	active := make([]*activeDownload, 0, len(s.active))
+	for _, d := range s.active {
+		active = append(active, d)
+	}
+	clear(s.active)
+	s.mu.Unlock()
+
+	lumo.Info("Restarting torrent client with new network settings (%d active downloads)...", len(active))
+	for _, d := range active {
+		// Save totals now, as new session of the same torrent starts counting from them
+		status := StatusDownloading
+		if d.stream {
+			status = StatusStreaming
+		} else if !d.tr.completedAt.IsZero() {
+			status = StatusSeeding
+		}
+		s.saveTransfer(d.tr, d.t.Stats(), status)
+	}
+
+	// Old client must release listen port first
+	old.Close()
+
+	c, bindIP, err := s.recreateTorrentClient(network)
+	if err != nil {
+		werr := lumo.WrapError(err)
+		lumo.Error("Failed to apply new network settings, restoring previous ones: %v", werr)
+
+		if c, bindIP, err = s.recreateTorrentClient(previous); err != nil {
+			lumo.Panic("Failed to restore torrent client: %v", lumo.WrapError(err))
+		}
+		network, err = previous, werr
+	}
+
+	s.mu.Lock()
+	s.client = c
+	s.setNetwork(network, bindIP)
+	s.mu.Unlock()
+
+	for _, d := range active {
+		if d.tr.completedAt.IsZero() {
+			s.add(&activeDownload{magnet: d.magnet, metaInfo: d.metaInfo, identifier: d.identifier, callback: d.callback, storage: d.storage, dir: d.dir, path: d.path, stream: d.stream, repair: d.repair})
+		} else {
+			s.resumeSeeding(d)
+		}
+	}
+	return err
+}
+
+// recreateTorrentClient retries creating client for a moment, since closed client releases its sockets in background.
+func (s *SwarmClient) recreateTorrentClient(network config.Network) (c *torrent.Client, bindIP net.IP, err error) {
+	for range 20 {
+		if c, bindIP, err = s.newTorrentClient(network); err == nil {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return
+}
+
+// resumeSeeding adds completed torrent back to the client, without downloading or reporting it again.
+func (s *SwarmClient) resumeSeeding(d *activeDownload) {
+	spec, err := s.torrentSpec(d)
+	if err != nil {
+		return
+	}
+
+	spec.Storage = d.storage
+	t, _, err := s.torrentClient().AddTorrentSpec(spec)
+	if err != nil {
+		lumo.Warn("Failed to resume seeding \"%s\": %v", d.identifier, err)
+		s.setStatus(d.tr.hash, StatusFinished)
+		return
+	}
+
+	s.mu.RLock()
+	paused := s.paused
+	s.mu.RUnlock()
+
+	if paused {
+		pauseTorrent(t)
+	}
+
+	resumed := &activeDownload{t: t, tr: d.tr, magnet: d.magnet, metaInfo: d.metaInfo, identifier: d.identifier, callback: d.callback, storage: d.storage, dir: d.dir, path: d.path}
+	s.track(resumed)
+
+	go func() {
+		select {
+		case <-t.GotInfo():
+		case <-t.Closed():
+			if s.untrack(resumed) {
+				s.mu.Lock()
+				delete(s.cancelled, d.tr.hash)
+				closing := s.closing
+				s.mu.Unlock()
+
+				if closing {
+					s.setStatus(d.tr.hash, StatusInterrupted)
+				} else {
+					s.setStatus(d.tr.hash, StatusFinished)
+				}
+			}
+			return
+		case <-time.After(s.metadataTimeout()):
+			t.Drop()
+			s.untrack(resumed)
+			s.setStatus(d.tr.hash, StatusFinished)
+			return
+		}
+
+		s.seed(resumed)
+	}()
+}
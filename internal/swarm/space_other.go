@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !windows
+
+package swarm
+
+import "errors"
+
+// freeSpace is not supported on this system, so disk guard is disabled.
+func freeSpace(dir string) (int64, error) {
+	return 0, errors.ErrUnsupported
+}
@@ -0,0 +1,14 @@
+//go:build linux || darwin
+
+package swarm
+
+import "golang.org/x/sys/unix"
+
+// freeSpace returns bytes available to unprivileged user on drive of given directory.
+func freeSpace(dir string) (int64, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
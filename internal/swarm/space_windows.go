@@ -0,0 +1,19 @@
+//go:build windows
+
+package swarm
+
+import "golang.org/x/sys/windows"
+
+// freeSpace returns bytes available to current user on drive of given directory.
+func freeSpace(dir string) (int64, error) {
+	path, err := windows.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	var available uint64
+	if err := windows.GetDiskFreeSpaceEx(path, &available, nil, nil); err != nil {
+		return 0, err
+	}
+	return int64(available), nil
+}
@@ -0,0 +1,106 @@
+package swarm
+
+import (
+	"jubako/internal/config"
+	"os"
+	"path/filepath"
+
+	"github.com/amatsagu/lumo"
+	"github.com/anacrolix/missinggo/v2/filecache"
+	"github.com/anacrolix/torrent/storage"
+)
+
+// pieceCacheDir inside cache directory holds pieces of streamed torrents.
+const pieceCacheDir = "pieces"
+
+type storageKey struct {
+	backend string
+	dir     string
+}
+
+// sharedCompletion is left open when storage closes, as other storages of the same directory may still use it.
+type sharedCompletion struct {
+	storage.PieceCompletion
+}
+
+func (sharedCompletion) Close() error { return nil }
+
+// SetStorage changes storage settings. Backend is used by torrents added from now on, while cache size applies right away.
+func (s *SwarmClient) SetStorage(cfg config.Storage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.storageCfg = cfg
+	if s.pieceCache != nil {
+		s.pieceCache.SetCapacity(cfg.StreamCacheSize)
+		s.pieceCache.TrimToCapacity() // Smaller cache frees space right away, not with the next written piece
+	}
+}
+
+// storage returns storage for new torrent and directory of its files. Streamed torrents have no files, so their directory is empty.
+func (s *SwarmClient) storage(stream bool) (storage.ClientImpl, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if stream {
+		st, err := s.streamStorage()
+		return st, "", err
+	}
+	return s.dirStorage(s.storageCfg.Backend, s.downloadDir), s.downloadDir, nil
+}
+
+// dirStorage returns storage keeping torrent files in dir. Storages of the same directory share its piece completion,
+// since its database can't be opened twice. Caller must hold the lock.
+func (s *SwarmClient) dirStorage(backend, dir string) storage.ClientImplCloser {
+	key := storageKey{backend: backend, dir: dir}
+	if st, ok := s.storages[key]; ok {
+		return st
+	}
+
+	pc, ok := s.completions[dir]
+	if !ok {
+		var err error
+		if err = os.MkdirAll(dir, 0755); err == nil {
+			pc, err = storage.NewDefaultPieceCompletionForDir(dir)
+		}
+
+		if err != nil {
+			lumo.Warn("Failed to open piece completion in %s, progress of its torrents won't be remembered: %v", dir, err)
+			pc = storage.NewMapPieceCompletion()
+		}
+		s.completions[dir] = pc
+	}
+
+	var st storage.ClientImplCloser
+	if backend == config.StorageMMap {
+		st = storage.NewMMapWithCompletion(dir, sharedCompletion{pc})
+	} else {
+		st = storage.NewFileWithCompletion(dir, sharedCompletion{pc})
+	}
+	s.storages[key] = st
+	return st
+}
+
+// streamStorage returns storage shared by all streamed torrents. Pieces are kept in cache directory
+// up to configured size, evicting least recently used ones first. Caller must hold the lock.
+func (s *SwarmClient) streamStorage() (storage.ClientImpl, error) {
+	if s.pieceStorage != nil {
+		return s.pieceStorage, nil
+	}
+
+	// Cache rescans its directory, so pieces from previous runs are counted towards its size as well
+	cache, err := filecache.NewCache(filepath.Join(s.cacheDir, pieceCacheDir))
+	if err != nil {
+		return nil, err
+	}
+	cache.SetCapacity(s.storageCfg.StreamCacheSize)
+
+	// Client must not want more pieces at once than cache holds, otherwise they would keep evicting each other
+	capacity := func() (int64, bool) {
+		return cache.Info().Capacity, true
+	}
+
+	s.pieceCache = cache
+	s.pieceStorage = storage.NewResourcePiecesOpts(cache.AsResourceProvider(), storage.ResourcePiecesOpts{Capacity: &capacity})
+	return s.pieceStorage, nil
+}
@@ -0,0 +1,90 @@
+package swarm
+
+import (
+	"jubako/internal/config"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStreamCacheEvictsLeastRecentlyUsedPieces(t *testing.T) {
+	s := newTestClient(t)
+
+	// Pieces left by previous run count towards cache size
+	dir := filepath.Join(s.cacheDir, pieceCacheDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("failed to create cache directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "old"), make([]byte, 30), 0600); err != nil {
+		t.Fatalf("failed to write cached piece: %v", err)
+	}
+
+	s.SetStorage(config.Storage{Backend: config.StorageFile, StreamCacheSize: 100})
+	if _, dir, err := s.storage(true); err != nil || dir != "" {
+		t.Fatalf("expected stream storage without directory, got %q (%v)", dir, err)
+	}
+
+	cache := s.pieceCache
+	if info := cache.Info(); info.Capacity != 100 || info.Filled != 30 {
+		t.Fatalf("expected cache of 100 bytes with 30 filled, got %+v", info)
+	}
+
+	write := func(name string) {
+		t.Helper()
+		time.Sleep(2 * time.Millisecond) // Keep access times apart
+		f, err := cache.OpenFile(name, os.O_CREATE|os.O_WRONLY)
+		if err != nil {
+			t.Fatalf("failed to open %s piece: %v", name, err)
+		}
+		defer f.Close()
+
+		if _, err := f.Write(make([]byte, 30)); err != nil {
+			t.Fatalf("failed to write %s piece: %v", name, err)
+		}
+	}
+
+	cached := func(name string) bool {
+		_, err := cache.Stat(name)
+		return err == nil
+	}
+
+	write("a")
+	write("b")
+
+	// Reading piece makes it recently used, so "a" is the oldest one now
+	time.Sleep(2 * time.Millisecond)
+	f, err := cache.OpenFile("old", os.O_RDONLY)
+	if err != nil {
+		t.Fatalf("failed to open old piece: %v", err)
+	}
+	f.Read(make([]byte, 30))
+	f.Close()
+
+	write("c")
+
+	cases := []struct {
+		piece  string
+		cached bool
+	}{
+		{"old", true},
+		{"a", false},
+		{"b", true},
+		{"c", true},
+	}
+	for _, c := range cases {
+		if got := cached(c.piece); got != c.cached {
+			t.Errorf("expected %s piece cached: %v, got %v", c.piece, c.cached, got)
+		}
+	}
+
+	// Shrinking cache evicts pieces right away
+	s.SetStorage(config.Storage{Backend: config.StorageFile, StreamCacheSize: 60})
+	if info := cache.Info(); info.Capacity != 60 || info.Filled > 60 {
+		t.Errorf("expected cache trimmed to 60 bytes, got %+v", info)
+	}
+
+	if cached("b") {
+		t.Error("expected least recently used piece to be evicted after shrinking cache")
+	}
+}
@@ -0,0 +1,351 @@
+package swarm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"jubako/internal/config"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/amatsagu/lumo"
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// Announce states of tracker.
+const (
+	TrackerPending = "pending" // Not announced to yet
+	TrackerWorking = "working"
+	TrackerError   = "error"
+)
+
+var ErrNotActive = errors.New("download is not active")
+
+// trackerLine matches tracker in status of torrent client, e.g. `"udp://tracker.example:1337/announce"  next ann: 29m59s, last ann: 12 peers`.
+// Client doesn't expose results of announces to HTTP and UDP trackers in any other way.
+var trackerLine = regexp.MustCompile(`^\s+("(?:[^"\\]|\\.)*")\s+next ann: (\S+), last ann: (.*)$`)
+
+// websocketTrackerLine matches WebSocket tracker, which client lists only with its connection stats, e.g.
+// `"wss://tracker.example/announce"  {Dials:1 ConvertedInboundConns:0 ConvertedOutboundConns:0}`.
+var websocketTrackerLine = regexp.MustCompile(`^\s+("(?:[^"\\]|\\.)*")\s+\{.*\}$`)
+
+// errTrackerStatus is returned when status of torrent client doesn't have the expected layout, e.g. after its update.
+var errTrackerStatus = errors.New("unexpected status of torrent client")
+
+// trackerRank orders announce states from the least useful one.
+var trackerRank = map[string]int{TrackerPending: 0, TrackerError: 1, TrackerWorking: 2}
+
+// TrackerStatus is result of the last announce to single tracker of active torrent.
+type TrackerStatus struct {
+	URL          string `json:"url"`
+	Status       string `json:"status"`
+	Peers        int    `json:"peers"`           // Peers returned by the last successful announce
+	Error        string `json:"error,omitempty"` // Why the last announce failed
+	NextAnnounce int    `json:"next_announce"`   // Seconds until next announce, 0 when it may happen anytime
+}
+
+// SetTrackers changes metadata timeout and extra trackers. New extra trackers are added to active torrents right away,
+// while removed ones are only left out of torrents added from now on.
+func (s *SwarmClient) SetTrackers(cfg config.Trackers) {
+	s.mu.Lock()
+	s.trackers = cfg
+	active := make([]*activeDownload, 0, len(s.active))
+	for _, d := range s.active {
+		active = append(active, d)
+	}
+	s.mu.Unlock()
+
+	if len(cfg.Extra) == 0 {
+		return
+	}
+
+	for _, d := range active {
+		d.t.AddTrackers([][]string{cfg.Extra})
+	}
+}
+
+// metadataTimeout returns how long torrent may look for peers that know its metadata.
+func (s *SwarmClient) metadataTimeout() time.Duration {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return time.Duration(s.trackers.MetadataTimeout) * time.Second
+}
+
+// torrentSpec returns spec needed to add download to the client, with trackers of its magnet and extra trackers
+// from settings. Magnet keeps trackers added later, which metainfo of .torrent file doesn't know about.
+func (s *SwarmClient) torrentSpec(d *activeDownload) (*torrent.TorrentSpec, error) {
+	spec, err := d.spec()
+	if err != nil {
+		return nil, err
+	}
+
+	var trackers []string
+	if m, err := metainfo.ParseMagnetV2Uri(d.magnet); err == nil {
+		trackers = m.Trackers
+	}
+
+	s.mu.RLock()
+	trackers = append(trackers, s.trackers.Extra...)
+	s.mu.RUnlock()
+
+	spec.Trackers = appendTrackers(spec.Trackers, trackers)
+	return spec, nil
+}
+
+// appendTrackers adds trackers missing from announce list as its last tier.
+func appendTrackers(list [][]string, trackers []string) [][]string {
+	var tier []string
+	for _, announce := range trackers {
+		known := slices.ContainsFunc(list, func(t []string) bool {
+			return slices.Contains(t, announce)
+		})
+
+		if !known && !slices.Contains(tier, announce) {
+			tier = append(tier, announce)
+		}
+	}
+
+	if len(tier) > 0 {
+		list = append(list, tier)
+	}
+	return list
+}
+
+// AddTrackers adds trackers to recorded download. They're kept in its magnet, so download uses them after restart
+// as well, and active torrent starts announcing to them right away.
+func (s *SwarmClient) AddTrackers(hash string, trackers []string) error {
+	for _, announce := range trackers {
+		if err := config.ValidateTracker(announce); err != nil {
+			return err
+		}
+	}
+
+	// Restart adds torrents again with their magnet, so it must not run while magnet changes
+	s.restartMu.Lock()
+	defer s.restartMu.Unlock()
+
+	d, err := s.Download(hash)
+	if err != nil {
+		return err
+	}
+
+	m, err := metainfo.ParseMagnetV2Uri(d.Magnet)
+	if err != nil {
+		return fmt.Errorf("stored magnet is invalid: %w", err)
+	}
+
+	for _, announce := range trackers {
+		if !slices.Contains(m.Trackers, announce) {
+			m.Trackers = append(m.Trackers, announce)
+		}
+	}
+	magnet := m.String()
+
+	if _, err := s.db.Exec("UPDATE downloads SET magnet = ? WHERE info_hash = ?", magnet, hash); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	active := s.active[hash]
+	if active != nil {
+		active.magnet = magnet
+	}
+	s.mu.Unlock()
+
+	if active != nil {
+		active.t.AddTrackers([][]string{trackers})
+	}
+	return nil
+}
+
+// Trackers returns announce status of every tracker of active torrent.
+func (s *SwarmClient) Trackers(hash string) ([]TrackerStatus, error) {
+	if _, err := s.Download(hash); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	active := s.active[hash]
+	c := s.client
+	s.mu.RUnlock()
+
+	if active == nil {
+		return nil, ErrNotActive
+	}
+
+	var status bytes.Buffer
+	c.WriteStatus(&status)
+	return parseTrackers(&status, hash)
+}
+
+// parseTrackers reads trackers of torrent with given info hash from status of torrent client.
+// Trackers are listed in table following "Enabled trackers:" line of the torrent, after its header.
+// Client announces to UDP tracker over IPv4 and IPv6 separately, these are merged back into the tracker.
+func parseTrackers(status io.Reader, hash string) ([]TrackerStatus, error) {
+	var trackers []TrackerStatus
+	var current string
+	var table, header bool
+	scanner := bufio.NewScanner(status)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if h, ok := strings.CutPrefix(line, "Infohash: "); ok {
+			current, table = h, false
+			continue
+		}
+
+		if current != hash {
+			continue
+		}
+
+		if line == "Enabled trackers:" {
+			trackers, table, header = make([]TrackerStatus, 0), true, true
+			continue
+		}
+
+		if !table {
+			continue
+		}
+
+		if header {
+			header = false
+			continue
+		}
+
+		if !strings.HasPrefix(strings.TrimSpace(line), `"`) {
+			table = false // Table ends with the first line that isn't a tracker
+			continue
+		}
+
+		if match := websocketTrackerLine.FindStringSubmatch(line); match != nil {
+			announce, err := strconv.Unquote(match[1])
+			if err != nil {
+				return nil, fmt.Errorf("%w: tracker url %s", errTrackerStatus, match[1])
+			}
+
+			// Results of announces to WebSocket trackers are not part of the status
+			trackers = append(trackers, TrackerStatus{URL: announce, Status: TrackerPending})
+			continue
+		}
+
+		match := trackerLine.FindStringSubmatch(line)
+		if match == nil {
+			return nil, fmt.Errorf("%w: tracker line %q", errTrackerStatus, line)
+		}
+
+		announce, err := strconv.Unquote(match[1])
+		if err != nil {
+			return nil, fmt.Errorf("%w: tracker url %s", errTrackerStatus, match[1])
+		}
+
+		for _, scheme := range []string{"udp4://", "udp6://"} {
+			if rest, ok := strings.CutPrefix(announce, scheme); ok {
+				announce = "udp://" + rest
+			}
+		}
+
+		tracker := TrackerStatus{URL: announce}
+		if next, err := time.ParseDuration(match[2]); err == nil {
+			tracker.NextAnnounce = int(next.Seconds())
+		}
+
+		last := match[3]
+		peers, ok := strings.CutSuffix(last, " peers")
+		n, err := strconv.Atoi(peers)
+		switch {
+		case ok && err == nil:
+			tracker.Status, tracker.Peers = TrackerWorking, n
+		case last == "never":
+			tracker.Status = TrackerPending
+		default:
+			tracker.Status, tracker.Error = TrackerError, last
+		}
+
+		i := slices.IndexFunc(trackers, func(t TrackerStatus) bool { return t.URL == announce })
+		switch {
+		case i == -1:
+			trackers = append(trackers, tracker)
+		case trackerRank[tracker.Status] > trackerRank[trackers[i].Status]:
+			trackers[i] = tracker // The other IP version works better
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if trackers == nil {
+		return nil, fmt.Errorf("%w: no trackers of %s torrent", errTrackerStatus, hash)
+	}
+	return trackers, nil
+}
+
+// TrackersHandler returns announce status of trackers of torrent from {hash} path value.
+func (s *SwarmClient) TrackersHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	trackers, err := s.Trackers(r.PathValue("hash"))
+	switch {
+	case errors.Is(err, ErrUnknownDownload):
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "unknown download"})
+		return
+	case errors.Is(err, ErrNotActive):
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	case err != nil:
+		lumo.Error("Failed to read trackers of %s download: %v", r.PathValue("hash"), err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to read trackers of download"})
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(trackers); err != nil {
+		lumo.Error("Failed to encode trackers: %v", err)
+	}
+}
+
+// AddTrackersHandler adds trackers to torrent from {hash} path value, e.g. {"trackers": ["udp://tracker.example:1337/announce"]}.
+func (s *SwarmClient) AddTrackersHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var body struct {
+		Trackers []string `json:"trackers"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || len(body.Trackers) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "expected list of trackers"})
+		return
+	}
+
+	for _, announce := range body.Trackers {
+		if err := config.ValidateTracker(announce); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+	}
+
+	err := s.AddTrackers(r.PathValue("hash"), body.Trackers)
+	switch {
+	case errors.Is(err, ErrUnknownDownload):
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "unknown download"})
+		return
+	case err != nil:
+		lumo.Error("Failed to add trackers to %s download: %v", r.PathValue("hash"), err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to add trackers"})
+		return
+	}
+
+	fmt.Fprint(w, `{"status": "success"}`)
+}
@@ -0,0 +1,190 @@
+package swarm
+
+import (
+	"errors"
+	"jubako/internal/config"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+func TestAppendTrackers(t *testing.T) {
+	cases := []struct {
+		list     [][]string
+		trackers []string
+		want     [][]string
+	}{
+		{nil, nil, nil},
+		{nil, []string{"udp://a", "udp://b", "udp://a"}, [][]string{{"udp://a", "udp://b"}}},
+		{[][]string{{"udp://a"}, {"udp://b"}}, []string{"udp://b", "udp://c"}, [][]string{{"udp://a"}, {"udp://b"}, {"udp://c"}}},
+		{[][]string{{"udp://a", "udp://b"}}, []string{"udp://b", "udp://a"}, [][]string{{"udp://a", "udp://b"}}}, // No empty tier
+	}
+
+	for _, c := range cases {
+		if got := appendTrackers(c.list, c.trackers); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("appending %v to %v: expected %v, got %v", c.trackers, c.list, c.want, got)
+		}
+	}
+}
+
+func TestTorrentSpecMergesTrackers(t *testing.T) {
+	s := newTestClient(t)
+	s.SetTrackers(config.Trackers{MetadataTimeout: 60, Extra: []string{"udp://extra", "udp://a"}})
+
+	hash := strings.Repeat("ab", 20)
+	magnet := "magnet:?xt=urn:btih:" + hash + "&tr=udp://a&tr=udp://b"
+	mi := &metainfo.MetaInfo{
+		InfoBytes:    []byte("d4:name3:abc12:piece lengthi32e6:pieces0:e"),
+		AnnounceList: metainfo.AnnounceList{{"udp://file"}},
+	}
+
+	cases := []struct {
+		name string
+		d    *activeDownload
+		want [][]string
+	}{
+		{"magnet", &activeDownload{magnet: magnet}, [][]string{{"udp://a", "udp://b"}, {"udp://extra"}}},
+		// Magnet keeps trackers added later, which metainfo of .torrent file doesn't know about
+		{"torrent file", &activeDownload{magnet: magnet, metaInfo: mi}, [][]string{{"udp://file"}, {"udp://a", "udp://b", "udp://extra"}}},
+	}
+
+	for _, c := range cases {
+		spec, err := s.torrentSpec(c.d)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.name, err)
+		}
+
+		if !reflect.DeepEqual(spec.Trackers, c.want) {
+			t.Errorf("%s: expected %v, got %v", c.name, c.want, spec.Trackers)
+		}
+	}
+}
+
+func TestParseTrackers(t *testing.T) {
+	hash := strings.Repeat("ab", 20)
+	other := "Infohash: " + strings.Repeat("cd", 20) + `
+Enabled trackers:
+    URL                                  Extra
+    "udp://other.example:1337/announce"  next ann: 10m0s, last ann: 3 peers
+DHT Announces: 0
+`
+	torrent := "Infohash: " + hash + `
+Metadata length: 141
+Enabled trackers:
+    URL                                           Extra
+    "http://quoted.example/announce?key=\"x\""    next ann: 5s, last ann: 0 peers
+    "https://tracker.example.org/announce"        next ann: anytime, last ann: never
+    "udp4://broken.example:80/announce"           next ann: anytime, last ann: lookup broken.example: no such host
+    "udp6://tracker.opentrackr.org:1337/announce" next ann: anytime, last ann: network is unreachable
+    "udp4://tracker.opentrackr.org:1337/announce" next ann: 29m59s, last ann: 12 peers
+    "wss://tracker.example.org/announce"          {Dials:1 ConvertedInboundConns:0 ConvertedOutboundConns:0}
+DHT Announces: 0
+`
+
+	want := []TrackerStatus{
+		{URL: `http://quoted.example/announce?key="x"`, Status: TrackerWorking, NextAnnounce: 5},
+		{URL: "https://tracker.example.org/announce", Status: TrackerPending},
+		{URL: "udp://broken.example:80/announce", Status: TrackerError, Error: "lookup broken.example: no such host"},
+		{URL: "udp://tracker.opentrackr.org:1337/announce", Status: TrackerWorking, Peers: 12, NextAnnounce: 1799},
+		{URL: "wss://tracker.example.org/announce", Status: TrackerPending},
+	}
+
+	got, err := parseTrackers(strings.NewReader("Listen port: 42069\n"+other+torrent), hash)
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %+v, got %+v (%v)", want, got, err)
+	}
+
+	empty := "Infohash: " + hash + "\nEnabled trackers:\n    URL  Extra\nDHT Announces: 0\n"
+	if got, err := parseTrackers(strings.NewReader(empty), hash); err != nil || got == nil || len(got) != 0 {
+		t.Errorf("expected empty list for torrent without trackers, got %#v (%v)", got, err)
+	}
+
+	// Changed layout must not look like torrent without trackers
+	broken := map[string]string{
+		"unknown torrent": other,
+		"renamed table":   strings.Replace(torrent, "Enabled trackers:", "Trackers:", 1),
+		"changed line":    strings.Replace(torrent, "next ann:", "next announce:", 1),
+		"invalid quoting": strings.Replace(torrent, `key=\"x\"`, `key="x"`, 1),
+	}
+
+	for name, status := range broken {
+		if got, err := parseTrackers(strings.NewReader(status), hash); !errors.Is(err, errTrackerStatus) {
+			t.Errorf("%s: expected unexpected status error, got %+v (%v)", name, got, err)
+		}
+	}
+}
+
+// TestTrackersReadsClientStatus checks layout of status written by the torrent library, which trackers are parsed from.
+func TestTrackersReadsClientStatus(t *testing.T) {
+	announced := make(chan struct{}, 1)
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case announced <- struct{}{}:
+		default:
+		}
+		w.Write([]byte("d8:intervali1800e5:peers0:e"))
+	}))
+	defer tracker.Close()
+
+	s := newTestClient(t)
+	s.SetSeedPolicy(config.SeedPolicy{Hours: 100})
+	hash, _ := seedTorrent(t, s)
+	if _, err := s.db.Exec("UPDATE downloads SET status = ?", StatusSeeding); err != nil {
+		t.Fatalf("failed to record seeding download: %v", err)
+	}
+
+	s.ResumeDownloads()
+	if activeTorrent(s, hash) == nil {
+		t.Fatal("expected seeding to be resumed")
+	}
+
+	if trackers, err := s.Trackers(hash); err != nil || trackers == nil || len(trackers) != 0 {
+		t.Fatalf("expected no trackers yet, got %#v (%v)", trackers, err)
+	}
+
+	working := tracker.URL + "/announce"
+	unreachable := "udp://127.0.0.1:1/announce"
+	if err := s.AddTrackers(hash, []string{working, unreachable}); err != nil {
+		t.Fatalf("failed to add trackers: %v", err)
+	}
+
+	select {
+	case <-announced:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected torrent to announce to tracker")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		trackers, err := s.Trackers(hash)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		statuses := make(map[string]TrackerStatus)
+		for _, tr := range trackers {
+			statuses[tr.URL] = tr
+		}
+
+		if _, ok := statuses[unreachable]; len(statuses) != 2 || !ok || statuses[unreachable].Status == TrackerWorking {
+			t.Fatalf("expected both added trackers, got %+v", trackers)
+		}
+
+		if tr := statuses[working]; tr.Status == TrackerWorking {
+			if tr.NextAnnounce < 1700 || tr.NextAnnounce > 1800 {
+				t.Errorf("expected next announce in interval of tracker, got %+v", tr)
+			}
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("expected working tracker, got %+v", trackers)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
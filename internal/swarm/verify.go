@@ -0,0 +1,232 @@
+package swarm
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/amatsagu/lumo"
+	g "github.com/anacrolix/generics"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+)
+
+var ErrNotComplete = errors.New("download is not complete")
+
+// Verification reports pieces of downloaded video file that don't match their hash.
+type Verification struct {
+	InfoHash  string `json:"info_hash"`
+	Pieces    int    `json:"pieces"`     // Pieces of the video file that were checked
+	BadPieces []int  `json:"bad_pieces"` // Indexes of pieces with wrong data
+	Skipped   int    `json:"skipped"`    // Pieces shared with other files of torrent, which are not kept
+	Repairing bool   `json:"repairing"`  // Bad pieces are being downloaded again
+}
+
+// Verify re-hashes pieces of downloaded video file against stored metainfo. When some don't match, they are
+// downloaded again - by seeding torrent itself, or by adding finished torrent back to the swarm.
+func (s *SwarmClient) Verify(ctx context.Context, hash string) (*Verification, error) {
+	d, err := s.Download(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.Status != StatusSeeding && d.Status != StatusFinished && d.Status != StatusInterrupted || d.CompletedAt == nil {
+		return nil, ErrNotComplete
+	}
+
+	mi, err := s.storedMetaInfo(hash, d.Magnet)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := mi.UnmarshalInfo()
+	if err != nil {
+		return nil, fmt.Errorf("stored metainfo is invalid: %w", err)
+	}
+
+	files := info.UpvertedFiles()
+	target := videoFile(&info, files)
+	if target == -1 || info.PieceLength == 0 || len(info.Pieces) == 0 {
+		return nil, errors.New("stored metainfo has no verifiable video file")
+	}
+
+	// Only pieces fully inside the video file can be checked, since other files of torrent are not downloaded
+	var offset int64
+	for _, f := range files[:target] {
+		offset += f.Length
+	}
+	length := files[target].Length
+
+	first := int(offset / info.PieceLength)
+	last := int((offset + length - 1) / info.PieceLength)
+	v := &Verification{InfoHash: hash, BadPieces: make([]int, 0)}
+	var pieces []int
+	for p := first; p <= last; p++ {
+		begin := int64(p) * info.PieceLength
+		end := min(begin+info.PieceLength, info.TotalLength())
+		if begin < offset || end > offset+length {
+			v.Skipped++
+			continue
+		}
+		pieces = append(pieces, p)
+	}
+	v.Pieces = len(pieces)
+
+	s.mu.RLock()
+	active := s.active[hash]
+	s.mu.RUnlock()
+
+	if active != nil {
+		// Torrent checks its own storage and downloads pieces that failed again on its own
+		for _, p := range pieces {
+			if err := active.t.Piece(p).VerifyDataContext(ctx); err != nil {
+				return nil, err
+			}
+
+			if !active.t.PieceState(p).Complete {
+				v.BadPieces = append(v.BadPieces, p)
+			}
+		}
+		v.Repairing = len(v.BadPieces) > 0
+		return v, nil
+	}
+
+	f, err := os.Open(d.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	buf := make([]byte, info.PieceLength)
+	for _, p := range pieces {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		begin := int64(p) * info.PieceLength
+		n := min(info.PieceLength, info.TotalLength()-begin)
+		read, _ := f.ReadAt(buf[:n], begin-offset) // Truncated or unreadable file leaves piece short
+		sum := sha1.Sum(buf[:read])
+
+		if int64(read) < n || !bytes.Equal(sum[:], info.Pieces[p*sha1.Size:(p+1)*sha1.Size]) {
+			v.BadPieces = append(v.BadPieces, p)
+		}
+	}
+
+	if len(v.BadPieces) > 0 {
+		if err := s.repair(d, mi, &info, v.BadPieces); err != nil {
+			return v, fmt.Errorf("failed to repair download: %w", err)
+		}
+		v.Repairing = true
+	}
+	return v, nil
+}
+
+// repair adds finished torrent back to the swarm, with storage pointing at its (possibly relocated) file.
+// Only bad pieces are marked as missing, so nothing else is downloaded again. Download keeps its record, so it stays
+// complete and isn't reported as completed again once repaired.
+func (s *SwarmClient) repair(d *Download, mi *metainfo.MetaInfo, info *metainfo.Info, bad []int) error {
+	files := info.UpvertedFiles()
+	targetPath := filePath(info, &files[videoFile(info, files)])
+
+	completion := storage.NewMapPieceCompletion()
+	ih := mi.HashInfoBytes()
+	for p := range info.NumPieces() {
+		if err := completion.Set(metainfo.PieceKey{InfoHash: ih, Index: p}, true); err != nil {
+			return err
+		}
+	}
+	for _, p := range bad {
+		if err := completion.Set(metainfo.PieceKey{InfoHash: ih, Index: p}, false); err != nil {
+			return err
+		}
+	}
+
+	// Other files sharing pieces with the video are found only while it's still in its torrent directory
+	dir, ok := storageDir(d.Path, info)
+	if !ok {
+		dir = filepath.Dir(d.Path)
+	}
+	video, err := filepath.Rel(dir, d.Path)
+	if err != nil {
+		return err
+	}
+
+	st := storage.NewFileOpts(storage.NewFileClientOpts{
+		ClientBaseDir: dir,
+		FilePathMaker: func(opts storage.FilePathMakerOpts) string {
+			if filePath(opts.Info, opts.File) == targetPath {
+				return video
+			}
+			return filepath.FromSlash(filePath(opts.Info, opts.File))
+		},
+		PieceCompletion: completion,
+		UsePartFiles:    g.Some(false), // Part files would mark existing file as complete again
+	})
+
+	lumo.Info("Downloading %d bad pieces of \"%s\" again.", len(bad), d.Identifier)
+	_, err = s.add(&activeDownload{magnet: d.Magnet, metaInfo: mi, identifier: d.Identifier, storage: st, dir: dir, path: d.Path, repair: true})
+	return err
+}
+
+// VerifyInterrupted checks complete downloads that were still active when application stopped unexpectedly.
+// It should run after settings are applied and downloads are resumed, so repairs use them and seeding torrents
+// check their own storage.
+func (s *SwarmClient) VerifyInterrupted() {
+	s.mu.Lock()
+	hashes := s.interrupted
+	s.interrupted = nil
+	s.mu.Unlock()
+
+	for _, hash := range hashes {
+		v, err := s.Verify(context.Background(), hash)
+		if errors.Is(err, ErrNotComplete) || errors.Is(err, ErrNoMetainfo) {
+			continue
+		}
+
+		if err != nil {
+			lumo.Warn("Failed to verify %s download after unexpected shutdown: %v", hash, err)
+			continue
+		}
+
+		if len(v.BadPieces) > 0 {
+			lumo.Warn("Found %d bad pieces in %s download after unexpected shutdown.", len(v.BadPieces), hash)
+		} else {
+			lumo.Debug("Verified %d pieces of %s download after unexpected shutdown.", v.Pieces, hash)
+		}
+	}
+}
+
+// VerifyHandler re-hashes downloaded file of {hash} path value and starts repairing bad pieces.
+func (s *SwarmClient) VerifyHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	v, err := s.Verify(r.Context(), r.PathValue("hash"))
+	switch {
+	case errors.Is(err, ErrUnknownDownload):
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "unknown download"})
+		return
+	case errors.Is(err, ErrNotComplete), errors.Is(err, ErrNoMetainfo):
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	case err != nil && v == nil:
+		lumo.Error("Failed to verify %s download: %v", r.PathValue("hash"), err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to verify download: " + err.Error()})
+		return
+	case err != nil:
+		lumo.Error("Failed to repair %s download: %v", r.PathValue("hash"), err)
+	}
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		lumo.Error("Failed to encode verification: %v", err)
+	}
+}
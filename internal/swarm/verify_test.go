@@ -0,0 +1,241 @@
+package swarm
+
+import (
+	"context"
+	"errors"
+	"jubako/internal/config"
+	"jubako/internal/testutil"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// seedTorrent writes two-file torrent into download directory and records it as finished download.
+// Pieces are 32 bytes long, so the first one is shared with "a.nfo" and the video covers pieces 1-3.
+func seedTorrent(t *testing.T, s *SwarmClient) (string, string) {
+	t.Helper()
+
+	root := filepath.Join(s.downloadDir, "Gachiakuta")
+	video := filepath.Join(root, "b.mkv")
+	if err := os.MkdirAll(root, 0755); err != nil {
+		t.Fatalf("failed to create torrent directory: %v", err)
+	}
+
+	data := make([]byte, 100)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	for path, content := range map[string][]byte{filepath.Join(root, "a.nfo"): []byte("0123456789"), video: data} {
+		if err := os.WriteFile(path, content, 0600); err != nil {
+			t.Fatalf("failed to write torrent file: %v", err)
+		}
+	}
+
+	info := metainfo.Info{PieceLength: 32}
+	if err := info.BuildFromFilePath(root); err != nil {
+		t.Fatalf("failed to build metainfo: %v", err)
+	}
+
+	infoBytes, err := bencode.Marshal(info)
+	if err != nil {
+		t.Fatalf("failed to encode metainfo: %v", err)
+	}
+
+	hash := metainfo.HashBytes(infoBytes).HexString()
+	_, err = s.db.Exec("INSERT INTO downloads (info_hash, identifier, magnet, path, status, size, added_at, completed_at, info) VALUES (?, 'Gachiakuta - 03', ?, ?, ?, 100, ?, ?, ?)",
+		hash, "magnet:?xt=urn:btih:"+hash, video, StatusFinished, time.Now(), time.Now(), infoBytes)
+	if err != nil {
+		t.Fatalf("failed to seed download: %v", err)
+	}
+	return hash, video
+}
+
+func TestVerifyFindsBadPieces(t *testing.T) {
+	cases := []struct {
+		name   string
+		damage func(video string) error
+		bad    []int
+	}{
+		{"intact", func(string) error { return nil }, []int{}},
+		{"corrupted", func(video string) error {
+			f, err := os.OpenFile(video, os.O_WRONLY, 0)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			_, err = f.WriteAt([]byte{0xff}, 40) // Byte 50 of torrent
+			return err
+		}, []int{1}},
+		{"truncated", func(video string) error { return os.Truncate(video, 60) }, []int{2, 3}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := newTestClient(t)
+			hash, video := seedTorrent(t, s)
+			if err := c.damage(video); err != nil {
+				t.Fatalf("failed to damage video: %v", err)
+			}
+
+			v, err := s.Verify(context.Background(), hash)
+			if err != nil {
+				t.Fatalf("unexpected verify error: %v", err)
+			}
+
+			if v.Pieces != 3 || v.Skipped != 1 {
+				t.Errorf("expected 3 checked and 1 skipped piece, got %+v", v)
+			}
+
+			if !slices.Equal(v.BadPieces, c.bad) {
+				t.Errorf("expected bad pieces %v, got %v", c.bad, v.BadPieces)
+			}
+
+			s.mu.RLock()
+			_, repairing := s.active[hash]
+			s.mu.RUnlock()
+
+			if repairing != (len(c.bad) > 0) || v.Repairing != repairing {
+				t.Errorf("expected repair only with bad pieces, got %+v (active: %v)", v, repairing)
+			}
+		})
+	}
+}
+
+func TestRepairKeepsDownloadComplete(t *testing.T) {
+	tests := []struct {
+		name  string
+		close bool // Application is closed before bad piece arrives
+	}{
+		{"repaired", false},
+		{"closed while repairing", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewSwarmClient(testutil.OpenDB(t), t.TempDir(), t.TempDir(), config.Network{})
+			hash, _ := seedTorrent(t, s)
+			before, err := s.Download(hash)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var hooks atomic.Int32
+			s.OnComplete(func(string, DownloadDetails) { hooks.Add(1) })
+			s.OnFinish(func(Download) { hooks.Add(1) })
+
+			mi, err := s.storedMetaInfo(hash, before.Magnet)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			info, err := mi.UnmarshalInfo()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			// Data on disk is intact, so checking the piece stands in for downloading it from peers
+			if err := s.repair(before, mi, &info, []int{1}); err != nil {
+				t.Fatalf("failed to start repair: %v", err)
+			}
+
+			d := activeTorrent(s, hash)
+			if d == nil {
+				t.Fatal("expected download to be repaired")
+			}
+
+			if tt.close {
+				s.Close()
+			} else {
+				t.Cleanup(s.Close)
+				<-d.t.GotInfo()
+				if err := d.t.Piece(1).VerifyDataContext(context.Background()); err != nil {
+					t.Fatalf("failed to verify piece: %v", err)
+				}
+			}
+
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				after, err := s.Download(hash)
+				if err == nil && after.Status == StatusFinished && activeTorrent(s, hash) == nil {
+					if !after.AddedAt.Equal(before.AddedAt) || after.CompletedAt == nil || !after.CompletedAt.Equal(*before.CompletedAt) {
+						t.Errorf("expected repair to keep dates %v and %v, got %v and %v", before.AddedAt, *before.CompletedAt, after.AddedAt, after.CompletedAt)
+					}
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("expected repaired download to be finished again, got %+v (%v)", after, err)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			if hooks.Load() != 0 {
+				t.Errorf("expected no completion or finish hooks for repair, got %d calls", hooks.Load())
+			}
+		})
+	}
+}
+
+func TestVerifyInterruptedChecksResumedSeeding(t *testing.T) {
+	db := testutil.OpenDB(t)
+	dir := t.TempDir()
+	first := NewSwarmClient(db, dir, t.TempDir(), config.Network{})
+	t.Cleanup(first.Close)
+
+	hash, video := seedTorrent(t, first)
+	if _, err := db.Exec("UPDATE downloads SET status = ?", StatusSeeding); err != nil {
+		t.Fatalf("failed to record seeding download: %v", err)
+	}
+	if err := os.Truncate(video, 60); err != nil {
+		t.Fatalf("failed to damage video: %v", err)
+	}
+
+	// Seeding download is still recorded as active, as if application crashed
+	s := NewSwarmClient(db, dir, t.TempDir(), config.Network{})
+	t.Cleanup(s.Close)
+	s.SetSeedPolicy(config.SeedPolicy{Hours: 100})
+	if activeTorrent(s, hash) != nil {
+		t.Fatal("expected nothing to be repaired before downloads are resumed")
+	}
+
+	s.ResumeDownloads()
+	s.VerifyInterrupted()
+
+	d := activeTorrent(s, hash)
+	if d == nil || d.repair {
+		t.Fatalf("expected resumed seeding to check its own pieces, got %+v", d)
+	}
+	if d.t.PieceState(3).Complete {
+		t.Error("expected truncated piece to be found by verification")
+	}
+
+	if after, err := s.Download(hash); err != nil || after.Status != StatusSeeding {
+		t.Errorf("expected download to keep seeding, got %+v (%v)", after, err)
+	}
+}
+
+func TestVerifyRejectsUnverifiableDownloads(t *testing.T) {
+	s := newTestClient(t)
+	hash, video := seedTorrent(t, s)
+
+	// File that can't be opened is reported instead of being downloaded whole again
+	if err := os.Remove(video); err != nil {
+		t.Fatalf("failed to remove video: %v", err)
+	}
+	if _, err := s.Verify(context.Background(), hash); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected missing file error, got %v", err)
+	}
+
+	s.setStatus(hash, StatusDownloading)
+	if _, err := s.Verify(context.Background(), hash); !errors.Is(err, ErrNotComplete) {
+		t.Errorf("expected ErrNotComplete, got %v", err)
+	}
+
+	if _, err := s.Verify(context.Background(), "unknown"); !errors.Is(err, ErrUnknownDownload) {
+		t.Errorf("expected ErrUnknownDownload, got %v", err)
+	}
+}
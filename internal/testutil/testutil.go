@@ -0,0 +1,21 @@
+// Package testutil holds fixtures shared by tests of several packages.
+package testutil
+
+import (
+	"database/sql"
+	"testing"
+
+	_ "modernc.org/sqlite"
+)
+
+// OpenDB returns empty database in temporary directory, which is closed once test finishes.
+func OpenDB(t testing.TB) *sql.DB {
+	t.Helper()
+
+	db, err := sql.Open("sqlite", t.TempDir()+"/data.db")
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
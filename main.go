@@ -2,11 +2,16 @@ package main
 
 import (
 	"embed"
+	"errors"
+	"flag"
 	"fmt"
 	"jubako/internal/app"
 	"jubako/internal/config"
+	"jubako/internal/desktop"
+	"jubako/internal/instance"
 	"os"
-	"os/exec"
+	"path/filepath"
+	_ "time/tzdata" // Timetable accepts IANA time zones, which are missing on some systems (Windows)
 
 	"github.com/amatsagu/lumo"
 )
@@ -18,46 +23,67 @@ func main() {
 	lumo.EnableDebug()
 	lumo.EnableStackOnWarns()
 
-	app.NewApplication(embeddedFrontend).Run()
+	cfg, err := config.Load(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration:\n%v\n", err)
+		lumo.Close()
+		os.Exit(2)
+	}
+
+	if cfg.RegisterMagnetHandler {
+		registerMagnetHandler(cfg)
+		return
+	}
+
+	// Lock is taken before directories are prepared, so running instance never has its data moved away
+	inst, err := instance.Acquire(cfg.DataDir)
+	if errors.Is(err, instance.ErrRunning) {
+		if err := instance.Forward(cfg.DataDir, instance.Request{Magnets: cfg.Magnets, Play: cfg.Play}); err != nil {
+			fmt.Fprintf(os.Stderr, "Jubako is already running, but it could not be reached:\n%v\n", err)
+			lumo.Close()
+			os.Exit(1)
+		}
+
+		lumo.Info("Jubako is already running - passed arguments to it.")
+		lumo.Close()
+		return
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to acquire single-instance lock:\n%v\n", err)
+		lumo.Close()
+		os.Exit(1)
+	}
+
+	if err := cfg.PrepareDirs(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to prepare application directories:\n%v\n", err)
+		inst.Close()
+		lumo.Close()
+		os.Exit(1)
+	}
+
+	app.NewApplication(embeddedFrontend, cfg, inst).Run()
 	lumo.Close()
 }
 
-// launchPlayer is a helper to launch external video players.
-func launchPlayer(videoInfoHash string) {
-	url := fmt.Sprintf("http://127.0.0.1:%s/stream?hash=%s", config.HTTP_PORT, videoInfoHash)
-	players := []struct {
-		Name string
-		Cmd  string
-		Args []string
-	}{
-		{
-			"MPV", "mpv",
-			[]string{
-				"--fs",
-				"--force-window=immediate",
-				url, // Passing URL instead of file path
-			},
-		},
-		{
-			"Haruna", "haruna",
-			[]string{url},
-		},
-		{
-			"VLC", "vlc",
-			[]string{"--fullscreen", url},
-		},
+// registerMagnetHandler makes this executable default application for magnet links.
+// Links are opened with the same config directory, so they reach instance using it.
+func registerMagnetHandler(cfg *config.Config) {
+	executable, err := os.Executable()
+	if err == nil {
+		executable, err = filepath.EvalSymlinks(executable)
 	}
 
-	for _, p := range players {
-		_, err := exec.LookPath(p.Cmd)
-		if err == nil {
-			lumo.Info("Found %s as available video player.", p.Name)
-			cmd := exec.Command(p.Cmd, p.Args...)
-			cmd.Stderr = os.Stderr
-			if err := cmd.Run(); err != nil {
-				lumo.Warn("Detected that %s was closed.", p.Name)
-			}
-			return
-		}
+	if err == nil {
+		err = desktop.RegisterMagnetHandler(executable, "-config_dir", cfg.ConfigDir)
 	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to register magnet link handler:\n%v\n", err)
+		lumo.Close()
+		os.Exit(1)
+	}
+
+	lumo.Info("Registered Jubako as default application for magnet links.")
+	lumo.Close()
 }